@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	accessLogCombined = "combined"
+	accessLogJSON     = "json"
+)
+
+// countingReader counts the bytes read from a request body.
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+type accessRecord struct {
+	Time      time.Time `json:"time"`
+	Remote    string    `json:"remote"`
+	Method    string    `json:"method"`
+	URI       string    `json:"uri"`
+	Proto     string    `json:"proto"`
+	Status    int       `json:"status"`
+	BytesIn   int64     `json:"bytesIn"`
+	BytesOut  int64     `json:"bytesOut"`
+	Latency   float64   `json:"latencyMs"`
+	LSPMethod string    `json:"lspMethod,omitempty"`
+	Referer   string    `json:"referer,omitempty"`
+	UserAgent string    `json:"userAgent,omitempty"`
+}
+
+// accessLogger writes a line for every HTTP request handled, separately
+// from the application logs.
+type accessLogger struct {
+	mutex  sync.Mutex
+	w      io.Writer
+	format string
+}
+
+// newAccessLogger creates an access logger writing to path, or to stdout
+// if path is "-".
+func newAccessLogger(path, format string, maxSize int64, maxBackups int) (*accessLogger, error) {
+	if format != accessLogCombined && format != accessLogJSON {
+		return nil, fmt.Errorf("invalid access log format: %v", format)
+	}
+
+	var w io.Writer = os.Stdout
+	if path != "-" {
+		var err error
+		w, err = newRotatingFile(path, maxSize, maxBackups)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &accessLogger{w: w, format: format}, nil
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// line returns the record as a line in the logger's format. The combined
+// format is the Apache/NGINX one, followed by the latency in milliseconds
+// and the LSP method.
+func (al *accessLogger) line(r *accessRecord) []byte {
+	if al.format == accessLogJSON {
+		data, err := json.Marshal(r)
+		if err != nil {
+			slog.Error("unable to marshal access log record", "err", err)
+		}
+		return append(data, '\n')
+	}
+
+	return []byte(fmt.Sprintf("%v - - [%v] %q %v %v %q %q %.3f %v\n",
+		orDash(r.Remote),
+		r.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		fmt.Sprintf("%v %v %v", r.Method, r.URI, r.Proto),
+		r.Status,
+		r.BytesOut,
+		orDash(r.Referer),
+		orDash(r.UserAgent),
+		r.Latency,
+		orDash(r.LSPMethod),
+	))
+}
+
+func (al *accessLogger) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		body := &countingReader{ReadCloser: req.Body}
+		req.Body = body
+		sw := &statusWriter{ResponseWriter: w}
+
+		next.ServeHTTP(sw, req)
+
+		record := &accessRecord{
+			Time:      start,
+			Remote:    req.RemoteAddr,
+			Method:    req.Method,
+			URI:       req.URL.RequestURI(),
+			Proto:     req.Proto,
+			Status:    sw.status,
+			BytesIn:   body.n,
+			BytesOut:  sw.written,
+			Latency:   float64(time.Since(start).Microseconds()) / 1000,
+			Referer:   req.Referer(),
+			UserAgent: req.UserAgent(),
+		}
+		if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+			record.Remote = host
+		}
+		if record.Status == 0 {
+			record.Status = http.StatusOK
+		}
+		if method, ok := strings.CutPrefix(req.URL.Path, "/lsp/"); ok {
+			record.LSPMethod = method
+		}
+
+		al.mutex.Lock()
+		defer al.mutex.Unlock()
+		_, err := al.w.Write(al.line(record))
+		if err != nil {
+			slog.Error("unable to write access log", "err", err)
+		}
+	})
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/federicotdn/hyperlsp/lsp"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Completed results are kept for this long.
+const asyncResultTTL = time.Hour
+
+const (
+	asyncPending = "pending"
+	asyncDone    = "done"
+)
+
+// asyncResult is the state of a request sent with ?async=1.
+type asyncResult struct {
+	ID          string        `json:"id"`
+	RequestID   string        `json:"requestId"`
+	Method      string        `json:"method"`
+	Status      string        `json:"status"`
+	CreatedAt   time.Time     `json:"createdAt"`
+	CompletedAt time.Time     `json:"completedAt,omitempty"`
+	Response    *lsp.Response `json:"response,omitempty"`
+	// HTTP status code for errors generated by the proxy itself.
+	ErrorStatus int `json:"errorStatus,omitempty"`
+	// URL the result is POSTed to once completed, if any.
+	Callback string           `json:"callback,omitempty"`
+	Delivery *webhookDelivery `json:"delivery,omitempty"`
+	// Params of the request and wire headers to send with it, kept until
+	// it completes.
+	Params  any               `json:"params,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+type webhookDelivery struct {
+	Attempts  int    `json:"attempts"`
+	Delivered bool   `json:"delivered"`
+	LastError string `json:"lastError,omitempty"`
+}
+
+type asyncResults struct {
+	mutex   sync.Mutex
+	results map[string]*asyncResult
+
+	// If set, results are persisted in this bucket.
+	db     *bolt.DB
+	bucket []byte
+	// Pending requests loaded from the database, which are sent again once
+	// the LSP server is initialized.
+	interrupted []asyncResult
+}
+
+func newAsyncResults() *asyncResults {
+	return &asyncResults{results: make(map[string]*asyncResult)}
+}
+
+// open persists results in the specified database bucket, loading the
+// ones already present. It returns the completed results whose callback
+// delivery was interrupted or failed.
+func (ar *asyncResults) open(db *bolt.DB, bucket string) ([]asyncResult, error) {
+	ar.mutex.Lock()
+	defer ar.mutex.Unlock()
+
+	ar.db = db
+	ar.bucket = []byte(bucket)
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(ar.bucket)
+		if err != nil {
+			return err
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			var r asyncResult
+			if err := json.Unmarshal(v, &r); err != nil {
+				slog.Warn("discarding invalid async result", "id", string(k), "err", err)
+				return nil
+			}
+			ar.results[r.ID] = &r
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ar.expire()
+
+	var undelivered []asyncResult
+	for _, r := range ar.results {
+		switch {
+		case r.Status == asyncPending:
+			ar.interrupted = append(ar.interrupted, *r)
+		case r.Callback != "" && (r.Delivery == nil || !r.Delivery.Delivered):
+			undelivered = append(undelivered, *r)
+		}
+	}
+
+	return undelivered, nil
+}
+
+// persist writes a result to the database, if any. It must be called with
+// the mutex held.
+func (ar *asyncResults) persist(r *asyncResult) {
+	if ar.db == nil {
+		return
+	}
+
+	data, err := json.Marshal(r)
+	if err == nil {
+		err = ar.db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket(ar.bucket).Put([]byte(r.ID), data)
+		})
+	}
+	if err != nil {
+		slog.Error("unable to persist async result", "id", r.ID, "err", err)
+	}
+}
+
+// expire removes completed results older than asyncResultTTL. It must be
+// called with the mutex held.
+func (ar *asyncResults) expire() {
+	now := time.Now()
+	var expired []string
+	for id, r := range ar.results {
+		if r.Status == asyncDone && now.Sub(r.CompletedAt) > asyncResultTTL {
+			delete(ar.results, id)
+			expired = append(expired, id)
+		}
+	}
+
+	if ar.db == nil || len(expired) == 0 {
+		return
+	}
+
+	err := ar.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(ar.bucket)
+		for _, id := range expired {
+			if err := b.Delete([]byte(id)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Error("unable to remove expired async results", "err", err)
+	}
+}
+
+func (ar *asyncResults) add(r *asyncResult) {
+	ar.mutex.Lock()
+	defer ar.mutex.Unlock()
+
+	ar.expire()
+	ar.results[r.ID] = r
+	ar.persist(r)
+}
+
+func (ar *asyncResults) complete(id string, resp *lsp.Response, status int) (asyncResult, bool) {
+	ar.mutex.Lock()
+	defer ar.mutex.Unlock()
+
+	r, ok := ar.results[id]
+	if !ok {
+		return asyncResult{}, false
+	}
+	r.Status = asyncDone
+	r.CompletedAt = time.Now()
+	r.Params = nil
+	r.Headers = nil
+	r.Response = resp
+	r.ErrorStatus = status
+	ar.persist(r)
+	return *r, true
+}
+
+func (ar *asyncResults) setDelivery(id string, delivery webhookDelivery) {
+	ar.mutex.Lock()
+	defer ar.mutex.Unlock()
+
+	if r, ok := ar.results[id]; ok {
+		r.Delivery = &delivery
+		ar.persist(r)
+	}
+}
+
+func (ar *asyncResults) get(id string) (asyncResult, bool) {
+	ar.mutex.Lock()
+	defer ar.mutex.Unlock()
+
+	ar.expire()
+	r, ok := ar.results[id]
+	if !ok {
+		return asyncResult{}, false
+	}
+	return *r, true
+}
+
+// takeInterrupted returns the pending requests loaded from the database,
+// only once.
+func (ar *asyncResults) takeInterrupted() []asyncResult {
+	ar.mutex.Lock()
+	defer ar.mutex.Unlock()
+
+	interrupted := ar.interrupted
+	ar.interrupted = nil
+	return interrupted
+}
+
+// runAsync sends an async request to the LSP server, storing the result
+// and delivering it to the callback URL, if any.
+func (p *proxy) runAsync(r asyncResult) {
+	// Like synchronous requests, async ones wait for the limits of the
+	// proxy, but in the background.
+	release, resp, status := p.acquireLimits(context.Background(), r.RequestID, r.Method, r.Params)
+	if resp == nil {
+		resp, status = p.forward(context.Background(), r.RequestID, r.Method, r.Params, r.Headers)
+		release()
+	}
+	completed, ok := p.results.complete(r.ID, resp, status)
+	if ok && completed.Callback != "" {
+		p.deliverAsync(completed)
+	}
+}
+
+func (p *proxy) deliverAsync(r asyncResult) {
+	p.results.setDelivery(r.ID, p.webhooks.deliver(r))
+}
+
+// resumeAsync sends the async requests that were pending when hyperlsp
+// was last stopped.
+func (p *proxy) resumeAsync() {
+	for _, r := range p.results.takeInterrupted() {
+		slog.Info("resuming async request", "id", r.ID, "lsp_method", r.Method)
+		go p.runAsync(r)
+	}
+}
+
+// handleAsync responds immediately with 202 and the URL where the result
+// will be available, and sends the request in the background. If a
+// callback URL is specified, the result is also POSTed to it.
+func (p *proxy) handleAsync(w http.ResponseWriter, req *http.Request, id, method string, params any) {
+	callback := req.URL.Query().Get("callback")
+	if callback != "" {
+		err := p.webhooks.validate(callback)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	release, ok := p.reserveID(w, req, id)
+	if !ok {
+		return
+	}
+
+	r := &asyncResult{
+		ID:        newUUID(),
+		RequestID: id,
+		Method:    method,
+		Status:    asyncPending,
+		CreatedAt: time.Now(),
+		Callback:  callback,
+		Params:    params,
+		Headers:   p.headers.forward(req.Header),
+	}
+	p.results.add(r)
+
+	go func() {
+		defer release()
+		p.runAsync(*r)
+	}()
+
+	url := "/results/" + r.ID
+	w.Header().Set("Location", url)
+	w.Header().Set(idHeader, id)
+	writeJSON(w, http.StatusAccepted, map[string]any{
+		"id":     r.ID,
+		"status": r.Status,
+		"url":    url,
+	})
+}
+
+// handleResult returns the result of a request sent with ?async=1. While
+// it is pending, 202 is returned; afterwards, the response is written
+// exactly as it would have been for a synchronous request.
+func (p *proxy) handleResult(w http.ResponseWriter, req *http.Request) {
+	r, ok := p.results.get(req.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "result not found")
+		return
+	}
+
+	if r.Status == asyncPending {
+		w.Header().Set("Retry-After", "1")
+		w.Header().Set(idHeader, r.RequestID)
+		writeJSON(w, http.StatusAccepted, map[string]any{
+			"id":        r.ID,
+			"status":    r.Status,
+			"method":    r.Method,
+			"createdAt": r.CreatedAt,
+		})
+		return
+	}
+
+	writeResponse(w, r.RequestID, r.Response, r.ErrorStatus)
+}
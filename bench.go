@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/federicotdn/hyperlsp/lsp"
+)
+
+// Operations generated by the bench subcommand.
+var benchOperations = []string{"hover", "completion", "didChange"}
+
+// benchMix is the relative weight of each operation, parsed from
+// op=weight[,op=weight...].
+type benchMix map[string]int
+
+func parseBenchMix(s string) (benchMix, error) {
+	mix := make(benchMix)
+	for _, part := range strings.Split(s, ",") {
+		op, w, ok := strings.Cut(strings.TrimSpace(part), "=")
+		weight, err := strconv.Atoi(w)
+		if !ok || err != nil || weight < 0 {
+			return nil, fmt.Errorf("invalid mix entry: %v", part)
+		}
+
+		found := false
+		for _, known := range benchOperations {
+			found = found || op == known
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown operation: %v", op)
+		}
+		mix[op] = weight
+	}
+
+	total := 0
+	for _, w := range mix {
+		total += w
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("mix has no operations")
+	}
+	return mix, nil
+}
+
+// pick returns a random operation, according to the weights.
+func (m benchMix) pick(r *rand.Rand) string {
+	total := 0
+	for _, op := range benchOperations {
+		total += m[op]
+	}
+
+	n := r.Intn(total)
+	for _, op := range benchOperations {
+		if n < m[op] {
+			return op
+		}
+		n -= m[op]
+	}
+	return ""
+}
+
+// benchStats holds the results of a single operation.
+type benchStats struct {
+	latencies []time.Duration
+	errors    int
+}
+
+// percentile returns the p-th percentile of sorted latencies.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted)-1) * p / 100)
+	return sorted[i]
+}
+
+type benchRunner struct {
+	client   *http.Client
+	base     string
+	apiKey   string
+	uri      string
+	position lsp.Position
+
+	// didChange notifications are sent in order, with increasing versions.
+	changeMutex sync.Mutex
+	version     int
+
+	mutex sync.Mutex
+	stats map[string]*benchStats
+}
+
+func (b *benchRunner) post(path string, body any, id bool) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, b.base+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if b.apiKey != "" {
+		req.Header.Set(apiKeyHeader, b.apiKey)
+	}
+	if id {
+		req.Header.Set(idHeader, newUUID())
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("status %v", resp.StatusCode)
+	}
+	return nil
+}
+
+// open opens the document (if it is not open already) via /docs/sync, and
+// returns its current version.
+func (b *benchRunner) open() (int, error) {
+	body := map[string]any{
+		"operations": []map[string]any{{"op": "open", "uri": b.uri}},
+	}
+	data, _ := json.Marshal(body)
+
+	req, err := http.NewRequest(http.MethodPost, b.base+"/docs/sync", bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+	if b.apiKey != "" {
+		req.Header.Set(apiKeyHeader, b.apiKey)
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Message string `json:"message"`
+		Results []struct {
+			Version int `json:"version"`
+		} `json:"results"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return 0, fmt.Errorf("unable to parse response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK || len(result.Results) == 0 {
+		return 0, fmt.Errorf("status %v: %v", resp.StatusCode, result.Message)
+	}
+	return result.Results[0].Version, nil
+}
+
+// run performs an operation, returning its latency.
+func (b *benchRunner) run(op string) (time.Duration, error) {
+	position := map[string]any{
+		"textDocument": lsp.TextDocumentIdentifier{URI: b.uri},
+		"position":     b.position,
+	}
+
+	switch op {
+	case "hover":
+		start := time.Now()
+		err := b.post("/lsp/textDocument/hover", position, true)
+		return time.Since(start), err
+	case "completion":
+		start := time.Now()
+		err := b.post("/lsp/textDocument/completion", position, true)
+		return time.Since(start), err
+	default:
+		b.changeMutex.Lock()
+		defer b.changeMutex.Unlock()
+
+		b.version++
+		// An empty edit, so that the content stays the same.
+		params := map[string]any{
+			"textDocument": map[string]any{"uri": b.uri, "version": b.version},
+			"contentChanges": []contentChange{{
+				Range: &lsp.Range{Start: b.position, End: b.position},
+				Text:  "",
+			}},
+		}
+		start := time.Now()
+		err := b.post("/lsp/textDocument/didChange", params, false)
+		return time.Since(start), err
+	}
+}
+
+func (b *benchRunner) record(op string, latency time.Duration, err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	stats := b.stats[op]
+	if err != nil {
+		stats.errors++
+		return
+	}
+	stats.latencies = append(stats.latencies, latency)
+}
+
+func (b *benchRunner) report(elapsed time.Duration) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "operation\trequests\terrors\treq/s\tp50\tp90\tp99\tmax\t")
+
+	all := &benchStats{}
+	line := func(name string, stats *benchStats) {
+		sorted := append([]time.Duration{}, stats.latencies...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		total := len(sorted) + stats.errors
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%.1f\t%v\t%v\t%v\t%v\t\n",
+			name, total, stats.errors, float64(total)/elapsed.Seconds(),
+			percentile(sorted, 50).Round(time.Microsecond),
+			percentile(sorted, 90).Round(time.Microsecond),
+			percentile(sorted, 99).Round(time.Microsecond),
+			percentile(sorted, 100).Round(time.Microsecond))
+	}
+
+	for _, op := range benchOperations {
+		stats := b.stats[op]
+		if len(stats.latencies)+stats.errors == 0 {
+			continue
+		}
+		line(op, stats)
+		all.latencies = append(all.latencies, stats.latencies...)
+		all.errors += stats.errors
+	}
+	line("total", all)
+	tw.Flush()
+}
+
+// bench implements the bench subcommand, which sends a mix of hover,
+// completion and didChange traffic for a document to a running hyperlsp
+// instance, and reports throughput and latency percentiles.
+func bench(args []string) int {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	addr := fs.String("addr", "localhost:8080", "Address of the hyperlsp instance to send requests to")
+	apiKey := fs.String("api-key", "", "API key to send with every request")
+	mixFlag := fs.String("mix", "hover=6,completion=3,didChange=1", "Relative weights of the operations, as op=weight[,op=weight...]")
+	concurrency := fs.Int("concurrency", 4, "Number of concurrent clients")
+	duration := fs.Duration("duration", 10*time.Second, "Duration of the benchmark")
+	requests := fs.Int("requests", 0, "Stop after this many requests (0 for no limit)")
+	line := fs.Int("line", 0, "Line (zero-based) of the position used for requests")
+	character := fs.Int("character", 0, "Character (zero-based) of the position used for requests")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: hyperlsp bench [flags] file\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 || *concurrency < 1 {
+		fs.Usage()
+		return 2
+	}
+
+	mix, err := parseBenchMix(*mixFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	path, err := filepath.Abs(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	base := *addr
+	if !strings.Contains(base, "://") {
+		base = "http://" + base
+	}
+
+	b := &benchRunner{
+		client:   &http.Client{},
+		base:     base,
+		apiKey:   *apiKey,
+		uri:      lsp.PathToURI(path),
+		position: lsp.Position{Line: *line, Character: *character},
+		stats:    make(map[string]*benchStats),
+	}
+	for _, op := range benchOperations {
+		b.stats[op] = &benchStats{}
+	}
+
+	b.version, err = b.open()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to open %v: %v\n", b.uri, err)
+		return 1
+	}
+
+	fmt.Printf("running for %v with %v clients against %v\n", *duration, *concurrency, base)
+
+	var sent sync.WaitGroup
+	var mutex sync.Mutex
+	count := 0
+	deadline := time.Now().Add(*duration)
+	start := time.Now()
+
+	for i := 0; i < *concurrency; i++ {
+		sent.Add(1)
+		go func(seed int64) {
+			defer sent.Done()
+			r := rand.New(rand.NewSource(seed))
+			for time.Now().Before(deadline) {
+				mutex.Lock()
+				if *requests > 0 && count >= *requests {
+					mutex.Unlock()
+					return
+				}
+				count++
+				mutex.Unlock()
+
+				op := mix.pick(r)
+				latency, err := b.run(op)
+				b.record(op, latency, err)
+			}
+		}(time.Now().UnixNano() + int64(i))
+	}
+	sent.Wait()
+
+	b.report(time.Since(start))
+	return 0
+}
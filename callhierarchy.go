@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/federicotdn/hyperlsp/lsp"
+)
+
+const (
+	callHierarchyDefaultDepth = 1
+	callHierarchyMaxDepth     = 10
+	callHierarchyMaxNodes     = 1000
+)
+
+type callNode struct {
+	Item       json.RawMessage `json:"item"`
+	FromRanges []lsp.Range     `json:"fromRanges,omitempty"`
+	Children   []*callNode     `json:"children"`
+	// Set if the item is already present among the node's ancestors, in
+	// which case it is not expanded any further.
+	Recursive bool `json:"recursive,omitempty"`
+}
+
+type callHierarchyCall struct {
+	From       json.RawMessage `json:"from"`
+	To         json.RawMessage `json:"to"`
+	FromRanges []lsp.Range     `json:"fromRanges"`
+}
+
+type callHierarchyExpander struct {
+	ctx       context.Context
+	p         *proxy
+	method    string
+	nodes     int
+	truncated bool
+}
+
+func callItemKey(item json.RawMessage) string {
+	var key struct {
+		URI            string    `json:"uri"`
+		SelectionRange lsp.Range `json:"selectionRange"`
+	}
+	json.Unmarshal(item, &key)
+	return fmt.Sprintf("%v:%v:%v", key.URI, key.SelectionRange.Start.Line, key.SelectionRange.Start.Character)
+}
+
+// expand fetches the calls of the node's item, recursively, until the
+// remaining depth reaches zero.
+func (e *callHierarchyExpander) expand(node *callNode, depth int, ancestors map[string]bool) error {
+	node.Children = []*callNode{}
+	if depth == 0 {
+		return nil
+	}
+
+	key := callItemKey(node.Item)
+	if ancestors[key] {
+		node.Recursive = true
+		return nil
+	}
+	ancestors[key] = true
+	defer delete(ancestors, key)
+
+	var calls []callHierarchyCall
+	err := e.p.call(e.ctx, e.method, map[string]any{"item": node.Item}, &calls)
+	if err != nil {
+		return err
+	}
+
+	for _, call := range calls {
+		if e.nodes >= callHierarchyMaxNodes {
+			e.truncated = true
+			return nil
+		}
+		e.nodes++
+
+		item := call.From
+		if item == nil {
+			item = call.To
+		}
+
+		child := &callNode{Item: item, FromRanges: call.FromRanges}
+		node.Children = append(node.Children, child)
+
+		err := e.expand(child, depth-1, ancestors)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func queryInt(req *http.Request, name string, def int) (int, error) {
+	v := req.URL.Query().Get(name)
+	if v == "" {
+		if def < 0 {
+			return 0, fmt.Errorf("missing %v", name)
+		}
+		return def, nil
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %v", name)
+	}
+	return n, nil
+}
+
+// handleCallHierarchy chains textDocument/prepareCallHierarchy with
+// callHierarchy/incomingCalls or outgoingCalls up to the requested depth,
+// returning the resulting call trees.
+func (p *proxy) handleCallHierarchy(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	uri := query.Get("uri")
+	if uri == "" {
+		writeError(w, http.StatusBadRequest, "no document uri specified")
+		return
+	}
+
+	var method string
+	switch query.Get("direction") {
+	case "", "incoming":
+		method = "callHierarchy/incomingCalls"
+	case "outgoing":
+		method = "callHierarchy/outgoingCalls"
+	default:
+		writeError(w, http.StatusBadRequest, "direction must be incoming or outgoing")
+		return
+	}
+
+	line, err := queryInt(req, "line", -1)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	char, err := queryInt(req, "char", -1)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	depth, err := queryInt(req, "depth", callHierarchyDefaultDepth)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	depth = min(depth, callHierarchyMaxDepth)
+
+	params := map[string]any{
+		"textDocument": lsp.TextDocumentIdentifier{URI: uri},
+		"position":     lsp.Position{Line: line, Character: char},
+	}
+
+	var items []json.RawMessage
+	err = p.call(req.Context(), "textDocument/prepareCallHierarchy", params, &items)
+	if err != nil {
+		writeCallError(w, err)
+		return
+	}
+
+	e := callHierarchyExpander{ctx: req.Context(), p: p, method: method}
+	roots := []*callNode{}
+	for _, item := range items {
+		root := &callNode{Item: item}
+		err := e.expand(root, depth, make(map[string]bool))
+		if err != nil {
+			writeCallError(w, err)
+			return
+		}
+		roots = append(roots, root)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"roots":     roots,
+		"truncated": e.truncated,
+	})
+}
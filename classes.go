@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/federicotdn/hyperlsp/lsp"
+)
+
+// Classes that LSP methods can be assigned to in the configuration file,
+// each with its own limits.
+const (
+	classInteractive = "interactive"
+	classBackground  = "background"
+	classExpensive   = "expensive"
+)
+
+type methodClassConfig struct {
+	Methods []string `json:"methods"`
+	// Maximum number of requests of the class sent to the LSP server at
+	// the same time (0 for no limit), and waiting for their turn (defaults
+	// to defaultMaxQueue).
+	MaxConcurrent int  `json:"maxConcurrent"`
+	MaxQueue      *int `json:"maxQueue"`
+	// Maximum number of requests of the class per minute (0 for no limit).
+	RequestsPerMinute int `json:"requestsPerMinute"`
+}
+
+// methodClassesConfig maps class names to their configuration.
+type methodClassesConfig map[string]methodClassConfig
+
+func (mc methodClassesConfig) validate() error {
+	classes := make(map[string]string)
+	for name, c := range mc {
+		switch name {
+		case classInteractive, classBackground, classExpensive:
+		default:
+			return fmt.Errorf("unknown method class %v", name)
+		}
+		if c.MaxConcurrent < 0 || c.RequestsPerMinute < 0 || (c.MaxQueue != nil && *c.MaxQueue < 0) {
+			return fmt.Errorf("method class %v has negative limits", name)
+		}
+		for _, method := range c.Methods {
+			if other, ok := classes[method]; ok {
+				return fmt.Errorf("method %v is assigned to both the %v and %v classes", method, other, name)
+			}
+			classes[method] = name
+		}
+	}
+	return nil
+}
+
+// methodClass holds the limits shared by the methods of a class.
+type methodClass struct {
+	name string
+	// Limits the requests of the class sent at the same time, if set.
+	limiter *concurrencyLimiter
+	rate    *rateLimiter
+}
+
+// methodClasses maps LSP methods to their class.
+type methodClasses map[string]*methodClass
+
+func newMethodClasses(cfg methodClassesConfig) methodClasses {
+	mc := make(methodClasses)
+	for name, c := range cfg {
+		class := &methodClass{name: name, rate: &rateLimiter{limit: c.RequestsPerMinute}}
+		if c.MaxConcurrent > 0 {
+			maxQueue := defaultMaxQueue
+			if c.MaxQueue != nil {
+				maxQueue = *c.MaxQueue
+			}
+			class.limiter = newConcurrencyLimiter(c.MaxConcurrent, maxQueue)
+		}
+		for _, method := range c.Methods {
+			mc[method] = class
+		}
+	}
+	return mc
+}
+
+// acquire applies the limits of the class to a request. If the request
+// can be sent, it returns a function to be called once it has completed.
+// Otherwise, it returns the error response and its HTTP status code.
+func (mc *methodClass) acquire(ctx context.Context, id string) (func(), *lsp.Response, int) {
+	if ok, retry := mc.rate.allow(); !ok {
+		status := http.StatusTooManyRequests
+		message := fmt.Sprintf("request rate limit of the %v method class exceeded", mc.name)
+		resp := errorResponse(id, status, message)
+		resp.Headers = map[string]string{"Retry-After": retryAfterSeconds(retry)}
+		return nil, resp, status
+	}
+
+	if mc.limiter == nil {
+		return func() {}, nil, 0
+	}
+	release, retry, err := mc.limiter.acquire(ctx, priorityNormal, "")
+	if err != nil && superseded(ctx) {
+		resp, status := cancelledResponse(id, errSuperseded)
+		return nil, resp, status
+	} else if err != nil {
+		status := http.StatusServiceUnavailable
+		message := fmt.Sprintf("too many concurrent requests of the %v method class", mc.name)
+		resp := &lsp.Response{Id: id, Error: newProxyError(status, codeBusy, message, nil)}
+		resp.Headers = map[string]string{"Retry-After": retryAfterSeconds(retry)}
+		return nil, resp, status
+	}
+	return release, nil, 0
+}
+
+// acquireLimits applies the limits of the class of an LSP method, and the
+// concurrency limit, to a request, whether it is sent synchronously, with
+// ?async=1 or by hyperlsp itself. If the request can be sent, it returns a
+// function to be called once it has completed. Otherwise, it returns the
+// error response and its HTTP status code.
+func (p *proxy) acquireLimits(ctx context.Context, id, method string, params any) (func(), *lsp.Response, int) {
+	releaseClass := func() {}
+	if class := p.classes[method]; class != nil {
+		release, resp, status := class.acquire(ctx, id)
+		if resp != nil {
+			return nil, resp, status
+		}
+		releaseClass = release
+	}
+	if p.limiter == nil {
+		return releaseClass, nil, 0
+	}
+
+	release, retry, err := p.limiter.acquire(ctx, p.priority(method), documentURI(params))
+	if err != nil {
+		releaseClass()
+	}
+	if errors.Is(err, errPreempted) {
+		resp, status := cancelledResponse(id, err)
+		return nil, resp, status
+	} else if err != nil && superseded(ctx) {
+		resp, status := cancelledResponse(id, errSuperseded)
+		return nil, resp, status
+	} else if err != nil {
+		status := http.StatusServiceUnavailable
+		resp := &lsp.Response{Id: id, Error: newProxyError(status, codeBusy, "too many concurrent requests", nil)}
+		resp.Headers = map[string]string{"Retry-After": retryAfterSeconds(retry)}
+		return nil, resp, status
+	}
+	return func() {
+		release()
+		releaseClass()
+	}, nil, 0
+}
+
+// priority returns the priority of requests of an LSP method waiting for
+// the concurrency limit, according to its class.
+func (p *proxy) priority(method string) int {
+	class := p.classes[method]
+	if class == nil {
+		return priorityNormal
+	}
+
+	switch class.name {
+	case classInteractive:
+		return priorityInteractive
+	case classBackground:
+		return priorityBackground
+	}
+	return priorityNormal
+}
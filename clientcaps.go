@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// featureProviders maps LSP methods to the server capability that
+// indicates they are supported.
+var featureProviders = map[string]string{
+	"textDocument/hover":                     "hoverProvider",
+	"textDocument/completion":                "completionProvider",
+	"textDocument/signatureHelp":             "signatureHelpProvider",
+	"textDocument/declaration":               "declarationProvider",
+	"textDocument/definition":                "definitionProvider",
+	"textDocument/typeDefinition":            "typeDefinitionProvider",
+	"textDocument/implementation":            "implementationProvider",
+	"textDocument/references":                "referencesProvider",
+	"textDocument/documentHighlight":         "documentHighlightProvider",
+	"textDocument/documentSymbol":            "documentSymbolProvider",
+	"textDocument/codeAction":                "codeActionProvider",
+	"textDocument/codeLens":                  "codeLensProvider",
+	"textDocument/documentLink":              "documentLinkProvider",
+	"textDocument/documentColor":             "colorProvider",
+	"textDocument/formatting":                "documentFormattingProvider",
+	"textDocument/rangeFormatting":           "documentRangeFormattingProvider",
+	"textDocument/onTypeFormatting":          "documentOnTypeFormattingProvider",
+	"textDocument/rename":                    "renameProvider",
+	"textDocument/foldingRange":              "foldingRangeProvider",
+	"textDocument/selectionRange":            "selectionRangeProvider",
+	"textDocument/prepareCallHierarchy":      "callHierarchyProvider",
+	"textDocument/semanticTokens/full":       "semanticTokensProvider",
+	"textDocument/semanticTokens/full/delta": "semanticTokensProvider",
+	"textDocument/semanticTokens/range":      "semanticTokensProvider",
+	"textDocument/linkedEditingRange":        "linkedEditingRangeProvider",
+	"textDocument/moniker":                   "monikerProvider",
+	"textDocument/prepareTypeHierarchy":      "typeHierarchyProvider",
+	"textDocument/inlayHint":                 "inlayHintProvider",
+	"textDocument/inlineValue":               "inlineValueProvider",
+	"textDocument/diagnostic":                "diagnosticProvider",
+	"workspace/symbol":                       "workspaceSymbolProvider",
+	"workspace/executeCommand":               "executeCommandProvider",
+}
+
+// mergeCaps returns a copy of dst with the values in src added, merging
+// nested objects. Values in src take precedence.
+func mergeCaps(dst, src map[string]any) map[string]any {
+	merged := make(map[string]any, len(dst)+len(src))
+	for k, v := range dst {
+		merged[k] = v
+	}
+	for k, v := range src {
+		srcObj, ok1 := v.(map[string]any)
+		dstObj, ok2 := merged[k].(map[string]any)
+		if ok1 && ok2 {
+			merged[k] = mergeCaps(dstObj, srcObj)
+		} else {
+			merged[k] = v
+		}
+	}
+	return merged
+}
+
+// withClientCaps returns the params of an initialize request, with the
+// capabilities declared via /capabilities/client, and the ones of the
+// client features implemented by the proxy itself, merged into them.
+func (p *proxy) withClientCaps(params any) any {
+	p.mutex.Lock()
+	declared := p.clientCaps
+	p.mutex.Unlock()
+
+	implemented := map[string]any{"configuration": true}
+	if p.serverEdits != serverEditsReject {
+		implemented["applyEdit"] = true
+	}
+	declared = mergeCaps(map[string]any{"workspace": implemented}, declared)
+
+	obj, ok := params.(map[string]any)
+	if !ok {
+		return params
+	}
+
+	caps, _ := obj["capabilities"].(map[string]any)
+	merged := mergeCaps(obj, nil)
+	merged["capabilities"] = mergeCaps(caps, declared)
+	return merged
+}
+
+// effectiveFeatures returns the LSP methods supported by the server,
+// according to its capabilities.
+func effectiveFeatures(serverCaps any) []string {
+	caps, _ := serverCaps.(map[string]any)
+	features := []string{}
+	for method, provider := range featureProviders {
+		switch v := caps[provider].(type) {
+		case nil:
+		case bool:
+			if v {
+				features = append(features, method)
+			}
+		default:
+			features = append(features, method)
+		}
+	}
+	sort.Strings(features)
+	return features
+}
+
+// handleClientCapabilities lets HTTP clients declare client capabilities,
+// which are merged into those sent to the LSP server in the initialize
+// request. If the server is already initialized, they only take effect
+// after it is restarted, unless reinitialize=true is specified, in which
+// case the server subprocess is restarted immediately.
+func (p *proxy) handleClientCapabilities(w http.ResponseWriter, req *http.Request) {
+	var declared map[string]any
+	defer req.Body.Close()
+	err := json.NewDecoder(req.Body).Decode(&declared)
+	if err != nil || declared == nil {
+		writeError(w, http.StatusBadRequest, "body must be a ClientCapabilities object")
+		return
+	}
+
+	reinitialize := req.URL.Query().Get("reinitialize")
+	restart := reinitialize == "1" || reinitialize == "true"
+
+	p.mutex.Lock()
+	p.clientCaps = mergeCaps(p.clientCaps, declared)
+	initParams := p.initParams
+	p.mutex.Unlock()
+	initialized := initParams != nil
+
+	if initialized && restart {
+		if p.server().Status() == nil {
+			writeError(w, http.StatusBadRequest, "reinitializing requires an LSP server subprocess")
+			return
+		}
+
+		p.setInitParams(p.withClientCaps(initParams))
+
+		err := p.restartServer()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Sprintf("unable to reinitialize LSP server: %v", err))
+			return
+		}
+		p.recordEvent(serverEvent{Type: "reinitialize", Message: "LSP server reinitialized with new client capabilities"})
+	}
+
+	p.mutex.Lock()
+	clientCaps := any(p.clientCaps)
+	if params, ok := p.initParams.(map[string]any); ok {
+		clientCaps = params["capabilities"]
+	}
+	serverCaps := p.serverCaps
+	p.mutex.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		// Whether the capabilities were sent to the server. If not, they
+		// are sent in the next initialize request.
+		"applied":  initialized && restart,
+		"client":   clientCaps,
+		"server":   serverCaps,
+		"features": effectiveFeatures(serverCaps),
+	})
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"github.com/federicotdn/hyperlsp/lsp"
+)
+
+// Number of codeLens/resolve requests sent at the same time.
+const codeLensResolveConcurrency = 8
+
+type codeLens struct {
+	Range   lsp.Range       `json:"range"`
+	Command json.RawMessage `json:"command,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+// codeLensResolveProvider reports whether the LSP server supports
+// codeLens/resolve.
+func (p *proxy) codeLensResolveProvider() bool {
+	var caps struct {
+		CodeLensProvider struct {
+			ResolveProvider bool `json:"resolveProvider"`
+		} `json:"codeLensProvider"`
+	}
+	return p.capabilities(&caps) == nil && caps.CodeLensProvider.ResolveProvider
+}
+
+// handleCodeLens runs textDocument/codeLens, and resolves the code lenses
+// without a command via codeLens/resolve (a few at a time), so that all
+// of them are returned with their commands. Code lenses which fail to
+// resolve are returned without a command, and counted as unresolved.
+func (p *proxy) handleCodeLens(w http.ResponseWriter, req *http.Request) {
+	uri := req.URL.Query().Get("uri")
+	if uri == "" {
+		writeError(w, http.StatusBadRequest, "no document uri specified")
+		return
+	}
+
+	var lenses []*codeLens
+	err := p.call(req.Context(), "textDocument/codeLens", map[string]any{"textDocument": lsp.TextDocumentIdentifier{URI: uri}}, &lenses)
+	if err != nil {
+		writeCallError(w, err)
+		return
+	}
+
+	var pending []*codeLens
+	for _, l := range lenses {
+		if len(l.Command) == 0 || string(l.Command) == "null" {
+			pending = append(pending, l)
+		}
+	}
+	if len(pending) > 0 && p.codeLensResolveProvider() {
+		forEachConcurrently(len(pending), codeLensResolveConcurrency, func(i int) {
+			var resolved codeLens
+			err := p.call(req.Context(), "codeLens/resolve", pending[i], &resolved)
+			if err != nil {
+				slog.Debug("unable to resolve code lens", "uri", uri, "line", pending[i].Range.Start.Line, "err", err)
+				return
+			}
+			*pending[i] = resolved
+		})
+	}
+
+	unresolved := 0
+	for _, l := range lenses {
+		if len(l.Command) == 0 || string(l.Command) == "null" {
+			unresolved++
+		}
+	}
+	if lenses == nil {
+		lenses = []*codeLens{}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"codeLenses": lenses,
+		"unresolved": unresolved,
+	})
+}
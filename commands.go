@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"github.com/federicotdn/hyperlsp/lsp"
+)
+
+// commandConfig allows a command of the LSP server to be executed via
+// /commands (or workspace/executeCommand requests).
+type commandConfig struct {
+	Name string `json:"name"`
+	// Schemas of the arguments, by position. The command can't be executed
+	// with more arguments than schemas.
+	Arguments []*lsp.Schema `json:"arguments"`
+}
+
+type commandsConfig []commandConfig
+
+func (cc commandsConfig) validate() error {
+	names := make(map[string]bool)
+	for i, c := range cc {
+		if c.Name == "" {
+			return fmt.Errorf("command %v has no name", i)
+		}
+		if names[c.Name] {
+			return fmt.Errorf("duplicate command %v", c.Name)
+		}
+		names[c.Name] = true
+		for j, s := range c.Arguments {
+			if err := s.Check(); err != nil {
+				return fmt.Errorf("command %v: argument %v: %w", c.Name, j, err)
+			}
+		}
+	}
+	return nil
+}
+
+// commandAllowlist holds the commands of the LSP server allowed to be
+// executed, by name.
+type commandAllowlist map[string]commandConfig
+
+func newCommandAllowlist(cfg commandsConfig) commandAllowlist {
+	al := make(commandAllowlist)
+	for _, c := range cfg {
+		al[c.Name] = c
+	}
+	return al
+}
+
+// checkCommand checks that a command is allowed and that its arguments
+// match their schemas. It returns the status, message and data of the
+// error otherwise, or a zero status.
+func (p *proxy) checkCommand(name string, args []any) (int, string, any) {
+	c, ok := p.commands[name]
+	if !ok {
+		return http.StatusForbidden, fmt.Sprintf("command %v is not allowed", name), nil
+	}
+	if len(args) > len(c.Arguments) {
+		return http.StatusBadRequest, fmt.Sprintf("too many arguments for command %v: got %v, expected at most %v", name, len(args), len(c.Arguments)), nil
+	}
+
+	var errs []lsp.ParamError
+	for i, arg := range args {
+		errs = append(errs, c.Arguments[i].Validate(fmt.Sprintf("/arguments/%v", i), arg)...)
+	}
+	if len(errs) == 0 {
+		return 0, "", nil
+	}
+
+	message := fmt.Sprintf("invalid arguments for command %v: %v", name, errs[0])
+	if len(errs) > 1 {
+		message += fmt.Sprintf(" (and %v more)", len(errs)-1)
+	}
+	method := "workspace/executeCommand"
+	return http.StatusBadRequest, message, paramsErrorData{Method: method, Definition: lsp.SpecURL(method), Errors: errs}
+}
+
+// auditCommand logs the execution of a command, or its rejection, along
+// with who requested it.
+func auditCommand(req *http.Request, name string, args []any, rejection string) {
+	attrs := []any{
+		"command", name,
+		"arguments", args,
+		"remote", req.RemoteAddr,
+		"client", req.Header.Get(clientHeader),
+	}
+	if rejection != "" {
+		slog.Warn("LSP command rejected", append(attrs, "reason", rejection)...)
+		return
+	}
+	slog.Info("LSP command executed", attrs...)
+}
+
+// allowExecuteCommand checks the params of a workspace/executeCommand
+// request against the allowlist, if configured, so that it can't be used
+// to bypass /commands. Otherwise, it writes the error response and returns
+// false.
+func (p *proxy) allowExecuteCommand(w http.ResponseWriter, req *http.Request, id string, params any) bool {
+	if p.commands == nil {
+		return true
+	}
+
+	var cmd struct {
+		Command   string `json:"command"`
+		Arguments []any  `json:"arguments"`
+	}
+	data, err := json.Marshal(params)
+	if err == nil {
+		err = json.Unmarshal(data, &cmd)
+	}
+	status, message, errData := http.StatusBadRequest, "invalid workspace/executeCommand params", any(nil)
+	if err == nil {
+		status, message, errData = p.checkCommand(cmd.Command, cmd.Arguments)
+	}
+	if status != 0 {
+		auditCommand(req, cmd.Command, cmd.Arguments, message)
+		writeResponse(w, id, errorResponse(id, status, message, errData), status)
+		return false
+	}
+
+	auditCommand(req, cmd.Command, cmd.Arguments, "")
+	return true
+}
+
+// handleCommand executes a command of the LSP server allowed in the
+// configuration file, via workspace/executeCommand. The body may contain
+// the array of arguments.
+func (p *proxy) handleCommand(w http.ResponseWriter, req *http.Request) {
+	name := req.PathValue("name")
+	if p.denyReadOnly(w, "", "executing commands") {
+		return
+	}
+
+	args := []any{}
+	defer req.Body.Close()
+	err := json.NewDecoder(req.Body).Decode(&args)
+	if err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, http.StatusBadRequest, "body must be an array of arguments")
+		return
+	}
+
+	if status, message, data := p.checkCommand(name, args); status != 0 {
+		auditCommand(req, name, args, message)
+		writeJSON(w, status, newProxyError(status, statusErrorCode(status), message, data))
+		return
+	}
+	auditCommand(req, name, args, "")
+
+	var result json.RawMessage
+	err = p.call(req.Context(), "workspace/executeCommand", map[string]any{"command": name, "arguments": args}, &result)
+	if err != nil {
+		writeCallError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	completionDefaultLimit = 50
+	completionMaxLimit     = 1000
+	completionCacheTTL     = 5 * time.Minute
+	completionCacheSize    = 64
+
+	// Maximum number of items of a page resolved with resolve=true, and
+	// number of completionItem/resolve requests sent at the same time.
+	completionResolveMax         = 100
+	completionResolveConcurrency = 8
+
+	// CompletionTriggerKind.TriggerForIncompleteCompletions
+	triggerForIncompleteCompletions = 3
+)
+
+type completionList struct {
+	IsIncomplete bool              `json:"isIncomplete"`
+	Items        []json.RawMessage `json:"items"`
+}
+
+type completionPage struct {
+	Items        []json.RawMessage `json:"items"`
+	IsIncomplete bool              `json:"isIncomplete"`
+	Total        int               `json:"total"`
+	NextCursor   string            `json:"nextCursor,omitempty"`
+}
+
+type completionEntry struct {
+	params  map[string]any
+	list    completionList
+	expires time.Time
+}
+
+// completionCache holds full completion lists, so that they can be served
+// in pages without querying the LSP server again.
+type completionCache struct {
+	mutex   sync.Mutex
+	entries map[string]*completionEntry
+}
+
+func newCompletionCache() *completionCache {
+	return &completionCache{entries: make(map[string]*completionEntry)}
+}
+
+func (cc *completionCache) purge(now time.Time) {
+	for k, e := range cc.entries {
+		if now.After(e.expires) {
+			delete(cc.entries, k)
+		}
+	}
+}
+
+func (cc *completionCache) add(entry *completionEntry) (string, error) {
+	buf := make([]byte, 8)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	key := hex.EncodeToString(buf)
+
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+
+	now := time.Now()
+	cc.purge(now)
+	if len(cc.entries) >= completionCacheSize {
+		var oldest string
+		for k, e := range cc.entries {
+			if oldest == "" || e.expires.Before(cc.entries[oldest].expires) {
+				oldest = k
+			}
+		}
+		delete(cc.entries, oldest)
+	}
+
+	entry.expires = now.Add(completionCacheTTL)
+	cc.entries[key] = entry
+	return key, nil
+}
+
+func (cc *completionCache) get(key string) (completionEntry, bool) {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+
+	cc.purge(time.Now())
+	e, ok := cc.entries[key]
+	if !ok {
+		return completionEntry{}, false
+	}
+	return *e, true
+}
+
+func (cc *completionCache) replace(key string, list completionList) {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+
+	if e, ok := cc.entries[key]; ok {
+		e.list = list
+		e.expires = time.Now().Add(completionCacheTTL)
+	}
+}
+
+func parseCursor(cursor string) (string, int, error) {
+	key, offset, ok := strings.Cut(cursor, ".")
+	if !ok {
+		return "", 0, fmt.Errorf("malformed cursor")
+	}
+
+	n, err := strconv.Atoi(offset)
+	if err != nil || n < 0 {
+		return "", 0, fmt.Errorf("malformed cursor")
+	}
+
+	return key, n, nil
+}
+
+// queryCompletions runs textDocument/completion, normalizing the result
+// to a CompletionList.
+func (p *proxy) queryCompletions(ctx context.Context, params map[string]any) (completionList, error) {
+	var result json.RawMessage
+	err := p.call(ctx, "textDocument/completion", params, &result)
+	if err != nil {
+		return completionList{}, err
+	}
+
+	var list completionList
+	switch {
+	case len(result) == 0 || string(result) == "null":
+	case result[0] == '[':
+		err = json.Unmarshal(result, &list.Items)
+	default:
+		err = json.Unmarshal(result, &list)
+	}
+	if err != nil {
+		return completionList{}, fmt.Errorf("unable to unmarshal completion result: %w", err)
+	}
+
+	return list, nil
+}
+
+// completionResolveProvider reports whether the LSP server supports
+// completionItem/resolve.
+func (p *proxy) completionResolveProvider() bool {
+	var caps struct {
+		CompletionProvider struct {
+			ResolveProvider bool `json:"resolveProvider"`
+		} `json:"completionProvider"`
+	}
+	return p.capabilities(&caps) == nil && caps.CompletionProvider.ResolveProvider
+}
+
+// resolveCompletions runs completionItem/resolve for the first
+// completionResolveMax items, a few at a time, and returns the items with
+// the resolved properties (such as documentation or additionalTextEdits)
+// merged into them. Items which fail to resolve are returned as-is.
+func (p *proxy) resolveCompletions(ctx context.Context, items []json.RawMessage) []json.RawMessage {
+	resolved := make([]json.RawMessage, len(items))
+	copy(resolved, items)
+
+	forEachConcurrently(min(len(items), completionResolveMax), completionResolveConcurrency, func(i int) {
+		var item, result map[string]any
+		if json.Unmarshal(items[i], &item) != nil {
+			return
+		}
+		err := p.call(ctx, "completionItem/resolve", items[i], &result)
+		if err != nil {
+			slog.Debug("unable to resolve completion item", "label", item["label"], "err", err)
+			return
+		}
+
+		for k, v := range result {
+			item[k] = v
+		}
+		data, err := json.Marshal(item)
+		if err == nil {
+			resolved[i] = data
+		}
+	})
+	return resolved
+}
+
+// handleCompletions serves completion lists in pages. The first request
+// must contain the CompletionParams in its body; the following pages are
+// requested with the returned cursor. With resolve=true, the items of the
+// page are resolved (if the LSP server supports it).
+func (p *proxy) handleCompletions(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+
+	limit := completionDefaultLimit
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+		limit = min(n, completionMaxLimit)
+	}
+
+	var key string
+	var offset int
+	var entry completionEntry
+
+	if cursor := query.Get("cursor"); cursor != "" {
+		var err error
+		key, offset, err = parseCursor(cursor)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		var ok bool
+		entry, ok = p.completions.get(key)
+		if !ok {
+			writeError(w, http.StatusNotFound, "cursor expired or not found")
+			return
+		}
+
+		if entry.list.IsIncomplete && query.Get("requery") == "true" {
+			params := make(map[string]any, len(entry.params))
+			for k, v := range entry.params {
+				params[k] = v
+			}
+			params["context"] = map[string]any{"triggerKind": triggerForIncompleteCompletions}
+
+			list, err := p.queryCompletions(req.Context(), params)
+			if err != nil {
+				writeCallError(w, err)
+				return
+			}
+
+			p.completions.replace(key, list)
+			entry.list = list
+			offset = 0
+		}
+	} else {
+		var params map[string]any
+		defer req.Body.Close()
+		err := json.NewDecoder(req.Body).Decode(&params)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "unable to unmarshal request json")
+			return
+		}
+
+		p.setDocumentHeaders(w.Header(), documentURI(params))
+		list, err := p.queryCompletions(req.Context(), params)
+		if err != nil {
+			writeCallError(w, err)
+			return
+		}
+
+		entry = completionEntry{params: params, list: list}
+		key, err = p.completions.add(&completionEntry{params: params, list: list})
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Sprintf("unable to create cursor: %v", err))
+			return
+		}
+	}
+
+	items := entry.list.Items
+	offset = min(offset, len(items))
+	end := min(offset+limit, len(items))
+
+	page := completionPage{
+		Items:        items[offset:end],
+		IsIncomplete: entry.list.IsIncomplete,
+		Total:        len(items),
+	}
+	if page.Items == nil {
+		page.Items = []json.RawMessage{}
+	}
+	if query.Get("resolve") == "true" && p.completionResolveProvider() {
+		page.Items = p.resolveCompletions(req.Context(), page.Items)
+	}
+	if end < len(items) {
+		page.NextCursor = fmt.Sprintf("%v.%v", key, end)
+	}
+
+	writeJSON(w, http.StatusOK, &page)
+}
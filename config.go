@@ -0,0 +1,394 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/federicotdn/hyperlsp/lsp"
+)
+
+// config is the structure of the (optional) JSON configuration file.
+type config struct {
+	Tenants []tenantConfig `json:"tenants"`
+	// LSP servers to route requests to by language, when there are no
+	// tenants.
+	Servers []routedServerConfig `json:"servers"`
+	// Additional file extension (or file name) to languageId mappings.
+	Extensions map[string]string `json:"extensions"`
+	// Additional shebang interpreter to languageId mappings.
+	Interpreters map[string]string `json:"interpreters"`
+	// Rules to change the severity of diagnostics, or suppress them.
+	DiagnosticRules diagnosticRules `json:"diagnosticRules"`
+	// Classes of LSP methods with separate request limits.
+	MethodClasses methodClassesConfig `json:"methodClasses"`
+	// Detectors of known errors in the stderr output of LSP server
+	// subprocesses.
+	StderrDetectors stderrDetectorsConfig `json:"stderrDetectors"`
+	// Commands of the LSP servers allowed to be executed.
+	Commands commandsConfig `json:"commands"`
+}
+
+type serverConfig struct {
+	// Command used to spawn the LSP server subprocess, if any.
+	Command commandArgs `json:"command"`
+	// Connection method, see lsp.Server.Connect.
+	Connect string `json:"connect"`
+	// Resource limits for the subprocess.
+	Limits limitsConfig `json:"limits"`
+	// Duration such as "10s" between samples of the subprocess's resource
+	// usage, or "0s" to disable sampling.
+	UsageInterval string `json:"usageInterval"`
+	// Restart policy for the subprocess.
+	Restart restartConfig `json:"restart"`
+	// Headers passed between the HTTP and LSP layers.
+	Headers headersConfig `json:"headers"`
+	// Policy for messages with invalid UTF-8 content, see
+	// lsp.Server.SetInvalidUTF8Policy.
+	InvalidUTF8 string `json:"invalidUTF8"`
+	// Options for TCP connections.
+	TCP tcpConfig `json:"tcp"`
+	// Size such as "64K" of the buffer used to read from the LSP server,
+	// see lsp.Server.SetReadBufferSize.
+	ReadBufferSize string `json:"readBufferSize"`
+	// Encoding offered for compressing message content ("gzip" or
+	// "zstd"), see lsp.Server.SetCompression.
+	Compression string `json:"compression"`
+}
+
+type tcpConfig struct {
+	// Durations such as "30s".
+	ReadTimeout  string `json:"readTimeout"`
+	WriteTimeout string `json:"writeTimeout"`
+	// Defaults to true.
+	NoDelay *bool `json:"noDelay"`
+	// Duration such as "15s", or "-1s" to disable keep-alives.
+	KeepAlive string `json:"keepAlive"`
+	// Sizes such as "256K", see lsp.ParseSize.
+	ReadBuffer  string `json:"readBuffer"`
+	WriteBuffer string `json:"writeBuffer"`
+	// Duration such as "30s".
+	DialRetry string `json:"dialRetry"`
+}
+
+func (tc *tcpConfig) tcpOptions() (lsp.TCPOptions, error) {
+	opts := lsp.TCPOptions{NoDelay: true}
+	if tc.NoDelay != nil {
+		opts.NoDelay = *tc.NoDelay
+	}
+
+	var err error
+	if tc.ReadTimeout != "" {
+		opts.ReadTimeout, err = time.ParseDuration(tc.ReadTimeout)
+		if err != nil {
+			return opts, fmt.Errorf("invalid TCP read timeout: %w", err)
+		}
+	}
+	if tc.WriteTimeout != "" {
+		opts.WriteTimeout, err = time.ParseDuration(tc.WriteTimeout)
+		if err != nil {
+			return opts, fmt.Errorf("invalid TCP write timeout: %w", err)
+		}
+	}
+	if tc.DialRetry != "" {
+		opts.DialRetry, err = time.ParseDuration(tc.DialRetry)
+		if err != nil {
+			return opts, fmt.Errorf("invalid TCP dial retry period: %w", err)
+		}
+	}
+	if tc.KeepAlive != "" {
+		opts.KeepAlive, err = time.ParseDuration(tc.KeepAlive)
+		if err != nil {
+			return opts, fmt.Errorf("invalid TCP keep-alive interval: %w", err)
+		}
+	}
+	if tc.ReadBuffer != "" {
+		size, err := lsp.ParseSize(tc.ReadBuffer)
+		if err != nil {
+			return opts, fmt.Errorf("invalid TCP read buffer size: %w", err)
+		}
+		opts.ReadBuffer = int(size)
+	}
+	if tc.WriteBuffer != "" {
+		size, err := lsp.ParseSize(tc.WriteBuffer)
+		if err != nil {
+			return opts, fmt.Errorf("invalid TCP write buffer size: %w", err)
+		}
+		opts.WriteBuffer = int(size)
+	}
+
+	return opts, nil
+}
+
+// commandArgs is a command and its arguments, specified in JSON either as
+// an array or as a string to be split like a shell would.
+type commandArgs []string
+
+func (ca *commandArgs) UnmarshalJSON(data []byte) error {
+	var s string
+	if json.Unmarshal(data, &s) == nil {
+		args, err := splitCommand(s)
+		if err != nil {
+			return err
+		}
+		*ca = args
+		return nil
+	}
+
+	var args []string
+	err := json.Unmarshal(data, &args)
+	if err != nil {
+		return fmt.Errorf("command must be a string or an array of strings")
+	}
+	*ca = args
+	return nil
+}
+
+// splitCommand splits a command line into words, following the quoting
+// rules of POSIX shells: words are separated by whitespace, single quotes
+// preserve their content literally, double quotes preserve it except for
+// backslash escapes of ", \, $ and `, and a backslash outside of quotes
+// escapes the next character. Expansions are not supported.
+func splitCommand(s string) ([]string, error) {
+	var args []string
+	var word strings.Builder
+	inWord := false
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				args = append(args, word.String())
+				word.Reset()
+				inWord = false
+			}
+		case c == '\\':
+			if i+1 == len(s) {
+				return nil, fmt.Errorf("trailing backslash in command")
+			}
+			i++
+			// A backslash-newline is a line continuation.
+			if s[i] != '\n' {
+				word.WriteByte(s[i])
+				inWord = true
+			}
+		case c == '\'':
+			end := strings.IndexByte(s[i+1:], '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated single quote in command")
+			}
+			word.WriteString(s[i+1 : i+1+end])
+			i += end + 1
+			inWord = true
+		case c == '"':
+			i++
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) && strings.IndexByte("\"\\$`", s[i+1]) >= 0 {
+					i++
+				}
+				word.WriteByte(s[i])
+			}
+			if i == len(s) {
+				return nil, fmt.Errorf("unterminated double quote in command")
+			}
+			inWord = true
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+
+	if inWord {
+		args = append(args, word.String())
+	}
+	return args, nil
+}
+
+type limitsConfig struct {
+	// Size such as "512M", see lsp.ParseSize.
+	Memory string `json:"memory"`
+	// Duration such as "10m".
+	CPUTime  string  `json:"cpuTime"`
+	Cgroup   string  `json:"cgroup"`
+	CPUQuota float64 `json:"cpuQuota"`
+}
+
+func (lc *limitsConfig) resourceLimits() (lsp.ResourceLimits, error) {
+	limits := lsp.ResourceLimits{Cgroup: lc.Cgroup, CPUQuota: lc.CPUQuota}
+
+	var err error
+	if lc.Memory != "" {
+		limits.Memory, err = lsp.ParseSize(lc.Memory)
+		if err != nil {
+			return limits, fmt.Errorf("invalid memory limit: %w", err)
+		}
+	}
+	if lc.CPUTime != "" {
+		limits.CPUTime, err = time.ParseDuration(lc.CPUTime)
+		if err != nil {
+			return limits, fmt.Errorf("invalid CPU time limit: %w", err)
+		}
+	}
+	if limits.CPUQuota > 0 && limits.Cgroup == "" {
+		return limits, fmt.Errorf("a CPU quota requires a cgroup")
+	}
+
+	return limits, nil
+}
+
+type tenantConfig struct {
+	Name    string       `json:"name"`
+	APIKeys []string     `json:"apiKeys"`
+	Server  serverConfig `json:"server"`
+	// Directories that file URIs sent by the tenant must be contained in.
+	Roots []string    `json:"roots"`
+	Quota quotaConfig `json:"quota"`
+	// Names of other tenants whose servers may also be accessed with the
+	// tenant's API keys, with the X-LSP-Workspace header.
+	Workspaces []string `json:"workspaces"`
+}
+
+type quotaConfig struct {
+	RequestsPerMinute int `json:"requestsPerMinute"`
+	MaxDocuments      int `json:"maxDocuments"`
+}
+
+func loadConfig(path string) (*config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg config
+	err = json.Unmarshal(data, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse config file %v: %w", path, err)
+	}
+
+	tenants := make(map[string]bool)
+	for i, t := range cfg.Tenants {
+		if t.Name == "" {
+			return nil, fmt.Errorf("tenant %v has no name", i)
+		}
+		if tenants[t.Name] {
+			return nil, fmt.Errorf("duplicate tenant name %v", t.Name)
+		}
+		tenants[t.Name] = true
+		if len(t.APIKeys) == 0 {
+			return nil, fmt.Errorf("tenant %v has no API keys", t.Name)
+		}
+		if err := t.Server.Restart.validate(); err != nil {
+			return nil, fmt.Errorf("tenant %v: %w", t.Name, err)
+		}
+	}
+
+	for _, t := range cfg.Tenants {
+		for _, name := range t.Workspaces {
+			if !tenants[name] {
+				return nil, fmt.Errorf("tenant %v: unknown workspace %v", t.Name, name)
+			}
+		}
+	}
+
+	if err := cfg.DiagnosticRules.validate(); err != nil {
+		return nil, err
+	}
+	if err := cfg.MethodClasses.validate(); err != nil {
+		return nil, err
+	}
+	if err := cfg.StderrDetectors.validate(); err != nil {
+		return nil, err
+	}
+	if err := cfg.Commands.validate(); err != nil {
+		return nil, err
+	}
+
+	if len(cfg.Servers) > 0 && len(cfg.Tenants) > 0 {
+		return nil, fmt.Errorf("servers cannot be configured along with tenants")
+	}
+
+	names := make(map[string]bool)
+	defaults := 0
+	for i, sc := range cfg.Servers {
+		if sc.Name == "" {
+			return nil, fmt.Errorf("server %v has no name", i)
+		}
+		if names[sc.Name] {
+			return nil, fmt.Errorf("duplicate server name %v", sc.Name)
+		}
+		names[sc.Name] = true
+		if len(sc.Languages) == 0 && !sc.Default {
+			return nil, fmt.Errorf("server %v has no languages", sc.Name)
+		}
+		if sc.Default {
+			defaults++
+		}
+		if err := sc.Restart.validate(); err != nil {
+			return nil, fmt.Errorf("server %v: %w", sc.Name, err)
+		}
+	}
+	if defaults > 1 {
+		return nil, fmt.Errorf("only one server can be the default")
+	}
+
+	return &cfg, nil
+}
+
+// start creates the LSP server (spawning it, if a command is configured)
+// and connects to it.
+func (sc *serverConfig) start() (*lsp.Server, error) {
+	limits, err := sc.Limits.resourceLimits()
+	if err != nil {
+		return nil, err
+	}
+	tcp, err := sc.TCP.tcpOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []lsp.Option{lsp.WithTCPOptions(tcp)}
+	if len(sc.Command) > 0 {
+		opts = append(opts, lsp.WithCommand(sc.Command[0], sc.Command[1:]...), lsp.WithResourceLimits(limits))
+		if sc.UsageInterval != "" {
+			interval, err := time.ParseDuration(sc.UsageInterval)
+			if err != nil || interval < 0 {
+				return nil, fmt.Errorf("invalid usage sampling interval: %v", sc.UsageInterval)
+			}
+			opts = append(opts, lsp.WithUsageInterval(interval))
+		}
+	}
+
+	if sc.ReadBufferSize != "" {
+		size, err := lsp.ParseSize(sc.ReadBufferSize)
+		if err != nil || size == 0 {
+			return nil, fmt.Errorf("invalid read buffer size: %v", sc.ReadBufferSize)
+		}
+		opts = append(opts, lsp.WithReadBufferSize(int(size)))
+	}
+	if sc.Compression != "" {
+		opts = append(opts, lsp.WithCompression(sc.Compression))
+	}
+	if sc.InvalidUTF8 != "" {
+		opts = append(opts, lsp.WithInvalidUTF8Policy(sc.InvalidUTF8))
+	}
+
+	headers := make(map[string]string)
+	for name, value := range sc.Headers.Add {
+		headers[name] = os.ExpandEnv(value)
+	}
+	opts = append(opts, lsp.WithHeaders(headers), lsp.WithConnect(sc.Connect))
+
+	srv, err := lsp.NewServer(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	err = srv.Connect("")
+	if err != nil {
+		return nil, err
+	}
+	return srv, nil
+}
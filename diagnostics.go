@@ -0,0 +1,353 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+
+	"github.com/federicotdn/hyperlsp/lsp"
+)
+
+// Severity of diagnostic rules which suppresses matching diagnostics.
+const severityIgnore = "ignore"
+
+// diagnosticRule changes the severity of the diagnostics it matches, or
+// suppresses them. Empty match fields match any diagnostic.
+type diagnosticRule struct {
+	Match struct {
+		// Severity name, e.g. "hint".
+		Severity string `json:"severity"`
+		Code     string `json:"code"`
+		Source   string `json:"source"`
+		// Glob matched against the path of the document's file.
+		Path string `json:"path"`
+	} `json:"match"`
+	// New severity name, or "ignore".
+	Severity string `json:"severity"`
+}
+
+// diagnosticRules are applied to diagnostics received from the LSP server
+// before they are cached or returned. The first matching rule applies.
+type diagnosticRules []diagnosticRule
+
+// severityValue returns the DiagnosticSeverity value of a severity name.
+func severityValue(name string) (int, bool) {
+	for severity := lsp.SeverityError; severity <= lsp.SeverityHint; severity++ {
+		if lsp.SeverityName(severity) == name {
+			return severity, true
+		}
+	}
+	return 0, false
+}
+
+func (dr diagnosticRules) validate() error {
+	for i, rule := range dr {
+		if _, ok := severityValue(rule.Severity); !ok && rule.Severity != severityIgnore {
+			return fmt.Errorf("diagnostic rule %v: invalid severity %q", i, rule.Severity)
+		}
+		if _, ok := severityValue(rule.Match.Severity); !ok && rule.Match.Severity != "" && rule.Match.Severity != "unknown" {
+			return fmt.Errorf("diagnostic rule %v: invalid severity to match %q", i, rule.Match.Severity)
+		}
+		if _, err := path.Match(rule.Match.Path, ""); err != nil {
+			return fmt.Errorf("diagnostic rule %v: invalid path glob %q", i, rule.Match.Path)
+		}
+	}
+	return nil
+}
+
+func (rule *diagnosticRule) matches(d lsp.Diagnostic, file string) bool {
+	m := rule.Match
+	switch {
+	case m.Severity != "" && m.Severity != lsp.SeverityName(d.Severity):
+		return false
+	case m.Code != "" && (d.Code == nil || m.Code != fmt.Sprint(d.Code)):
+		return false
+	case m.Source != "" && m.Source != d.Source:
+		return false
+	case m.Path != "" && (file == "" || !matchGlob(m.Path, file)):
+		return false
+	}
+	return true
+}
+
+// severity returns the severity of a diagnostic of the document file
+// after applying the rules, or false if it is suppressed.
+func (dr diagnosticRules) severity(d lsp.Diagnostic, file string) (int, bool) {
+	for i := range dr {
+		if !dr[i].matches(d, file) {
+			continue
+		}
+		if dr[i].Severity == severityIgnore {
+			return 0, false
+		}
+		severity, _ := severityValue(dr[i].Severity)
+		return severity, true
+	}
+	return d.Severity, true
+}
+
+// rulesFile returns the slash separated path matched by path globs for a
+// document, or an empty string if it is not a file.
+func rulesFile(uri string) string {
+	p, err := lsp.URIToPath(uri)
+	if err != nil {
+		return ""
+	}
+	return filepath.ToSlash(p)
+}
+
+// apply returns the diagnostics of a document after applying the rules.
+func (dr diagnosticRules) apply(uri string, diagnostics []lsp.Diagnostic) []lsp.Diagnostic {
+	if len(dr) == 0 {
+		return diagnostics
+	}
+
+	file := rulesFile(uri)
+	kept := []lsp.Diagnostic{}
+	for _, d := range diagnostics {
+		if severity, ok := dr.severity(d, file); ok {
+			d.Severity = severity
+			kept = append(kept, d)
+		}
+	}
+	return kept
+}
+
+// applyJSON works like apply, but on diagnostics as unmarshaled JSON, so
+// that fields unknown to lsp.Diagnostic are kept.
+func (dr diagnosticRules) applyJSON(uri string, diagnostics []any) []any {
+	file := rulesFile(uri)
+	kept := []any{}
+	for _, item := range diagnostics {
+		obj, ok := item.(map[string]any)
+		if !ok {
+			kept = append(kept, item)
+			continue
+		}
+
+		var d lsp.Diagnostic
+		data, _ := json.Marshal(obj)
+		if json.Unmarshal(data, &d) != nil {
+			kept = append(kept, item)
+			continue
+		}
+		if severity, ok := dr.severity(d, file); ok {
+			if severity != 0 {
+				obj["severity"] = severity
+			}
+			kept = append(kept, obj)
+		}
+	}
+	return kept
+}
+
+// applyDiagnosticRules applies the diagnostic rules to the result of a
+// textDocument/diagnostic request.
+func (p *proxy) applyDiagnosticRules(method string, params any, result any) any {
+	if method != "textDocument/diagnostic" || len(p.diagnosticRules) == 0 {
+		return result
+	}
+
+	report, ok := decodeResult(result).(map[string]any)
+	if !ok {
+		return result
+	}
+	if items, ok := report["items"].([]any); ok {
+		report["items"] = p.diagnosticRules.applyJSON(documentURI(params), items)
+	}
+	return report
+}
+
+// documentDiagnostics are the diagnostics of a single document.
+type documentDiagnostics struct {
+	URI         string           `json:"uri"`
+	Diagnostics []lsp.Diagnostic `json:"diagnostics"`
+}
+
+// cachedDiagnostics returns the latest diagnostics published by the LSP
+// server, sorted by URI.
+func (p *proxy) cachedDiagnostics() []documentDiagnostics {
+	p.mutex.Lock()
+	diagnostics := []documentDiagnostics{}
+	for uri, diags := range p.diagnostics {
+		diagnostics = append(diagnostics, documentDiagnostics{URI: uri, Diagnostics: diags})
+	}
+	p.mutex.Unlock()
+
+	sort.Slice(diagnostics, func(i, j int) bool {
+		return diagnostics[i].URI < diagnostics[j].URI
+	})
+	return diagnostics
+}
+
+// documentText returns the content of a document: its tracked content if
+// it is open, or otherwise the content of its file.
+func (p *proxy) documentText(uri string) (string, error) {
+	if doc, ok := p.docs.get(uri); ok {
+		return doc.Text, nil
+	}
+
+	path, err := lsp.URIToPath(uri)
+	if err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// touchesLines reports whether any of the lines spanned by a diagnostic's
+// range is in lines.
+func touchesLines(d lsp.Diagnostic, lines map[int]bool) bool {
+	end := d.Range.End.Line
+	if end > d.Range.Start.Line && d.Range.End.Character == 0 {
+		// The range ends at the start of a line, which is not included.
+		end--
+	}
+	for line := d.Range.Start.Line; line <= end; line++ {
+		if lines[line] {
+			return true
+		}
+	}
+	return false
+}
+
+// handleDiagnosticsChanged returns the cached diagnostics which touch lines
+// added or modified relative to a Git ref, i.e. the ones most likely
+// introduced by the current changes.
+func (p *proxy) handleDiagnosticsChanged(w http.ResponseWriter, req *http.Request) {
+	ref := req.URL.Query().Get("ref")
+	if ref == "" {
+		ref = "HEAD"
+	}
+	only := make(map[string]bool)
+	for _, uri := range req.URL.Query()["uri"] {
+		only[uri] = true
+	}
+
+	type fileError struct {
+		URI   string `json:"uri"`
+		Error string `json:"error"`
+	}
+
+	result := []documentDiagnostics{}
+	errs := []fileError{}
+	commits := make(map[string]bool)
+	// Repositories are opened once per directory.
+	bases := make(map[string]*gitBase)
+	baseErrs := make(map[string]error)
+	total := 0
+
+	for _, dd := range p.cachedDiagnostics() {
+		if len(only) > 0 && !only[dd.URI] {
+			continue
+		}
+
+		path, err := lsp.URIToPath(dd.URI)
+		if err != nil {
+			errs = append(errs, fileError{URI: dd.URI, Error: err.Error()})
+			continue
+		}
+
+		dir := filepath.Dir(path)
+		base, ok := bases[dir]
+		if !ok && baseErrs[dir] == nil {
+			base, err = openGitBase(path, ref)
+			bases[dir], baseErrs[dir] = base, err
+		}
+		if base == nil {
+			errs = append(errs, fileError{URI: dd.URI, Error: baseErrs[dir].Error()})
+			continue
+		}
+		commits[base.commit] = true
+
+		text, err := p.documentText(dd.URI)
+		if err != nil {
+			errs = append(errs, fileError{URI: dd.URI, Error: err.Error()})
+			continue
+		}
+		lines, err := base.changedLines(path, text)
+		if err != nil {
+			errs = append(errs, fileError{URI: dd.URI, Error: err.Error()})
+			continue
+		}
+
+		var kept []lsp.Diagnostic
+		for _, d := range dd.Diagnostics {
+			if touchesLines(d, lines) {
+				kept = append(kept, d)
+			}
+		}
+		if len(kept) > 0 {
+			result = append(result, documentDiagnostics{URI: dd.URI, Diagnostics: kept})
+			total += len(kept)
+		}
+	}
+
+	commitList := []string{}
+	for commit := range commits {
+		commitList = append(commitList, commit)
+	}
+	sort.Strings(commitList)
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"ref":         ref,
+		"commits":     commitList,
+		"total":       total,
+		"diagnostics": result,
+		"errors":      errs,
+	})
+}
+
+// diagnosticCounts counts diagnostics by severity name.
+type diagnosticCounts struct {
+	Total      int            `json:"total"`
+	BySeverity map[string]int `json:"bySeverity"`
+}
+
+func (dc *diagnosticCounts) add(d lsp.Diagnostic) {
+	if dc.BySeverity == nil {
+		dc.BySeverity = make(map[string]int)
+	}
+	dc.Total++
+	dc.BySeverity[lsp.SeverityName(d.Severity)]++
+}
+
+// handleDiagnosticsSummary returns the number of cached diagnostics per
+// severity, file and source.
+func (p *proxy) handleDiagnosticsSummary(w http.ResponseWriter, req *http.Request) {
+	var summary struct {
+		diagnosticCounts
+		ByFile   map[string]*diagnosticCounts `json:"byFile"`
+		BySource map[string]*diagnosticCounts `json:"bySource"`
+	}
+	summary.BySeverity = make(map[string]int)
+	summary.ByFile = make(map[string]*diagnosticCounts)
+	summary.BySource = make(map[string]*diagnosticCounts)
+
+	for _, dd := range p.cachedDiagnostics() {
+		file := &diagnosticCounts{}
+		summary.ByFile[dd.URI] = file
+		for _, d := range dd.Diagnostics {
+			summary.add(d)
+			file.add(d)
+
+			source := d.Source
+			if source == "" {
+				source = "unknown"
+			}
+			if summary.BySource[source] == nil {
+				summary.BySource[source] = &diagnosticCounts{}
+			}
+			summary.BySource[source].add(d)
+		}
+	}
+
+	writeJSON(w, http.StatusOK, &summary)
+}
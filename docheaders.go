@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// Header set to the version of the document a response is about.
+const documentVersionHeader = "X-LSP-Document-Version"
+
+// setDocumentHeaders sets the version and last modification time of a
+// tracked document as response headers, so that clients can tell which
+// version of the document a result was computed against. It returns false
+// if the document is not being tracked.
+func (p *proxy) setDocumentHeaders(header http.Header, uri string) bool {
+	if uri == "" {
+		return false
+	}
+	doc, ok := p.docs.get(uri)
+	if !ok {
+		return false
+	}
+
+	writeDocumentHeaders(header, doc)
+	return true
+}
+
+// writeDocumentHeaders sets the version and last modification time of doc
+// as response headers.
+func writeDocumentHeaders(header http.Header, doc document) {
+	header.Set(documentVersionHeader, strconv.Itoa(doc.Version))
+	header.Set("Last-Modified", doc.modified.UTC().Format(http.TimeFormat))
+}
+
+// documentHeaders sets the document headers (see setDocumentHeaders) for
+// the document specified in the uri query parameter, as it is when the
+// request is received.
+func (p *proxy) documentHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		p.setDocumentHeaders(w.Header(), req.URL.Query().Get("uri"))
+		next.ServeHTTP(w, req)
+	})
+}
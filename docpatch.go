@@ -0,0 +1,294 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/federicotdn/hyperlsp/lsp"
+)
+
+// Media type of RFC 6902 JSON Patch documents.
+const jsonPatchMediaType = "application/json-patch+json"
+
+// Kind of text document synchronization in which the LSP server expects
+// the full content of documents on every change.
+const textDocumentSyncFull = 1
+
+var errPatchTestFailed = errors.New("test operation failed")
+
+// patchOperation is a JSON Patch (RFC 6902) style operation on a document.
+// Paths are JSON Pointers to either a line of the document ("/lines/N",
+// 0-based, or "/lines/-" to add a line at the end) or its whole content
+// ("/text"). Values of lines don't include their terminator.
+type patchOperation struct {
+	Op    string  `json:"op"`
+	Path  string  `json:"path"`
+	Value *string `json:"value"`
+}
+
+// patchTarget resolves the path of a patch operation against text,
+// returning the byte offsets of the line's content and of its end
+// (including the terminator). whole is set for "/text".
+func patchTarget(text, path string, add bool) (start, content, end int, whole bool, err error) {
+	if path == "/text" {
+		return 0, len(text), len(text), true, nil
+	}
+
+	index, ok := strings.CutPrefix(path, "/lines/")
+	if !ok {
+		return 0, 0, 0, false, fmt.Errorf("invalid path %q, expected /lines/N or /text", path)
+	}
+
+	lines := splitLines(text)
+	n := len(lines)
+	if index != "-" {
+		n, err = strconv.Atoi(index)
+		if err != nil || n < 0 || strconv.Itoa(n) != index {
+			return 0, 0, 0, false, fmt.Errorf("invalid line index in path %q", path)
+		}
+	}
+	if n > len(lines) || (n == len(lines) && !add) {
+		return 0, 0, 0, false, fmt.Errorf("line %v does not exist, the document has %v lines", index, len(lines))
+	}
+
+	for _, line := range lines[:n] {
+		start += len(line)
+	}
+	if n == len(lines) {
+		return start, start, start, false, nil
+	}
+	line := lines[n]
+	return start, start + len(strings.TrimRight(line, "\r\n")), start + len(line), false, nil
+}
+
+// patchChanges converts patch operations into content changes of text,
+// to be applied in order. All operations must succeed for the patch to be
+// applied.
+func patchChanges(text string, ops []patchOperation, encoding string) ([]contentChange, error) {
+	var changes []contentChange
+	for i, op := range ops {
+		if op.Op != "remove" && op.Value == nil {
+			return nil, fmt.Errorf("operation %v: no value specified", i)
+		}
+
+		start, content, end, whole, err := patchTarget(text, op.Path, op.Op == "add")
+		if err != nil {
+			return nil, fmt.Errorf("operation %v: %w", i, err)
+		}
+
+		var newText string
+		switch op.Op {
+		case "test":
+			if text[start:content] != *op.Value {
+				return nil, fmt.Errorf("operation %v: %w: %v is %q", i, errPatchTestFailed, op.Path, text[start:content])
+			}
+			continue
+		case "replace":
+			newText = *op.Value
+			end = content
+		case "add":
+			if whole {
+				newText = *op.Value
+				break
+			}
+			end = start
+			if start == len(text) && text != "" && !strings.HasSuffix(text, "\n") && !strings.HasSuffix(text, "\r") {
+				// The last line is not terminated.
+				newText = "\n" + *op.Value
+			} else {
+				newText = *op.Value + "\n"
+			}
+		case "remove":
+			if !whole && end == len(text) && content == end && start > 0 {
+				// Remove the terminator of the previous line instead, as
+				// the last line is not terminated.
+				start--
+				if start > 0 && text[start-1:start+1] == "\r\n" {
+					start--
+				}
+			}
+		default:
+			return nil, fmt.Errorf("operation %v: unsupported op %q, expected add, remove, replace or test", i, op.Op)
+		}
+
+		if whole {
+			changes = append(changes, contentChange{Text: newText})
+			text = newText
+			continue
+		}
+
+		startPos, err := lsp.PositionAt(text, start, encoding)
+		if err != nil {
+			return nil, err
+		}
+		endPos, err := lsp.PositionAt(text, end, encoding)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, contentChange{Range: &lsp.Range{Start: startPos, End: endPos}, Text: newText})
+		text = text[:start] + newText + text[end:]
+	}
+	return changes, nil
+}
+
+// editChanges converts text edits, which are relative to the original
+// text, into content changes to be applied in order: edits are applied
+// from the end of the text to its start, so that their ranges stay valid.
+func editChanges(text string, edits []lsp.TextEdit, encoding string) ([]contentChange, error) {
+	_, err := lsp.ApplyTextEdits(text, edits, encoding)
+	if err != nil {
+		return nil, err
+	}
+
+	offsets := make([]int, len(edits))
+	order := make([]int, len(edits))
+	for i, e := range edits {
+		offsets[i], err = lsp.Offset(text, e.Range.Start, encoding)
+		if err != nil {
+			return nil, err
+		}
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return offsets[order[i]] < offsets[order[j]]
+	})
+
+	changes := make([]contentChange, 0, len(edits))
+	for i := len(order) - 1; i >= 0; i-- {
+		e := edits[order[i]]
+		changes = append(changes, contentChange{Range: &e.Range, Text: e.NewText})
+	}
+	return changes, nil
+}
+
+// fullSync reports whether the LSP server expects the full content of
+// documents on every change, instead of incremental changes.
+func (p *proxy) fullSync() bool {
+	var caps struct {
+		TextDocumentSync json.RawMessage `json:"textDocumentSync"`
+	}
+	if p.capabilities(&caps) != nil {
+		return false
+	}
+
+	var kind int
+	if json.Unmarshal(caps.TextDocumentSync, &kind) == nil {
+		return kind == textDocumentSyncFull
+	}
+	var options struct {
+		Change int `json:"change"`
+	}
+	return json.Unmarshal(caps.TextDocumentSync, &options) == nil && options.Change == textDocumentSyncFull
+}
+
+// handleDocPatch updates a tracked document with either LSP text edits
+// ({"edits": [...], "version": N}) or, with the application/json-patch+json
+// content type, JSON Patch style operations (see patchOperation). The
+// update is sent to the LSP server as a textDocument/didChange
+// notification with incremental changes (unless the server only supports
+// full changes), bumping the document's version. Concurrent updates of a
+// document are applied one at a time.
+func (p *proxy) handleDocPatch(w http.ResponseWriter, req *http.Request) {
+	uri := req.PathValue("uri")
+	unlock := p.docs.lock(uri)
+	defer unlock()
+
+	doc, ok := p.docs.get(uri)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("document %v is not open", uri))
+		return
+	}
+	encoding := p.positionEncoding()
+
+	var changes []contentChange
+	version := doc.Version + 1
+	defer req.Body.Close()
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if mediaType == jsonPatchMediaType {
+		var ops []patchOperation
+		err := json.NewDecoder(req.Body).Decode(&ops)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "request json must be an array of patch operations")
+			return
+		}
+
+		changes, err = patchChanges(doc.Text, ops, encoding)
+		if errors.Is(err, errPatchTestFailed) {
+			writeError(w, http.StatusConflict, err.Error())
+			return
+		} else if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	} else {
+		var body struct {
+			Edits   []lsp.TextEdit `json:"edits"`
+			Version int            `json:"version"`
+		}
+		err := json.NewDecoder(req.Body).Decode(&body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "request json must contain edits")
+			return
+		}
+		if body.Version != 0 {
+			if body.Version <= doc.Version {
+				writeError(w, http.StatusConflict, fmt.Sprintf("version %v is not newer than the document's version %v", body.Version, doc.Version))
+				return
+			}
+			version = body.Version
+		}
+
+		changes, err = editChanges(doc.Text, body.Edits, encoding)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("unable to apply edits: %v", err))
+			return
+		}
+	}
+
+	if len(changes) == 0 {
+		writeDocumentHeaders(w.Header(), doc)
+		writeJSON(w, http.StatusOK, doc)
+		return
+	}
+
+	if p.fullSync() {
+		text := doc.Text
+		for _, c := range changes {
+			var err error
+			text, err = applyContentChange(text, c, encoding)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, fmt.Sprintf("unable to apply changes: %v", err))
+				return
+			}
+		}
+		changes = []contentChange{{Text: text}}
+	}
+
+	err := p.notify("textDocument/didChange", map[string]any{
+		"textDocument":   map[string]any{"uri": uri, "version": version},
+		"contentChanges": changes,
+	})
+	if err != nil {
+		writeCallError(w, err)
+		return
+	}
+
+	doc, _ = p.docs.get(uri)
+	writeDocumentHeaders(w.Header(), doc)
+	writeJSON(w, http.StatusOK, doc)
+}
+
+// applyContentChange applies a content change of a didChange notification
+// to text.
+func applyContentChange(text string, c contentChange, encoding string) (string, error) {
+	if c.Range == nil {
+		return c.Text, nil
+	}
+	return lsp.ApplyTextEdits(text, []lsp.TextEdit{{Range: *c.Range, NewText: c.Text}}, encoding)
+}
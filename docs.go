@@ -0,0 +1,570 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/federicotdn/hyperlsp/lsp"
+)
+
+const openBulkDefaultLimit = 1000
+
+var (
+	errDocumentQuota   = errors.New("document quota exceeded")
+	errDocumentNotOpen = errors.New("document is not open")
+	errDocumentOpen    = errors.New("document is already open")
+	errStaleVersion    = errors.New("version is not newer than the document's version")
+	errUnknownLanguage = errors.New("unable to detect the languageId of the document, and none was specified")
+)
+
+type document struct {
+	URI        string `json:"uri"`
+	LanguageID string `json:"languageId"`
+	Version    int    `json:"version"`
+	Text       string `json:"text"`
+	// Time at which the document was opened or last changed.
+	modified time.Time
+}
+
+type contentChange struct {
+	Range *lsp.Range `json:"range,omitempty"`
+	Text  string     `json:"text"`
+}
+
+// documentStore tracks the content of the documents opened in the LSP
+// server, by observing the textDocument/didOpen, didChange and didClose
+// notifications sent through the proxy.
+type documentStore struct {
+	mutex sync.Mutex
+	docs  map[string]*document
+	// Maximum amount of tracked documents, or 0 for no limit.
+	limit int
+	// Locks of the documents being updated by the proxy, by URI.
+	locks map[string]*documentLock
+	// Number of documents being opened, which count towards the limit.
+	opening int
+}
+
+// documentLock is held while the proxy updates a document based on its
+// content, so that concurrent updates are not computed against the same
+// version of it.
+type documentLock struct {
+	sync.Mutex
+	// Number of holders and waiters, so that unused locks are removed.
+	refs int
+}
+
+func newDocumentStore() *documentStore {
+	return &documentStore{
+		docs:  make(map[string]*document),
+		locks: make(map[string]*documentLock),
+	}
+}
+
+// lock acquires the lock of the document with the specified URI, whether
+// it is tracked or not, and returns the function which releases it.
+func (ds *documentStore) lock(uri string) func() {
+	ds.mutex.Lock()
+	l, ok := ds.locks[uri]
+	if !ok {
+		l = &documentLock{}
+		ds.locks[uri] = l
+	}
+	l.refs++
+	ds.mutex.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+
+		ds.mutex.Lock()
+		defer ds.mutex.Unlock()
+		l.refs--
+		if l.refs == 0 {
+			delete(ds.locks, uri)
+		}
+	}
+}
+
+func (ds *documentStore) get(uri string) (document, bool) {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+
+	doc, ok := ds.docs[uri]
+	if !ok {
+		return document{}, false
+	}
+	return *doc, true
+}
+
+// list returns all tracked documents, sorted by URI.
+func (ds *documentStore) list() []document {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+
+	docs := make([]document, 0, len(ds.docs))
+	for _, doc := range ds.docs {
+		docs = append(docs, *doc)
+	}
+
+	sort.Slice(docs, func(i, j int) bool {
+		return docs[i].URI < docs[j].URI
+	})
+	return docs
+}
+
+// reserve reports whether the document with the specified URI can be
+// opened without exceeding the store's limit, counting the documents being
+// opened. If so, it reserves a slot for it until the returned function is
+// called, which must be once the didOpen notification has been observed (or
+// failed to be sent), so that concurrent opens can't exceed the limit.
+func (ds *documentStore) reserve(uri string) (func(), bool) {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+
+	if _, ok := ds.docs[uri]; ok || ds.limit <= 0 {
+		return func() {}, true
+	}
+	if len(ds.docs)+ds.opening >= ds.limit {
+		return nil, false
+	}
+	ds.opening++
+	return func() {
+		ds.mutex.Lock()
+		defer ds.mutex.Unlock()
+		ds.opening--
+	}, true
+}
+
+func (ds *documentStore) open(doc document) {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+
+	doc.modified = time.Now()
+	ds.docs[doc.URI] = &doc
+}
+
+func (ds *documentStore) change(uri string, version int, changes []contentChange, encoding string) error {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+
+	doc, ok := ds.docs[uri]
+	if !ok {
+		return fmt.Errorf("document %v is not open", uri)
+	}
+
+	text := doc.Text
+	for _, c := range changes {
+		if c.Range == nil {
+			text = c.Text
+			continue
+		}
+
+		var err error
+		text, err = lsp.ApplyTextEdits(text, []lsp.TextEdit{{Range: *c.Range, NewText: c.Text}}, encoding)
+		if err != nil {
+			return err
+		}
+	}
+
+	doc.Text = text
+	doc.Version = version
+	doc.modified = time.Now()
+	return nil
+}
+
+func (ds *documentStore) close(uri string) {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+
+	delete(ds.docs, uri)
+}
+
+// observe updates the store according to a notification sent to the LSP
+// server. Notifications unrelated to document synchronization are
+// ignored.
+func (ds *documentStore) observe(method string, params any, encoding string) error {
+	switch method {
+	case "textDocument/didOpen", "textDocument/didChange", "textDocument/didClose":
+	default:
+		return nil
+	}
+
+	data, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+
+	var p struct {
+		TextDocument   document        `json:"textDocument"`
+		ContentChanges []contentChange `json:"contentChanges"`
+	}
+	err = json.Unmarshal(data, &p)
+	if err != nil {
+		return err
+	}
+
+	switch method {
+	case "textDocument/didOpen":
+		ds.open(p.TextDocument)
+	case "textDocument/didChange":
+		return ds.change(p.TextDocument.URI, p.TextDocument.Version, p.ContentChanges, encoding)
+	case "textDocument/didClose":
+		ds.close(p.TextDocument.URI)
+	}
+
+	return nil
+}
+
+// documentURI returns the value of params.textDocument.uri, if present.
+func documentURI(params any) string {
+	obj, _ := params.(map[string]any)
+	td, _ := obj["textDocument"].(map[string]any)
+	uri, _ := td["uri"].(string)
+	return uri
+}
+
+// notify sends a notification to the LSP server on behalf of the proxy,
+// keeping the document store up to date.
+func (p *proxy) notify(method string, params any) error {
+	p.docSync.RLock()
+	defer p.docSync.RUnlock()
+
+	_, err := lsp.NewClient(p.server()).Send(&lsp.Message{Method: method, Params: params})
+	if err != nil {
+		return p.proxyError(err)
+	}
+
+	if p.mirror != nil {
+		p.mirror.notify(method, params)
+	}
+	p.observeSettings(method, params)
+	p.invalidateCaches(method, params)
+	return p.docs.observe(method, params, p.positionEncoding())
+}
+
+// openDocument returns the tracked document with the specified URI. If it
+// is not being tracked, it is read from disk and opened in the LSP server.
+// If languageId is empty, it is detected from the document.
+func (p *proxy) openDocument(uri, languageId string) (document, error) {
+	if doc, ok := p.docs.get(uri); ok {
+		return doc, nil
+	}
+
+	release, ok := p.docs.reserve(uri)
+	if !ok {
+		return document{}, errDocumentQuota
+	}
+	defer release()
+
+	path, err := lsp.URIToPath(uri)
+	if err != nil {
+		return document{}, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return document{}, err
+	}
+
+	if languageId == "" {
+		languageId = p.languages.detect(uri, string(data))
+		if languageId == "" {
+			return document{}, errUnknownLanguage
+		}
+	}
+
+	doc := document{URI: uri, LanguageID: languageId, Version: 1, Text: string(data)}
+	err = p.notify("textDocument/didOpen", map[string]any{"textDocument": &doc})
+	if err != nil {
+		return document{}, err
+	}
+
+	return doc, nil
+}
+
+// changeDocument replaces the full content of a tracked document, bumping
+// its version. The version is bumped from the latest one while holding the
+// document's lock, so that concurrent changes are sent in order.
+func (p *proxy) changeDocument(doc document, text string) (document, error) {
+	unlock := p.docs.lock(doc.URI)
+	defer unlock()
+
+	current, ok := p.docs.get(doc.URI)
+	if !ok {
+		return document{}, errDocumentNotOpen
+	}
+	doc.LanguageID = current.LanguageID
+	doc.Version = max(doc.Version, current.Version) + 1
+	doc.Text = text
+
+	params := map[string]any{
+		"textDocument":   map[string]any{"uri": doc.URI, "version": doc.Version},
+		"contentChanges": []contentChange{{Text: text}},
+	}
+	err := p.notify("textDocument/didChange", params)
+	if err != nil {
+		return document{}, err
+	}
+
+	return doc, nil
+}
+
+// writeFile writes data to path by first writing it to a temporary file
+// in the same directory, and then renaming it.
+func writeFile(path string, data []byte) error {
+	mode := os.FileMode(0o644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), ".hyperlsp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.Write(data)
+	if err = errors.Join(err, f.Chmod(mode), f.Close()); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// handleDocsOpenBulk opens all files matching a glob pattern in the LSP
+// server (if not open already), so that servers which only analyze open
+// documents can start working on them.
+func (p *proxy) handleDocsOpenBulk(w http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Pattern    string `json:"pattern"`
+		LanguageID string `json:"languageId"`
+		Limit      int    `json:"limit"`
+	}
+
+	defer req.Body.Close()
+	err := json.NewDecoder(req.Body).Decode(&body)
+	if err != nil || body.Pattern == "" {
+		writeError(w, http.StatusBadRequest, "request json must contain a pattern")
+		return
+	}
+	if body.Limit <= 0 {
+		body.Limit = openBulkDefaultLimit
+	}
+
+	if !p.allowedPath(globRoot(filepath.ToSlash(filepath.Clean(body.Pattern)))) {
+		writeError(w, http.StatusForbidden, "pattern is outside of the allowed roots")
+		return
+	}
+
+	files, err := globFiles(body.Pattern)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("unable to match pattern: %v", err))
+		return
+	}
+	if len(files) > body.Limit {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("pattern matches %v files, which exceeds the limit of %v", len(files), body.Limit))
+		return
+	}
+
+	opened, skipped := []string{}, []string{}
+	for _, file := range files {
+		uri := lsp.PathToURI(file)
+		if _, ok := p.docs.get(uri); ok {
+			skipped = append(skipped, uri)
+			continue
+		}
+
+		_, err := p.openDocument(uri, body.LanguageID)
+		if errors.Is(err, errDocumentQuota) {
+			writeError(w, http.StatusForbidden, err.Error())
+			return
+		} else if errors.Is(err, errUnknownLanguage) {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("unable to open %v: %v", uri, err))
+			return
+		} else if err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Sprintf("unable to open %v: %v", uri, err))
+			return
+		}
+		opened = append(opened, uri)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"opened":  opened,
+		"skipped": skipped,
+	})
+}
+
+type syncOperation struct {
+	// One of open, change or close.
+	Op         string          `json:"op"`
+	URI        string          `json:"uri"`
+	LanguageID string          `json:"languageId"`
+	Version    int             `json:"version"`
+	Text       *string         `json:"text"`
+	Changes    []contentChange `json:"changes"`
+}
+
+func (op *syncOperation) validate() error {
+	if op.URI == "" {
+		return fmt.Errorf("no document uri specified")
+	}
+
+	switch op.Op {
+	case "open":
+	case "change":
+		if len(op.Changes) == 0 {
+			return fmt.Errorf("no content changes specified")
+		}
+	case "close":
+	default:
+		return fmt.Errorf("invalid operation: %v", op.Op)
+	}
+
+	return nil
+}
+
+// applySyncOperation sends the notification corresponding to the
+// operation, returning the resulting document version (zero for close).
+// The document's lock is held, so that concurrent operations on it are
+// applied one at a time.
+func (p *proxy) applySyncOperation(op *syncOperation) (int, error) {
+	unlock := p.docs.lock(op.URI)
+	defer unlock()
+
+	switch op.Op {
+	case "open":
+		if op.Text == nil {
+			// Read from disk.
+			doc, err := p.openDocument(op.URI, op.LanguageID)
+			return doc.Version, err
+		}
+		// The LSP server can't be sent a second didOpen notification.
+		if _, ok := p.docs.get(op.URI); ok {
+			return 0, errDocumentOpen
+		}
+
+		release, ok := p.docs.reserve(op.URI)
+		if !ok {
+			return 0, errDocumentQuota
+		}
+		defer release()
+		languageId := op.LanguageID
+		if languageId == "" {
+			languageId = p.languages.detect(op.URI, *op.Text)
+			if languageId == "" {
+				return 0, errUnknownLanguage
+			}
+		}
+		version := max(op.Version, 1)
+		err := p.notify("textDocument/didOpen", map[string]any{
+			"textDocument": document{URI: op.URI, LanguageID: languageId, Version: version, Text: *op.Text},
+		})
+		return version, err
+
+	case "change":
+		doc, ok := p.docs.get(op.URI)
+		if !ok {
+			return 0, errDocumentNotOpen
+		}
+
+		version := op.Version
+		if version == 0 {
+			version = doc.Version + 1
+		} else if version <= doc.Version {
+			return 0, fmt.Errorf("%w: %v <= %v", errStaleVersion, version, doc.Version)
+		}
+		err := p.notify("textDocument/didChange", map[string]any{
+			"textDocument":   map[string]any{"uri": op.URI, "version": version},
+			"contentChanges": op.Changes,
+		})
+		return version, err
+
+	default:
+		if _, ok := p.docs.get(op.URI); !ok {
+			return 0, errDocumentNotOpen
+		}
+		err := p.notify("textDocument/didClose", map[string]any{
+			"textDocument": lsp.TextDocumentIdentifier{URI: op.URI},
+		})
+		return 0, err
+	}
+}
+
+// handleDocsSync applies a list of document operations (open, change and
+// close) in order, sending the corresponding notifications to the LSP
+// server. Processing stops at the first operation that fails.
+func (p *proxy) handleDocsSync(w http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Operations []syncOperation `json:"operations"`
+	}
+
+	defer req.Body.Close()
+	err := json.NewDecoder(req.Body).Decode(&body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "unable to unmarshal request json")
+		return
+	}
+
+	for i := range body.Operations {
+		if err := body.Operations[i].validate(); err != nil {
+			message := fmt.Sprintf("operation %v: %v", i, err)
+			writeJSON(w, http.StatusBadRequest, newProxyError(http.StatusBadRequest, codeInvalidRequest, message, map[string]any{"index": i, "applied": 0}))
+			return
+		}
+	}
+
+	type syncResult struct {
+		Op      string `json:"op"`
+		URI     string `json:"uri"`
+		Version int    `json:"version,omitempty"`
+	}
+
+	results := []syncResult{}
+	for i := range body.Operations {
+		op := &body.Operations[i]
+
+		version, err := p.applySyncOperation(op)
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, errDocumentQuota) {
+				status = http.StatusForbidden
+			} else if errors.Is(err, errDocumentNotOpen) || errors.Is(err, errDocumentOpen) || errors.Is(err, errStaleVersion) {
+				status = http.StatusConflict
+			} else if errors.Is(err, errUnknownLanguage) {
+				status = http.StatusBadRequest
+			}
+			message := fmt.Sprintf("operation %v: %v", i, err)
+			writeJSON(w, status, newProxyError(status, statusErrorCode(status), message, map[string]any{"index": i, "applied": i}))
+			return
+		}
+
+		results = append(results, syncResult{Op: op.Op, URI: op.URI, Version: version})
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"applied": len(results),
+		"results": results,
+	})
+}
+
+// handleDocGet returns the content, version and languageId of a tracked
+// document, as currently known to the LSP server. The document's URI is
+// URL-encoded in the path, e.g. /docs/file%3A%2F%2F%2Ftmp%2Fmain.go.
+func (p *proxy) handleDocGet(w http.ResponseWriter, req *http.Request) {
+	uri := req.PathValue("uri")
+	doc, ok := p.docs.get(uri)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("document %v is not open", uri))
+		return
+	}
+
+	writeDocumentHeaders(w.Header(), doc)
+	writeJSON(w, http.StatusOK, doc)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/federicotdn/hyperlsp/lsp"
+)
+
+// Maximum number of edits kept in the journal. Backups of older edits are
+// left on disk, but they can't be undone via /edits/journal anymore.
+const maxJournalEntries = 100
+
+// journalEntry is an edit of the LSP server applied to disk.
+type journalEntry struct {
+	ID      string        `json:"id"`
+	Label   string        `json:"label,omitempty"`
+	Applied time.Time     `json:"applied"`
+	Files   []appliedFile `json:"files"`
+	Undone  bool          `json:"undone"`
+
+	// Hashes of the contents written, by path, to detect later changes.
+	// Deleted files have no hash.
+	hashes map[string]string
+}
+
+// editJournal records the edits of the LSP server applied to disk, so that
+// they can be undone.
+type editJournal struct {
+	// Held while applying or undoing edits, so that they don't interleave.
+	mutex sync.Mutex
+	// From the oldest.
+	entries []*journalEntry
+}
+
+// add records an applied edit, dropping the oldest entries once the
+// journal is full. The mutex must be held.
+func (ej *editJournal) add(entry *journalEntry) {
+	ej.entries = append(ej.entries, entry)
+	if len(ej.entries) > maxJournalEntries {
+		ej.entries = slices.Delete(ej.entries, 0, len(ej.entries)-maxJournalEntries)
+	}
+}
+
+// list returns copies of the journal entries, from the newest.
+func (ej *editJournal) list() []journalEntry {
+	ej.mutex.Lock()
+	defer ej.mutex.Unlock()
+
+	entries := make([]journalEntry, len(ej.entries))
+	for i, entry := range ej.entries {
+		entries[len(entries)-1-i] = *entry
+	}
+	return entries
+}
+
+// timestampedBackupSuffix returns the suffix of the backups of an edit of
+// the LSP server applied now, so that backups of successive edits of the
+// same file don't replace each other.
+func timestampedBackupSuffix(now time.Time) string {
+	return "." + now.UTC().Format("20060102T150405.000") + backupSuffix
+}
+
+// modified returns the files of an entry which have been modified since
+// it was applied.
+func (entry *journalEntry) modified() []string {
+	var paths []string
+	for _, a := range entry.Files {
+		data, err := os.ReadFile(a.Path)
+		hash, written := entry.hashes[a.Path]
+		switch {
+		case !written && errors.Is(err, fs.ErrNotExist):
+		case written && err == nil && contentHash(string(data)) == hash:
+		default:
+			paths = append(paths, a.Path)
+		}
+	}
+	return paths
+}
+
+// undoEdit reverts the files of a journal entry to their backups. Unless
+// force is set, it fails if any of them has been modified since.
+func (p *proxy) undoEdit(id string, force bool) (*journalEntry, int, error) {
+	ej := &p.editJournal
+	ej.mutex.Lock()
+	defer ej.mutex.Unlock()
+
+	i := slices.IndexFunc(ej.entries, func(entry *journalEntry) bool { return entry.ID == id })
+	if i < 0 {
+		return nil, http.StatusNotFound, fmt.Errorf("no edit with the specified id in the journal")
+	}
+	entry := ej.entries[i]
+	if entry.Undone {
+		return nil, http.StatusConflict, fmt.Errorf("edit has already been undone")
+	}
+	if modified := entry.modified(); len(modified) > 0 && !force {
+		return nil, http.StatusConflict, fmt.Errorf("files have been modified since the edit was applied: %v", modified)
+	}
+
+	err := revert(entry.Files)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	entry.Undone = true
+	p.reloadDocuments(entry.Files)
+	return entry, 0, nil
+}
+
+// reloadDocuments updates the tracked documents of files changed on disk
+// by the proxy, as the LSP server expects them to match.
+func (p *proxy) reloadDocuments(files []appliedFile) {
+	for _, a := range files {
+		doc, ok := p.docs.get(lsp.PathToURI(a.Path))
+		if !ok {
+			continue
+		}
+		data, err := os.ReadFile(a.Path)
+		if err != nil || string(data) == doc.Text {
+			continue
+		}
+		_, err = p.changeDocument(doc, string(data))
+		if err != nil {
+			slog.Warn("unable to update document after editing file", "uri", doc.URI, "err", err)
+		}
+	}
+}
+
+// handleEditsJournal returns the edits of the LSP server applied to disk,
+// from the newest.
+func (p *proxy) handleEditsJournal(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, p.editJournal.list())
+}
+
+// handleEditUndo reverts an edit of the LSP server applied to disk. With
+// force=true, files modified since are reverted as well.
+func (p *proxy) handleEditUndo(w http.ResponseWriter, req *http.Request) {
+	entry, status, err := p.undoEdit(req.PathValue("id"), req.URL.Query().Get("force") == "true")
+	if err != nil {
+		writeError(w, status, err.Error())
+		return
+	}
+	slog.Info("LSP server edit undone", "id", entry.ID, "files", len(entry.Files))
+	writeJSON(w, http.StatusOK, entry)
+}
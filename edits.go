@@ -0,0 +1,467 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/federicotdn/hyperlsp/lsp"
+)
+
+const backupSuffix = ".bak"
+
+type workspaceEdit struct {
+	Changes         map[string][]lsp.TextEdit `json:"changes"`
+	DocumentChanges []documentChange          `json:"documentChanges"`
+}
+
+// documentChange represents the TextDocumentEdit, CreateFile, RenameFile
+// and DeleteFile types, which can be present in the documentChanges
+// property of a WorkspaceEdit.
+type documentChange struct {
+	Kind         string `json:"kind"`
+	TextDocument *struct {
+		URI     string `json:"uri"`
+		Version *int   `json:"version"`
+	} `json:"textDocument"`
+	Edits   []lsp.TextEdit `json:"edits"`
+	URI     string         `json:"uri"`
+	OldURI  string         `json:"oldUri"`
+	NewURI  string         `json:"newUri"`
+	Options struct {
+		Overwrite         bool `json:"overwrite"`
+		IgnoreIfExists    bool `json:"ignoreIfExists"`
+		IgnoreIfNotExists bool `json:"ignoreIfNotExists"`
+	} `json:"options"`
+}
+
+// fileChange is the planned state of a single file. A nil original means
+// that the file did not exist, and a nil content that it will be deleted.
+type fileChange struct {
+	path     string
+	mode     fs.FileMode
+	original *string
+	content  *string
+}
+
+func (fc *fileChange) changed() bool {
+	if fc.original == nil || fc.content == nil {
+		return fc.original != fc.content
+	}
+	return *fc.original != *fc.content
+}
+
+func (fc *fileChange) action() string {
+	switch {
+	case fc.original == nil:
+		return "create"
+	case fc.content == nil:
+		return "delete"
+	default:
+		return "modify"
+	}
+}
+
+type appliedFile struct {
+	Path   string `json:"path"`
+	Action string `json:"action"`
+	Backup string `json:"backup,omitempty"`
+}
+
+// editPlan computes the result of applying one or more WorkspaceEdits in
+// memory, so that they can be either previewed as a diff, or written to
+// disk all at once. If a document store is set, the content of tracked
+// documents is used instead of the one on disk.
+type editPlan struct {
+	encoding string
+	docs     *documentStore
+	files    map[string]*fileChange
+	order    []string
+	// Suffix added to the paths of backups.
+	backupSuffix string
+	// If set, files for which it returns false can't be edited.
+	allowedPath func(path string) bool
+}
+
+func newEditPlan(encoding string, docs *documentStore) *editPlan {
+	return &editPlan{
+		encoding:     encoding,
+		docs:         docs,
+		files:        make(map[string]*fileChange),
+		backupSuffix: backupSuffix,
+	}
+}
+
+func (ep *editPlan) file(uri string) (*fileChange, error) {
+	path, err := lsp.URIToPath(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	if fc, ok := ep.files[path]; ok {
+		return fc, nil
+	}
+	if ep.allowedPath != nil && !ep.allowedPath(path) {
+		return nil, fmt.Errorf("cannot edit %v: %w", path, errOutsideRoots)
+	}
+
+	fc := &fileChange{path: path, mode: 0o644}
+	if ep.docs != nil {
+		if doc, ok := ep.docs.get(uri); ok {
+			fc.original = &doc.Text
+			fc.content = &doc.Text
+		}
+	}
+
+	info, err := os.Stat(path)
+	switch {
+	case fc.original != nil:
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		return nil, err
+	case info.IsDir():
+		return nil, fmt.Errorf("%v is a directory", path)
+	default:
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		content := string(data)
+		fc.mode = info.Mode().Perm()
+		fc.original = &content
+		fc.content = &content
+	}
+
+	ep.files[path] = fc
+	ep.order = append(ep.order, path)
+	return fc, nil
+}
+
+func (ep *editPlan) editFile(uri string, edits []lsp.TextEdit) error {
+	fc, err := ep.file(uri)
+	if err != nil {
+		return err
+	}
+	if fc.content == nil {
+		return fmt.Errorf("cannot edit %v: file does not exist", fc.path)
+	}
+
+	content, err := lsp.ApplyTextEdits(*fc.content, edits, ep.encoding)
+	if err != nil {
+		return fmt.Errorf("cannot edit %v: %w", fc.path, err)
+	}
+	fc.content = &content
+	return nil
+}
+
+func (ep *editPlan) documentChange(dc *documentChange) error {
+	switch dc.Kind {
+	case "":
+		if dc.TextDocument == nil {
+			return fmt.Errorf("document change has no kind or text document")
+		}
+		return ep.editFile(dc.TextDocument.URI, dc.Edits)
+	case "create":
+		fc, err := ep.file(dc.URI)
+		if err != nil {
+			return err
+		}
+		if fc.content != nil && !dc.Options.Overwrite {
+			if dc.Options.IgnoreIfExists {
+				return nil
+			}
+			return fmt.Errorf("cannot create %v: file already exists", fc.path)
+		}
+		empty := ""
+		fc.content = &empty
+	case "rename":
+		src, err := ep.file(dc.OldURI)
+		if err != nil {
+			return err
+		}
+		dst, err := ep.file(dc.NewURI)
+		if err != nil {
+			return err
+		}
+		if src.content == nil {
+			return fmt.Errorf("cannot rename %v: file does not exist", src.path)
+		}
+		if dst.content != nil && !dc.Options.Overwrite {
+			if dc.Options.IgnoreIfExists {
+				return nil
+			}
+			return fmt.Errorf("cannot rename to %v: file already exists", dst.path)
+		}
+		dst.content, dst.mode = src.content, src.mode
+		src.content = nil
+	case "delete":
+		fc, err := ep.file(dc.URI)
+		if err != nil {
+			return err
+		}
+		if fc.content == nil {
+			if dc.Options.IgnoreIfNotExists {
+				return nil
+			}
+			return fmt.Errorf("cannot delete %v: file does not exist", fc.path)
+		}
+		fc.content = nil
+	default:
+		return fmt.Errorf("unknown document change kind %q", dc.Kind)
+	}
+
+	return nil
+}
+
+// add computes the changes in a WorkspaceEdit. As specified by LSP,
+// documentChanges take precedence over changes if both are present.
+func (ep *editPlan) add(edit *workspaceEdit) error {
+	if edit.DocumentChanges != nil {
+		for i := range edit.DocumentChanges {
+			err := ep.documentChange(&edit.DocumentChanges[i])
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for uri, edits := range edit.Changes {
+		err := ep.editFile(uri, edits)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ep *editPlan) changes() []*fileChange {
+	var changes []*fileChange
+	for _, path := range ep.order {
+		if fc := ep.files[path]; fc.changed() {
+			changes = append(changes, fc)
+		}
+	}
+	return changes
+}
+
+// diff renders all planned changes as a unified diff.
+func (ep *editPlan) diff() string {
+	var sb strings.Builder
+	for _, fc := range ep.changes() {
+		oldName, newName := "a"+filepath.ToSlash(fc.path), "b"+filepath.ToSlash(fc.path)
+		oldText, newText := "", ""
+		if fc.original != nil {
+			oldText = *fc.original
+		} else {
+			oldName = "/dev/null"
+		}
+		if fc.content != nil {
+			newText = *fc.content
+		} else {
+			newName = "/dev/null"
+		}
+
+		if oldText == newText {
+			// Creation or deletion of an empty file.
+			fmt.Fprintf(&sb, "--- %v\n+++ %v\n", oldName, newName)
+			continue
+		}
+		sb.WriteString(unifiedDiff(oldName, newName, oldText, newText))
+	}
+	return sb.String()
+}
+
+// apply writes all planned changes to disk. New contents are first
+// written to temporary files, and original files are moved to backups
+// before being replaced, so that all changes can be rolled back if any of
+// them fails. Backups are removed afterwards unless keepBackups is set.
+func (ep *editPlan) apply(keepBackups bool) ([]appliedFile, error) {
+	changes := ep.changes()
+	temps := make(map[string]string)
+
+	cleanup := func() {
+		for _, tmp := range temps {
+			os.Remove(tmp)
+		}
+	}
+
+	for _, fc := range changes {
+		if fc.content == nil {
+			continue
+		}
+
+		dir := filepath.Dir(fc.path)
+		err := os.MkdirAll(dir, 0o755)
+		if err != nil {
+			cleanup()
+			return nil, err
+		}
+
+		f, err := os.CreateTemp(dir, ".hyperlsp-*")
+		if err != nil {
+			cleanup()
+			return nil, err
+		}
+		temps[fc.path] = f.Name()
+
+		_, err = f.WriteString(*fc.content)
+		err = errors.Join(err, f.Chmod(fc.mode), f.Close())
+		if err != nil {
+			cleanup()
+			return nil, fmt.Errorf("unable to write %v: %w", fc.path, err)
+		}
+	}
+
+	var applied []appliedFile
+	rollback := func() {
+		if err := revert(applied); err != nil {
+			slog.Error("unable to roll back file changes", "err", err)
+		}
+		cleanup()
+	}
+
+	for _, fc := range changes {
+		a := appliedFile{Path: fc.path, Action: fc.action()}
+
+		if fc.original != nil {
+			backup, err := ep.backupPath(fc.path)
+			if err == nil {
+				a.Backup = backup
+				err = os.Rename(fc.path, a.Backup)
+			}
+			if err != nil {
+				rollback()
+				return nil, fmt.Errorf("unable to back up %v: %w", fc.path, err)
+			}
+		}
+
+		if fc.content != nil {
+			err := os.Rename(temps[fc.path], fc.path)
+			if err != nil {
+				if a.Backup != "" {
+					os.Rename(a.Backup, fc.path)
+				}
+				rollback()
+				return nil, fmt.Errorf("unable to replace %v: %w", fc.path, err)
+			}
+			delete(temps, fc.path)
+		}
+
+		applied = append(applied, a)
+	}
+
+	if !keepBackups {
+		for i := range applied {
+			if applied[i].Backup != "" {
+				os.Remove(applied[i].Backup)
+				applied[i].Backup = ""
+			}
+		}
+	}
+
+	return applied, nil
+}
+
+// backupPath returns the path of the backup of a file. If a file already
+// exists with the usual suffix (e.g. a backup of a previous edit, or a file
+// of the user), a number is added before it, so that it is never replaced.
+func (ep *editPlan) backupPath(path string) (string, error) {
+	for i := 0; ; i++ {
+		backup := path + ep.backupSuffix
+		if i > 0 {
+			backup = fmt.Sprintf("%v.%v%v", path, i, ep.backupSuffix)
+		}
+		_, err := os.Lstat(backup)
+		if errors.Is(err, fs.ErrNotExist) {
+			return backup, nil
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+}
+
+// revert undoes applied file changes, from the last one: backups are
+// moved back to their original paths, and created files are removed.
+func revert(applied []appliedFile) error {
+	var errs []error
+	for i := len(applied) - 1; i >= 0; i-- {
+		a := applied[i]
+		var err error
+		if a.Backup != "" {
+			err = os.Rename(a.Backup, a.Path)
+		} else {
+			err = os.Remove(a.Path)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("unable to revert %v: %w", a.Path, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// handleEditsApply applies a WorkspaceEdit to the files on disk. With
+// dryRun=true, nothing is written and only the resulting diff is
+// returned. Backups of modified and deleted files are kept unless
+// backup=false is specified.
+func (p *proxy) handleEditsApply(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	dryRun := query.Get("dryRun") == "true"
+	keepBackups := query.Get("backup") != "false"
+
+	if !dryRun && p.denyReadOnly(w, "", "applying edits to disk") {
+		return
+	}
+
+	var edit workspaceEdit
+	defer req.Body.Close()
+	err := json.NewDecoder(req.Body).Decode(&edit)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "unable to unmarshal request json")
+		return
+	}
+
+	plan := newEditPlan(p.positionEncoding(), nil)
+	err = plan.add(&edit)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	resp := struct {
+		Applied bool          `json:"applied"`
+		Files   []appliedFile `json:"files"`
+		Diff    string        `json:"diff"`
+	}{
+		Files: []appliedFile{},
+		Diff:  plan.diff(),
+	}
+
+	if dryRun {
+		for _, fc := range plan.changes() {
+			resp.Files = append(resp.Files, appliedFile{Path: fc.path, Action: fc.action()})
+		}
+		writeJSON(w, http.StatusOK, &resp)
+		return
+	}
+
+	files, err := plan.apply(keepBackups)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("unable to apply edit: %v", err))
+		return
+	}
+	p.reloadDocuments(files)
+
+	resp.Applied = true
+	if files != nil {
+		resp.Files = files
+	}
+	writeJSON(w, http.StatusOK, &resp)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/federicotdn/hyperlsp/lsp"
+)
+
+// Stable codes of the errors generated by hyperlsp itself, set as
+// ResponseError.ProxyCode. Unlike messages, which may change, clients can
+// branch on them.
+const (
+	codeInvalidRequest = "invalid_request"
+	codeUnauthorized   = "unauthorized"
+	codeForbidden      = "forbidden"
+	codeNotFound       = "not_found"
+	codeConflict       = "conflict"
+	codeRateLimited    = "rate_limited"
+	codeInternal       = "internal"
+	codeUnavailable    = "unavailable"
+	// Too many requests are being sent to the LSP server.
+	codeBusy = "busy"
+	// The request was cancelled before being sent to the LSP server.
+	codeCancelled = "cancelled"
+	// The LSP server subprocess is not running.
+	codeServerDown = "server_down"
+	// The LSP server did not answer in time.
+	codeTimeout = "timeout"
+	// The LSP server sent a malformed frame.
+	codeFraming = "framing"
+	// The connection to the LSP server failed.
+	codeConnection = "connection"
+)
+
+// statusErrorCode returns the error code for a proxy error with an HTTP
+// status code, when there is no more specific one.
+func statusErrorCode(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return codeInvalidRequest
+	case http.StatusUnauthorized:
+		return codeUnauthorized
+	case http.StatusForbidden:
+		return codeForbidden
+	case http.StatusNotFound:
+		return codeNotFound
+	case http.StatusConflict:
+		return codeConflict
+	case http.StatusTooManyRequests:
+		return codeRateLimited
+	case http.StatusServiceUnavailable:
+		return codeUnavailable
+	case http.StatusGatewayTimeout:
+		return codeTimeout
+	}
+	return codeInternal
+}
+
+// newProxyError returns an error generated by hyperlsp itself, as opposed
+// to one returned by the LSP server. Its JSON-RPC code is the HTTP status
+// code.
+func newProxyError(status int, code string, message string, data any) *lsp.ResponseError {
+	return &lsp.ResponseError{
+		Code:      status,
+		Message:   message,
+		Data:      data,
+		Source:    lsp.ErrorSourceProxy,
+		ProxyCode: code,
+	}
+}
+
+// limitError is the error of a request of hyperlsp itself which was
+// rejected by the limits of the proxy (see acquireLimits).
+type limitError struct {
+	resp   *lsp.Response
+	status int
+}
+
+func (e *limitError) Error() string {
+	return e.resp.Error.Message
+}
+
+// Maximum time to wait for the LSP server subprocess to exit after a
+// message could not be sent to it, to report how it exited.
+const exitWaitTimeout = time.Second
+
+// sendError is the error of a message which could not be sent to the LSP
+// server, or answered by it.
+type sendError struct {
+	err error
+	// How the server subprocess exited, if it is down.
+	exit *lsp.ExitInfo
+}
+
+func (e *sendError) Error() string {
+	return e.err.Error()
+}
+
+func (e *sendError) Unwrap() error {
+	return e.err
+}
+
+// proxyError wraps the error of a message which could not be sent to the
+// LSP server (or answered by it). If the server subprocess is down, the
+// error includes how it exited.
+func (p *proxy) proxyError(err error) error {
+	wrapped := &sendError{err: fmt.Errorf("proxy error: %w", err)}
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		wrapped.exit = p.server().AwaitExit(exitWaitTimeout)
+	}
+	return wrapped
+}
+
+// errorStatus returns the HTTP status code, error code and error data for
+// an error of the proxy, which may have been returned by proxyError.
+func errorStatus(err error) (int, string, any) {
+	var sendErr *sendError
+	var frameErr *lsp.FrameError
+	switch {
+	case !errors.As(err, &sendErr):
+		return http.StatusInternalServerError, codeInternal, nil
+	case sendErr.exit != nil:
+		return http.StatusServiceUnavailable, codeServerDown, map[string]any{"exit": sendErr.exit}
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return http.StatusGatewayTimeout, codeTimeout, nil
+	case errors.As(err, &frameErr):
+		return http.StatusBadGateway, codeFraming, nil
+	}
+	return http.StatusBadGateway, codeConnection, nil
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const eventSubscriberBuffer = 256
+
+// Number of the latest notifications kept so that reconnecting subscribers
+// can receive the ones they missed.
+const eventReplayBuffer = 1024
+
+// serverNotification is a notification sent by the LSP server, streamed
+// to the subscribers of /events.
+type serverNotification struct {
+	Method string `json:"method"`
+	Params any    `json:"params"`
+	// Name of the server which sent the notification, if there are
+	// several.
+	Server string `json:"server,omitempty"`
+	// Sequence number assigned by the hub, sent as the event's ID.
+	seq uint64
+}
+
+type eventSubscriber struct {
+	events chan serverNotification
+	mutex  sync.Mutex
+	// Notifications missed because the subscriber was too slow, by method.
+	missed map[string]int
+}
+
+// eventHub broadcasts the notifications sent by the LSP server (or by all
+// servers, with multiple servers) to subscribers. Notifications are numbered
+// in the order they are published, and the latest ones are kept to be
+// replayed to reconnecting subscribers.
+type eventHub struct {
+	mutex       sync.Mutex
+	subscribers map[*eventSubscriber]bool
+	// Sequence number of the latest notification.
+	seq    uint64
+	replay []serverNotification
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subscribers: make(map[*eventSubscriber]bool)}
+}
+
+func (h *eventHub) publish(n serverNotification) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.seq++
+	n.seq = h.seq
+	h.replay = append(h.replay, n)
+	if len(h.replay) > eventReplayBuffer {
+		h.replay = h.replay[1:]
+	}
+
+	for sub := range h.subscribers {
+		// Slow subscribers miss notifications instead of blocking the
+		// LSP server connection.
+		select {
+		case sub.events <- n:
+		default:
+			sub.mutex.Lock()
+			sub.missed[n.Method]++
+			sub.mutex.Unlock()
+		}
+	}
+}
+
+// subscribe adds a subscriber. If resume is true, it also returns the
+// buffered notifications published after the one numbered since, and how
+// many of them are no longer buffered. If since is newer than any
+// notification, e.g. because hyperlsp was restarted, all buffered
+// notifications are returned.
+func (h *eventHub) subscribe(sub *eventSubscriber, since uint64, resume bool) ([]serverNotification, uint64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.subscribers[sub] = true
+
+	if !resume {
+		return nil, 0
+	}
+	if since > h.seq {
+		since = 0
+	}
+	i := sort.Search(len(h.replay), func(i int) bool {
+		return h.replay[i].seq > since
+	})
+	replay := slices.Clone(h.replay[i:])
+
+	oldest := h.seq + 1
+	if len(replay) > 0 {
+		oldest = replay[0].seq
+	}
+	return replay, oldest - since - 1
+}
+
+func (h *eventHub) unsubscribe(sub *eventSubscriber) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	delete(h.subscribers, sub)
+}
+
+// notificationRates maps LSP notification methods to the maximum number of
+// them streamed to each subscriber per second.
+type notificationRates map[string]float64
+
+func (nr notificationRates) String() string {
+	return ""
+}
+
+// Set parses a rate specification of the form "method=rate". It
+// implements flag.Value so that the -notify-rate flag can be specified
+// multiple times.
+func (nr notificationRates) Set(value string) error {
+	method, spec, ok := strings.Cut(value, "=")
+	rate, err := strconv.ParseFloat(spec, 64)
+	if !ok || method == "" || err != nil || rate <= 0 {
+		return fmt.Errorf("invalid notification rate %q, expected method=rate", value)
+	}
+	nr[method] = rate
+	return nil
+}
+
+// notificationWindows maps LSP notification methods to the period during
+// which notifications with the same coalescing key (see coalescingKey) are
+// coalesced, delivering only the latest one.
+type notificationWindows map[string]time.Duration
+
+func (nw notificationWindows) String() string {
+	return ""
+}
+
+// Set parses a coalescing specification of the form "method=duration".
+// It implements flag.Value so that the -notify-coalesce flag can be
+// specified multiple times.
+func (nw notificationWindows) Set(value string) error {
+	method, spec, ok := strings.Cut(value, "=")
+	window, err := time.ParseDuration(spec)
+	if !ok || method == "" || err != nil || window <= 0 {
+		return fmt.Errorf("invalid notification coalescing %q, expected method=duration", value)
+	}
+	nw[method] = window
+	return nil
+}
+
+// floodControl limits the notifications streamed to subscribers.
+type floodControl struct {
+	rates   notificationRates
+	windows notificationWindows
+}
+
+// coalescingKey returns the key of notifications which replace each other
+// when coalesced: the document of publishDiagnostics, the token of
+// $/progress, or otherwise only the method.
+func coalescingKey(n serverNotification) string {
+	params, _ := n.Params.(map[string]any)
+	switch n.Method {
+	case "textDocument/publishDiagnostics":
+		return fmt.Sprintf("%v %v", n.Method, params["uri"])
+	case "$/progress":
+		return fmt.Sprintf("%v %v", n.Method, params["token"])
+	}
+	return n.Method
+}
+
+// throttle applies flood control to the notifications streamed to a
+// single subscriber.
+type throttle struct {
+	fc floodControl
+	// Tokens available for each rate limited method, and when they were
+	// last refilled.
+	tokens   map[string]float64
+	refilled map[string]time.Time
+	// When the last notification of each coalescing key was delivered,
+	// and the latest one waiting to be delivered, if any.
+	sent    map[string]time.Time
+	pending map[string]serverNotification
+	// Notifications dropped by rate limits, by method.
+	dropped map[string]int
+}
+
+func newThrottle(fc floodControl) *throttle {
+	return &throttle{
+		fc:       fc,
+		tokens:   make(map[string]float64),
+		refilled: make(map[string]time.Time),
+		sent:     make(map[string]time.Time),
+		pending:  make(map[string]serverNotification),
+		dropped:  make(map[string]int),
+	}
+}
+
+// allow reports whether a notification is within its method's rate limit,
+// allowing bursts of up to a second's worth of notifications.
+func (t *throttle) allow(method string, now time.Time) bool {
+	rate, ok := t.fc.rates[method]
+	if !ok {
+		return true
+	}
+
+	tokens, ok := t.tokens[method]
+	if !ok {
+		tokens = rate
+	} else {
+		tokens = min(rate, tokens+now.Sub(t.refilled[method]).Seconds()*rate)
+	}
+	t.refilled[method] = now
+
+	if tokens < 1 {
+		t.tokens[method] = tokens
+		t.dropped[method]++
+		return false
+	}
+	t.tokens[method] = tokens - 1
+	return true
+}
+
+// admit returns the notifications to deliver after receiving n: either
+// n itself, or none if it is dropped or waiting to be coalesced.
+func (t *throttle) admit(n serverNotification, now time.Time) []serverNotification {
+	window, ok := t.fc.windows[n.Method]
+	if ok {
+		key := coalescingKey(n)
+		if _, waiting := t.pending[key]; waiting || now.Sub(t.sent[key]) < window {
+			t.pending[key] = n
+			return nil
+		}
+		t.sent[key] = now
+	}
+
+	if !t.allow(n.Method, now) {
+		return nil
+	}
+	return []serverNotification{n}
+}
+
+// due returns the coalesced notifications whose window has passed.
+func (t *throttle) due(now time.Time) []serverNotification {
+	var ns []serverNotification
+	for key, n := range t.pending {
+		if now.Sub(t.sent[key]) < t.fc.windows[n.Method] {
+			continue
+		}
+		delete(t.pending, key)
+		t.sent[key] = now
+		if t.allow(n.Method, now) {
+			ns = append(ns, n)
+		}
+	}
+	return ns
+}
+
+// nextDue returns how long until the next coalesced notification is due,
+// or false if there are none.
+func (t *throttle) nextDue(now time.Time) (time.Duration, bool) {
+	next, found := time.Duration(0), false
+	for key, n := range t.pending {
+		wait := t.sent[key].Add(t.fc.windows[n.Method]).Sub(now)
+		if !found || wait < next {
+			next, found = wait, true
+		}
+	}
+	return max(next, 0), found
+}
+
+// takeDropped returns the number of notifications dropped since it was
+// last called, by method.
+func (t *throttle) takeDropped(sub *eventSubscriber) map[string]int {
+	counts := make(map[string]int)
+	for method, n := range t.dropped {
+		counts[method] += n
+	}
+	t.dropped = make(map[string]int)
+
+	sub.mutex.Lock()
+	for method, n := range sub.missed {
+		counts[method] += n
+	}
+	sub.missed = make(map[string]int)
+	sub.mutex.Unlock()
+
+	return counts
+}
+
+// serveEvents streams the notifications published by a hub as server-sent
+// events, applying flood control. The optional ?methods= parameter is a
+// comma-separated list of the methods to stream. Notifications dropped by
+// rate limits (or because the client is too slow) are reported in
+// "dropped" events, at most once per second.
+//
+// Each event's ID is the notification's sequence number. Reconnecting
+// clients which send it in the Last-Event-ID header (or in the ?since=
+// parameter) first receive the notifications they missed, as far as they
+// are still buffered; the number of those which aren't is reported in a
+// "missed" event.
+func serveEvents(w http.ResponseWriter, req *http.Request, hub *eventHub, fc floodControl) {
+	methods := make(map[string]bool)
+	if v := req.URL.Query().Get("methods"); v != "" {
+		for _, method := range strings.Split(v, ",") {
+			methods[method] = true
+		}
+	}
+
+	lastID := req.Header.Get("Last-Event-ID")
+	if v := req.URL.Query().Get("since"); v != "" {
+		lastID = v
+	}
+	var since uint64
+	if lastID != "" {
+		var err error
+		since, err = strconv.ParseUint(lastID, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid event ID: %q", lastID))
+			return
+		}
+	}
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	sub := &eventSubscriber{
+		events: make(chan serverNotification, eventSubscriberBuffer),
+		missed: make(map[string]int),
+	}
+	replay, missed := hub.subscribe(sub, since, lastID != "")
+	defer hub.unsubscribe(sub)
+
+	t := newThrottle(fc)
+	receive := func(n serverNotification) []serverNotification {
+		if len(methods) > 0 && !methods[n.Method] {
+			return nil
+		}
+		return t.admit(n, time.Now())
+	}
+
+	keepAlive := time.NewTicker(logKeepAlive)
+	defer keepAlive.Stop()
+	report := time.NewTicker(time.Second)
+	defer report.Stop()
+	flush := time.NewTimer(0)
+	<-flush.C
+
+	var ns []serverNotification
+	var err error
+	if missed > 0 {
+		_, err = fmt.Fprintf(w, "event: missed\ndata: {\"missed\":%v}\n\n", missed)
+	}
+	// Missed notifications are written before waiting for new ones.
+	for _, n := range replay {
+		ns = append(ns, receive(n)...)
+	}
+
+	for {
+		for _, n := range ns {
+			if err != nil {
+				break
+			}
+			data, _ := json.Marshal(n)
+			_, err = fmt.Fprintf(w, "id: %v\ndata: %s\n\n", n.seq, data)
+		}
+		if err == nil {
+			err = rc.Flush()
+		}
+		if err != nil {
+			return
+		}
+
+		flush.Stop()
+		if wait, ok := t.nextDue(time.Now()); ok {
+			flush.Reset(wait)
+		}
+
+		ns = nil
+		select {
+		case <-req.Context().Done():
+			return
+		case n := <-sub.events:
+			ns = receive(n)
+		case <-flush.C:
+			ns = t.due(time.Now())
+		case <-report.C:
+			if dropped := t.takeDropped(sub); len(dropped) > 0 {
+				data, _ := json.Marshal(map[string]any{"dropped": dropped})
+				_, err = fmt.Fprintf(w, "event: dropped\ndata: %s\n\n", data)
+			}
+		case <-keepAlive.C:
+			_, err = fmt.Fprint(w, ": keep-alive\n\n")
+		}
+	}
+}
+
+// handleEvents streams the notifications sent by the LSP server.
+func (p *proxy) handleEvents(w http.ResponseWriter, req *http.Request) {
+	serveEvents(w, req, p.notifications, p.floodControl)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// resultFilter transforms the (already unmarshaled) JSON result of an LSP
+// request before it is sent back to the HTTP client.
+type resultFilter func(any) any
+
+// resultFilters maps LSP method names to the filters applied to their
+// results, in order.
+type resultFilters map[string][]resultFilter
+
+const deprecatedTag = 1
+
+func (rf resultFilters) String() string {
+	return ""
+}
+
+// Set parses a filter specification of the form
+// "method=filter1,filter2,...". It implements flag.Value so that the
+// -filter flag can be specified multiple times.
+func (rf resultFilters) Set(value string) error {
+	method, specs, ok := strings.Cut(value, "=")
+	if !ok || method == "" || specs == "" {
+		return fmt.Errorf("invalid filter %q, expected method=filter[,filter...]", value)
+	}
+
+	for _, spec := range strings.Split(specs, ",") {
+		filter, err := parseFilter(spec)
+		if err != nil {
+			return err
+		}
+		rf[method] = append(rf[method], filter)
+	}
+
+	return nil
+}
+
+func (rf resultFilters) apply(method string, result any) any {
+	if len(rf[method]) == 0 {
+		return result
+	}
+
+	result = decodeResult(result)
+	for _, filter := range rf[method] {
+		result = filter(result)
+	}
+	return result
+}
+
+func parseFilter(spec string) (resultFilter, error) {
+	name, arg, _ := strings.Cut(spec, ":")
+	switch name {
+	case "strip":
+		if arg == "" {
+			return nil, fmt.Errorf("filter %q requires a field name", name)
+		}
+		return func(v any) any { return stripField(v, arg) }, nil
+	case "drop-deprecated":
+		return dropDeprecated, nil
+	default:
+		return nil, fmt.Errorf("unknown filter %q", name)
+	}
+}
+
+// stripField removes every object key named field, at any depth.
+func stripField(v any, field string) any {
+	switch v := v.(type) {
+	case map[string]any:
+		delete(v, field)
+		for k, e := range v {
+			v[k] = stripField(e, field)
+		}
+	case []any:
+		for i, e := range v {
+			v[i] = stripField(e, field)
+		}
+	}
+	return v
+}
+
+func isDeprecated(v any) bool {
+	obj, ok := v.(map[string]any)
+	if !ok {
+		return false
+	}
+
+	if deprecated, ok := obj["deprecated"].(bool); ok && deprecated {
+		return true
+	}
+
+	tags, _ := obj["tags"].([]any)
+	for _, tag := range tags {
+		if n, ok := tag.(float64); ok && n == deprecatedTag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// dropDeprecated removes array elements marked as deprecated, either via
+// the "deprecated" property or the Deprecated tag (used by completion
+// items and symbols), at any depth.
+func dropDeprecated(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, e := range v {
+			v[k] = dropDeprecated(e)
+		}
+	case []any:
+		kept := v[:0]
+		for _, e := range v {
+			if !isDeprecated(e) {
+				kept = append(kept, dropDeprecated(e))
+			}
+		}
+		return kept
+	}
+	return v
+}
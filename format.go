@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/federicotdn/hyperlsp/lsp"
+)
+
+// handleFormat runs textDocument/formatting on a document, and applies
+// the resulting edits to it. The document is opened if it is not being
+// tracked already, using the languageId query parameter (or detecting it,
+// if not specified). With write=true, the formatted content is also written to
+// disk. The body may contain the FormattingOptions to use.
+func (p *proxy) handleFormat(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	uri := query.Get("uri")
+	write := query.Get("write") == "true"
+
+	if uri == "" {
+		writeError(w, http.StatusBadRequest, "no document uri specified")
+		return
+	}
+
+	options := map[string]any{
+		"tabSize":      4,
+		"insertSpaces": true,
+	}
+
+	defer req.Body.Close()
+	err := json.NewDecoder(req.Body).Decode(&options)
+	if err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, http.StatusBadRequest, "unable to unmarshal request json")
+		return
+	}
+
+	if write && p.denyReadOnly(w, "", "writing formatted documents to disk") {
+		return
+	}
+
+	doc, err := p.openDocument(uri, query.Get("languageId"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	params := map[string]any{
+		"textDocument": lsp.TextDocumentIdentifier{URI: uri},
+		"options":      options,
+	}
+
+	var edits []lsp.TextEdit
+	err = p.call(req.Context(), "textDocument/formatting", params, &edits)
+	if err != nil {
+		writeCallError(w, err)
+		return
+	}
+
+	text, err := lsp.ApplyTextEdits(doc.Text, edits, p.positionEncoding())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("unable to apply formatting edits: %v", err))
+		return
+	}
+
+	changed := text != doc.Text
+	if changed {
+		doc, err = p.changeDocument(doc, text)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	if write {
+		path, err := lsp.URIToPath(uri)
+		if err == nil {
+			err = writeFile(path, []byte(text))
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Sprintf("unable to write document: %v", err))
+			return
+		}
+
+		err = p.notify("textDocument/didSave", map[string]any{"textDocument": lsp.TextDocumentIdentifier{URI: uri}})
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"uri":     doc.URI,
+		"version": doc.Version,
+		"changed": changed,
+		"written": write,
+		"content": doc.Text,
+	})
+}
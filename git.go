@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// gitBase is the tree of a Git commit, which the current content of files
+// in its repository is compared against.
+type gitBase struct {
+	// Root directory of the repository's worktree.
+	root   string
+	commit string
+	tree   *object.Tree
+}
+
+// openGitBase opens the Git repository containing path, and resolves ref
+// (a branch, tag, commit hash or any other revision) in it.
+func openGitBase(path, ref string) (*gitBase, error) {
+	repo, err := git.PlainOpenWithOptions(filepath.Dir(path), &git.PlainOpenOptions{DetectDotGit: true})
+	if err != nil {
+		return nil, fmt.Errorf("unable to open Git repository: %w", err)
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		return nil, fmt.Errorf("unable to open Git worktree: %w", err)
+	}
+
+	hash, err := repo.ResolveRevision(plumbing.Revision(ref))
+	if err != nil {
+		return nil, fmt.Errorf("unable to resolve Git ref %q: %w", ref, err)
+	}
+	commit, err := repo.CommitObject(*hash)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read Git commit %v: %w", hash, err)
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read Git tree of commit %v: %w", hash, err)
+	}
+
+	return &gitBase{root: wt.Filesystem.Root(), commit: hash.String(), tree: tree}, nil
+}
+
+// changedLines returns the (0-based) lines of text, the current content of
+// the file at path, which were added or modified relative to the base. All
+// lines of files not present in the base are considered changed.
+func (gb *gitBase) changedLines(path, text string) (map[int]bool, error) {
+	rel, err := filepath.Rel(gb.root, path)
+	if err != nil {
+		return nil, err
+	}
+
+	old := ""
+	file, err := gb.tree.File(filepath.ToSlash(rel))
+	if err == nil {
+		old, err = file.Contents()
+	}
+	if err != nil && !errors.Is(err, object.ErrFileNotFound) {
+		return nil, fmt.Errorf("unable to read %v from Git: %w", rel, err)
+	}
+
+	changed := make(map[int]bool)
+	line := 0
+	for _, l := range diffLines(splitLines(old), splitLines(text)) {
+		switch l.op {
+		case diffInsert:
+			changed[line] = true
+			line++
+		case diffEqual:
+			line++
+		}
+	}
+	return changed, nil
+}
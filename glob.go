@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io/fs"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// matchGlob reports whether name matches pattern. Both are slash
+// separated paths. In addition to the syntax supported by path.Match, a
+// "**" path segment matches zero or more segments.
+func matchGlob(pattern, name string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(name) == 0 {
+			return false
+		}
+		ok, err := path.Match(pattern[0], name[0])
+		if err != nil || !ok {
+			return false
+		}
+
+		pattern, name = pattern[1:], name[1:]
+	}
+
+	return len(name) == 0
+}
+
+// globRoot returns the longest leading directory of pattern without any
+// glob metacharacters.
+func globRoot(pattern string) string {
+	segments := strings.Split(pattern, "/")
+	i := 0
+	for ; i < len(segments)-1; i++ {
+		if strings.ContainsAny(segments[i], `*?[\`) {
+			break
+		}
+	}
+
+	root := strings.Join(segments[:i], "/")
+	if root == "" && strings.HasPrefix(pattern, "/") {
+		return "/"
+	}
+	if root == "" {
+		return "."
+	}
+	return root
+}
+
+// globFiles returns the regular files matching pattern (see matchGlob),
+// in lexical order.
+func globFiles(pattern string) ([]string, error) {
+	pattern = filepath.ToSlash(filepath.Clean(pattern))
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+
+	var files []string
+	root := globRoot(pattern)
+	err := filepath.WalkDir(filepath.FromSlash(root), func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() && matchGlob(pattern, filepath.ToSlash(p)) {
+			files = append(files, p)
+		}
+		return nil
+	})
+
+	return files, err
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/federicotdn/hyperlsp/lsp"
+	"github.com/graphql-go/graphql"
+)
+
+// graphqlRequest is the body of a GraphQL request sent over HTTP.
+type graphqlRequest struct {
+	Query         string         `json:"query"`
+	OperationName string         `json:"operationName"`
+	Variables     map[string]any `json:"variables"`
+}
+
+// hoverContents converts the contents of a Hover (MarkupContent,
+// MarkedString or MarkedString[]) into a single string, along with its
+// kind.
+func hoverContents(contents any) (string, string) {
+	switch c := contents.(type) {
+	case string:
+		return c, "plaintext"
+	case map[string]any:
+		value, _ := c["value"].(string)
+		if kind, ok := c["kind"].(string); ok {
+			return value, kind
+		}
+		// MarkedString with a language.
+		language, _ := c["language"].(string)
+		return "```" + language + "\n" + value + "\n```", "markdown"
+	case []any:
+		parts := []string{}
+		for _, part := range c {
+			value, _ := hoverContents(part)
+			parts = append(parts, value)
+		}
+		return strings.Join(parts, "\n\n"), "markdown"
+	default:
+		return "", "plaintext"
+	}
+}
+
+// graphqlURI returns the uri argument of a field. As URIs in the query
+// text are not seen by restrictRoots, it fails if the URI is outside of the
+// proxy's roots.
+func (p *proxy) graphqlURI(args map[string]any) (string, error) {
+	uri, _ := args["uri"].(string)
+	if !p.allowedURI(uri) {
+		return "", fmt.Errorf("URI %v is outside of the allowed roots", uri)
+	}
+	return uri, nil
+}
+
+// positionParams returns TextDocumentPositionParams for the uri, line and
+// character arguments of a field.
+func (p *proxy) positionParams(args map[string]any) (map[string]any, error) {
+	uri, err := p.graphqlURI(args)
+	if err != nil {
+		return nil, err
+	}
+	line, _ := args["line"].(int)
+	char, _ := args["character"].(int)
+	return map[string]any{
+		"textDocument": lsp.TextDocumentIdentifier{URI: uri},
+		"position":     lsp.Position{Line: line, Character: char},
+	}, nil
+}
+
+func (p *proxy) graphqlHover(ctx context.Context, params map[string]any) (any, error) {
+	var hover *struct {
+		Contents any        `json:"contents"`
+		Range    *lsp.Range `json:"range"`
+	}
+	err := p.call(ctx, "textDocument/hover", params, &hover)
+	if err != nil || hover == nil {
+		return nil, err
+	}
+
+	contents, kind := hoverContents(hover.Contents)
+	return map[string]any{"contents": contents, "kind": kind, "range": hover.Range}, nil
+}
+
+// graphqlLocations calls a method returning Location | Location[] |
+// LocationLink[] | null, and returns the result as Locations.
+func (p *proxy) graphqlLocations(ctx context.Context, method string, params map[string]any) (any, error) {
+	var result json.RawMessage
+	err := p.call(ctx, method, params, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	var links []struct {
+		lsp.Location
+		TargetURI            string     `json:"targetUri"`
+		TargetSelectionRange *lsp.Range `json:"targetSelectionRange"`
+	}
+	if json.Unmarshal(result, &links) != nil {
+		var single lsp.Location
+		if json.Unmarshal(result, &single) == nil && single.URI != "" {
+			return []lsp.Location{single}, nil
+		}
+		return []lsp.Location{}, nil
+	}
+
+	locations := []lsp.Location{}
+	for _, l := range links {
+		if l.TargetURI != "" && l.TargetSelectionRange != nil {
+			locations = append(locations, lsp.Location{URI: l.TargetURI, Range: *l.TargetSelectionRange})
+		} else {
+			locations = append(locations, l.Location)
+		}
+	}
+	return locations, nil
+}
+
+// graphqlSchema builds the GraphQL schema exposing the proxy's queries.
+func (p *proxy) graphqlSchema() (graphql.Schema, error) {
+	positionArgs := graphql.FieldConfigArgument{
+		"uri":       &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+		"line":      &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.Int)},
+		"character": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.Int)},
+	}
+
+	positionType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Position",
+		Fields: graphql.Fields{
+			"line":      &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"character": &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+		},
+	})
+
+	rangeType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Range",
+		Fields: graphql.Fields{
+			"start": &graphql.Field{Type: graphql.NewNonNull(positionType)},
+			"end":   &graphql.Field{Type: graphql.NewNonNull(positionType)},
+		},
+	})
+
+	hoverType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Hover",
+		Fields: graphql.Fields{
+			"contents": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"kind":     &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"range":    &graphql.Field{Type: rangeType},
+		},
+	})
+
+	locationType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Location",
+		Fields: graphql.Fields{
+			"uri":   &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"range": &graphql.Field{Type: graphql.NewNonNull(rangeType)},
+			// Hover information at the start of the location.
+			"hover": &graphql.Field{
+				Type: hoverType,
+				Resolve: func(rp graphql.ResolveParams) (any, error) {
+					loc, _ := rp.Source.(lsp.Location)
+					return p.graphqlHover(rp.Context, map[string]any{
+						"textDocument": lsp.TextDocumentIdentifier{URI: loc.URI},
+						"position":     loc.Range.Start,
+					})
+				},
+			},
+		},
+	})
+
+	symbolType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Symbol",
+		Fields: graphql.Fields{
+			"name":          &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"kind":          &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"containerName": &graphql.Field{Type: graphql.String},
+			"location": &graphql.Field{
+				Type: locationType,
+				Resolve: func(rp graphql.ResolveParams) (any, error) {
+					s, _ := rp.Source.(symbol)
+					if s.Range == nil {
+						return nil, nil
+					}
+					return lsp.Location{URI: s.URI, Range: *s.Range}, nil
+				},
+			},
+		},
+	})
+
+	diagnosticType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Diagnostic",
+		Fields: graphql.Fields{
+			"range": &graphql.Field{Type: graphql.NewNonNull(rangeType)},
+			"severity": &graphql.Field{
+				Type: graphql.String,
+				Resolve: func(rp graphql.ResolveParams) (any, error) {
+					d, _ := rp.Source.(lsp.Diagnostic)
+					if d.Severity == 0 {
+						return nil, nil
+					}
+					return lsp.SeverityName(d.Severity), nil
+				},
+			},
+			"code": &graphql.Field{
+				Type: graphql.String,
+				Resolve: func(rp graphql.ResolveParams) (any, error) {
+					d, _ := rp.Source.(lsp.Diagnostic)
+					if d.Code == nil {
+						return nil, nil
+					}
+					data, err := json.Marshal(d.Code)
+					return strings.Trim(string(data), `"`), err
+				},
+			},
+			"source":  &graphql.Field{Type: graphql.String},
+			"message": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+		},
+	})
+
+	locationList := graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(locationType)))
+
+	queryType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"hover": &graphql.Field{
+				Type: hoverType,
+				Args: positionArgs,
+				Resolve: func(rp graphql.ResolveParams) (any, error) {
+					params, err := p.positionParams(rp.Args)
+					if err != nil {
+						return nil, err
+					}
+					return p.graphqlHover(rp.Context, params)
+				},
+			},
+			"definition": &graphql.Field{
+				Type: locationList,
+				Args: positionArgs,
+				Resolve: func(rp graphql.ResolveParams) (any, error) {
+					params, err := p.positionParams(rp.Args)
+					if err != nil {
+						return nil, err
+					}
+					return p.graphqlLocations(rp.Context, "textDocument/definition", params)
+				},
+			},
+			"references": &graphql.Field{
+				Type: locationList,
+				Args: graphql.FieldConfigArgument{
+					"uri":                positionArgs["uri"],
+					"line":               positionArgs["line"],
+					"character":          positionArgs["character"],
+					"includeDeclaration": &graphql.ArgumentConfig{Type: graphql.Boolean, DefaultValue: true},
+				},
+				Resolve: func(rp graphql.ResolveParams) (any, error) {
+					params, err := p.positionParams(rp.Args)
+					if err != nil {
+						return nil, err
+					}
+					params["context"] = map[string]any{"includeDeclaration": rp.Args["includeDeclaration"]}
+					return p.graphqlLocations(rp.Context, "textDocument/references", params)
+				},
+			},
+			"symbols": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(symbolType))),
+				Args: graphql.FieldConfigArgument{
+					"query": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					"kinds": &graphql.ArgumentConfig{Type: graphql.NewList(graphql.NewNonNull(graphql.String))},
+					"limit": &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: symbolsDefaultLimit},
+				},
+				Resolve: func(rp graphql.ResolveParams) (any, error) {
+					q, _ := rp.Args["query"].(string)
+					limit, _ := rp.Args["limit"].(int)
+
+					var kinds map[int]bool
+					if names, ok := rp.Args["kinds"].([]any); ok {
+						parts := []string{}
+						for _, name := range names {
+							parts = append(parts, name.(string))
+						}
+						kinds, ok = parseSymbolKinds(strings.Join(parts, ","))
+						if !ok {
+							return nil, fmt.Errorf("invalid symbol kind")
+						}
+					}
+
+					return p.searchSymbols(rp.Context, q, kinds, max(limit, 1))
+				},
+			},
+			"diagnostics": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(diagnosticType))),
+				Args: graphql.FieldConfigArgument{
+					"uri": positionArgs["uri"],
+				},
+				Resolve: func(rp graphql.ResolveParams) (any, error) {
+					uri, err := p.graphqlURI(rp.Args)
+					if err != nil {
+						return nil, err
+					}
+					return p.pullDiagnostics(rp.Context, uri)
+				},
+			},
+		},
+	})
+
+	return graphql.NewSchema(graphql.SchemaConfig{Query: queryType})
+}
+
+// handleGraphQL executes a GraphQL query, sent either as JSON in a POST
+// body or in the query parameter of a GET request.
+func (p *proxy) handleGraphQL(w http.ResponseWriter, req *http.Request) {
+	if p.graphql == nil {
+		writeError(w, http.StatusNotFound, "GraphQL endpoint is not enabled")
+		return
+	}
+
+	var body graphqlRequest
+	if req.Method == http.MethodGet {
+		query := req.URL.Query()
+		body.Query = query.Get("query")
+		body.OperationName = query.Get("operationName")
+		if v := query.Get("variables"); v != "" {
+			if json.Unmarshal([]byte(v), &body.Variables) != nil {
+				writeError(w, http.StatusBadRequest, "unable to unmarshal variables json")
+				return
+			}
+		}
+	} else {
+		defer req.Body.Close()
+		err := json.NewDecoder(req.Body).Decode(&body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "unable to unmarshal request json")
+			return
+		}
+	}
+
+	if body.Query == "" {
+		writeError(w, http.StatusBadRequest, "no query specified")
+		return
+	}
+
+	result := graphql.Do(graphql.Params{
+		Schema:         *p.graphql,
+		RequestString:  body.Query,
+		OperationName:  body.OperationName,
+		VariableValues: body.Variables,
+		Context:        req.Context(),
+	})
+	writeJSON(w, http.StatusOK, result)
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The log is kept valid at all times by rewriting this trailer after each
+// entry.
+const harTrailer = "\n]}}\n"
+
+// Maximum size of the request and response bodies recorded in an entry.
+// Larger bodies are truncated, and event streams are not recorded at all,
+// as they may never end.
+const harMaxBodySize = 1024 * 1024
+
+// Headers whose values are not written to the log.
+var harRedactedHeaders = map[string]bool{
+	apiKeyHeader:    true,
+	"Authorization": true,
+}
+
+// harLog is the top-level structure of a HAR (HTTP Archive) file. Only the
+// fields used by hyperlsp are included.
+type harLog struct {
+	Log struct {
+		Version string     `json:"version"`
+		Creator harCreator `json:"creator"`
+		Entries []harEntry `json:"entries"`
+	} `json:"log"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	// Messages exchanged with the LSP server while handling the request.
+	LSP []harLSPMessage `json:"_lsp,omitempty"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+type harLSPMessage struct {
+	// Either "send" or "receive".
+	Direction string          `json:"direction"`
+	Message   json.RawMessage `json:"message"`
+}
+
+func harHeaders(h http.Header) []harNameValue {
+	headers := []harNameValue{}
+	for name, values := range h {
+		for _, v := range values {
+			if harRedactedHeaders[name] {
+				v = "REDACTED"
+			}
+			headers = append(headers, harNameValue{Name: name, Value: v})
+		}
+	}
+	sort.Slice(headers, func(i, j int) bool {
+		return headers[i].Name < headers[j].Name
+	})
+	return headers
+}
+
+// harResponseWriter records the response written by a handler, up to
+// harMaxBodySize.
+type harResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+	// Size of the whole body written.
+	size int
+}
+
+func (w *harResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *harResponseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.size += len(p)
+	if !w.streaming() {
+		w.body.Write(p[:min(len(p), harMaxBodySize-w.body.Len())])
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// streaming reports whether the response is an event stream, which is not
+// recorded.
+func (w *harResponseWriter) streaming() bool {
+	return strings.HasPrefix(w.Header().Get("Content-Type"), "text/event-stream")
+}
+
+// Unwrap allows http.ResponseController to flush the underlying writer.
+func (w *harResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// harRecorder writes every HTTP request handled, along with its response
+// and LSP messages, to a HAR file. LSP messages are attributed to requests
+// through the contexts they are sent with (see lsp.Server.SetTracer), so
+// that requests can still be handled concurrently.
+type harRecorder struct {
+	// Held while writing to the file.
+	mutex   sync.Mutex
+	file    *os.File
+	entries int
+
+	// Held while adding LSP messages to entries.
+	traceMutex sync.Mutex
+}
+
+// harContextKey is the key of the context value holding the entry of the
+// request being recorded.
+type harContextKey struct{}
+
+// harRecording is the entry of a request being recorded.
+type harRecording struct {
+	entry *harEntry
+	// Set once the request has been handled, after which LSP messages
+	// (e.g. the responses of cancelled requests) are ignored.
+	done bool
+}
+
+func newHARRecorder(path string) (*harRecorder, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	creator, err := json.Marshal(harCreator{Name: "hyperlsp", Version: "1"})
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = fmt.Fprintf(file, `{"log":{"version":"1.2","creator":%s,"entries":[%v`, creator, harTrailer)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &harRecorder{file: file}, nil
+}
+
+// traceLSP is set as the tracer of the LSP servers. Messages are added to
+// the entry of the request they were sent for, if any.
+func (hr *harRecorder) traceLSP(ctx context.Context, outgoing bool, data []byte) {
+	rec, _ := ctx.Value(harContextKey{}).(*harRecording)
+	if rec == nil {
+		return
+	}
+
+	hr.traceMutex.Lock()
+	defer hr.traceMutex.Unlock()
+
+	if rec.done {
+		return
+	}
+
+	direction := "receive"
+	if outgoing {
+		direction = "send"
+	}
+	rec.entry.LSP = append(rec.entry.LSP, harLSPMessage{
+		Direction: direction,
+		Message:   bytes.Clone(data),
+	})
+}
+
+func (hr *harRecorder) write(entry *harEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	hr.mutex.Lock()
+	defer hr.mutex.Unlock()
+
+	_, err = hr.file.Seek(-int64(len(harTrailer)), io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	sep := "\n"
+	if hr.entries > 0 {
+		sep = ",\n"
+	}
+	_, err = fmt.Fprintf(hr.file, "%v%s%v", sep, data, harTrailer)
+	if err != nil {
+		return err
+	}
+
+	hr.entries++
+	return nil
+}
+
+func (hr *harRecorder) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := io.ReadAll(io.LimitReader(req.Body, harMaxBodySize+1))
+		if err != nil {
+			req.Body.Close()
+			writeError(w, http.StatusBadRequest, "unable to read request body")
+			return
+		}
+		// The handler reads the rest of the body, if any.
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+		bodySize := len(body)
+		bodyComment := ""
+		if len(body) > harMaxBodySize {
+			body = body[:harMaxBodySize]
+			bodySize = int(req.ContentLength)
+			bodyComment = "truncated"
+		}
+
+		entry := &harEntry{
+			StartedDateTime: time.Now(),
+			Request: harRequest{
+				Method:      req.Method,
+				URL:         req.URL.RequestURI(),
+				HTTPVersion: req.Proto,
+				Headers:     harHeaders(req.Header),
+				QueryString: []harNameValue{},
+				HeadersSize: -1,
+				BodySize:    bodySize,
+			},
+		}
+		for name, values := range req.URL.Query() {
+			for _, v := range values {
+				entry.Request.QueryString = append(entry.Request.QueryString, harNameValue{Name: name, Value: v})
+			}
+		}
+		if len(body) > 0 {
+			entry.Request.PostData = &harPostData{
+				MimeType: req.Header.Get("Content-Type"),
+				Text:     string(body),
+				Comment:  bodyComment,
+			}
+		}
+
+		rec := &harRecording{entry: entry}
+		req = req.WithContext(context.WithValue(req.Context(), harContextKey{}, rec))
+
+		rw := &harResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(rw, req)
+
+		hr.traceMutex.Lock()
+		rec.done = true
+		hr.traceMutex.Unlock()
+
+		if rw.status == 0 {
+			rw.status = http.StatusOK
+		}
+
+		elapsed := float64(time.Since(entry.StartedDateTime).Microseconds()) / 1000
+		entry.Time = elapsed
+		entry.Timings.Wait = elapsed
+		entry.Response = harResponse{
+			Status:      rw.status,
+			StatusText:  http.StatusText(rw.status),
+			HTTPVersion: req.Proto,
+			Headers:     harHeaders(w.Header()),
+			Content: harContent{
+				Size:     rw.size,
+				MimeType: w.Header().Get("Content-Type"),
+				Text:     rw.body.String(),
+			},
+			HeadersSize: -1,
+			BodySize:    rw.size,
+		}
+		if rw.streaming() {
+			entry.Response.Content.Comment = "event stream not recorded"
+		} else if rw.size > rw.body.Len() {
+			entry.Response.Content.Comment = "truncated"
+		}
+
+		err = hr.write(entry)
+		if err != nil {
+			slog.Error("unable to write HAR entry", "err", err)
+		}
+	})
+}
+
+func (hr *harRecorder) close() error {
+	hr.mutex.Lock()
+	defer hr.mutex.Unlock()
+	return hr.file.Close()
+}
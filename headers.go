@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+type headersConfig struct {
+	// LSP wire headers of responses surfaced as HTTP response headers, or
+	// "*" for all of them (except Content-Length).
+	Expose []string `json:"expose"`
+	// Prefix added to the names of the exposed headers.
+	ExposePrefix string `json:"exposePrefix"`
+	// HTTP request headers attached to outgoing LSP messages.
+	Forward []string `json:"forward"`
+	// Headers attached to every outgoing LSP message, which may reference
+	// environment variables (e.g. ${TOKEN}).
+	Add map[string]string `json:"add"`
+}
+
+// expose returns the wire headers of an LSP response that should be
+// surfaced as HTTP response headers, with their final names.
+func (hc *headersConfig) expose(wire map[string]string) map[string]string {
+	exposed := make(map[string]string)
+	for k, v := range wire {
+		for _, name := range hc.Expose {
+			if (name == "*" && !strings.EqualFold(k, "Content-Length")) || strings.EqualFold(name, k) {
+				exposed[hc.ExposePrefix+k] = v
+				break
+			}
+		}
+	}
+	return exposed
+}
+
+// forward returns the headers of an HTTP request that should be attached
+// to the outgoing LSP message.
+func (hc *headersConfig) forward(header http.Header) map[string]string {
+	forwarded := make(map[string]string)
+	for _, name := range hc.Forward {
+		if v := header.Get(name); v != "" {
+			forwarded[name] = v
+		}
+	}
+	return forwarded
+}
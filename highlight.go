@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/federicotdn/hyperlsp/lsp"
+)
+
+// highlightSegment is a part of a document's content, with the type and
+// modifiers of the semantic token covering it (if any).
+type highlightSegment struct {
+	Text      string   `json:"text"`
+	Type      string   `json:"type,omitempty"`
+	Modifiers []string `json:"modifiers,omitempty"`
+}
+
+// highlightSegments splits text into segments according to its semantic
+// tokens, which must be sorted and are expected not to overlap (overlapping
+// tokens are skipped).
+func highlightSegments(text string, tokens []semanticToken, encoding string) ([]highlightSegment, error) {
+	segments := []highlightSegment{}
+	last := 0
+	for _, t := range tokens {
+		start, err := lsp.Offset(text, t.Range.Start, encoding)
+		if err != nil {
+			return nil, err
+		}
+		end, err := lsp.Offset(text, t.Range.End, encoding)
+		if err != nil {
+			return nil, err
+		}
+		if start < last || end <= start {
+			continue
+		}
+
+		if start > last {
+			segments = append(segments, highlightSegment{Text: text[last:start]})
+		}
+		segments = append(segments, highlightSegment{Text: text[start:end], Type: t.Type, Modifiers: t.Modifiers})
+		last = end
+	}
+	if last < len(text) {
+		segments = append(segments, highlightSegment{Text: text[last:]})
+	}
+	return segments, nil
+}
+
+// highlightHTML renders segments as an HTML fragment, where tokens are
+// spans with the classes "tok-{type}" and "mod-{modifier}".
+func highlightHTML(segments []highlightSegment, languageId string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, `<pre class="hyperlsp-highlight"><code class="language-%v">`, html.EscapeString(languageId))
+	for _, s := range segments {
+		if s.Type == "" {
+			b.WriteString(html.EscapeString(s.Text))
+			continue
+		}
+
+		classes := []string{"tok-" + s.Type}
+		for _, m := range s.Modifiers {
+			classes = append(classes, "mod-"+m)
+		}
+		fmt.Fprintf(&b, `<span class="%v">%v</span>`, html.EscapeString(strings.Join(classes, " ")), html.EscapeString(s.Text))
+	}
+	b.WriteString("</code></pre>\n")
+	return b.String()
+}
+
+// handleHighlight renders a document highlighted with the semantic tokens
+// of the LSP server, as an HTML fragment or, with format=json, as a list
+// of segments annotated with their token types and modifiers. The
+// document is opened if it is not being tracked already, using the
+// languageId query parameter (or detecting it, if not specified).
+func (p *proxy) handleHighlight(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	uri := query.Get("uri")
+	if uri == "" {
+		writeError(w, http.StatusBadRequest, "no document uri specified")
+		return
+	}
+	format := query.Get("format")
+	if format != "" && format != "html" && format != "json" {
+		writeError(w, http.StatusBadRequest, "format must be html or json")
+		return
+	}
+
+	legend, err := p.semanticTokensLegend()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	doc, err := p.openDocument(uri, query.Get("languageId"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var result struct {
+		Data []int `json:"data"`
+	}
+	err = p.call(req.Context(), "textDocument/semanticTokens/full", map[string]any{"textDocument": lsp.TextDocumentIdentifier{URI: uri}}, &result)
+	if err != nil {
+		writeCallError(w, err)
+		return
+	}
+
+	tokens, err := decodeSemanticTokens(result.Data, legend)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("unable to decode semantic tokens: %v", err))
+		return
+	}
+	segments, err := highlightSegments(doc.Text, tokens, p.positionEncoding())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("unable to resolve semantic tokens: %v", err))
+		return
+	}
+
+	if format == "json" {
+		writeJSON(w, http.StatusOK, map[string]any{
+			"uri":        doc.URI,
+			"version":    doc.Version,
+			"languageId": doc.LanguageID,
+			"segments":   segments,
+		})
+		return
+	}
+
+	data := highlightHTML(segments, doc.LanguageID)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write([]byte(data))
+	if err != nil {
+		slog.Error("error writing response data", "err", err)
+	}
+}
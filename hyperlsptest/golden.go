@@ -0,0 +1,186 @@
+// Package hyperlsptest records the HTTP exchanges of tests with a hyperlsp
+// instance (and the LSP server behind it) into golden files, and asserts
+// that later runs reproduce them. It can be used to write CI tests for
+// hyperlsp configurations, e.g. to check that upgrading the LSP server or
+// changing result filters doesn't change the responses clients receive.
+//
+// A test drives a Session, which either records the exchanges when the
+// HYPERLSPTEST_UPDATE environment variable is set, or otherwise checks
+// them against the golden file:
+//
+//	func TestHover(t *testing.T) {
+//		base := hyperlsptest.StartProxy(t, "hyperlsp", "--", "gopls")
+//		s := hyperlsptest.NewSession(t, base, "testdata/hover.json",
+//			hyperlsptest.WithReplacement(workspace, "$WORKSPACE"))
+//		s.Request("initialize", map[string]any{"rootUri": "file://" + workspace, "capabilities": map[string]any{}})
+//		s.Notify("initialized", map[string]any{})
+//		s.Request("textDocument/hover", hoverParams)
+//	}
+//
+// Golden files can also be replayed as a whole with Verify.
+package hyperlsptest
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// UpdateEnv is the environment variable which, when set to a non-empty
+// value, makes sessions record exchanges into their golden files instead
+// of checking them.
+const UpdateEnv = "HYPERLSPTEST_UPDATE"
+
+// Exchange is an HTTP request sent to hyperlsp and its response. Request
+// and response bodies are stored as JSON, normalized with the session's
+// replacements and ignored fields.
+type Exchange struct {
+	Method   string            `json:"method"`
+	Path     string            `json:"path"`
+	Headers  map[string]string `json:"headers,omitempty"`
+	Body     json.RawMessage   `json:"body,omitempty"`
+	Status   int               `json:"status"`
+	Response json.RawMessage   `json:"response,omitempty"`
+}
+
+func (e *Exchange) String() string {
+	return fmt.Sprintf("%v %v", e.Method, e.Path)
+}
+
+// Golden is the content of a golden file: the exchanges of a test, in
+// order.
+type Golden struct {
+	Exchanges []Exchange `json:"exchanges"`
+}
+
+// Load reads a golden file.
+func Load(path string) (*Golden, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var g Golden
+	err = json.Unmarshal(data, &g)
+	if err != nil {
+		return nil, fmt.Errorf("invalid golden file %v: %w", path, err)
+	}
+	return &g, nil
+}
+
+// Save writes a golden file, creating its directory if needed. Exchanges
+// are indented so that changes to golden files are easy to review.
+func (g *Golden) Save(path string) error {
+	data, err := json.MarshalIndent(g, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
+
+type options struct {
+	replacements []string
+	ignored      map[string]bool
+	headers      map[string]string
+}
+
+// Option configures a Session or Verify.
+type Option func(*options)
+
+// WithReplacement replaces value with placeholder in the exchanges
+// recorded, and placeholder with value in the requests replayed, so that
+// golden files don't depend on values which change between runs or
+// machines, such as the path of the workspace.
+func WithReplacement(value, placeholder string) Option {
+	return func(o *options) {
+		o.replacements = append(o.replacements, value, placeholder)
+	}
+}
+
+// WithIgnoredFields removes the object fields with any of the specified
+// names from responses before recording or comparing them, e.g. for
+// timestamps or process IDs.
+func WithIgnoredFields(names ...string) Option {
+	return func(o *options) {
+		for _, name := range names {
+			o.ignored[name] = true
+		}
+	}
+}
+
+// WithHeader sends an additional header with every request, which is not
+// recorded, e.g. an API key.
+func WithHeader(name, value string) Option {
+	return func(o *options) {
+		o.headers[name] = value
+	}
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{
+		ignored: make(map[string]bool),
+		headers: make(map[string]string),
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// normalize applies the replacements to a recorded value.
+func (o *options) normalize(s string) string {
+	return strings.NewReplacer(o.replacements...).Replace(s)
+}
+
+// expand reverts the replacements in a value to be replayed.
+func (o *options) expand(s string) string {
+	reversed := make([]string, len(o.replacements))
+	for i := 0; i < len(o.replacements); i += 2 {
+		reversed[i], reversed[i+1] = o.replacements[i+1], o.replacements[i]
+	}
+	return strings.NewReplacer(reversed...).Replace(s)
+}
+
+// normalizeJSON normalizes a JSON body, applying the replacements and
+// removing the ignored fields. Bodies which aren't valid JSON are stored as
+// JSON strings.
+func (o *options) normalizeJSON(data []byte, response bool) json.RawMessage {
+	if len(data) == 0 {
+		return nil
+	}
+
+	var v any
+	if json.Unmarshal(data, &v) != nil {
+		v = string(data)
+	}
+	if response {
+		v = o.removeIgnored(v)
+	}
+	normalized, _ := json.Marshal(v)
+	return json.RawMessage(o.normalize(string(normalized)))
+}
+
+func (o *options) removeIgnored(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for key, value := range v {
+			if o.ignored[key] {
+				delete(v, key)
+				continue
+			}
+			v[key] = o.removeIgnored(value)
+		}
+	case []any:
+		for i, value := range v {
+			v[i] = o.removeIgnored(value)
+		}
+	}
+	return v
+}
@@ -0,0 +1,296 @@
+package hyperlsptest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Maximum time StartProxy waits for hyperlsp to accept connections.
+const startTimeout = 10 * time.Second
+
+// Maximum time hyperlsp is given to shut down its LSP servers at the end
+// of a test, before it is killed.
+const stopTimeout = 10 * time.Second
+
+// Session sends requests to a hyperlsp instance, recording the exchanges
+// into a golden file or checking them against it (see UpdateEnv).
+type Session struct {
+	t      testing.TB
+	base   string
+	client *http.Client
+	opts   *options
+	path   string
+	update bool
+	// Exchanges recorded, or expected when checking them.
+	golden *Golden
+	// Number of exchanges checked so far.
+	checked int
+	nextId  int
+}
+
+// NewSession returns a session sending requests to the hyperlsp instance
+// at base (e.g. "http://localhost:8080"). When checking exchanges, the
+// test fails if the golden file can't be read; when recording them, the
+// golden file is written once the test completes successfully.
+func NewSession(t testing.TB, base, path string, opts ...Option) *Session {
+	t.Helper()
+
+	s := &Session{
+		t:      t,
+		base:   strings.TrimSuffix(base, "/"),
+		client: &http.Client{},
+		opts:   newOptions(opts),
+		path:   path,
+		update: os.Getenv(UpdateEnv) != "",
+		golden: &Golden{},
+	}
+
+	if s.update {
+		t.Cleanup(func() {
+			if t.Failed() {
+				return
+			}
+			err := s.golden.Save(path)
+			if err != nil {
+				t.Errorf("unable to write golden file: %v", err)
+			}
+		})
+		return s
+	}
+
+	g, err := Load(path)
+	if err != nil {
+		t.Fatalf("unable to read golden file (set %v=1 to record it): %v", UpdateEnv, err)
+	}
+	s.golden = g
+	t.Cleanup(func() {
+		if s.checked < len(s.golden.Exchanges) && !t.Failed() {
+			t.Errorf("%v: %v recorded exchanges were not reproduced, starting with %v",
+				path, len(s.golden.Exchanges)-s.checked, &s.golden.Exchanges[s.checked])
+		}
+	})
+	return s
+}
+
+// Request sends an LSP request to the /lsp/{method} endpoint, and returns
+// the response body.
+func (s *Session) Request(method string, params any) json.RawMessage {
+	s.t.Helper()
+	s.nextId++
+	_, body := s.do(http.MethodPost, "/lsp/"+method, map[string]string{"X-LSP-Id": strconv.Itoa(s.nextId)}, params)
+	return body
+}
+
+// Notify sends an LSP notification to the /notify/{method} endpoint.
+func (s *Session) Notify(method string, params any) {
+	s.t.Helper()
+	s.do(http.MethodPost, "/notify/"+method, nil, params)
+}
+
+// Do sends an HTTP request with a JSON body (unless body is nil) to any
+// hyperlsp endpoint, and returns the response status and body.
+func (s *Session) Do(method, path string, body any) (int, json.RawMessage) {
+	s.t.Helper()
+	return s.do(method, path, nil, body)
+}
+
+func (s *Session) do(method, path string, headers map[string]string, body any) (int, json.RawMessage) {
+	s.t.Helper()
+
+	var data []byte
+	if body != nil {
+		var err error
+		data, err = json.Marshal(body)
+		if err != nil {
+			s.t.Fatalf("unable to marshal request body: %v", err)
+		}
+	}
+
+	status, resp, err := send(s.client, s.base, s.opts, method, path, headers, data)
+	if err != nil {
+		s.t.Fatalf("%v %v: %v", method, path, err)
+	}
+
+	got := Exchange{
+		Method:   method,
+		Path:     s.opts.normalize(path),
+		Headers:  headers,
+		Body:     s.opts.normalizeJSON(data, false),
+		Status:   status,
+		Response: s.opts.normalizeJSON(resp, true),
+	}
+	if s.update {
+		s.golden.Exchanges = append(s.golden.Exchanges, got)
+		return status, resp
+	}
+
+	if s.checked >= len(s.golden.Exchanges) {
+		s.t.Fatalf("%v: unexpected exchange %v, not recorded", s.path, &got)
+	}
+	want := &s.golden.Exchanges[s.checked]
+	s.checked++
+	if got.Method != want.Method || got.Path != want.Path || !sameJSON(got.Body, want.Body) {
+		s.t.Fatalf("%v: exchange %v is %v, recorded %v (the test no longer matches its golden file)", s.path, s.checked, &got, want)
+	}
+	if message := compare(&got, want); message != "" {
+		s.t.Errorf("%v: exchange %v (%v): %v", s.path, s.checked, want, message)
+	}
+	return status, resp
+}
+
+// send sends an HTTP request to hyperlsp and reads the response.
+func send(client *http.Client, base string, opts *options, method, path string, headers map[string]string, body []byte) (int, []byte, error) {
+	req, err := http.NewRequest(method, base+path, bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	for name, value := range opts.headers {
+		req.Header.Set(name, value)
+	}
+	if len(body) > 0 {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	return resp.StatusCode, data, err
+}
+
+// sameJSON reports whether two JSON values are equal.
+func sameJSON(a, b json.RawMessage) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return len(a) == len(b)
+	}
+	var va, vb any
+	if json.Unmarshal(a, &va) != nil || json.Unmarshal(b, &vb) != nil {
+		return bytes.Equal(a, b)
+	}
+	return reflect.DeepEqual(va, vb)
+}
+
+// indent returns a JSON value indented, for error messages.
+func indent(data json.RawMessage) string {
+	var buf bytes.Buffer
+	if json.Indent(&buf, data, "", "  ") != nil {
+		return string(data)
+	}
+	return buf.String()
+}
+
+// compare returns why the response of an exchange differs from the
+// recorded one, or an empty string if it doesn't.
+func compare(got, want *Exchange) string {
+	if got.Status != want.Status {
+		return fmt.Sprintf("status %v, recorded %v\n  got: %s", got.Status, want.Status, got.Response)
+	}
+	if !sameJSON(got.Response, want.Response) {
+		return fmt.Sprintf("response differs\ngot:\n%v\nrecorded:\n%v", indent(got.Response), indent(want.Response))
+	}
+	return ""
+}
+
+// Verify replays all exchanges recorded in a golden file against the
+// hyperlsp instance at base, in order, and fails the test for every
+// response which differs from the recorded one.
+func Verify(t testing.TB, base, path string, opts ...Option) {
+	t.Helper()
+
+	g, err := Load(path)
+	if err != nil {
+		t.Fatalf("unable to read golden file: %v", err)
+	}
+	o := newOptions(opts)
+	client := &http.Client{}
+	base = strings.TrimSuffix(base, "/")
+
+	for i := range g.Exchanges {
+		want := &g.Exchanges[i]
+		var body []byte
+		if len(want.Body) > 0 {
+			body = []byte(o.expand(string(want.Body)))
+		}
+
+		status, resp, err := send(client, base, o, want.Method, o.expand(want.Path), want.Headers, body)
+		if err != nil {
+			t.Fatalf("%v: exchange %v (%v): %v", path, i+1, want, err)
+		}
+		got := Exchange{Status: status, Response: o.normalizeJSON(resp, true)}
+		if message := compare(&got, want); message != "" {
+			t.Errorf("%v: exchange %v (%v): %v", path, i+1, want, message)
+		}
+	}
+}
+
+// StartProxy starts the hyperlsp binary with args on a free local port,
+// waits until it accepts connections, and returns its base URL. It is
+// interrupted (shutting down its LSP servers) when the test completes.
+func StartProxy(t testing.TB, binary string, args ...string) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("unable to find a free port: %v", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	cmd := exec.Command(binary, append([]string{"-addr", addr}, args...)...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	err = cmd.Start()
+	if err != nil {
+		t.Fatalf("unable to start hyperlsp: %v", err)
+	}
+
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+	t.Cleanup(func() {
+		cmd.Process.Signal(os.Interrupt)
+		select {
+		case <-exited:
+		case <-time.After(stopTimeout):
+			cmd.Process.Kill()
+			<-exited
+		}
+	})
+
+	deadline := time.Now().Add(startTimeout)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			return "http://" + addr
+		}
+
+		select {
+		case <-exited:
+			t.Fatalf("hyperlsp exited before accepting connections: %v", cmd.ProcessState)
+		case <-time.After(50 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("hyperlsp did not accept connections after %v", startTimeout)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/federicotdn/hyperlsp/lsp"
+)
+
+const (
+	// Number of lines of the windows in which inlay hints are requested.
+	inlayHintsDefaultWindow = 200
+	inlayHintsMaxWindows    = 100
+	// Number of textDocument/inlayHint requests sent at the same time.
+	inlayHintsConcurrency = 4
+)
+
+type inlayHint struct {
+	raw      json.RawMessage
+	position lsp.Position
+}
+
+// handleInlayHints runs textDocument/inlayHint for the lines from
+// startLine to endLine (inclusive, defaulting to the whole document if it
+// is tracked), split into windows of at most window lines so that servers
+// don't have to compute hints for large ranges at once. The hints of all
+// windows are merged, deduplicated and sorted by position.
+func (p *proxy) handleInlayHints(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	uri := query.Get("uri")
+	if uri == "" {
+		writeError(w, http.StatusBadRequest, "no document uri specified")
+		return
+	}
+
+	startLine, err := queryInt(req, "startLine", 0)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	window, err := queryInt(req, "window", inlayHintsDefaultWindow)
+	if err != nil || window == 0 {
+		writeError(w, http.StatusBadRequest, "invalid window")
+		return
+	}
+
+	var endLine int
+	if query.Has("endLine") {
+		endLine, err = queryInt(req, "endLine", 0)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	} else {
+		doc, ok := p.docs.get(uri)
+		if !ok {
+			writeError(w, http.StatusBadRequest, "endLine must be specified for documents that are not open")
+			return
+		}
+		endLine = max(len(splitLines(doc.Text))-1, 0)
+	}
+	if endLine < startLine {
+		writeError(w, http.StatusBadRequest, "endLine is before startLine")
+		return
+	}
+
+	var windows []lsp.Range
+	for line := startLine; line <= endLine; line += window {
+		windows = append(windows, lsp.Range{
+			Start: lsp.Position{Line: line},
+			End:   lsp.Position{Line: min(line+window, endLine+1)},
+		})
+	}
+	if len(windows) > inlayHintsMaxWindows {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("the range spans %v windows, which exceeds the limit of %v", len(windows), inlayHintsMaxWindows))
+		return
+	}
+
+	var mutex sync.Mutex
+	var callErr error
+	seen := make(map[string]bool)
+	hints := []inlayHint{}
+	forEachConcurrently(len(windows), inlayHintsConcurrency, func(i int) {
+		var result []json.RawMessage
+		err := p.call(req.Context(), "textDocument/inlayHint", map[string]any{
+			"textDocument": lsp.TextDocumentIdentifier{URI: uri},
+			"range":        windows[i],
+		}, &result)
+
+		mutex.Lock()
+		defer mutex.Unlock()
+		if err != nil {
+			callErr = err
+			return
+		}
+		for _, raw := range result {
+			var hint struct {
+				Position lsp.Position `json:"position"`
+			}
+			if json.Unmarshal(raw, &hint) != nil {
+				continue
+			}
+			// Hints at the boundary of windows may be returned twice, and
+			// servers may return hints outside of the requested range.
+			key := string(raw)
+			if seen[key] || hint.Position.Line < startLine || hint.Position.Line > endLine {
+				continue
+			}
+			seen[key] = true
+			hints = append(hints, inlayHint{raw: raw, position: hint.Position})
+		}
+	})
+	if callErr != nil {
+		writeCallError(w, callErr)
+		return
+	}
+
+	sort.SliceStable(hints, func(i, j int) bool {
+		a, b := hints[i].position, hints[j].position
+		if a != b {
+			return before(a, b)
+		}
+		return strings.Compare(string(hints[i].raw), string(hints[j].raw)) < 0
+	})
+	result := make([]json.RawMessage, len(hints))
+	for i, h := range hints {
+		result[i] = h.raw
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"hints":     result,
+		"startLine": startLine,
+		"endLine":   endLine,
+		"windows":   len(windows),
+	})
+}
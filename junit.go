@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/federicotdn/hyperlsp/lsp"
+)
+
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Name     string           `xml:"name,attr"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	ClassName string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// pullDiagnostics runs textDocument/diagnostic for a single document. If
+// the LSP server doesn't support pull diagnostics, the diagnostics it last
+// published for the document are returned instead.
+func (p *proxy) pullDiagnostics(ctx context.Context, uri string) ([]lsp.Diagnostic, error) {
+	var caps struct {
+		DiagnosticProvider any `json:"diagnosticProvider"`
+	}
+	if p.capabilities(&caps) == nil && caps.DiagnosticProvider == nil {
+		return p.publishedDiagnostics(uri), nil
+	}
+
+	params := map[string]any{
+		"textDocument": lsp.TextDocumentIdentifier{URI: uri},
+	}
+
+	var report struct {
+		Kind  string           `json:"kind"`
+		Items []lsp.Diagnostic `json:"items"`
+	}
+	err := p.call(ctx, "textDocument/diagnostic", params, &report)
+	var respErr *lsp.ResponseError
+	if errors.As(err, &respErr) && respErr.Code == lsp.CodeMethodNotFound {
+		return p.publishedDiagnostics(uri), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return p.diagnosticRules.apply(uri, report.Items), nil
+}
+
+// publishedDiagnostics returns a copy of the diagnostics last published by
+// the LSP server for a document, with the diagnostic rules already applied.
+func (p *proxy) publishedDiagnostics(uri string) []lsp.Diagnostic {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return slices.Clone(p.diagnostics[uri])
+}
+
+// junitSuite builds a test suite for a single file, containing one
+// failing test case per diagnostic, or a single passing test case if
+// there are none.
+func junitSuite(uri string, diagnostics []lsp.Diagnostic) junitTestSuite {
+	name := uri
+	if path, err := lsp.URIToPath(uri); err == nil {
+		name = path
+	}
+
+	suite := junitTestSuite{Name: name}
+	for _, d := range diagnostics {
+		line, char := d.Range.Start.Line+1, d.Range.Start.Character+1
+		caseName := fmt.Sprintf("%v:%v", line, char)
+		if d.Source != "" {
+			caseName += " " + d.Source
+		}
+		if d.Code != nil {
+			caseName += fmt.Sprintf(" (%v)", d.Code)
+		}
+
+		suite.Cases = append(suite.Cases, junitTestCase{
+			ClassName: name,
+			Name:      caseName,
+			Failure: &junitFailure{
+				Message: d.Message,
+				Type:    lsp.SeverityName(d.Severity),
+				Text:    fmt.Sprintf("%v:%v:%v: %v", name, line, char, d.Message),
+			},
+		})
+	}
+
+	if len(suite.Cases) == 0 {
+		suite.Cases = append(suite.Cases, junitTestCase{ClassName: name, Name: "diagnostics"})
+	}
+
+	suite.Tests = len(suite.Cases)
+	suite.Failures = len(diagnostics)
+	return suite
+}
+
+// handleDiagnosticsJUnit pulls the diagnostics of the documents specified
+// in the body, and exports them as JUnit-style XML. Diagnostics less
+// severe than the (optional) severity query parameter are ignored.
+func (p *proxy) handleDiagnosticsJUnit(w http.ResponseWriter, req *http.Request) {
+	var body struct {
+		URIs []string `json:"uris"`
+	}
+
+	defer req.Body.Close()
+	err := json.NewDecoder(req.Body).Decode(&body)
+	if err != nil || len(body.URIs) == 0 {
+		writeError(w, http.StatusBadRequest, "request json must contain a non-empty uris list")
+		return
+	}
+
+	maxSeverity := lsp.SeverityHint
+	if v := req.URL.Query().Get("severity"); v != "" {
+		maxSeverity, err = strconv.Atoi(v)
+		if err != nil || maxSeverity < lsp.SeverityError || maxSeverity > lsp.SeverityHint {
+			writeError(w, http.StatusBadRequest, "invalid severity")
+			return
+		}
+	}
+
+	suites := junitTestSuites{Name: "hyperlsp"}
+	for _, uri := range body.URIs {
+		diagnostics, err := p.pullDiagnostics(req.Context(), uri)
+		if err != nil {
+			writeCallError(w, err)
+			return
+		}
+
+		kept := diagnostics[:0]
+		for _, d := range diagnostics {
+			// Missing severity is interpreted as an error.
+			if d.Severity <= maxSeverity {
+				kept = append(kept, d)
+			}
+		}
+
+		suite := junitSuite(uri, kept)
+		suites.Tests += suite.Tests
+		suites.Failures += suite.Failures
+		suites.Suites = append(suites.Suites, suite)
+	}
+
+	data, err := xml.MarshalIndent(&suites, "", "  ")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("unable to marshal xml: %v", err))
+		return
+	}
+	data = append([]byte(xml.Header), data...)
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	_, err = w.Write(data)
+	if err != nil {
+		slog.Error("error writing response data", "err", err)
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/federicotdn/hyperlsp/lsp"
+)
+
+// defaultExtensions maps file extensions (and some well-known file names)
+// to languageId values, as listed in the LSP specification.
+var defaultExtensions = map[string]string{
+	".bat":           "bat",
+	".bib":           "bibtex",
+	".c":             "c",
+	".h":             "c",
+	".clj":           "clojure",
+	".coffee":        "coffeescript",
+	".cc":            "cpp",
+	".cpp":           "cpp",
+	".cxx":           "cpp",
+	".hh":            "cpp",
+	".hpp":           "cpp",
+	".cs":            "csharp",
+	".css":           "css",
+	".dart":          "dart",
+	".diff":          "diff",
+	".patch":         "diff",
+	"Dockerfile":     "dockerfile",
+	".ex":            "elixir",
+	".exs":           "elixir",
+	".erl":           "erlang",
+	".fs":            "fsharp",
+	".go":            "go",
+	"go.mod":         "go.mod",
+	".groovy":        "groovy",
+	".hbs":           "handlebars",
+	".hs":            "haskell",
+	".html":          "html",
+	".ini":           "ini",
+	".java":          "java",
+	".js":            "javascript",
+	".mjs":           "javascript",
+	".jsx":           "javascriptreact",
+	".json":          "json",
+	".tex":           "latex",
+	".less":          "less",
+	".lua":           "lua",
+	"Makefile":       "makefile",
+	".md":            "markdown",
+	".m":             "objective-c",
+	".mm":            "objective-cpp",
+	".pl":            "perl",
+	".php":           "php",
+	".ps1":           "powershell",
+	".py":            "python",
+	".r":             "r",
+	".rb":            "ruby",
+	".rs":            "rust",
+	".scala":         "scala",
+	".scss":          "scss",
+	".sh":            "shellscript",
+	".bash":          "shellscript",
+	".sql":           "sql",
+	".swift":         "swift",
+	".ts":            "typescript",
+	".tsx":           "typescriptreact",
+	".vb":            "vb",
+	".xml":           "xml",
+	".xsl":           "xsl",
+	".yaml":          "yaml",
+	".yml":           "yaml",
+	".zig":           "zig",
+	".toml":          "toml",
+	"CMakeLists.txt": "cmake",
+}
+
+// defaultInterpreters maps interpreters found in shebang lines to
+// languageId values.
+var defaultInterpreters = map[string]string{
+	"bash":    "shellscript",
+	"dash":    "shellscript",
+	"ksh":     "shellscript",
+	"sh":      "shellscript",
+	"zsh":     "shellscript",
+	"node":    "javascript",
+	"deno":    "typescript",
+	"lua":     "lua",
+	"perl":    "perl",
+	"php":     "php",
+	"python":  "python",
+	"Rscript": "r",
+	"ruby":    "ruby",
+}
+
+// languageDetector determines the languageId of documents, based on their
+// file name or extension and, failing that, on the interpreter in their
+// shebang line.
+type languageDetector struct {
+	// File extensions (including the leading dot) or file names.
+	extensions map[string]string
+	// Interpreter names, without versions.
+	interpreters map[string]string
+}
+
+// newLanguageDetector returns a detector using the default mappings,
+// extended (or overridden) by extensions and interpreters.
+func newLanguageDetector(extensions, interpreters map[string]string) *languageDetector {
+	ld := &languageDetector{
+		extensions:   make(map[string]string),
+		interpreters: make(map[string]string),
+	}
+	for k, v := range defaultExtensions {
+		ld.extensions[k] = v
+	}
+	for k, v := range extensions {
+		ld.extensions[k] = v
+	}
+	for k, v := range defaultInterpreters {
+		ld.interpreters[k] = v
+	}
+	for k, v := range interpreters {
+		ld.interpreters[k] = v
+	}
+	return ld
+}
+
+// byName returns the languageId of the document with the specified URI
+// based on its name, or an empty string if it is not known. File names
+// take precedence over extensions.
+func (ld *languageDetector) byName(uri string) string {
+	// Strip the query and fragment, if any.
+	uri, _, _ = strings.Cut(uri, "?")
+	uri, _, _ = strings.Cut(uri, "#")
+
+	name := path.Base(uri)
+	if id, ok := ld.extensions[name]; ok {
+		return id
+	}
+	if id, ok := ld.extensions[strings.ToLower(path.Ext(name))]; ok {
+		return id
+	}
+	return ""
+}
+
+// byShebang returns the languageId corresponding to the interpreter in the
+// shebang line of text, or an empty string if there is none or it is not
+// known.
+func (ld *languageDetector) byShebang(text string) string {
+	line, ok := strings.CutPrefix(text, "#!")
+	if !ok {
+		return ""
+	}
+	line, _, _ = strings.Cut(line, "\n")
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return ""
+	}
+	interpreter := path.Base(fields[0])
+	if interpreter == "env" {
+		// Skip options such as -S.
+		interpreter = ""
+		for _, f := range fields[1:] {
+			if !strings.HasPrefix(f, "-") {
+				interpreter = path.Base(f)
+				break
+			}
+		}
+	}
+
+	if id, ok := ld.interpreters[interpreter]; ok {
+		return id
+	}
+	// Strip the version, e.g. python3.12.
+	if id, ok := ld.interpreters[strings.TrimRight(interpreter, "0123456789.")]; ok {
+		return id
+	}
+	return ""
+}
+
+// detect returns the languageId of a document, given its URI and its
+// content (which may be empty if it is not known), or an empty string if
+// it cannot be determined.
+func (ld *languageDetector) detect(uri, text string) string {
+	if id := ld.byName(uri); id != "" {
+		return id
+	}
+	return ld.byShebang(text)
+}
+
+// detectFile is like detect, but reads the beginning of the document from
+// disk if needed.
+func (ld *languageDetector) detectFile(uri string) string {
+	if id := ld.byName(uri); id != "" {
+		return id
+	}
+
+	path, err := lsp.URIToPath(uri)
+	if err != nil {
+		return ""
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	buf := make([]byte, 256)
+	n, _ := io.ReadFull(f, buf)
+	return ld.byShebang(string(buf[:n]))
+}
+
+// fillLanguageId sets the languageId of the document in the params of a
+// textDocument/didOpen notification, if the client omitted it.
+func (p *proxy) fillLanguageId(method string, params any) {
+	if method != "textDocument/didOpen" {
+		return
+	}
+
+	obj, _ := params.(map[string]any)
+	td, _ := obj["textDocument"].(map[string]any)
+	uri, _ := td["uri"].(string)
+	if id, _ := td["languageId"].(string); id != "" || uri == "" {
+		return
+	}
+
+	text, _ := td["text"].(string)
+	if id := p.languages.detect(uri, text); id != "" {
+		td["languageId"] = id
+	}
+}
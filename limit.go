@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Default maximum number of requests waiting for the concurrency limit.
+const defaultMaxQueue = 64
+
+// Weight of the latest request in the average request duration used to
+// estimate when a rejected request may be retried.
+const latencySmoothing = 0.2
+
+// Priorities of requests waiting for the concurrency limit, according to
+// the class of their method (see classes.go).
+const (
+	priorityBackground = iota
+	priorityNormal
+	priorityInteractive
+)
+
+var (
+	errQueueFull = errors.New("too many concurrent requests")
+	errPreempted = errors.New("request cancelled in favor of an interactive request for the same document")
+)
+
+// limiterWaiter is a request waiting for the concurrency limit.
+type limiterWaiter struct {
+	priority int
+	uri      string
+	// Receives true once the request can be sent, or false if it has been
+	// preempted.
+	result chan bool
+}
+
+// concurrencyLimiter limits the number of requests sent to the LSP server
+// at the same time. Requests beyond the limit wait in a bounded queue,
+// ordered by priority, and are rejected once it is full.
+type concurrencyLimiter struct {
+	maxConcurrent int
+	maxQueue      int
+
+	mutex  sync.Mutex
+	active int
+	// Waiting requests, from the highest priority (and the oldest within a
+	// priority).
+	queue []*limiterWaiter
+	// Average duration of completed requests.
+	latency time.Duration
+}
+
+func newConcurrencyLimiter(maxConcurrent, maxQueue int) *concurrencyLimiter {
+	return &concurrencyLimiter{
+		maxConcurrent: maxConcurrent,
+		maxQueue:      maxQueue,
+	}
+}
+
+// acquire waits until a request with a priority, about the document with
+// the specified URI (if any), can be sent, and returns a function to be
+// called once it has completed. Interactive requests preempt the waiting
+// background requests about the same document, which fail with
+// errPreempted. If the queue is full (errQueueFull), or ctx is done while
+// waiting, it instead returns an error and an estimate of when the request
+// may be retried.
+func (cl *concurrencyLimiter) acquire(ctx context.Context, priority int, uri string) (func(), time.Duration, error) {
+	cl.mutex.Lock()
+	if priority == priorityInteractive && uri != "" {
+		cl.preempt(uri)
+	}
+	if cl.active < cl.maxConcurrent {
+		cl.active++
+		cl.mutex.Unlock()
+		return cl.releaser(), 0, nil
+	}
+	if len(cl.queue) >= cl.maxQueue {
+		retry := cl.retryAfter()
+		cl.mutex.Unlock()
+		return nil, retry, errQueueFull
+	}
+
+	w := &limiterWaiter{priority: priority, uri: uri, result: make(chan bool, 1)}
+	i := len(cl.queue)
+	for i > 0 && cl.queue[i-1].priority < priority {
+		i--
+	}
+	cl.queue = slices.Insert(cl.queue, i, w)
+	cl.mutex.Unlock()
+
+	select {
+	case ok := <-w.result:
+		if !ok {
+			return nil, 0, errPreempted
+		}
+		return cl.releaser(), 0, nil
+	case <-ctx.Done():
+		cl.mutex.Lock()
+		defer cl.mutex.Unlock()
+		if i := slices.Index(cl.queue, w); i >= 0 {
+			cl.queue = slices.Delete(cl.queue, i, i+1)
+		} else if <-w.result {
+			// The request was allowed in the meantime.
+			cl.active--
+			cl.dispatch()
+		}
+		return nil, cl.retryAfter(), ctx.Err()
+	}
+}
+
+// preempt removes the waiting background requests about a document from
+// the queue. It must be called with cl.mutex held.
+func (cl *concurrencyLimiter) preempt(uri string) {
+	cl.queue = slices.DeleteFunc(cl.queue, func(w *limiterWaiter) bool {
+		if w.priority != priorityBackground || w.uri != uri {
+			return false
+		}
+		w.result <- false
+		return true
+	})
+}
+
+// dispatch allows the first waiting requests to be sent, while there are
+// free slots. It must be called with cl.mutex held.
+func (cl *concurrencyLimiter) dispatch() {
+	for cl.active < cl.maxConcurrent && len(cl.queue) > 0 {
+		w := cl.queue[0]
+		cl.queue = cl.queue[1:]
+		cl.active++
+		w.result <- true
+	}
+}
+
+func (cl *concurrencyLimiter) releaser() func() {
+	start := time.Now()
+	return func() {
+		elapsed := time.Since(start)
+		cl.mutex.Lock()
+		defer cl.mutex.Unlock()
+		if cl.latency == 0 {
+			cl.latency = elapsed
+		} else {
+			cl.latency += time.Duration(latencySmoothing * float64(elapsed-cl.latency))
+		}
+		cl.active--
+		cl.dispatch()
+	}
+}
+
+// retryAfter estimates how long it takes for the queue to drain, given
+// the average request duration. It must be called with cl.mutex held.
+func (cl *concurrencyLimiter) retryAfter() time.Duration {
+	return time.Duration(len(cl.queue)+1) * cl.latency / time.Duration(cl.maxConcurrent)
+}
+
+// retryAfterSeconds returns the value of a Retry-After header for delay,
+// rounded up to whole seconds (and at least one).
+func retryAfterSeconds(delay time.Duration) string {
+	return strconv.Itoa(max(int((delay+time.Second-1)/time.Second), 1))
+}
+
+// setRetryAfter sets the Retry-After header to delay.
+func setRetryAfter(h http.Header, delay time.Duration) {
+	h.Set("Retry-After", retryAfterSeconds(delay))
+}
+
+// forEachConcurrently calls fn for every index from 0 to n-1, with at most
+// concurrency calls running at the same time, and waits for all of them.
+func forEachConcurrently(n, concurrency int, fn func(i int)) {
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrency)
+	for i := 0; i < n; i++ {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			fn(i)
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	logSubscriberBuffer = 256
+	logKeepAlive        = 15 * time.Second
+)
+
+type logConfig struct {
+	Level  string
+	Format string
+	// Path of the log file, or empty to log to stderr.
+	File       string
+	MaxSize    int64
+	MaxBackups int
+}
+
+// newHandler returns the slog.Handler that writes the logs configured.
+func (lc *logConfig) newHandler() (slog.Handler, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(strings.ToUpper(lc.Level)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid log level: %v", lc.Level)
+	}
+
+	var w io.Writer = os.Stderr
+	if lc.File != "" {
+		w, err = newRotatingFile(lc.File, lc.MaxSize, lc.MaxBackups)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	switch lc.Format {
+	case "text":
+		return slog.NewTextHandler(w, opts), nil
+	case "json":
+		return slog.NewJSONHandler(w, opts), nil
+	default:
+		return nil, fmt.Errorf("invalid log format: %v", lc.Format)
+	}
+}
+
+// rotatingFile is a log file that is rotated once it reaches a maximum
+// size: path is renamed to path.1, path.1 to path.2 and so on, keeping up to
+// maxBackups old files.
+type rotatingFile struct {
+	mutex      sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func newRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	rf := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	err := rf.open()
+	if err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	file, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	rf.file = file
+	rf.size = info.Size()
+	return nil
+}
+
+func (rf *rotatingFile) rotate() error {
+	rf.file.Close()
+	rf.file = nil
+
+	var err error
+	if rf.maxBackups > 0 {
+		for i := rf.maxBackups - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%v.%v", rf.path, i), fmt.Sprintf("%v.%v", rf.path, i+1))
+		}
+		err = os.Rename(rf.path, rf.path+".1")
+	} else {
+		err = os.Remove(rf.path)
+	}
+
+	// Reopen the file even if it could not be renamed, to keep logging.
+	return errors.Join(err, rf.open())
+}
+
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+
+	if rf.maxSize > 0 && rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize {
+		err := rf.rotate()
+		if err != nil {
+			// Keep logging to stderr rather than losing records.
+			fmt.Fprintf(os.Stderr, "unable to rotate log file: %v\n", err)
+		}
+	}
+	if rf.file == nil {
+		return os.Stderr.Write(p)
+	}
+
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// teeHandler is a slog.Handler that passes records to several handlers.
+type teeHandler []slog.Handler
+
+func (t teeHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, h := range t {
+		if h.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t teeHandler) Handle(ctx context.Context, r slog.Record) error {
+	var errs []error
+	for _, h := range t {
+		if h.Enabled(ctx, r.Level) {
+			if err := h.Handle(ctx, r.Clone()); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+func (t teeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	handlers := make(teeHandler, len(t))
+	for i, h := range t {
+		handlers[i] = h.WithAttrs(attrs)
+	}
+	return handlers
+}
+
+func (t teeHandler) WithGroup(name string) slog.Handler {
+	handlers := make(teeHandler, len(t))
+	for i, h := range t {
+		handlers[i] = h.WithGroup(name)
+	}
+	return handlers
+}
+
+type logSubscriber struct {
+	level slog.Level
+	lines chan []byte
+}
+
+// logHub broadcasts log records, formatted as JSON, to subscribers.
+type logHub struct {
+	mutex       sync.Mutex
+	subscribers map[*logSubscriber]bool
+}
+
+func newLogHub() *logHub {
+	return &logHub{subscribers: make(map[*logSubscriber]bool)}
+}
+
+// handler returns a slog.Handler for records to be broadcast.
+func (h *logHub) handler() slog.Handler {
+	return slog.NewJSONHandler(h, &slog.HandlerOptions{Level: h})
+}
+
+// Level implements slog.Leveler, returning the lowest level any subscriber
+// is interested in, so that records are only formatted when needed.
+func (h *logHub) Level() slog.Level {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	level := slog.Level(math.MaxInt)
+	for sub := range h.subscribers {
+		level = min(level, sub.level)
+	}
+	return level
+}
+
+// Write receives a single record formatted by the JSON handler.
+func (h *logHub) Write(p []byte) (int, error) {
+	var record struct {
+		Level slog.Level `json:"level"`
+	}
+	json.Unmarshal(p, &record)
+	line := bytes.TrimSpace(bytes.Clone(p))
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for sub := range h.subscribers {
+		if record.Level < sub.level {
+			continue
+		}
+		// Slow subscribers miss records instead of blocking logging.
+		select {
+		case sub.lines <- line:
+		default:
+		}
+	}
+	return len(p), nil
+}
+
+func (h *logHub) subscribe(level slog.Level) *logSubscriber {
+	sub := &logSubscriber{level: level, lines: make(chan []byte, logSubscriberBuffer)}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.subscribers[sub] = true
+	return sub
+}
+
+func (h *logHub) unsubscribe(sub *logSubscriber) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	delete(h.subscribers, sub)
+}
+
+// handleLogs streams log records as server-sent events, each containing a
+// record formatted as JSON. The minimum level is set with ?level=debug,
+// info (default), warn or error.
+func (h *logHub) handleLogs(w http.ResponseWriter, req *http.Request) {
+	level := slog.LevelInfo
+	if v := req.URL.Query().Get("level"); v != "" {
+		err := level.UnmarshalText([]byte(strings.ToUpper(v)))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid level: %v", v))
+			return
+		}
+	}
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	sub := h.subscribe(level)
+	defer h.unsubscribe(sub)
+
+	ticker := time.NewTicker(logKeepAlive)
+	defer ticker.Stop()
+
+	for {
+		var err error
+		select {
+		case <-req.Context().Done():
+			return
+		case line := <-sub.lines:
+			_, err = fmt.Fprintf(w, "data: %s\n\n", line)
+		case <-ticker.C:
+			_, err = fmt.Fprint(w, ": keep-alive\n\n")
+		}
+
+		if err == nil {
+			err = rc.Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
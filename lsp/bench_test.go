@@ -0,0 +1,197 @@
+package lsp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+// Read buffer sizes compared by the benchmarks.
+var benchReadBufferSizes = []int{DefaultReadBufferSize, 64 * 1024, 1024 * 1024}
+
+// benchFrameSizes are the approximate content sizes of the frames used by
+// the benchmarks. Servers such as rust-analyzer send frames of several
+// megabytes during startup.
+var benchFrameSizes = []int{64 * 1024, 1024 * 1024, 16 * 1024 * 1024}
+
+func sizeName(n int) string {
+	switch {
+	case n >= 1024*1024 && n%(1024*1024) == 0:
+		return fmt.Sprintf("%dM", n/(1024*1024))
+	case n >= 1024 && n%1024 == 0:
+		return fmt.Sprintf("%dK", n/1024)
+	}
+	return fmt.Sprint(n)
+}
+
+// benchResult returns a JSON array of roughly size bytes, resembling a
+// list of completion items.
+func benchResult(size int) string {
+	item := `{"label":"item","kind":6,"detail":"func() string","sortText":"00000"},`
+	var sb strings.Builder
+	sb.Grow(size + len(item))
+	sb.WriteString("[")
+	for sb.Len() < size {
+		sb.WriteString(item)
+	}
+	return strings.TrimSuffix(sb.String(), ",") + "]"
+}
+
+// benchFrame returns a complete response frame for the request with the
+// specified ID.
+func benchFrame(id string, result string) []byte {
+	content := fmt.Sprintf(`{"jsonrpc":"2.0","id":%q,"result":%v}`, id, result)
+	return []byte(fmt.Sprintf("Content-Length: %v\r\n\r\n%v", len(content), content))
+}
+
+// BenchmarkParserLargeFrame measures the throughput of the message parser
+// when a large frame is received in chunks of the read buffer's size.
+func BenchmarkParserLargeFrame(b *testing.B) {
+	for _, frameSize := range benchFrameSizes {
+		frame := benchFrame("1", benchResult(frameSize))
+		for _, bufSize := range benchReadBufferSizes {
+			name := fmt.Sprintf("frame=%v/buffer=%v", sizeName(frameSize), sizeName(bufSize))
+			b.Run(name, func(b *testing.B) {
+				mp := newMessageParser()
+				b.SetBytes(int64(len(frame)))
+				b.ReportAllocs()
+				b.ResetTimer()
+
+				for i := 0; i < b.N; i++ {
+					for start := 0; start < len(frame); start += bufSize {
+						end := min(start+bufSize, len(frame))
+						err := mp.write(frame[start:end])
+						if err != nil {
+							b.Fatal(err)
+						}
+					}
+					msgs, _ := mp.pop()
+					if len(msgs) != 1 {
+						b.Fatalf("expected 1 message, got %v", len(msgs))
+					}
+				}
+			})
+		}
+	}
+}
+
+// benchConn is a serverConn backed by one end of an in-memory pipe.
+type benchConn struct {
+	conn net.Conn
+}
+
+func (c *benchConn) read(p []byte) (int, error) {
+	return c.conn.Read(p)
+}
+
+func (c *benchConn) readErr(p []byte) (int, error) {
+	select {}
+}
+
+func (c *benchConn) write(p []byte) (int, error) {
+	return c.conn.Write(p)
+}
+
+func (c *benchConn) close() error {
+	return c.conn.Close()
+}
+
+// benchServer answers every request received on conn with result.
+func benchServer(conn net.Conn, result string) {
+	mp := newMessageParser()
+	buf := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+		if mp.write(buf[:n]) != nil {
+			return
+		}
+		msgs, _ := mp.pop()
+		for _, msg := range msgs {
+			_, err := conn.Write(benchFrame(msg.id(), result))
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// BenchmarkClientLargeResponse measures the throughput of complete
+// requests whose responses are large, through a session reading with
+// different buffer sizes.
+func BenchmarkClientLargeResponse(b *testing.B) {
+	for _, frameSize := range benchFrameSizes {
+		result := benchResult(frameSize)
+		for _, bufSize := range benchReadBufferSizes {
+			name := fmt.Sprintf("frame=%v/buffer=%v", sizeName(frameSize), sizeName(bufSize))
+			b.Run(name, func(b *testing.B) {
+				local, remote := net.Pipe()
+				go benchServer(remote, result)
+
+				s, err := NewServer(WithReadBufferSize(bufSize))
+				if err != nil {
+					b.Fatal(err)
+				}
+				s.conn = &benchConn{conn: local}
+				s.session = newSession(s, s.conn, newMessageParser())
+				defer s.session.close()
+				client := NewClient(s)
+
+				b.SetBytes(int64(len(result)))
+				b.ReportAllocs()
+				b.ResetTimer()
+
+				for i := 0; i < b.N; i++ {
+					resp, err := client.Send(&Message{
+						Id:     fmt.Sprint(i),
+						Method: "textDocument/completion",
+					})
+					if err != nil {
+						b.Fatal(err)
+					}
+					if resp.Error != nil {
+						b.Fatal(resp.Error)
+					}
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkEncodeLargeMessage measures the throughput of encoding large
+// outgoing messages, such as didOpen notifications for big files.
+func BenchmarkEncodeLargeMessage(b *testing.B) {
+	for _, size := range benchFrameSizes {
+		text := strings.Repeat("x := 1\n", size/7)
+		msg := &Message{
+			Jsonrpc: jsonRpcVersion,
+			Method:  "textDocument/didOpen",
+			Params: map[string]any{
+				"textDocument": map[string]any{
+					"uri":        "file:///bench.go",
+					"languageId": "go",
+					"version":    1,
+					"text":       text,
+				},
+			},
+		}
+		b.Run(fmt.Sprintf("size=%v", sizeName(size)), func(b *testing.B) {
+			s, _ := NewServer()
+			b.SetBytes(int64(len(text)))
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				frame, err := s.encode(context.Background(), msg, nil, "")
+				if err != nil {
+					b.Fatal(err)
+				}
+				putBuffer(frame)
+			}
+		})
+	}
+}
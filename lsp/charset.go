@@ -0,0 +1,96 @@
+package lsp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"mime"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Policies for messages received with invalid UTF-8 content.
+const (
+	// Responses are replaced with an error, and other messages dropped.
+	InvalidUTF8Reject = "reject"
+	// Invalid sequences are replaced with U+FFFD.
+	InvalidUTF8Replace = "replace"
+)
+
+const CodeParseError = -32700
+
+// ValidInvalidUTF8Policy reports whether policy is a known invalid UTF-8
+// policy.
+func ValidInvalidUTF8Policy(policy string) bool {
+	return policy == InvalidUTF8Reject || policy == InvalidUTF8Replace
+}
+
+// contentCharset returns the (lowercase) charset parameter of a
+// Content-Type header, which defaults to utf-8.
+func contentCharset(headers map[string]string) string {
+	value, ok := HeaderValue(headers, "Content-Type")
+	if !ok {
+		return "utf-8"
+	}
+
+	_, params, err := mime.ParseMediaType(value)
+	if err != nil || params["charset"] == "" {
+		return "utf-8"
+	}
+	return strings.ToLower(params["charset"])
+}
+
+// decodeCharset converts content encoded with charset to UTF-8.
+func decodeCharset(data []byte, charset string) ([]byte, error) {
+	switch charset {
+	case "utf-8", "utf8":
+		// utf8 is accepted for backwards compatibility, as per the LSP
+		// specification.
+		return data, nil
+	case "us-ascii", "ascii", "iso-8859-1", "latin1":
+		var buf bytes.Buffer
+		for _, b := range data {
+			buf.WriteRune(rune(b))
+		}
+		return buf.Bytes(), nil
+	case "utf-16", "utf-16le", "utf-16be":
+		if len(data)%2 != 0 {
+			return nil, fmt.Errorf("odd number of bytes in %v content", charset)
+		}
+
+		var order binary.ByteOrder = binary.BigEndian
+		if charset == "utf-16le" {
+			order = binary.LittleEndian
+		} else if charset == "utf-16" && len(data) >= 2 {
+			// Use the byte order mark, if any.
+			if data[0] == 0xff && data[1] == 0xfe {
+				order = binary.LittleEndian
+				data = data[2:]
+			} else if data[0] == 0xfe && data[1] == 0xff {
+				data = data[2:]
+			}
+		}
+
+		units := make([]uint16, len(data)/2)
+		for i := range units {
+			units[i] = order.Uint16(data[2*i:])
+		}
+		return []byte(string(utf16.Decode(units))), nil
+	default:
+		return nil, fmt.Errorf("unsupported charset: %v", charset)
+	}
+}
+
+// invalidUTF8Offset returns the offset of the first invalid UTF-8 sequence
+// in data, or -1 if it is valid.
+func invalidUTF8Offset(data []byte) int {
+	for i := 0; i < len(data); {
+		r, size := utf8.DecodeRune(data[i:])
+		if r == utf8.RuneError && size == 1 {
+			return i
+		}
+		i += size
+	}
+	return -1
+}
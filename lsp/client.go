@@ -2,18 +2,25 @@ package lsp
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
+	"log/slog"
+	"sort"
 	"strconv"
 	"strings"
 )
 
 const (
-	jsonRpcVersion  = "2.0"
-	noContentLength = -1
+	jsonRpcVersion = "2.0"
+
+	CodeMethodNotFound = -32601
+	CodeInternalError  = -32603
 )
 
+// Client sends messages to an LSP server. Clients are lightweight, and
+// any number of them may be used concurrently with the same server.
 type Client struct {
 	s *Server
 }
@@ -23,20 +30,76 @@ type Message struct {
 	Id      string `json:"id,omitempty"`
 	Method  string `json:"method"`
 	Params  any    `json:"params,omitempty"`
+	// Additional wire headers to send along with the message.
+	Headers map[string]string `json:"-"`
 }
 
+// Sources of the errors returned to HTTP clients, see ResponseError.
+const (
+	ErrorSourceProxy  = "proxy"
+	ErrorSourceServer = "server"
+)
+
 type ResponseError struct {
 	Code    int    `json:"code"`
 	Message string `json:"message"`
 	Data    any    `json:"data,omitempty"`
+	// Whether the error was returned by the LSP server or generated by
+	// hyperlsp (not part of the JSON-RPC error object). Errors generated by
+	// hyperlsp also have a stable ProxyCode.
+	Source    string `json:"source,omitempty"`
+	ProxyCode string `json:"proxyCode,omitempty"`
+}
+
+func (e *ResponseError) Error() string {
+	return fmt.Sprintf("LSP error %v: %v", e.Code, e.Message)
 }
 
 type Response struct {
-	Headers      map[string]string `json:"-"`
-	Id           string            `json:"id"`
-	Result       any               `json:"result,omitempty"`
-	Error        *ResponseError    `json:"error,omitempty"`
-	Notification bool              `json:"-"`
+	Headers map[string]string `json:"-"`
+	Id      string            `json:"id"`
+	// Result of the request. For responses received from the LSP server,
+	// it is a json.RawMessage, which is only unmarshaled if needed.
+	Result       any            `json:"result,omitempty"`
+	Error        *ResponseError `json:"error,omitempty"`
+	Notification bool           `json:"-"`
+}
+
+// incomingMessage is any message sent by the LSP server: a response, a
+// notification or a request.
+type incomingMessage struct {
+	Id      json.RawMessage `json:"id"`
+	Method  string          `json:"method"`
+	Params  any             `json:"params"`
+	Result  json.RawMessage `json:"result"`
+	Error   *ResponseError  `json:"error"`
+	headers map[string]string
+}
+
+// id returns the message's ID as a string.
+func (m *incomingMessage) id() string {
+	return rawID(m.Id)
+}
+
+// rawID returns a JSON-RPC ID as a string. LSP allows IDs to be either
+// strings or integers.
+func rawID(raw json.RawMessage) string {
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return s
+	}
+	return string(raw)
+}
+
+// wireRequest is a request as written to the LSP server. Requests are not
+// written with the ID they were sent with, but with an ID generated by the
+// Server, so that requests of different HTTP clients and internal ones
+// never have the same ID on the wire.
+type wireRequest struct {
+	Jsonrpc string `json:"jsonrpc"`
+	Id      uint64 `json:"id"`
+	Method  string `json:"method"`
+	Params  any    `json:"params,omitempty"`
 }
 
 func (req *Message) fill() {
@@ -47,140 +110,483 @@ func NewClient(s *Server) *Client {
 	return &Client{s: s}
 }
 
+// Send sends a message to the LSP server. If the message has an ID, Send
+// waits for the corresponding response. Notifications sent by the server
+// are handed to the server's notification handler as they are received.
+// Send may be called concurrently: messages are written in the order in
+// which they are sent, but waiting for a response does not block other
+// messages. Requests are written with IDs generated by the Server (see
+// wireRequest), and their responses have the ID they were sent with.
+// $/cancelRequest notifications for the ID of a pending request are
+// rewritten accordingly.
 func (c *Client) Send(req *Message) (*Response, error) {
-	c.s.lock()
-	defer c.s.unlock()
+	return c.send(context.Background(), req, "", nil)
+}
 
-	req.fill()
+// SendContext works like Send, but stops waiting for the response once
+// ctx is done, returning its error. The LSP server is then sent a
+// $/cancelRequest notification for the request, and its response is
+// discarded once received.
+func (c *Client) SendContext(ctx context.Context, req *Message) (*Response, error) {
+	return c.send(ctx, req, "", nil)
+}
+
+// SendWithPartialResults works like Send, but also calls partial with the
+// value of every $/progress notification reported for token, which should
+// be set as the request's partialResultToken.
+func (c *Client) SendWithPartialResults(req *Message, token string, partial func(value any)) (*Response, error) {
+	return c.send(context.Background(), req, token, partial)
+}
+
+// SendWithPartialResultsContext works like SendWithPartialResults, but
+// stops waiting for the response once ctx is done, like SendContext.
+func (c *Client) SendWithPartialResultsContext(ctx context.Context, req *Message, token string, partial func(value any)) (*Response, error) {
+	return c.send(ctx, req, token, partial)
+}
 
-	data, err := json.Marshal(req)
+// validHeader reports whether a header can be written to the wire as-is,
+// without breaking the message's framing.
+func validHeader(name, value string) bool {
+	return name != "" &&
+		!strings.ContainsAny(name, ":\r\n") &&
+		!strings.ContainsAny(value, "\r\n") &&
+		!strings.EqualFold(name, "Content-Length")
+}
+
+// encode returns the frame (headers and content) of a message, in a
+// buffer from the pool. The content is compressed with encoding, if set
+// and the content is large enough. ctx is passed to the tracer.
+func (s *Server) encode(ctx context.Context, msg any, headers map[string]string, encoding string) (*bytes.Buffer, error) {
+	content := getBuffer()
+	defer putBuffer(content)
+
+	err := json.NewEncoder(content).Encode(msg)
 	if err != nil {
-		return nil, fmt.Errorf("unable to json marshal request: %w", err)
+		return nil, fmt.Errorf("unable to json marshal message: %w", err)
 	}
+	// Remove the newline added by the encoder.
+	data := content.Bytes()[:content.Len()-1]
 
-	length := strconv.Itoa(len(data))
-	_, err = c.s.write([]byte(fmt.Sprintf("Content-Length: %v\r\n\r\n", length)))
-	if err != nil {
-		return nil, fmt.Errorf("error sending headers to server: %w", err)
+	if trace := s.trace.Load(); trace != nil {
+		(*trace)(ctx, true, data)
+	}
+
+	compressed := false
+	if encoding != "" && len(data) >= minCompressedContent {
+		body := getBuffer()
+		defer putBuffer(body)
+		err := compress(body, data, encoding)
+		if err != nil {
+			return nil, fmt.Errorf("unable to compress message: %w", err)
+		}
+		data = body.Bytes()
+		compressed = true
 	}
 
-	_, err = c.s.write(data)
+	if len(s.headers) > 0 || s.compression != "" {
+		merged := make(map[string]string)
+		for name, value := range headers {
+			if _, ok := HeaderValue(s.headers, name); !ok {
+				merged[name] = value
+			}
+		}
+		for name, value := range s.headers {
+			merged[name] = value
+		}
+		if s.compression != "" {
+			// Announce that compressed messages are accepted.
+			merged["Accept-Encoding"] = s.compression
+		}
+		if compressed {
+			merged["Content-Encoding"] = encoding
+		}
+		headers = merged
+	}
+
+	buf := getBuffer()
+	buf.Grow(len(data) + 64)
+	fmt.Fprintf(buf, "Content-Length: %v\r\n", len(data))
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !validHeader(name, headers[name]) {
+			s.log().Warn("discarding invalid header for LSP message", "name", name)
+			continue
+		}
+		fmt.Fprintf(buf, "%v: %v\r\n", name, headers[name])
+	}
+	buf.WriteString("\r\n")
+	buf.Write(data)
+
+	return buf, nil
+}
+
+func (c *Client) send(ctx context.Context, req *Message, token string, partial func(value any)) (*Response, error) {
+	req.fill()
+
+	sess, err := c.s.currentSession()
 	if err != nil {
-		return nil, fmt.Errorf("error sending content to server: %w", err)
+		return nil, err
 	}
 
 	// Notification
 	if req.Id == "" {
+		msg := req
+		if req.Method == "$/cancelRequest" {
+			var ok bool
+			msg, ok = sess.wireCancel(req)
+			if !ok {
+				// The request is not pending (anymore).
+				return &Response{Notification: true}, nil
+			}
+		}
+		err := c.write(ctx, sess, msg, req.Headers)
+		if err != nil {
+			return nil, err
+		}
 		return &Response{Notification: true}, nil
 	}
 
-	lrp := newResponseParser(req.Id)
-	buf := make([]byte, 4096)
-
-	for {
-		n, ioErr := c.s.read(buf)
-		resp, err := lrp.write(buf[:n])
+	// The call is registered before sending the request, as the response
+	// may be received right after it is written.
+	wireID := c.s.lastWireID.Add(1)
+	call, err := sess.register(ctx, wireID, req.Id, token, partial)
+	if err != nil {
+		return nil, err
+	}
+	err = c.write(ctx, sess, &wireRequest{Jsonrpc: req.Jsonrpc, Id: wireID, Method: req.Method, Params: req.Params}, req.Headers)
+	if err != nil {
+		sess.unregister(wireID)
+		return nil, err
+	}
 
-		switch {
-		case ioErr == io.EOF:
-			return nil, fmt.Errorf("read error: EOF")
-		case ioErr != nil:
-			return nil, fmt.Errorf("read error: %w", err)
-		case err != nil:
-			return nil, fmt.Errorf("error reading LSP server output: %w", err)
+	select {
+	case <-call.done:
+	case <-ctx.Done():
+		if sess.cancel(wireID) {
+			cancel := Message{Jsonrpc: jsonRpcVersion, Method: "$/cancelRequest", Params: map[string]any{"id": wireID}}
+			err := c.write(ctx, sess, &cancel, nil)
+			if err != nil {
+				c.s.log().Warn("unable to cancel LSP request", "id", req.Id, "err", err)
+			}
+			return nil, ctx.Err()
 		}
+		// The response was received in the meantime.
+		<-call.done
+	}
+	if call.err != nil {
+		return nil, call.err
+	}
+	if call.resp.Error != nil {
+		call.resp.Error.Source = ErrorSourceServer
+	}
+	return &Response{
+		Headers: call.resp.headers,
+		Id:      req.Id,
+		Result:  call.resp.Result,
+		Error:   call.resp.Error,
+	}, nil
+}
+
+// write encodes a message and writes it to the LSP server.
+func (c *Client) write(ctx context.Context, sess *session, msg any, headers map[string]string) error {
+	frame, err := c.s.encode(ctx, msg, headers, sess.outgoingEncoding())
+	if err != nil {
+		return err
+	}
+	defer putBuffer(frame)
+	return sess.send(frame.Bytes())
+}
+
+// Maximum length of a header line received from the LSP server.
+const maxHeaderLineLength = 64 * 1024
+
+// Maximum size of the buffer allocated in advance for the content of a
+// message received from the LSP server.
+const maxContentPrealloc = 16 * 1024 * 1024
+
+// FrameError describes a malformed frame received from the LSP server.
+type FrameError struct {
+	// Position of the error in the server's output, in bytes.
+	Offset int64
+	// Index (zero-based) of the message the error occurred in.
+	Message int
+	// Line (1-based) of the header block the error occurred in, or zero if
+	// it occurred in the message's content.
+	Line   int
+	Reason string
+}
 
-		if resp != nil {
-			return resp, nil
+func (e *FrameError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("malformed frame (message %v, header line %v, offset %v): %v", e.Message, e.Line, e.Offset, e.Reason)
+	}
+	return fmt.Sprintf("malformed frame (message %v, offset %v): %v", e.Message, e.Offset, e.Reason)
+}
+
+// headerKey returns the key of a header in headers, looked up
+// case-insensitively. If it is not present, name itself is returned.
+func headerKey(headers map[string]string, name string) (string, bool) {
+	for k := range headers {
+		if strings.EqualFold(k, name) {
+			return k, true
 		}
 	}
+	return name, false
+}
+
+// HeaderValue returns the value of a header of a message, looked up
+// case-insensitively.
+func HeaderValue(headers map[string]string, name string) (string, bool) {
+	k, ok := headerKey(headers, name)
+	return headers[k], ok
 }
 
-type responseParser struct {
-	received      bytes.Buffer
+// messageParser incrementally parses the LSP server's output, which may
+// contain any number of (possibly incomplete) messages. Header names keep
+// their original casing; unknown headers are preserved.
+type messageParser struct {
 	current       bytes.Buffer
-	i             int
 	headers       map[string]string
 	parsedHeaders bool
-	last          byte
 	contentLength int
-	id            string
+	parsed        []*incomingMessage
+	err           error
+	// Called with every message parsed, and its content.
+	trace func(msg *incomingMessage, data []byte)
+	// Policy for messages with invalid UTF-8 content.
+	invalidUTF8 string
+	// Content encoding accepted for compressed messages, if any.
+	compression string
+	// Logger for rejected messages, or nil for the default logger.
+	logger *slog.Logger
+
+	// Position in the server's output, used to report errors.
+	offset   int64
+	messages int
+	line     int
+	// Offsets at which the current header line and the current message's
+	// content start.
+	lineStart    int64
+	contentStart int64
 }
 
-func newResponseParser(id string) *responseParser {
-	return &responseParser{
-		headers: make(map[string]string),
-		id:      id,
+func newMessageParser() *messageParser {
+	return &messageParser{
+		headers:     make(map[string]string),
+		invalidUTF8: InvalidUTF8Reject,
 	}
 }
 
-func (lrp *responseParser) getContentLength() int {
-	for k, v := range lrp.headers {
-		if strings.ToLower(k) != "content-length" {
-			continue
+func (mp *messageParser) log() *slog.Logger {
+	if mp.logger != nil {
+		return mp.logger
+	}
+	return slog.Default()
+}
+
+func (mp *messageParser) fail(offset int64, reason string, args ...any) error {
+	line := mp.line + 1
+	if mp.parsedHeaders {
+		line = 0
+	}
+
+	mp.err = &FrameError{
+		Offset:  offset,
+		Message: mp.messages,
+		Line:    line,
+		Reason:  fmt.Sprintf(reason, args...),
+	}
+	return mp.err
+}
+
+// pop returns all messages parsed so far.
+func (mp *messageParser) pop() ([]*incomingMessage, error) {
+	msgs := mp.parsed
+	mp.parsed = nil
+	return msgs, mp.err
+}
+
+func (mp *messageParser) reset() {
+	if mp.current.Cap() > maxPooledBuffer {
+		// Release the memory used by a large message.
+		mp.current = bytes.Buffer{}
+	}
+	mp.current.Reset()
+	mp.headers = make(map[string]string)
+	mp.parsedHeaders = false
+	mp.contentLength = 0
+	mp.line = 0
+}
+
+// parseHeaderLine parses a complete header line (without its line
+// terminator). An empty line ends the header block.
+func (mp *messageParser) parseHeaderLine() error {
+	line := strings.TrimSuffix(mp.current.String(), "\r")
+	mp.current.Reset()
+
+	start := mp.lineStart
+	mp.lineStart = mp.offset + 1
+
+	if line == "" {
+		if len(mp.headers) == 0 {
+			// Tolerate empty lines between messages.
+			return nil
 		}
 
-		n, err := strconv.Atoi(v)
-		if err != nil {
-			return noContentLength
+		value, ok := HeaderValue(mp.headers, "Content-Length")
+		if !ok {
+			return mp.fail(start, "missing Content-Length header")
 		}
-		return n
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return mp.fail(start, "invalid Content-Length: %q", value)
+		}
+
+		mp.parsedHeaders = true
+		mp.contentLength = n
+		// The content is received in full before being parsed, so
+		// its buffer is allocated at once (up to a limit, in case the
+		// length is bogus).
+		mp.current.Grow(min(n, maxContentPrealloc))
+		mp.contentStart = mp.offset + 1
+		return nil
 	}
 
-	return noContentLength
-}
+	k, v, ok := strings.Cut(line, ":")
+	if !ok {
+		return mp.fail(start, "header line without a colon: %q", truncate(line, 80))
+	}
+	k = strings.TrimSpace(k)
+	if k == "" {
+		return mp.fail(start, "header with empty name")
+	}
 
-func (lrp *responseParser) write(data []byte) (*Response, error) {
-	lrp.received.Write(data)
+	key, found := headerKey(mp.headers, k)
+	if found && strings.EqualFold(k, "Content-Length") {
+		return mp.fail(start, "duplicate Content-Length header")
+	}
+	mp.headers[key] = strings.TrimSpace(v)
+	mp.line++
+	return nil
+}
 
-	receivedBytes := lrp.received.Bytes()
-	for ; lrp.i < len(receivedBytes); lrp.i++ {
-		c := receivedBytes[lrp.i]
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
 
-		if lrp.parsedHeaders {
-			lrp.current.WriteByte(c)
+// finish parses the content of the current message, once it has been
+// received completely.
+func (mp *messageParser) finish() error {
+	data := mp.current.Bytes()
+	encoding := contentEncoding(mp.headers)
+	compressed := encoding != "" && encoding != "identity"
+	if compressed {
+		if encoding != mp.compression {
+			return mp.fail(mp.contentStart, "unsupported Content-Encoding: %q", encoding)
+		}
+		var err error
+		data, err = decompress(data, encoding)
+		if err != nil {
+			return mp.fail(mp.contentStart, "%v", err)
+		}
+	}
 
-			if lrp.current.Len() == lrp.contentLength {
-				if lrp.i < len(receivedBytes)-1 {
-					return nil, fmt.Errorf("received content exceeded content-length")
-				}
+	charset := contentCharset(mp.headers)
+	content, err := decodeCharset(data, charset)
+	if err != nil {
+		return mp.fail(mp.contentStart, "%v", err)
+	}
 
-				var resp Response
-				err := json.Unmarshal(lrp.current.Bytes(), &resp)
-				if err != nil {
-					return nil, fmt.Errorf("unable to json unmarshal response content")
-				}
-				resp.Headers = lrp.headers
-				return &resp, nil
+	var invalid *FrameError
+	if i := invalidUTF8Offset(content); i >= 0 {
+		if mp.invalidUTF8 == InvalidUTF8Replace {
+			content = bytes.ToValidUTF8(content, []byte("\uFFFD"))
+		} else {
+			invalid = &FrameError{
+				Offset:  mp.contentStart + int64(i),
+				Message: mp.messages,
+				Reason:  "invalid UTF-8 in message content",
 			}
-		} else if c == '\n' && lrp.last == '\r' {
-			if lrp.current.Len() == 0 {
-				if len(lrp.headers) == 0 {
-					return nil, fmt.Errorf("did not receive response headers")
-				}
+		}
+	}
 
-				lrp.parsedHeaders = true
+	var msg incomingMessage
+	err = json.Unmarshal(content, &msg)
+	if err != nil {
+		offset := mp.contentStart
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) && !compressed && len(content) == mp.current.Len() {
+			offset += syntaxErr.Offset - 1
+		}
+		return mp.fail(offset, "unable to json unmarshal message content: %v", err)
+	}
+	msg.headers = mp.headers
+	if mp.trace != nil {
+		mp.trace(&msg, content)
+	}
 
-				lrp.contentLength = lrp.getContentLength()
-				if lrp.contentLength == noContentLength {
-					return nil, fmt.Errorf("did not receive a valid content length")
-				}
-			} else {
-				line := lrp.current.String()
-				k, v, _ := strings.Cut(line, ": ")
-				if k == "" {
-					return nil, fmt.Errorf("received header with empty name")
-				}
+	mp.messages++
+	mp.lineStart = mp.offset
+	mp.reset()
+
+	if invalid != nil {
+		mp.log().Warn("rejected LSP server message", "err", invalid)
+		if msg.Method != "" || msg.Id == nil {
+			// Notifications and requests are dropped.
+			return nil
+		}
+		msg.Result = nil
+		msg.Error = &ResponseError{Code: CodeParseError, Message: invalid.Error()}
+	}
+
+	mp.parsed = append(mp.parsed, &msg)
+	return nil
+}
+
+func (mp *messageParser) write(data []byte) error {
+	if mp.err != nil {
+		return mp.err
+	}
+
+	for len(data) > 0 {
+		if mp.parsedHeaders {
+			// Copy as much of the content as possible at once.
+			n := min(mp.contentLength-mp.current.Len(), len(data))
+			mp.current.Write(data[:n])
+			data = data[n:]
+			mp.offset += int64(n)
 
-				lrp.headers[k] = v
-				lrp.current.Reset()
+			if mp.current.Len() == mp.contentLength {
+				err := mp.finish()
+				if err != nil {
+					return err
+				}
 			}
-		} else if c != '\r' && c != '\n' {
-			lrp.current.WriteByte(c)
+			continue
 		}
 
-		lrp.last = c
+		c := data[0]
+		if c == '\n' {
+			// Lines should end with \r\n, but a bare \n is tolerated.
+			if err := mp.parseHeaderLine(); err != nil {
+				return err
+			}
+		} else {
+			if mp.current.Len() >= maxHeaderLineLength {
+				return mp.fail(mp.lineStart, "header line exceeds %v bytes", maxHeaderLineLength)
+			}
+			mp.current.WriteByte(c)
+		}
+		data = data[1:]
+		mp.offset++
 	}
 
-	return nil, nil
+	return nil
 }
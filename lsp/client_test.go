@@ -0,0 +1,301 @@
+package lsp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testServer is the LSP server end of a session's connection. The
+// messages it receives are handed to the test, which answers them.
+type testServer struct {
+	conn     net.Conn
+	messages chan *incomingMessage
+}
+
+// newTestClient returns a client connected to a testServer.
+func newTestClient(t *testing.T) (*Client, *testServer) {
+	t.Helper()
+	local, remote := net.Pipe()
+	ts := &testServer{conn: remote, messages: make(chan *incomingMessage, 100)}
+	go ts.readLoop()
+
+	s, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.conn = &benchConn{conn: local}
+	s.session = newSession(s, s.conn, newMessageParser())
+	t.Cleanup(func() {
+		s.session.close()
+		remote.Close()
+	})
+	return NewClient(s), ts
+}
+
+func (ts *testServer) readLoop() {
+	defer close(ts.messages)
+	mp := newMessageParser()
+	buf := make([]byte, 4096)
+	for {
+		n, err := ts.conn.Read(buf)
+		if err != nil {
+			return
+		}
+		if mp.write(buf[:n]) != nil {
+			return
+		}
+		msgs, _ := mp.pop()
+		for _, msg := range msgs {
+			ts.messages <- msg
+		}
+	}
+}
+
+// receive returns the next message received by the server, or nil if
+// none is received in time. It may be called from any goroutine.
+func (ts *testServer) receive(t *testing.T) *incomingMessage {
+	t.Helper()
+	select {
+	case msg, ok := <-ts.messages:
+		if !ok {
+			t.Error("connection closed")
+		}
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Error("timed out waiting for a message")
+	}
+	return nil
+}
+
+// reply answers the request msg with its own params as result.
+func (ts *testServer) reply(t *testing.T, msg *incomingMessage) {
+	t.Helper()
+	if msg == nil {
+		return
+	}
+	params, err := json.Marshal(msg.Params)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	_, err = ts.conn.Write(benchFrame(msg.id(), string(params)))
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+// echoParams are the params of the requests answered by testServer.reply,
+// with text of different sizes so that mixing up pooled buffers would
+// corrupt them.
+type echoParams struct {
+	N    int    `json:"n"`
+	Text string `json:"text"`
+}
+
+func newEchoParams(n int) echoParams {
+	return echoParams{N: n, Text: strings.Repeat(fmt.Sprint(n%10), n*97%5000)}
+}
+
+// checkEcho checks that resp is the answer to the request with id and
+// params.
+func checkEcho(t *testing.T, resp *Response, id string, params echoParams) {
+	t.Helper()
+	if resp.Id != id {
+		t.Errorf("expected response ID %q, got %q", id, resp.Id)
+	}
+	if resp.Error != nil {
+		t.Errorf("unexpected error: %v", resp.Error)
+		return
+	}
+	raw, ok := resp.Result.(json.RawMessage)
+	if !ok {
+		t.Errorf("unexpected result type %T", resp.Result)
+		return
+	}
+	var got echoParams
+	err := json.Unmarshal(raw, &got)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if got != params {
+		t.Errorf("request %v got the response of request %v", params.N, got.N)
+	}
+}
+
+func TestClientConcurrentCalls(t *testing.T) {
+	client, ts := newTestClient(t)
+	const calls = 50
+
+	// Answer in the order received, checking that every request is
+	// written with its own wire ID.
+	go func() {
+		seen := map[string]bool{}
+		for i := 0; i < calls; i++ {
+			msg := ts.receive(t)
+			if msg == nil {
+				return
+			}
+			if seen[msg.id()] {
+				t.Errorf("wire ID %v used twice", msg.id())
+			}
+			seen[msg.id()] = true
+			ts.reply(t, msg)
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < calls; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			params := newEchoParams(i)
+			// Half of the requests share the same ID, as those of
+			// different HTTP clients may.
+			id := "shared"
+			if i%2 == 0 {
+				id = fmt.Sprint(i)
+			}
+			resp, err := client.Send(&Message{Id: id, Method: "test/echo", Params: params})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			checkEcho(t, resp, id, params)
+		}()
+	}
+	wg.Wait()
+}
+
+func TestClientOutOfOrderResponses(t *testing.T) {
+	client, ts := newTestClient(t)
+	const calls = 10
+
+	// Answer once all requests have been received, in reverse order.
+	go func() {
+		var msgs []*incomingMessage
+		for i := 0; i < calls; i++ {
+			msg := ts.receive(t)
+			if msg == nil {
+				return
+			}
+			msgs = append(msgs, msg)
+		}
+		for i := len(msgs) - 1; i >= 0; i-- {
+			ts.reply(t, msgs[i])
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < calls; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			params := newEchoParams(i)
+			id := fmt.Sprint(i)
+			resp, err := client.Send(&Message{Id: id, Method: "test/echo", Params: params})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			checkEcho(t, resp, id, params)
+		}()
+	}
+	wg.Wait()
+}
+
+func TestClientCancel(t *testing.T) {
+	client, ts := newTestClient(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		_, err := client.SendContext(ctx, &Message{Id: "1", Method: "test/slow", Params: newEchoParams(1)})
+		errs <- err
+	}()
+
+	slow := ts.receive(t)
+	if slow == nil {
+		t.FailNow()
+	}
+	cancel()
+	select {
+	case err := <-errs:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected context.Canceled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("SendContext did not return once cancelled")
+	}
+
+	msg := ts.receive(t)
+	if msg == nil {
+		t.FailNow()
+	}
+	if msg.Method != "$/cancelRequest" {
+		t.Fatalf("expected $/cancelRequest, got %v", msg.Method)
+	}
+	params, _ := msg.Params.(map[string]any)
+	if id := fmt.Sprint(params["id"]); id != slow.id() {
+		t.Errorf("expected cancellation of wire ID %v, got %v", slow.id(), id)
+	}
+
+	// The late response is discarded, and doesn't reach the next call
+	// with the same ID.
+	ts.reply(t, slow)
+	go func() {
+		ts.reply(t, ts.receive(t))
+	}()
+	params2 := newEchoParams(2)
+	resp, err := client.Send(&Message{Id: "1", Method: "test/echo", Params: params2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEcho(t, resp, "1", params2)
+}
+
+func TestClientCancelRequestNotification(t *testing.T) {
+	client, ts := newTestClient(t)
+
+	go client.Send(&Message{Id: "client-7", Method: "test/slow"})
+	slow := ts.receive(t)
+	if slow == nil {
+		t.FailNow()
+	}
+
+	// A $/cancelRequest sent with the request's ID is written with its
+	// wire ID.
+	_, err := client.Send(&Message{Method: "$/cancelRequest", Params: map[string]any{"id": "client-7"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := ts.receive(t)
+	if msg == nil {
+		t.FailNow()
+	}
+	params, _ := msg.Params.(map[string]any)
+	if id := fmt.Sprint(params["id"]); msg.Method != "$/cancelRequest" || id != slow.id() {
+		t.Errorf("expected cancellation of wire ID %v, got %v %v", slow.id(), msg.Method, id)
+	}
+
+	// It is not written at all for requests which are not pending.
+	_, err = client.Send(&Message{Method: "$/cancelRequest", Params: map[string]any{"id": "unknown"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.reply(t, slow)
+	select {
+	case msg, ok := <-ts.messages:
+		if ok {
+			t.Errorf("unexpected message %v", msg.Method)
+		}
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,123 @@
+package lsp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Encodings which may be used to compress message content on the wire.
+// Compression is not part of the LSP specification, and is only used with
+// servers which announce support for it (see Server.SetCompression).
+const (
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+// Content smaller than this is always sent uncompressed, as compressing it
+// would save little or nothing.
+const minCompressedContent = 1024
+
+// Maximum size of decompressed message content, so that a small compressed
+// message can't exhaust the memory of the proxy.
+const maxDecompressedContent = 256 * 1024 * 1024
+
+// ValidCompression reports whether encoding is a known wire compression
+// encoding.
+func ValidCompression(encoding string) bool {
+	return encoding == CompressionGzip || encoding == CompressionZstd
+}
+
+// acceptsEncoding reports whether an Accept-Encoding header lists
+// encoding.
+func acceptsEncoding(headers map[string]string, encoding string) bool {
+	value, ok := HeaderValue(headers, "Accept-Encoding")
+	if !ok {
+		return false
+	}
+	for _, item := range strings.Split(value, ",") {
+		name, _, _ := strings.Cut(item, ";")
+		if strings.EqualFold(strings.TrimSpace(name), encoding) {
+			return true
+		}
+	}
+	return false
+}
+
+// contentEncoding returns the (lowercase) value of the Content-Encoding
+// header, if any.
+func contentEncoding(headers map[string]string) string {
+	value, _ := HeaderValue(headers, "Content-Encoding")
+	return strings.ToLower(strings.TrimSpace(value))
+}
+
+var gzipWriters = sync.Pool{
+	New: func() any {
+		return gzip.NewWriter(nil)
+	},
+}
+
+var zstdEncoder = sync.OnceValue(func() *zstd.Encoder {
+	enc, _ := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest))
+	return enc
+})
+
+var zstdDecoder = sync.OnceValue(func() *zstd.Decoder {
+	dec, _ := zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxDecompressedContent))
+	return dec
+})
+
+// compress writes data compressed with encoding to buf.
+func compress(buf *bytes.Buffer, data []byte, encoding string) error {
+	switch encoding {
+	case CompressionGzip:
+		w := gzipWriters.Get().(*gzip.Writer)
+		defer gzipWriters.Put(w)
+		w.Reset(buf)
+		_, err := w.Write(data)
+		if err != nil {
+			return err
+		}
+		return w.Close()
+	case CompressionZstd:
+		buf.Write(zstdEncoder().EncodeAll(data, nil))
+		return nil
+	default:
+		return fmt.Errorf("unsupported content encoding: %q", encoding)
+	}
+}
+
+// decompress returns data decompressed with encoding.
+func decompress(data []byte, encoding string) ([]byte, error) {
+	switch encoding {
+	case CompressionGzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzip content: %w", err)
+		}
+		content, err := io.ReadAll(io.LimitReader(r, maxDecompressedContent+1))
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzip content: %w", err)
+		}
+		if len(content) > maxDecompressedContent {
+			return nil, fmt.Errorf("decompressed content exceeds %v bytes", maxDecompressedContent)
+		}
+		return content, nil
+	case CompressionZstd:
+		content, err := zstdDecoder().DecodeAll(data, nil)
+		if errors.Is(err, zstd.ErrDecoderSizeExceeded) || errors.Is(err, zstd.ErrWindowSizeExceeded) {
+			return nil, fmt.Errorf("decompressed content exceeds %v bytes", maxDecompressedContent)
+		} else if err != nil {
+			return nil, fmt.Errorf("invalid zstd content: %w", err)
+		}
+		return content, nil
+	default:
+		return nil, fmt.Errorf("unsupported content encoding: %q", encoding)
+	}
+}
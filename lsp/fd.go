@@ -0,0 +1,116 @@
+package lsp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Prefix of connection methods using file descriptors inherited from the
+// parent process, e.g. "fd:3,4" to write the server's input to descriptor
+// 3 and read its output from descriptor 4, or "fd:3" for a single
+// bidirectional descriptor such as a socket.
+const fdConnectPrefix = "fd:"
+
+// isFDConnect reports whether a connection method uses inherited file
+// descriptors.
+func isFDConnect(method string) bool {
+	return strings.HasPrefix(method, fdConnectPrefix)
+}
+
+// serverConnFD is a connection through inherited file descriptors. They
+// can't be reopened once closed, so the connection can't be reestablished.
+type serverConnFD struct {
+	// The server's input and output, which are the same file for a
+	// bidirectional descriptor.
+	input  *os.File
+	output *os.File
+}
+
+// Inherited file descriptors already used by a connection. Once closed,
+// their numbers may be reused for other files, so they can't be used
+// again.
+var (
+	usedFDsMutex sync.Mutex
+	usedFDs      = make(map[int]bool)
+)
+
+// openFD returns the inherited file descriptor fd as a file, making it
+// non-blocking so that reads are interrupted when it is closed.
+func openFD(fd int) (*os.File, error) {
+	usedFDsMutex.Lock()
+	defer usedFDsMutex.Unlock()
+	if usedFDs[fd] {
+		return nil, fmt.Errorf("file descriptor %v has already been used, and can't be reconnected to", fd)
+	}
+
+	var stat syscall.Stat_t
+	err := syscall.Fstat(fd, &stat)
+	if err != nil {
+		return nil, fmt.Errorf("file descriptor %v is not open: %w", fd, err)
+	}
+	err = syscall.SetNonblock(fd, true)
+	if err != nil {
+		return nil, fmt.Errorf("unable to use file descriptor %v: %w", fd, err)
+	}
+	usedFDs[fd] = true
+	return os.NewFile(uintptr(fd), fmt.Sprintf("fd%v", fd)), nil
+}
+
+func newServerConnFD(method string) (*serverConnFD, error) {
+	spec := strings.TrimPrefix(method, fdConnectPrefix)
+	var fds []int
+	for _, part := range strings.Split(spec, ",") {
+		fd, err := strconv.Atoi(part)
+		// Descriptors 0 to 2 are hyperlsp's own standard streams.
+		if err != nil || fd < 3 {
+			return nil, fmt.Errorf("invalid file descriptor connection: %q, expected fd:input,output or fd:n (n >= 3)", method)
+		}
+		fds = append(fds, fd)
+	}
+	if len(fds) > 2 {
+		return nil, fmt.Errorf("invalid file descriptor connection: %q, expected fd:input,output or fd:n (n >= 3)", method)
+	}
+
+	input, err := openFD(fds[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(fds) == 1 || fds[1] == fds[0] {
+		return &serverConnFD{input: input, output: input}, nil
+	}
+
+	output, err := openFD(fds[1])
+	if err != nil {
+		return nil, err
+	}
+	return &serverConnFD{input: input, output: output}, nil
+}
+
+func (c *serverConnFD) read(p []byte) (int, error) {
+	n, err := c.output.Read(p)
+	if errors.Is(err, os.ErrClosed) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (c *serverConnFD) readErr(p []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (c *serverConnFD) write(p []byte) (int, error) {
+	return c.input.Write(p)
+}
+
+func (c *serverConnFD) close() error {
+	if c.output == c.input {
+		return c.input.Close()
+	}
+	return errors.Join(c.input.Close(), c.output.Close())
+}
@@ -0,0 +1,70 @@
+package lsp
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ResourceLimits restricts the resources available to a subprocess LSP
+// server. Zero values mean no limit.
+type ResourceLimits struct {
+	// Maximum memory in bytes. Applied as RLIMIT_AS (virtual memory), and
+	// as memory.max when a cgroup is used.
+	Memory uint64
+	// Maximum CPU time, applied as RLIMIT_CPU.
+	CPUTime time.Duration
+	// Parent cgroup (v2) directory. If set, a child cgroup is created for
+	// the server process.
+	Cgroup string
+	// Maximum number of CPUs the server may use, applied as cpu.max.
+	// Requires Cgroup.
+	CPUQuota float64
+}
+
+func (l ResourceLimits) empty() bool {
+	return l == ResourceLimits{}
+}
+
+// ParseSize parses a size in bytes with an optional K, M or G suffix
+// (powers of 1024), for example "512M".
+func ParseSize(s string) (uint64, error) {
+	mult := uint64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		mult = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		mult = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		mult = 1 << 30
+	}
+	if mult != 1 {
+		s = s[:len(s)-1]
+	}
+
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size: %v", s)
+	}
+	if n > math.MaxUint64/mult {
+		return 0, fmt.Errorf("size is too large: %v", s)
+	}
+	return n * mult, nil
+}
+
+// ExitInfo describes how the LSP server subprocess exited.
+type ExitInfo struct {
+	Time time.Time `json:"time"`
+	// Exit code, or -1 if the process was terminated by a signal.
+	Code   int    `json:"code"`
+	Signal string `json:"signal,omitempty"`
+	// Set if the process was killed for running out of memory, as reported
+	// by its cgroup.
+	OOM bool `json:"oom"`
+	// Set if the exit was requested by hyperlsp itself.
+	Expected bool `json:"expected"`
+	// Last lines written by the process to stderr, if captured.
+	Stderr []string `json:"stderr,omitempty"`
+}
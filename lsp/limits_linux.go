@@ -0,0 +1,105 @@
+//go:build linux
+
+package lsp
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+)
+
+const cgroupCPUPeriod = 100000
+
+// cgroupID numbers the cgroups created by this process.
+var cgroupID atomic.Uint64
+
+// cgroupCommand creates a cgroup for the process started by cmd, if
+// limits.Cgroup is set, and changes cmd so that the process is created
+// directly in it. It returns the path of the cgroup and a function to call
+// once cmd has been started.
+func cgroupCommand(cmd *exec.Cmd, limits ResourceLimits) (string, func(), error) {
+	if limits.Cgroup == "" {
+		if limits.CPUQuota > 0 {
+			return "", nil, fmt.Errorf("a CPU quota requires a cgroup")
+		}
+		return "", func() {}, nil
+	}
+
+	dir := filepath.Join(limits.Cgroup, fmt.Sprintf("hyperlsp-%v-%v", os.Getpid(), cgroupID.Add(1)))
+	err := os.Mkdir(dir, 0o755)
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to create cgroup: %w", err)
+	}
+
+	files := map[string]string{}
+	if limits.Memory > 0 {
+		files["memory.max"] = strconv.FormatUint(limits.Memory, 10)
+	}
+	if limits.CPUQuota > 0 {
+		files["cpu.max"] = fmt.Sprintf("%v %v", int(limits.CPUQuota*cgroupCPUPeriod), cgroupCPUPeriod)
+	}
+
+	for _, name := range []string{"memory.max", "cpu.max"} {
+		value, ok := files[name]
+		if !ok {
+			continue
+		}
+		err := os.WriteFile(filepath.Join(dir, name), []byte(value), 0o644)
+		if err != nil {
+			os.Remove(dir)
+			return "", nil, fmt.Errorf("unable to write %v: %w", name, err)
+		}
+	}
+
+	f, err := os.Open(dir)
+	if err != nil {
+		os.Remove(dir)
+		return "", nil, fmt.Errorf("unable to open cgroup: %w", err)
+	}
+
+	// The process is cloned into the cgroup, so that it never runs outside
+	// of it. SysProcAttr may be shared with other commands, so it is copied.
+	attr := syscall.SysProcAttr{}
+	if cmd.SysProcAttr != nil {
+		attr = *cmd.SysProcAttr
+	}
+	attr.UseCgroupFD = true
+	attr.CgroupFD = int(f.Fd())
+	cmd.SysProcAttr = &attr
+
+	return dir, func() { f.Close() }, nil
+}
+
+// cgroupOOMKills returns the number of processes killed by the OOM killer
+// in the cgroup.
+func cgroupOOMKills(dir string) int {
+	data, err := os.ReadFile(filepath.Join(dir, "memory.events"))
+	if err != nil {
+		return 0
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		k, v, _ := strings.Cut(scanner.Text(), " ")
+		if k == "oom_kill" {
+			n, _ := strconv.Atoi(v)
+			return n
+		}
+	}
+	return 0
+}
+
+// removeCgroup removes a cgroup created by cgroupCommand, once its process
+// has exited.
+func removeCgroup(dir string) {
+	if dir != "" {
+		os.Remove(dir)
+	}
+}
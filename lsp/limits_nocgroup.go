@@ -0,0 +1,21 @@
+//go:build unix && !linux
+
+package lsp
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+func cgroupCommand(cmd *exec.Cmd, limits ResourceLimits) (string, func(), error) {
+	if limits.Cgroup != "" || limits.CPUQuota > 0 {
+		return "", nil, fmt.Errorf("cgroups are only supported on Linux")
+	}
+	return "", func() {}, nil
+}
+
+func cgroupOOMKills(dir string) int {
+	return 0
+}
+
+func removeCgroup(dir string) {}
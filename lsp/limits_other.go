@@ -0,0 +1,30 @@
+//go:build !unix
+
+package lsp
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// ExecLimitedCommand is the hidden subcommand with which hyperlsp
+// re-executes itself to start an LSP server subprocess with memory or CPU
+// time limits. It is not supported on this platform.
+const ExecLimitedCommand = "exec-limited"
+
+func prepareLimits(cmd *exec.Cmd, limits ResourceLimits) (string, func(), error) {
+	return "", nil, fmt.Errorf("resource limits are only supported on Unix")
+}
+
+// ExecLimited is not supported on this platform.
+func ExecLimited(args []string) int {
+	fmt.Fprintln(os.Stderr, "resource limits are only supported on Unix")
+	return 1
+}
+
+func cgroupOOMKills(dir string) int {
+	return 0
+}
+
+func removeCgroup(dir string) {}
@@ -0,0 +1,106 @@
+//go:build unix
+
+package lsp
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// ExecLimitedCommand is the hidden subcommand with which hyperlsp
+// re-executes itself to start an LSP server subprocess with memory or CPU
+// time limits (see ExecLimited).
+const ExecLimitedCommand = "exec-limited"
+
+// prepareLimits changes cmd so that the process it starts is subject to
+// limits from its first instruction: the rlimits are set by re-executing
+// the current program as a wrapper (see ExecLimited), and on Linux the
+// process is created directly in its cgroup. It returns the path of the
+// cgroup, if any, and a function to call once cmd has been started, which
+// restores its program and arguments.
+func prepareLimits(cmd *exec.Cmd, limits ResourceLimits) (string, func(), error) {
+	path, args, attr := cmd.Path, cmd.Args, cmd.SysProcAttr
+	restore := func() {
+		cmd.Path, cmd.Args, cmd.SysProcAttr = path, args, attr
+	}
+
+	if limits.Memory > 0 || limits.CPUTime > 0 {
+		self, err := os.Executable()
+		if err != nil {
+			return "", nil, fmt.Errorf("unable to find hyperlsp executable: %w", err)
+		}
+		secs := uint64(limits.CPUTime.Seconds())
+		cmd.Path = self
+		cmd.Args = append([]string{self, ExecLimitedCommand, strconv.FormatUint(limits.Memory, 10), strconv.FormatUint(secs, 10), path}, args...)
+	}
+
+	cgroup, closeCgroup, err := cgroupCommand(cmd, limits)
+	if err != nil {
+		restore()
+		return "", nil, err
+	}
+	return cgroup, func() {
+		closeCgroup()
+		restore()
+	}, nil
+}
+
+// ExecLimited sets the memory and CPU time limits given in args, and
+// replaces the current process with the program and arguments in the rest
+// of args. It must be called by the main package before doing anything
+// else when run as ExecLimitedCommand. It only returns on failure, with
+// the exit code to use.
+func ExecLimited(args []string) int {
+	if len(args) < 4 {
+		fmt.Fprintf(os.Stderr, "usage: %v <memory> <cpu-seconds> <path> <argv...>\n", ExecLimitedCommand)
+		return 2
+	}
+
+	memory, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid memory limit: %v\n", args[0])
+		return 2
+	}
+	secs, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid CPU time limit: %v\n", args[1])
+		return 2
+	}
+
+	if memory > 0 {
+		err := setrlimit(rlimitMemory, memory, memory)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to set memory limit: %v\n", err)
+			return 1
+		}
+	}
+	if secs > 0 {
+		// Send SIGXCPU at the soft limit, SIGKILL a bit later.
+		err := setrlimit(unix.RLIMIT_CPU, secs, secs+5)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to set CPU time limit: %v\n", err)
+			return 1
+		}
+	}
+
+	err = unix.Exec(args[2], args[3:], os.Environ())
+	fmt.Fprintf(os.Stderr, "unable to run LSP server: %v\n", err)
+	return 1
+}
+
+func setrlimit(resource int, cur, max uint64) error {
+	var lim unix.Rlimit
+	lim.Cur = rlimitValue(lim.Cur, cur)
+	lim.Max = rlimitValue(lim.Max, max)
+	return unix.Setrlimit(resource, &lim)
+}
+
+// rlimitValue converts v to the type of the Rlimit fields, which is signed
+// on some platforms.
+func rlimitValue[T int64 | uint64](_ T, v uint64) T {
+	return T(v)
+}
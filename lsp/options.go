@@ -0,0 +1,243 @@
+package lsp
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// serverBuilder holds the configuration of a server being created by
+// NewServer, as the subprocess's command is only created once all options
+// have been applied.
+type serverBuilder struct {
+	s       *Server
+	command []string
+	env     []string
+	dir     string
+}
+
+// Option configures a Server created with NewServer.
+type Option func(b *serverBuilder) error
+
+// NewServer creates an LSP server configured with opts, which is connected
+// to with Server.Connect. With WithCommand, the server is a subprocess
+// started when connecting; otherwise, it is an external server.
+func NewServer(opts ...Option) (*Server, error) {
+	b := &serverBuilder{
+		s: &Server{
+			mutex:          &sync.Mutex{},
+			invalidUTF8:    InvalidUTF8Reject,
+			tcp:            TCPOptions{NoDelay: true},
+			readBufferSize: DefaultReadBufferSize,
+			usageInterval:  DefaultUsageInterval,
+		},
+	}
+	for _, opt := range opts {
+		err := opt(b)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(b.command) == 0 {
+		if b.env != nil || b.dir != "" {
+			return nil, fmt.Errorf("environment and working directory require a command")
+		}
+		return b.s, nil
+	}
+
+	cmd := exec.Command(b.command[0], b.command[1:]...)
+	cmd.Env = b.env
+	cmd.Dir = b.dir
+	// Prevent Ctrl-C from killing LSP server in Linux.
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setpgid: true,
+	}
+	b.s.cmd = cmd
+	return b.s, nil
+}
+
+// WithCommand runs the LSP server as a subprocess, with the specified
+// command and arguments.
+func WithCommand(name string, arg ...string) Option {
+	return func(b *serverBuilder) error {
+		if name == "" {
+			return fmt.Errorf("empty LSP server command")
+		}
+		b.command = append([]string{name}, arg...)
+		return nil
+	}
+}
+
+// WithEnv sets the environment of the subprocess, as "key=value" strings.
+// By default, it inherits hyperlsp's environment.
+func WithEnv(env []string) Option {
+	return func(b *serverBuilder) error {
+		b.env = env
+		return nil
+	}
+}
+
+// WithDir sets the working directory of the subprocess.
+func WithDir(dir string) Option {
+	return func(b *serverBuilder) error {
+		b.dir = dir
+		return nil
+	}
+}
+
+// WithConnect sets the connection method used by Server.Connect when
+// called with an empty method (see Server.Connect). By default, it is
+// ServerConnectStdio for subprocesses.
+func WithConnect(method string) Option {
+	return func(b *serverBuilder) error {
+		b.s.method = method
+		return nil
+	}
+}
+
+// WithTCPOptions sets the options used when connecting over TCP (see
+// Server.SetTCPOptions).
+func WithTCPOptions(opts TCPOptions) Option {
+	return func(b *serverBuilder) error {
+		b.s.tcp = opts
+		return nil
+	}
+}
+
+// WithTimeouts sets the read and write timeouts of TCP connections (see
+// TCPOptions), keeping their other options.
+func WithTimeouts(read, write time.Duration) Option {
+	return func(b *serverBuilder) error {
+		if read < 0 || write < 0 {
+			return fmt.Errorf("invalid timeouts: %v, %v", read, write)
+		}
+		b.s.tcp.ReadTimeout = read
+		b.s.tcp.WriteTimeout = write
+		return nil
+	}
+}
+
+// WithReadBufferSize sets the size of the buffer used to read from the LSP
+// server (see Server.SetReadBufferSize).
+func WithReadBufferSize(size int) Option {
+	return func(b *serverBuilder) error {
+		if size <= 0 {
+			return fmt.Errorf("invalid read buffer size: %v", size)
+		}
+		b.s.readBufferSize = size
+		return nil
+	}
+}
+
+// WithCompression enables compression of message content (see
+// Server.SetCompression).
+func WithCompression(encoding string) Option {
+	return func(b *serverBuilder) error {
+		if !ValidCompression(encoding) {
+			return fmt.Errorf("invalid wire compression: %v", encoding)
+		}
+		b.s.compression = encoding
+		return nil
+	}
+}
+
+// WithInvalidUTF8Policy sets how messages received with invalid UTF-8
+// content are handled (see Server.SetInvalidUTF8Policy).
+func WithInvalidUTF8Policy(policy string) Option {
+	return func(b *serverBuilder) error {
+		if !ValidInvalidUTF8Policy(policy) {
+			return fmt.Errorf("invalid UTF-8 policy: %v", policy)
+		}
+		b.s.invalidUTF8 = policy
+		return nil
+	}
+}
+
+// WithHeaders sets additional wire headers to send with every message (see
+// Server.SetHeaders).
+func WithHeaders(headers map[string]string) Option {
+	return func(b *serverBuilder) error {
+		return b.s.SetHeaders(headers)
+	}
+}
+
+// WithResourceLimits sets the limits applied to the subprocess (see
+// Server.SetResourceLimits).
+func WithResourceLimits(limits ResourceLimits) Option {
+	return func(b *serverBuilder) error {
+		b.s.limits = limits
+		return nil
+	}
+}
+
+// WithUsageInterval sets the interval between samples of the subprocess's
+// resource usage (see Server.SetUsageInterval).
+func WithUsageInterval(interval time.Duration) Option {
+	return func(b *serverBuilder) error {
+		if interval < 0 {
+			return fmt.Errorf("invalid usage sampling interval: %v", interval)
+		}
+		b.s.usageInterval = interval
+		return nil
+	}
+}
+
+// WithLogger sets the logger for the server's events, such as its exits
+// and stderr output. By default, slog's default logger is used.
+func WithLogger(logger *slog.Logger) Option {
+	return func(b *serverBuilder) error {
+		b.s.logger = logger
+		return nil
+	}
+}
+
+// WithNotificationHandler sets a function to be called for every
+// notification received from the LSP server (see
+// Server.SetNotificationHandler).
+func WithNotificationHandler(handler func(method string, params any)) Option {
+	return func(b *serverBuilder) error {
+		b.s.onNotification = handler
+		return nil
+	}
+}
+
+// WithRequestHandler sets a function to be called for every request
+// received from the LSP server (see Server.SetRequestHandler).
+func WithRequestHandler(handler func(method string, params any) (any, error)) Option {
+	return func(b *serverBuilder) error {
+		b.s.onRequest = handler
+		return nil
+	}
+}
+
+// WithExitHandler sets a function to be called when the subprocess exits
+// (see Server.SetExitHandler).
+func WithExitHandler(handler func(info ExitInfo)) Option {
+	return func(b *serverBuilder) error {
+		b.s.onExit = handler
+		return nil
+	}
+}
+
+// WithTracer sets a function to be called with the content of every
+// message exchanged with the LSP server (see Server.SetTracer).
+func WithTracer(trace func(ctx context.Context, outgoing bool, data []byte)) Option {
+	return func(b *serverBuilder) error {
+		b.s.trace.Store(&trace)
+		return nil
+	}
+}
+
+// WithStderrHandler sets a function to be called with every line written
+// by the subprocess to its stderr (see Server.SetStderrHandler).
+func WithStderrHandler(handler func(line string)) Option {
+	return func(b *serverBuilder) error {
+		b.s.onStderr.Store(&handler)
+		return nil
+	}
+}
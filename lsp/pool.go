@@ -0,0 +1,31 @@
+package lsp
+
+import (
+	"bytes"
+	"sync"
+)
+
+// Buffers larger than this are not returned to the pool, so that a single
+// large message doesn't keep its memory allocated.
+const maxPooledBuffer = 1024 * 1024
+
+var bufferPool = sync.Pool{
+	New: func() any {
+		return new(bytes.Buffer)
+	},
+}
+
+// getBuffer returns an empty buffer from the pool.
+func getBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+// putBuffer returns a buffer to the pool. Its content must no longer be
+// used.
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBuffer {
+		return
+	}
+	buf.Reset()
+	bufferPool.Put(buf)
+}
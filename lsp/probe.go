@@ -0,0 +1,105 @@
+package lsp
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Method of the request sent by Probe. As it isn't implemented by any
+// server, it is answered right away with an error, without side effects.
+const probeMethod = "$/hyperlsp/ping"
+
+// Probe checks whether the LSP server is alive. For a subprocess, it checks
+// that the process is running (and, where supported, that it isn't stopped);
+// otherwise, it sends a request which the server must answer within timeout,
+// with any result or error.
+func (s *Server) Probe(timeout time.Duration) error {
+	if s.command() != nil {
+		return s.probeProcess()
+	}
+
+	sess, err := s.currentSession()
+	if err != nil {
+		return err
+	}
+	wireID := s.lastWireID.Add(1)
+	frame, err := s.encode(context.Background(), &wireRequest{
+		Jsonrpc: jsonRpcVersion,
+		Id:      wireID,
+		Method:  probeMethod,
+	}, nil, sess.outgoingEncoding())
+	if err != nil {
+		return err
+	}
+	defer putBuffer(frame)
+
+	call, err := sess.register(context.Background(), wireID, "", "", nil)
+	if err != nil {
+		return err
+	}
+	err = sess.send(frame.Bytes())
+	if err != nil {
+		sess.unregister(wireID)
+		return err
+	}
+
+	select {
+	case <-call.done:
+		return call.err
+	case <-time.After(timeout):
+		sess.unregister(wireID)
+		return fmt.Errorf("no response from LSP server within %v", timeout)
+	}
+}
+
+// probeProcess checks that the LSP server subprocess is running.
+func (s *Server) probeProcess() error {
+	s.stateMutex.Lock()
+	exited := s.exited
+	cmd := s.cmd
+	s.stateMutex.Unlock()
+
+	if exited == nil {
+		return fmt.Errorf("LSP server process not started")
+	}
+	select {
+	case <-exited:
+		return fmt.Errorf("LSP server process exited")
+	default:
+	}
+
+	state, err := processState(cmd.Process.Pid)
+	if err != nil {
+		// Either unsupported, or the process has just exited, which is
+		// handled separately.
+		return nil
+	}
+	switch state {
+	case 'T', 't':
+		return fmt.Errorf("LSP server process is stopped")
+	case 'Z', 'X':
+		return fmt.Errorf("LSP server process is defunct")
+	}
+	return nil
+}
+
+// Reconnect closes the connection to an external LSP server and opens a
+// new one. The server is not initialized again.
+func (s *Server) Reconnect() error {
+	if s.command() != nil {
+		return fmt.Errorf("LSP server is a subprocess, it must be restarted instead")
+	}
+
+	s.lock()
+	defer s.unlock()
+
+	if s.session != nil {
+		s.session.close()
+	} else if s.conn != nil {
+		s.conn.close()
+	}
+	s.session = nil
+	s.conn = nil
+	return s.connect()
+}
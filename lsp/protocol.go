@@ -0,0 +1,119 @@
+package lsp
+
+import "strings"
+
+// Subset of the LSP protocol types, used by the proxy when it needs to
+// inspect or build messages itself.
+
+type Position struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type Range struct {
+	Start Position `json:"start"`
+	End   Position `json:"end"`
+}
+
+type Location struct {
+	URI   string `json:"uri"`
+	Range Range  `json:"range"`
+}
+
+type TextDocumentIdentifier struct {
+	URI string `json:"uri"`
+}
+
+type Diagnostic struct {
+	Range    Range  `json:"range"`
+	Severity int    `json:"severity,omitempty"`
+	Code     any    `json:"code,omitempty"`
+	Source   string `json:"source,omitempty"`
+	Message  string `json:"message"`
+}
+
+const (
+	SeverityError       = 1
+	SeverityWarning     = 2
+	SeverityInformation = 3
+	SeverityHint        = 4
+)
+
+// SeverityName returns the lowercase name of a DiagnosticSeverity value.
+func SeverityName(severity int) string {
+	switch severity {
+	case SeverityError:
+		return "error"
+	case SeverityWarning:
+		return "warning"
+	case SeverityInformation:
+		return "information"
+	case SeverityHint:
+		return "hint"
+	default:
+		return "unknown"
+	}
+}
+
+var symbolKinds = []string{
+	"file", "module", "namespace", "package", "class", "method", "property",
+	"field", "constructor", "enum", "interface", "function", "variable",
+	"constant", "string", "number", "boolean", "array", "object", "key",
+	"null", "enumMember", "struct", "event", "operator", "typeParameter",
+}
+
+// SymbolKindName returns the name of a SymbolKind value, as written in the
+// LSP specification (in camel case).
+func SymbolKindName(kind int) string {
+	if kind < 1 || kind > len(symbolKinds) {
+		return "unknown"
+	}
+	return symbolKinds[kind-1]
+}
+
+// SymbolKindByName returns the SymbolKind value with the specified name
+// (case-insensitive), or 0 if there is none.
+func SymbolKindByName(name string) int {
+	for i, k := range symbolKinds {
+		if strings.EqualFold(k, name) {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+type TextEdit struct {
+	Range   Range  `json:"range"`
+	NewText string `json:"newText"`
+}
+
+// Notifications that can be sent by the client to the server.
+var clientNotifications = map[string]bool{
+	"initialized":                         true,
+	"exit":                                true,
+	"textDocument/didOpen":                true,
+	"textDocument/didChange":              true,
+	"textDocument/didClose":               true,
+	"textDocument/didSave":                true,
+	"textDocument/willSave":               true,
+	"notebookDocument/didOpen":            true,
+	"notebookDocument/didChange":          true,
+	"notebookDocument/didSave":            true,
+	"notebookDocument/didClose":           true,
+	"workspace/didChangeConfiguration":    true,
+	"workspace/didChangeWatchedFiles":     true,
+	"workspace/didChangeWorkspaceFolders": true,
+	"workspace/didCreateFiles":            true,
+	"workspace/didRenameFiles":            true,
+	"workspace/didDeleteFiles":            true,
+	"window/workDoneProgress/cancel":      true,
+	"$/cancelRequest":                     true,
+	"$/setTrace":                          true,
+	"$/progress":                          true,
+}
+
+// IsClientNotification reports whether method is a notification sent by
+// the client, as opposed to a request.
+func IsClientNotification(method string) bool {
+	return clientNotifications[method]
+}
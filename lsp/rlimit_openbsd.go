@@ -0,0 +1,6 @@
+package lsp
+
+import "golang.org/x/sys/unix"
+
+// OpenBSD has no RLIMIT_AS, so memory is limited with RLIMIT_DATA.
+const rlimitMemory = unix.RLIMIT_DATA
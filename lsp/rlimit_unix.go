@@ -0,0 +1,7 @@
+//go:build unix && !openbsd
+
+package lsp
+
+import "golang.org/x/sys/unix"
+
+const rlimitMemory = unix.RLIMIT_AS
@@ -0,0 +1,436 @@
+package lsp
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+const specURL = "https://microsoft.github.io/language-server-protocol/specifications/lsp/3.17/specification/"
+
+// schema describes the expected structure of a JSON value, as decoded by
+// encoding/json into an any. Only the parts of the LSP types that servers
+// rely on are described; unknown properties are always allowed.
+type schema struct {
+	// Allowed types: object, array, string, integer, uinteger, number,
+	// boolean or null. Empty means any type.
+	types      []string
+	properties map[string]*schema
+	required   []string
+	items      *schema
+}
+
+func typ(types ...string) *schema {
+	return &schema{types: types}
+}
+
+func object(properties map[string]*schema, required ...string) *schema {
+	return &schema{types: []string{"object"}, properties: properties, required: required}
+}
+
+func array(items *schema) *schema {
+	return &schema{types: []string{"array"}, items: items}
+}
+
+// with returns a copy of an object schema with additional properties.
+func (s *schema) with(properties map[string]*schema, required ...string) *schema {
+	props := make(map[string]*schema)
+	for k, v := range s.properties {
+		props[k] = v
+	}
+	for k, v := range properties {
+		props[k] = v
+	}
+	return object(props, append(append([]string{}, s.required...), required...)...)
+}
+
+var (
+	anyValue       = typ()
+	stringValue    = typ("string")
+	integerValue   = typ("integer")
+	uintegerValue  = typ("uinteger")
+	booleanValue   = typ("boolean")
+	anyObjectValue = typ("object")
+
+	positionSchema = object(map[string]*schema{
+		"line":      uintegerValue,
+		"character": uintegerValue,
+	}, "line", "character")
+
+	rangeSchema = object(map[string]*schema{
+		"start": positionSchema,
+		"end":   positionSchema,
+	}, "start", "end")
+
+	textDocumentIdentifierSchema = object(map[string]*schema{
+		"uri": stringValue,
+	}, "uri")
+
+	versionedTextDocumentIdentifierSchema = textDocumentIdentifierSchema.with(map[string]*schema{
+		"version": integerValue,
+	}, "version")
+
+	textDocumentItemSchema = object(map[string]*schema{
+		"uri":        stringValue,
+		"languageId": stringValue,
+		"version":    integerValue,
+		"text":       stringValue,
+	}, "uri", "languageId", "version", "text")
+
+	textDocumentParamsSchema = object(map[string]*schema{
+		"textDocument": textDocumentIdentifierSchema,
+	}, "textDocument")
+
+	textDocumentPositionParamsSchema = textDocumentParamsSchema.with(map[string]*schema{
+		"position": positionSchema,
+	}, "position")
+
+	textDocumentRangeParamsSchema = textDocumentParamsSchema.with(map[string]*schema{
+		"range": rangeSchema,
+	}, "range")
+
+	formattingOptionsSchema = object(map[string]*schema{
+		"tabSize":      uintegerValue,
+		"insertSpaces": booleanValue,
+	}, "tabSize", "insertSpaces")
+
+	callHierarchyCallsSchema = object(map[string]*schema{
+		"item": object(map[string]*schema{
+			"name":           stringValue,
+			"kind":           integerValue,
+			"uri":            stringValue,
+			"range":          rangeSchema,
+			"selectionRange": rangeSchema,
+		}, "name", "kind", "uri", "range", "selectionRange"),
+	}, "item")
+)
+
+// paramSchemas contains the schemas of the params of the methods that can
+// be validated.
+var paramSchemas = map[string]*schema{
+	"initialize": object(map[string]*schema{
+		"processId":    typ("integer", "null"),
+		"rootUri":      typ("string", "null"),
+		"capabilities": anyObjectValue,
+	}, "processId", "capabilities"),
+	"initialized": anyObjectValue,
+
+	"textDocument/didOpen": object(map[string]*schema{
+		"textDocument": textDocumentItemSchema,
+	}, "textDocument"),
+	"textDocument/didChange": object(map[string]*schema{
+		"textDocument": versionedTextDocumentIdentifierSchema,
+		"contentChanges": array(object(map[string]*schema{
+			"range": rangeSchema,
+			"text":  stringValue,
+		}, "text")),
+	}, "textDocument", "contentChanges"),
+	"textDocument/didClose": textDocumentParamsSchema,
+	"textDocument/didSave":  textDocumentParamsSchema,
+	"textDocument/willSave": textDocumentParamsSchema.with(map[string]*schema{
+		"reason": integerValue,
+	}, "reason"),
+
+	"textDocument/hover":                textDocumentPositionParamsSchema,
+	"textDocument/definition":           textDocumentPositionParamsSchema,
+	"textDocument/declaration":          textDocumentPositionParamsSchema,
+	"textDocument/typeDefinition":       textDocumentPositionParamsSchema,
+	"textDocument/implementation":       textDocumentPositionParamsSchema,
+	"textDocument/documentHighlight":    textDocumentPositionParamsSchema,
+	"textDocument/completion":           textDocumentPositionParamsSchema,
+	"textDocument/signatureHelp":        textDocumentPositionParamsSchema,
+	"textDocument/prepareRename":        textDocumentPositionParamsSchema,
+	"textDocument/prepareCallHierarchy": textDocumentPositionParamsSchema,
+	"textDocument/prepareTypeHierarchy": textDocumentPositionParamsSchema,
+	"textDocument/linkedEditingRange":   textDocumentPositionParamsSchema,
+	"textDocument/moniker":              textDocumentPositionParamsSchema,
+	"textDocument/references": textDocumentPositionParamsSchema.with(map[string]*schema{
+		"context": object(map[string]*schema{
+			"includeDeclaration": booleanValue,
+		}, "includeDeclaration"),
+	}, "context"),
+	"textDocument/rename": textDocumentPositionParamsSchema.with(map[string]*schema{
+		"newName": stringValue,
+	}, "newName"),
+
+	"textDocument/documentSymbol":       textDocumentParamsSchema,
+	"textDocument/foldingRange":         textDocumentParamsSchema,
+	"textDocument/codeLens":             textDocumentParamsSchema,
+	"textDocument/documentLink":         textDocumentParamsSchema,
+	"textDocument/documentColor":        textDocumentParamsSchema,
+	"textDocument/diagnostic":           textDocumentParamsSchema,
+	"textDocument/semanticTokens/full":  textDocumentParamsSchema,
+	"textDocument/semanticTokens/range": textDocumentRangeParamsSchema,
+	"textDocument/inlayHint":            textDocumentRangeParamsSchema,
+	"textDocument/codeAction": textDocumentRangeParamsSchema.with(map[string]*schema{
+		"context": object(map[string]*schema{
+			"diagnostics": array(anyObjectValue),
+		}, "diagnostics"),
+	}, "context"),
+	"textDocument/selectionRange": textDocumentParamsSchema.with(map[string]*schema{
+		"positions": array(positionSchema),
+	}, "positions"),
+	"textDocument/formatting": textDocumentParamsSchema.with(map[string]*schema{
+		"options": formattingOptionsSchema,
+	}, "options"),
+	"textDocument/rangeFormatting": textDocumentRangeParamsSchema.with(map[string]*schema{
+		"options": formattingOptionsSchema,
+	}, "options"),
+
+	"callHierarchy/incomingCalls": callHierarchyCallsSchema,
+	"callHierarchy/outgoingCalls": callHierarchyCallsSchema,
+
+	"workspace/symbol": object(map[string]*schema{
+		"query": stringValue,
+	}, "query"),
+	"workspace/executeCommand": object(map[string]*schema{
+		"command":   stringValue,
+		"arguments": array(anyValue),
+	}, "command"),
+	"workspace/didChangeConfiguration": object(map[string]*schema{
+		"settings": anyValue,
+	}, "settings"),
+}
+
+// ParamError describes a part of a method's params that does not match
+// the expected structure.
+type ParamError struct {
+	// JSON pointer (RFC 6901) to the offending value.
+	Pointer  string `json:"pointer"`
+	Expected string `json:"expected"`
+	// Type of the value found, or "missing".
+	Got string `json:"got"`
+}
+
+func (e ParamError) Error() string {
+	pointer := e.Pointer
+	if pointer == "" {
+		pointer = "params"
+	}
+	return fmt.Sprintf("%v: expected %v, got %v", pointer, e.Expected, e.Got)
+}
+
+// ValidateParams checks params (as decoded by encoding/json) against the
+// schema of method, returning the mismatches found. Methods with no known
+// schema are not validated.
+func ValidateParams(method string, params any) []ParamError {
+	s, ok := paramSchemas[method]
+	if !ok {
+		return nil
+	}
+
+	errs := []ParamError{}
+	s.validate("", params, &errs)
+	return errs
+}
+
+// SpecURL returns the link to the definition of method in the LSP
+// specification.
+func SpecURL(method string) string {
+	return specURL + "#" + strings.ReplaceAll(method, "/", "_")
+}
+
+func (s *schema) validate(pointer string, value any, errs *[]ParamError) {
+	if len(s.types) > 0 {
+		matched := false
+		for _, t := range s.types {
+			if hasType(value, t) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			*errs = append(*errs, ParamError{
+				Pointer:  pointer,
+				Expected: strings.Join(s.types, " | "),
+				Got:      typeName(value),
+			})
+			return
+		}
+	}
+
+	switch v := value.(type) {
+	case map[string]any:
+		for _, name := range s.required {
+			if _, ok := v[name]; !ok {
+				*errs = append(*errs, ParamError{
+					Pointer:  pointer + "/" + escapePointer(name),
+					Expected: s.properties[name].expected(),
+					Got:      "missing",
+				})
+			}
+		}
+
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if prop, ok := s.properties[name]; ok {
+				prop.validate(pointer+"/"+escapePointer(name), v[name], errs)
+			}
+		}
+	case []any:
+		if s.items != nil {
+			for i, item := range v {
+				s.items.validate(fmt.Sprintf("%v/%v", pointer, i), item, errs)
+			}
+		}
+	}
+}
+
+func (s *schema) expected() string {
+	if len(s.types) == 0 {
+		return "any"
+	}
+	return strings.Join(s.types, " | ")
+}
+
+func hasType(value any, t string) bool {
+	switch v := value.(type) {
+	case map[string]any:
+		return t == "object"
+	case []any:
+		return t == "array"
+	case string:
+		return t == "string"
+	case bool:
+		return t == "boolean"
+	case nil:
+		return t == "null"
+	case float64:
+		switch t {
+		case "number":
+			return true
+		case "integer":
+			return v == math.Trunc(v)
+		case "uinteger":
+			return v == math.Trunc(v) && v >= 0
+		}
+	}
+	return false
+}
+
+func typeName(value any) string {
+	switch v := value.(type) {
+	case map[string]any:
+		return "object"
+	case []any:
+		return "array"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case nil:
+		return "null"
+	case float64:
+		if v != math.Trunc(v) {
+			return "number"
+		} else if v < 0 {
+			return "integer"
+		}
+		return "uinteger"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
+
+func escapePointer(name string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(name)
+}
+
+// Schema describes the expected structure of a JSON value with a subset of
+// JSON Schema: the allowed types (object, array, string, integer,
+// uinteger, number, boolean or null), and the properties and required
+// properties of objects or the items of arrays. Like the schemas of LSP
+// methods, unknown properties are always allowed.
+type Schema struct {
+	Type       SchemaTypes        `json:"type"`
+	Properties map[string]*Schema `json:"properties"`
+	Required   []string           `json:"required"`
+	Items      *Schema            `json:"items"`
+}
+
+// SchemaTypes are the types allowed by a Schema, decoded from either a
+// single type or an array of them. Empty means any type.
+type SchemaTypes []string
+
+func (st *SchemaTypes) UnmarshalJSON(data []byte) error {
+	var single string
+	if json.Unmarshal(data, &single) == nil {
+		*st = SchemaTypes{single}
+		return nil
+	}
+	var types []string
+	err := json.Unmarshal(data, &types)
+	if err != nil {
+		return fmt.Errorf("schema type must be a string or an array of strings")
+	}
+	*st = types
+	return nil
+}
+
+func (s *Schema) compile() (*schema, error) {
+	if s == nil {
+		return anyValue, nil
+	}
+
+	c := &schema{required: s.Required}
+	for _, t := range s.Type {
+		switch t {
+		case "object", "array", "string", "integer", "uinteger", "number", "boolean", "null":
+		default:
+			return nil, fmt.Errorf("unknown schema type %q", t)
+		}
+		c.types = append(c.types, t)
+	}
+	if len(s.Properties) > 0 {
+		c.properties = make(map[string]*schema, len(s.Properties))
+		for name, prop := range s.Properties {
+			p, err := prop.compile()
+			if err != nil {
+				return nil, err
+			}
+			c.properties[name] = p
+		}
+	}
+	for _, name := range s.Required {
+		if _, ok := c.properties[name]; !ok {
+			// Required properties of any type.
+			if c.properties == nil {
+				c.properties = make(map[string]*schema)
+			}
+			c.properties[name] = anyValue
+		}
+	}
+	if s.Items != nil {
+		items, err := s.Items.compile()
+		if err != nil {
+			return nil, err
+		}
+		c.items = items
+	}
+	return c, nil
+}
+
+// Check reports whether a schema is valid, e.g. when loaded from a
+// configuration file.
+func (s *Schema) Check() error {
+	_, err := s.compile()
+	return err
+}
+
+// Validate checks value (as decoded by encoding/json) against the schema,
+// returning the mismatches found, with pointers relative to pointer.
+func (s *Schema) Validate(pointer string, value any) []ParamError {
+	errs := []ParamError{}
+	c, err := s.compile()
+	if err != nil {
+		return errs
+	}
+	c.validate(pointer, value, &errs)
+	return errs
+}
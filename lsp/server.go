@@ -1,22 +1,79 @@
 package lsp
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
-	"net"
+	"os"
 	"os/exec"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 )
 
 const ServerConnectStdio = "stdio"
 
+// Default size of the buffer used to read from the LSP server.
+const DefaultReadBufferSize = 4096
+
 type Server struct {
-	cmd   *exec.Cmd
-	mutex *sync.Mutex
-	conn  serverConn
+	// Guards the connection, which is replaced when restarting.
+	mutex   *sync.Mutex
+	conn    serverConn
+	session *session
+	method  string
+	limits  ResourceLimits
+	// Wire headers sent with every message.
+	headers map[string]string
+	// Policy for messages with invalid UTF-8 content.
+	invalidUTF8 string
+	// Options for TCP connections.
+	tcp TCPOptions
+	// Size of the buffer used to read from the LSP server.
+	readBufferSize int
+	// Encoding offered for compressing message content, if any.
+	compression string
+	// Interval between samples of the subprocess's resource usage.
+	usageInterval time.Duration
+	// Logger for the server's events, or nil for the default logger.
+	logger *slog.Logger
+
+	// Subprocess state, guarded by stateMutex. The command is replaced
+	// when restarting the subprocess, and is nil for external servers.
+	stateMutex sync.Mutex
+	cmd        *exec.Cmd
+	startedAt  time.Time
+	exited     chan struct{}
+	lastExit   *ExitInfo
+	restarts   int
+	expectExit bool
+	cgroup     string
+	usage      *ProcessUsage
+
+	onNotification func(method string, params any)
+	onRequest      func(method string, params any) (any, error)
+	onExit         func(info ExitInfo)
+	trace          atomic.Pointer[func(ctx context.Context, outgoing bool, data []byte)]
+	onStderr       atomic.Pointer[func(line string)]
+	// Last ID generated for requests written to the wire.
+	lastWireID atomic.Uint64
+}
+
+// ProcessStatus describes the state of a subprocess LSP server.
+type ProcessStatus struct {
+	Pid       int       `json:"pid,omitempty"`
+	Running   bool      `json:"running"`
+	StartedAt time.Time `json:"startedAt"`
+	Restarts  int       `json:"restarts"`
+	Cgroup    string    `json:"cgroup,omitempty"`
+	LastExit  *ExitInfo `json:"lastExit,omitempty"`
+	// Latest resource usage sample, while running.
+	Usage *ProcessUsage `json:"usage,omitempty"`
 }
 
 type serverConn interface {
@@ -28,12 +85,14 @@ type serverConn interface {
 
 type serverConnPipe struct {
 	stdout io.ReadCloser
-	stderr io.ReadCloser
 	stdin  io.WriteCloser
-}
-
-type serverConnTCP struct {
-	conn net.Conn
+	// The stderr pipe is created separately from the subprocess, so that
+	// it isn't closed when the subprocess exits before all of its output
+	// has been read. The write end is closed once the subprocess has
+	// started.
+	stderr       *os.File
+	stderrWriter *os.File
+	tail         *stderrTail
 }
 
 func newServerConnPipe(cmd *exec.Cmd) (*serverConnPipe, error) {
@@ -45,19 +104,22 @@ func newServerConnPipe(cmd *exec.Cmd) (*serverConnPipe, error) {
 	if err != nil {
 		return nil, fmt.Errorf("unable to create stdout pipe: %w", err)
 	}
-	stderr, err := cmd.StderrPipe()
-	if err != nil {
-		return nil, fmt.Errorf("unable to create stderr pipe: %w", err)
-	}
 	stdin, err := cmd.StdinPipe()
 	if err != nil {
 		return nil, fmt.Errorf("unable to create stdin pipe: %w", err)
 	}
+	stderr, stderrWriter, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("unable to create stderr pipe: %w", err)
+	}
+	cmd.Stderr = stderrWriter
 
 	return &serverConnPipe{
-		stdout: stdout,
-		stderr: stderr,
-		stdin:  stdin,
+		stdout:       stdout,
+		stdin:        stdin,
+		stderr:       stderr,
+		stderrWriter: stderrWriter,
+		tail:         newStderrTail(),
 	}, nil
 }
 
@@ -74,6 +136,7 @@ func (c *serverConnPipe) write(p []byte) (int, error) {
 }
 
 func (c *serverConnPipe) close() error {
+	c.stderrWriter.Close()
 	return errors.Join(
 		c.stdout.Close(),
 		c.stderr.Close(),
@@ -81,56 +144,191 @@ func (c *serverConnPipe) close() error {
 	)
 }
 
-func newServerConnTCP(addr string) (*serverConnTCP, error) {
-	conn, err := net.Dial("tcp", addr)
-	if err != nil {
-		return nil, err
-	}
+// NewSubprocessServer creates an LSP server run as a subprocess.
+//
+// Deprecated: Use NewServer with WithCommand.
+func NewSubprocessServer(name string, arg ...string) *Server {
+	srv, _ := NewServer(WithCommand(name, arg...))
+	return srv
+}
 
-	return &serverConnTCP{conn: conn}, nil
+// NewExternalServer creates an LSP server which is not run by hyperlsp.
+//
+// Deprecated: Use NewServer.
+func NewExternalServer() *Server {
+	srv, _ := NewServer()
+	return srv
 }
 
-func (c *serverConnTCP) read(p []byte) (int, error) {
-	return c.conn.Read(p)
+// SetNotificationHandler sets a function to be called for every
+// notification received from the LSP server. It is called from the
+// goroutine reading the server's output, so it should not block.
+func (s *Server) SetNotificationHandler(handler func(method string, params any)) {
+	s.onNotification = handler
 }
 
-func (c *serverConnTCP) readErr(p []byte) (int, error) {
-	return 0, io.EOF
+// SetRequestHandler sets a function to be called for every request
+// received from the LSP server, returning its result. It is called from
+// its own goroutine, so it may block until the result is known. Requests
+// are answered with a MethodNotFound error if no handler is set or it
+// returns ErrUnsupportedRequest, with the error itself if it is a
+// *ResponseError, and with an InternalError otherwise.
+func (s *Server) SetRequestHandler(handler func(method string, params any) (any, error)) {
+	s.onRequest = handler
 }
 
-func (c *serverConnTCP) write(p []byte) (int, error) {
-	return c.conn.Write(p)
+// SetExitHandler sets a function to be called when the LSP server
+// subprocess exits.
+func (s *Server) SetExitHandler(handler func(info ExitInfo)) {
+	s.onExit = handler
 }
 
-func (c *serverConnTCP) close() error {
-	return c.conn.Close()
+// SetTracer sets a function to be called with the content of every
+// message sent to (outgoing) or received from the LSP server. The content
+// must not be retained after the function returns. ctx is the context
+// messages were sent with, or the one of the request a response (or a
+// partial result) answers. It is context.Background() for other messages
+// received.
+func (s *Server) SetTracer(trace func(ctx context.Context, outgoing bool, data []byte)) {
+	s.trace.Store(&trace)
 }
 
-func NewSubprocessServer(name string, arg ...string) *Server {
-	cmd := exec.Command(name, arg...)
+// SetStderrHandler sets a function to be called with every line written
+// by the LSP server subprocess to its stderr. It is called from the
+// goroutine reading the output, so it should not block.
+func (s *Server) SetStderrHandler(handler func(line string)) {
+	s.onStderr.Store(&handler)
+}
 
-	// Prevent Ctrl-C from killing LSP server in Linux.
-	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Setpgid: true,
+// SetInvalidUTF8Policy sets how messages received with invalid UTF-8
+// content are handled: InvalidUTF8Reject or InvalidUTF8Replace. It applies
+// to connections established afterwards.
+func (s *Server) SetInvalidUTF8Policy(policy string) {
+	s.lock()
+	defer s.unlock()
+	s.invalidUTF8 = policy
+}
+
+// SetTCPOptions sets the options used when connecting to the LSP server
+// over TCP.
+func (s *Server) SetTCPOptions(opts TCPOptions) {
+	s.tcp = opts
+}
+
+// SetReadBufferSize sets the size of the buffer used to read from the LSP
+// server. Larger buffers reduce the number of reads for servers which send
+// large amounts of data. It applies to connections established afterwards.
+func (s *Server) SetReadBufferSize(size int) {
+	s.lock()
+	defer s.unlock()
+	s.readBufferSize = size
+}
+
+// SetCompression enables compression of message content with encoding
+// (CompressionGzip or CompressionZstd), which is not part of the LSP
+// specification. Every message sent announces the encoding with an
+// Accept-Encoding header, and messages received may be compressed with
+// it, as indicated by their Content-Encoding header. Messages sent are
+// only compressed once the server has announced that it accepts the
+// encoding as well. It applies to connections established afterwards.
+func (s *Server) SetCompression(encoding string) {
+	s.lock()
+	defer s.unlock()
+	s.compression = encoding
+}
+
+// SetUsageInterval sets the interval between samples of the subprocess's
+// resource usage, reported by Status. Zero disables sampling. It applies
+// to subprocesses started afterwards.
+func (s *Server) SetUsageInterval(interval time.Duration) {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	s.usageInterval = interval
+}
+
+// SetHeaders sets additional wire headers to send with every message,
+// taking precedence over the headers of individual messages.
+func (s *Server) SetHeaders(headers map[string]string) error {
+	for name, value := range headers {
+		if !validHeader(name, value) {
+			return fmt.Errorf("invalid header: %q", name)
+		}
 	}
+	s.headers = headers
+	return nil
+}
 
-	srv := NewExternalServer()
-	srv.cmd = cmd
-	return srv
+// SetResourceLimits sets the limits applied to the LSP server subprocess
+// when it is started.
+func (s *Server) SetResourceLimits(limits ResourceLimits) {
+	s.limits = limits
 }
 
-func NewExternalServer() *Server {
-	return &Server{
-		mutex: &sync.Mutex{},
+// Status returns the state of the LSP server subprocess, or nil if the
+// server is external.
+func (s *Server) Status() *ProcessStatus {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+
+	if s.cmd == nil {
+		return nil
+	}
+
+	status := &ProcessStatus{
+		StartedAt: s.startedAt,
+		Restarts:  s.restarts,
+		Cgroup:    s.cgroup,
+		LastExit:  s.lastExit,
+	}
+	if s.exited != nil {
+		select {
+		case <-s.exited:
+		default:
+			status.Running = true
+			status.Pid = s.cmd.Process.Pid
+			status.Usage = s.usage
+		}
 	}
+	return status
 }
 
-func (s *Server) forwardStderr() {
+// AwaitExit returns how the LSP server subprocess exited, if it is not
+// running, waiting up to timeout for a running one to exit, e.g. after an
+// error on its connection. It returns nil if the server is external, or if
+// the subprocess is still running.
+func (s *Server) AwaitExit(timeout time.Duration) *ExitInfo {
+	s.stateMutex.Lock()
+	exited := s.exited
+	s.stateMutex.Unlock()
+	if exited == nil {
+		return nil
+	}
+
+	select {
+	case <-exited:
+	case <-time.After(timeout):
+		return nil
+	}
+
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	return s.lastExit
+}
+
+func (s *Server) forwardStderr(conn *serverConnPipe) {
+	defer conn.tail.end()
+
 	buf := make([]byte, 4096)
 	for {
-		n, err := s.conn.readErr(buf)
+		n, err := conn.readErr(buf)
 		if n > 0 {
-			slog.Error("LSP server stderr output", "value", buf[:n])
+			s.log().Error("LSP server stderr output", "value", buf[:n])
+			lines := conn.tail.write(buf[:n])
+			if handler := s.onStderr.Load(); handler != nil {
+				for _, line := range lines {
+					(*handler)(line)
+				}
+			}
 		}
 
 		if err != nil {
@@ -139,59 +337,464 @@ func (s *Server) forwardStderr() {
 	}
 }
 
+// Connect connects to the LSP server, starting the subprocess first if
+// there is one. The connection method is ServerConnectStdio (only for
+// subprocesses), the URL of an upstream hyperlsp instance, inherited file
+// descriptors (e.g. "fd:3,4" for the server's input and output), a
+// connection method of a registered transport (see RegisterTransport), or
+// otherwise a TCP address, optionally prefixed with "tcp:".
+//
+// If method is empty, the method set with WithConnect is used, or
+// otherwise ServerConnectStdio for subprocesses. method may also be a
+// comma-separated list of methods, which are tried in order until one
+// succeeds; the first one that does is used when reconnecting.
 func (s *Server) Connect(method string) error {
 	if s.conn != nil {
 		return fmt.Errorf("already connected to server")
 	}
 
-	if method == ServerConnectStdio {
+	if method == "" {
+		method = s.method
+	}
+	if method == "" && s.command() != nil {
+		method = ServerConnectStdio
+	}
+	if method == "" {
+		return fmt.Errorf("no connection method specified")
+	}
+
+	methods := splitConnectMethods(method)
+	var errs []error
+	for i, m := range methods {
+		s.method = m
+		err := s.connect()
+		if err == nil {
+			if i > 0 {
+				s.log().Info("connected to LSP server", "method", m)
+			}
+			return nil
+		}
+
+		s.abortConnect()
+		if len(methods) == 1 {
+			return err
+		}
+		s.log().Warn("unable to connect to LSP server", "method", m, "err", err)
+		errs = append(errs, fmt.Errorf("%v: %w", m, err))
+	}
+	return fmt.Errorf("unable to connect with any method: %w", errors.Join(errs...))
+}
+
+// splitConnectMethods splits a comma-separated list of connection methods.
+// Numbers following a file descriptor method belong to it, as in
+// "fd:3,4".
+func splitConnectMethods(method string) []string {
+	var methods []string
+	for _, m := range strings.Split(method, ",") {
+		m = strings.TrimSpace(m)
+		if _, err := strconv.Atoi(m); err == nil && len(methods) > 0 && isFDConnect(methods[len(methods)-1]) {
+			methods[len(methods)-1] += "," + m
+			continue
+		}
+		methods = append(methods, m)
+	}
+	return methods
+}
+
+// abortConnect undoes a failed connection attempt, so that another method
+// can be tried: the connection is closed, and the subprocess is stopped if
+// it was started.
+func (s *Server) abortConnect() {
+	if s.conn != nil {
+		s.conn.close()
+		s.conn = nil
+	}
+	cmd := s.command()
+	if cmd == nil {
+		return
+	}
+
+	if cmd.Process != nil {
+		s.stateMutex.Lock()
+		s.expectExit = true
+		exited := s.exited
+		s.stateMutex.Unlock()
+
+		cmd.Process.Kill()
+		if exited != nil {
+			<-exited
+		}
+	}
+	s.resetCommand()
+}
+
+// command returns the command of the LSP server subprocess, or nil if the
+// server is external.
+func (s *Server) command() *exec.Cmd {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	return s.cmd
+}
+
+// resetCommand replaces the command of the subprocess with a copy, as a
+// command can only be started once.
+func (s *Server) resetCommand() {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	s.cmd = cloneCommand(s.cmd)
+}
+
+// cloneCommand returns a command which runs the same program as cmd, with
+// the same settings, which can be started again.
+func cloneCommand(cmd *exec.Cmd) *exec.Cmd {
+	clone := exec.Command(cmd.Path, cmd.Args[1:]...)
+	clone.Env = cmd.Env
+	clone.Dir = cmd.Dir
+	clone.SysProcAttr = cmd.SysProcAttr
+	return clone
+}
+
+func (s *Server) connect() error {
+	cmd := s.command()
+	var pipe *serverConnPipe
+	if s.method == ServerConnectStdio {
 		var err error
-		s.conn, err = newServerConnPipe(s.cmd)
+		pipe, err = newServerConnPipe(cmd)
 		if err != nil {
 			return err
 		}
+		s.conn = pipe
 	}
 
-	if s.cmd != nil {
-		err := s.cmd.Start()
+	if cmd != nil {
+		var tail *stderrTail
+		if pipe != nil {
+			tail = pipe.tail
+		}
+		err := s.start(cmd, tail)
+		if pipe != nil {
+			pipe.stderrWriter.Close()
+		}
 		if err != nil {
 			return err
 		}
 
-		if method == ServerConnectStdio {
-			go s.forwardStderr()
+		if pipe != nil {
+			go s.forwardStderr(pipe)
 		}
 	}
 
-	if method != ServerConnectStdio {
+	if s.method != ServerConnectStdio {
+		conn, err := s.dial()
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+
+	parser := newMessageParser()
+	parser.invalidUTF8 = s.invalidUTF8
+	parser.compression = s.compression
+	parser.logger = s.log()
+	s.session = newSession(s, s.conn, parser)
+	return nil
+}
+
+// dial opens a connection with a method other than ServerConnectStdio.
+func (s *Server) dial() (serverConn, error) {
+	// The connection is only returned on success, as a nil pointer is not
+	// a nil serverConn.
+	var conn serverConn
+	var err error
+	factory, registered := transportFactory(s.method)
+	switch {
+	case registered:
+		conn, err = newServerConnTransport(s.method, factory)
+	case isHTTPConnect(s.method):
+		conn, err = newServerConnHTTP(s.method, s.log())
+	case isFDConnect(s.method):
+		conn, err = newServerConnFD(s.method)
+	default:
+		conn, err = newServerConnTCP(strings.TrimPrefix(s.method, tcpConnectPrefix), s.tcp, s.log())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// currentSession returns the session of the current connection.
+func (s *Server) currentSession() (*session, error) {
+	s.lock()
+	defer s.unlock()
+
+	if s.session == nil {
+		return nil, fmt.Errorf("not connected to LSP server")
+	}
+	return s.session, nil
+}
+
+// start starts the subprocess with cmd, subject to the resource limits,
+// and watches for its exit. The last lines of its stderr output, if
+// captured in tail, are reported along with the exit.
+func (s *Server) start(cmd *exec.Cmd, tail *stderrTail) error {
+	cgroup := ""
+	if !s.limits.empty() {
+		var started func()
 		var err error
-		s.conn, err = newServerConnTCP(method)
+		cgroup, started, err = prepareLimits(cmd, s.limits)
 		if err != nil {
 			return err
 		}
+		defer started()
 	}
 
+	err := cmd.Start()
+	if err != nil {
+		removeCgroup(cgroup)
+		return err
+	}
+
+	exited := make(chan struct{})
+	s.stateMutex.Lock()
+	s.startedAt = time.Now()
+	s.exited = exited
+	s.cgroup = cgroup
+	s.expectExit = false
+	s.usage = nil
+	interval := s.usageInterval
+	s.stateMutex.Unlock()
+
+	go s.wait(cmd, cgroup, exited, tail)
+	if interval > 0 {
+		go s.sampleUsage(cmd.Process.Pid, interval, exited)
+	}
 	return nil
 }
 
+func (s *Server) wait(cmd *exec.Cmd, cgroup string, exited chan struct{}, tail *stderrTail) {
+	cmd.Wait()
+
+	s.stateMutex.Lock()
+	expected := s.expectExit
+	s.stateMutex.Unlock()
+
+	info := ExitInfo{Time: time.Now(), Code: cmd.ProcessState.ExitCode(), Expected: expected}
+	if ws, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		info.Signal = ws.Signal().String()
+	}
+	// Only the cgroup's memory events tell an OOM kill apart from any other
+	// SIGKILL, e.g. for exceeding the CPU time limit.
+	if cgroup != "" {
+		info.OOM = cgroupOOMKills(cgroup) > 0
+		removeCgroup(cgroup)
+	}
+	if tail != nil {
+		info.Stderr = tail.drain()
+	}
+
+	s.stateMutex.Lock()
+	s.lastExit = &info
+	s.stateMutex.Unlock()
+	close(exited)
+
+	if info.Expected {
+		s.log().Info("LSP server exited", "code", info.Code)
+	} else {
+		s.log().Error("LSP server exited unexpectedly", "code", info.Code, "signal", info.Signal, "oom", info.OOM)
+	}
+
+	if s.onExit != nil {
+		s.onExit(info)
+	}
+}
+
+// Restart kills the LSP server subprocess if it is still running, and
+// starts and connects to a new one with the same command. The new server
+// is not initialized.
+func (s *Server) Restart() error {
+	s.stateMutex.Lock()
+	cmd := s.cmd
+	s.expectExit = true
+	exited := s.exited
+	s.stateMutex.Unlock()
+
+	if cmd == nil {
+		return fmt.Errorf("no LSP server subprocess to restart")
+	}
+	if exited != nil {
+		cmd.Process.Kill()
+		<-exited
+	}
+
+	s.lock()
+	defer s.unlock()
+
+	if s.session != nil {
+		s.session.close()
+	} else if s.conn != nil {
+		s.conn.close()
+	}
+	s.session = nil
+	s.conn = nil
+
+	s.stateMutex.Lock()
+	s.cmd = cloneCommand(s.cmd)
+	s.restarts++
+	s.stateMutex.Unlock()
+
+	return s.connect()
+}
+
+// shutdownGracefully sends the shutdown request and exit notification to
+// the LSP server subprocess, and waits up to timeout for it to exit. If the
+// server doesn't answer, the messages fail once the connection is closed.
+func (s *Server) shutdownGracefully(timeout time.Duration) {
+	s.stateMutex.Lock()
+	s.expectExit = true
+	exited := s.exited
+	s.stateMutex.Unlock()
+
+	if exited == nil {
+		return
+	}
+	go func() {
+		client := NewClient(s)
+		client.Send(&Message{Method: "shutdown", Id: "shutdown"})
+		client.Send(&Message{Method: "exit"})
+	}()
+
+	select {
+	case <-exited:
+	case <-time.After(timeout):
+		s.log().Warn("LSP server did not exit after shutdown, killing it", "timeout", timeout)
+	}
+}
+
+// SoftRestart shuts down the LSP server subprocess gracefully, with the
+// shutdown request and exit notification, and then starts and connects to
+// a new one like Restart. If the server doesn't exit within timeout, it is
+// killed.
+func (s *Server) SoftRestart(timeout time.Duration) error {
+	if s.command() == nil {
+		return fmt.Errorf("no LSP server subprocess to restart")
+	}
+
+	s.shutdownGracefully(timeout)
+	return s.Restart()
+}
+
+// Stop shuts down the LSP server subprocess gracefully like SoftRestart,
+// killing it if it doesn't exit within timeout (or right away, if timeout
+// is zero), and closes the connection.
+func (s *Server) Stop(timeout time.Duration) {
+	if s.command() == nil {
+		return
+	}
+
+	if timeout > 0 {
+		s.shutdownGracefully(timeout)
+	}
+
+	s.stateMutex.Lock()
+	cmd := s.cmd
+	s.expectExit = true
+	exited := s.exited
+	s.stateMutex.Unlock()
+	if exited != nil {
+		cmd.Process.Kill()
+		<-exited
+	}
+
+	s.lock()
+	defer s.unlock()
+	if s.session != nil {
+		s.session.close()
+	} else if s.conn != nil {
+		s.conn.close()
+	}
+	s.session = nil
+	s.conn = nil
+}
+
+// NewStandby starts and connects to a new LSP server subprocess with the
+// same settings and handlers as s, running command (or s's command, if
+// empty). It is meant to replace s once ready, e.g. to upgrade the server
+// without downtime.
+func (s *Server) NewStandby(command []string) (*Server, error) {
+	cmd := s.command()
+	if cmd == nil {
+		return nil, fmt.Errorf("no LSP server subprocess to replace")
+	}
+
+	path, args := cmd.Path, cmd.Args[1:]
+	if len(command) > 0 {
+		path, args = command[0], command[1:]
+	}
+	standby, err := NewServer(WithCommand(path, args...), WithEnv(cmd.Env), WithDir(cmd.Dir))
+	if err != nil {
+		return nil, err
+	}
+	standby.cmd.SysProcAttr = cmd.SysProcAttr
+
+	standby.limits = s.limits
+	standby.headers = s.headers
+	standby.invalidUTF8 = s.invalidUTF8
+	standby.tcp = s.tcp
+	standby.readBufferSize = s.readBufferSize
+	standby.compression = s.compression
+	standby.usageInterval = s.usageInterval
+	standby.logger = s.logger
+	standby.onNotification = s.onNotification
+	standby.onRequest = s.onRequest
+	standby.onExit = s.onExit
+	if trace := s.trace.Load(); trace != nil {
+		standby.trace.Store(trace)
+	}
+	if handler := s.onStderr.Load(); handler != nil {
+		standby.onStderr.Store(handler)
+	}
+
+	err = standby.Connect(s.method)
+	if err != nil {
+		return nil, err
+	}
+	return standby, nil
+}
+
 func (s *Server) ShutdownAndExit() error {
-	if s.cmd == nil {
+	if s.command() == nil {
 		return nil
 	}
 
+	s.stateMutex.Lock()
+	s.expectExit = true
+	exited := s.exited
+	s.stateMutex.Unlock()
+
 	client := NewClient(s)
 	client.Send(&Message{Method: "shutdown", Id: "shutdown"})
 	client.Send(&Message{Method: "exit"})
 
-	return s.cmd.Wait()
-}
+	if exited == nil {
+		return nil
+	}
+	<-exited
 
-func (s *Server) read(p []byte) (int, error) {
-	return s.conn.read(p)
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	if s.lastExit.Code != 0 {
+		return fmt.Errorf("LSP server exited with code %v", s.lastExit.Code)
+	}
+	return nil
 }
 
-func (s *Server) write(p []byte) (int, error) {
-	return s.conn.write(p)
+// log returns the logger for the server's events.
+func (s *Server) log() *slog.Logger {
+	if s.logger != nil {
+		return s.logger
+	}
+	return slog.Default()
 }
 
 func (s *Server) lock() {
@@ -0,0 +1,446 @@
+package lsp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// errConnectionClosed ends the session of a connection closed by hyperlsp,
+// e.g. when restarting the LSP server.
+var errConnectionClosed = errors.New("LSP server connection closed")
+
+// ErrUnsupportedRequest is returned by request handlers (see
+// Server.SetRequestHandler) for methods they don't implement.
+var ErrUnsupportedRequest = errors.New("unsupported LSP server request")
+
+// pendingCall is a request waiting for its response.
+type pendingCall struct {
+	// ID the request was sent with, and its ID on the wire.
+	id     string
+	wireID uint64
+	sentAt time.Time
+	// Context the request was sent with, passed to the tracer along with
+	// its response.
+	ctx context.Context
+	// Closed once resp or err is set.
+	done chan struct{}
+	resp *incomingMessage
+	err  error
+	// Token and handler for partial results, if any.
+	token   string
+	partial func(value any)
+}
+
+// outgoingFrame is a complete message to be written to the connection.
+type outgoingFrame struct {
+	data []byte
+	// Receives the result of the write.
+	written chan error
+}
+
+// session holds the state of a single connection to the LSP server. A
+// reader goroutine parses all messages received and dispatches them to the
+// calls waiting for them (or to the server's notification handler), and a
+// writer goroutine writes all outgoing messages in order, so that slow
+// requests don't block other traffic.
+type session struct {
+	s      *Server
+	conn   serverConn
+	parser *messageParser
+	writes chan *outgoingFrame
+	// Closed when the session ends.
+	closed chan struct{}
+	// Maximum time a call may wait without data being received, if the
+	// connection reports read timeouts.
+	readTimeout time.Duration
+	// Size of the buffer used to read from the connection.
+	readBufferSize int
+	// Encoding offered for compressing message content, if any.
+	compression string
+
+	mutex sync.Mutex
+	// Calls waiting for a response, by wire ID.
+	pending map[string]*pendingCall
+	// Calls expecting partial results, by token.
+	progress map[string]*pendingCall
+	// Wire IDs of cancelled calls, whose responses are discarded.
+	cancelled map[string]bool
+	// Error that ended the session, if any.
+	err error
+	// Encoding used to compress outgoing messages, once the server has
+	// announced that it accepts it.
+	encoding string
+}
+
+func newSession(s *Server, conn serverConn, parser *messageParser) *session {
+	sess := &session{
+		s:              s,
+		conn:           conn,
+		parser:         parser,
+		writes:         make(chan *outgoingFrame),
+		closed:         make(chan struct{}),
+		readTimeout:    s.tcp.ReadTimeout,
+		readBufferSize: s.readBufferSize,
+		compression:    s.compression,
+		pending:        make(map[string]*pendingCall),
+		progress:       make(map[string]*pendingCall),
+		cancelled:      make(map[string]bool),
+	}
+	parser.trace = sess.traceIncoming
+	go sess.readLoop()
+	go sess.writeLoop()
+	return sess
+}
+
+// wireKey returns the key of a wire ID in the session's maps, which is
+// the ID of its response as returned by incomingMessage.id.
+func wireKey(wireID uint64) string {
+	return strconv.FormatUint(wireID, 10)
+}
+
+// register adds a call waiting for the response to the request sent with
+// the specified ID, written to the wire with wireID.
+func (sess *session) register(ctx context.Context, wireID uint64, id, token string, partial func(value any)) (*pendingCall, error) {
+	sess.mutex.Lock()
+	defer sess.mutex.Unlock()
+
+	if sess.err != nil {
+		return nil, sess.err
+	}
+
+	call := &pendingCall{
+		id:      id,
+		wireID:  wireID,
+		sentAt:  time.Now(),
+		ctx:     ctx,
+		done:    make(chan struct{}),
+		token:   token,
+		partial: partial,
+	}
+	sess.pending[wireKey(wireID)] = call
+	if token != "" {
+		sess.progress[token] = call
+	}
+	return call, nil
+}
+
+// unregister removes a call, e.g. if its request could not be sent.
+func (sess *session) unregister(wireID uint64) {
+	sess.mutex.Lock()
+	defer sess.mutex.Unlock()
+
+	key := wireKey(wireID)
+	if call, ok := sess.pending[key]; ok {
+		delete(sess.pending, key)
+		delete(sess.progress, call.token)
+	}
+}
+
+// cancel removes a call which is no longer waited for, so that its
+// response is discarded once received. It returns false if the call has
+// already completed.
+func (sess *session) cancel(wireID uint64) bool {
+	sess.mutex.Lock()
+	defer sess.mutex.Unlock()
+
+	key := wireKey(wireID)
+	call, ok := sess.pending[key]
+	if !ok {
+		return false
+	}
+	delete(sess.pending, key)
+	delete(sess.progress, call.token)
+	sess.cancelled[key] = true
+	return true
+}
+
+// wireCancel returns a $/cancelRequest notification sent by a client for
+// the ID it sent a request with, with the request's wire ID instead. It
+// returns false if no such request is pending.
+func (sess *session) wireCancel(msg *Message) (*Message, bool) {
+	data, err := json.Marshal(msg.Params)
+	if err != nil {
+		return nil, false
+	}
+	var params struct {
+		Id json.RawMessage `json:"id"`
+	}
+	if json.Unmarshal(data, &params) != nil || params.Id == nil {
+		return nil, false
+	}
+	id := rawID(params.Id)
+	if id == "" {
+		return nil, false
+	}
+
+	sess.mutex.Lock()
+	defer sess.mutex.Unlock()
+
+	for _, call := range sess.pending {
+		if call.id == id {
+			return &Message{Jsonrpc: msg.Jsonrpc, Method: msg.Method, Params: map[string]any{"id": call.wireID}}, true
+		}
+	}
+	return nil, false
+}
+
+// send queues a frame to be written, and waits until it has been.
+func (sess *session) send(data []byte) error {
+	frame := &outgoingFrame{data: data, written: make(chan error, 1)}
+	select {
+	case sess.writes <- frame:
+	case <-sess.closed:
+		return sess.failure()
+	}
+
+	// Once the writer has the frame, it always reports the result, so
+	// that the frame's data is no longer in use when returning.
+	return <-frame.written
+}
+
+func (sess *session) writeLoop() {
+	for {
+		select {
+		case frame := <-sess.writes:
+			_, err := sess.conn.write(frame.data)
+			if err != nil {
+				err = fmt.Errorf("error sending message to server: %w", err)
+			}
+			frame.written <- err
+		case <-sess.closed:
+			return
+		}
+	}
+}
+
+func (sess *session) readLoop() {
+	buf := make([]byte, sess.readBufferSize)
+	for {
+		n, ioErr := sess.conn.read(buf)
+		err := sess.parser.write(buf[:n])
+
+		// Messages parsed before an error are still delivered.
+		msgs, _ := sess.parser.pop()
+		for _, msg := range msgs {
+			sess.dispatch(msg)
+		}
+
+		switch {
+		case err != nil:
+			sess.end(fmt.Errorf("error reading LSP server output: %w", err))
+			return
+		case errors.Is(ioErr, os.ErrDeadlineExceeded):
+			// The connection is still usable, but calls which have been
+			// waiting for too long fail.
+			sess.expire()
+		case ioErr == io.EOF:
+			sess.end(fmt.Errorf("read error: EOF"))
+			return
+		case ioErr != nil:
+			sess.end(fmt.Errorf("read error: %w", ioErr))
+			return
+		}
+	}
+}
+
+// negotiate enables compression of outgoing messages once the server has
+// announced that it accepts the offered encoding, or has used it itself.
+func (sess *session) negotiate(headers map[string]string) {
+	if sess.compression == "" {
+		return
+	}
+	if !acceptsEncoding(headers, sess.compression) && contentEncoding(headers) != sess.compression {
+		return
+	}
+
+	sess.mutex.Lock()
+	defer sess.mutex.Unlock()
+	if sess.encoding == "" {
+		sess.s.log().Info("LSP server accepts compressed messages", "encoding", sess.compression)
+		sess.encoding = sess.compression
+	}
+}
+
+// outgoingEncoding returns the encoding to compress outgoing messages with,
+// if any.
+func (sess *session) outgoingEncoding() string {
+	sess.mutex.Lock()
+	defer sess.mutex.Unlock()
+	return sess.encoding
+}
+
+// traceIncoming passes a message received from the LSP server to the
+// server's tracer, if any, along with the context of the call it answers
+// (with its response or a partial result).
+func (sess *session) traceIncoming(msg *incomingMessage, data []byte) {
+	trace := sess.s.trace.Load()
+	if trace == nil {
+		return
+	}
+
+	ctx := context.Background()
+	sess.mutex.Lock()
+	var call *pendingCall
+	switch msg.Method {
+	case "":
+		call = sess.pending[msg.id()]
+	case "$/progress":
+		params, _ := msg.Params.(map[string]any)
+		token, _ := params["token"].(string)
+		call = sess.progress[token]
+	}
+	if call != nil {
+		ctx = call.ctx
+	}
+	sess.mutex.Unlock()
+
+	(*trace)(ctx, false, data)
+}
+
+// dispatch handles a message received from the LSP server.
+func (sess *session) dispatch(msg *incomingMessage) {
+	sess.negotiate(msg.headers)
+
+	if msg.Method == "" {
+		id := msg.id()
+		sess.mutex.Lock()
+		if sess.cancelled[id] {
+			delete(sess.cancelled, id)
+			sess.mutex.Unlock()
+			return
+		}
+		call, ok := sess.pending[id]
+		if ok {
+			delete(sess.pending, id)
+			delete(sess.progress, call.token)
+		}
+		sess.mutex.Unlock()
+
+		if !ok {
+			sess.s.log().Warn("discarding unexpected LSP server response", "id", id)
+			return
+		}
+		call.resp = msg
+		close(call.done)
+		return
+	}
+
+	if msg.Id == nil {
+		if msg.Method == "$/progress" {
+			params, _ := msg.Params.(map[string]any)
+			token, _ := params["token"].(string)
+
+			sess.mutex.Lock()
+			call, ok := sess.progress[token]
+			sess.mutex.Unlock()
+
+			if ok {
+				call.partial(params["value"])
+				return
+			}
+		}
+
+		if sess.s.onNotification != nil {
+			sess.s.onNotification(msg.Method, msg.Params)
+		}
+		return
+	}
+
+	// Requests from the server are answered asynchronously, so that
+	// reading is never blocked by the handler or by writing.
+	go sess.answer(msg)
+}
+
+// answer sends the response to a request received from the LSP server,
+// as returned by the request handler (if any).
+func (sess *session) answer(msg *incomingMessage) {
+	err := ErrUnsupportedRequest
+	var result any
+	if sess.s.onRequest != nil {
+		result, err = sess.s.onRequest(msg.Method, msg.Params)
+	}
+
+	answer := map[string]any{"jsonrpc": jsonRpcVersion, "id": msg.Id}
+	var respErr *ResponseError
+	switch {
+	case err == nil:
+		answer["result"] = result
+	case errors.Is(err, ErrUnsupportedRequest):
+		sess.s.log().Warn("unsupported LSP server request", "method", msg.Method)
+		answer["error"] = &ResponseError{
+			Code:    CodeMethodNotFound,
+			Message: fmt.Sprintf("method not supported by hyperlsp: %v", msg.Method),
+		}
+	case errors.As(err, &respErr):
+		answer["error"] = respErr
+	default:
+		answer["error"] = &ResponseError{Code: CodeInternalError, Message: err.Error()}
+	}
+
+	frame, err := sess.s.encode(context.Background(), answer, nil, sess.outgoingEncoding())
+	if err != nil {
+		sess.s.log().Error("unable to encode response", "err", err)
+		return
+	}
+	defer putBuffer(frame)
+	err = sess.send(frame.Bytes())
+	if err != nil {
+		sess.s.log().Warn("unable to answer LSP server request", "method", msg.Method, "err", err)
+	}
+}
+
+// expire fails the calls which have been waiting for longer than the read
+// timeout.
+func (sess *session) expire() {
+	sess.mutex.Lock()
+	defer sess.mutex.Unlock()
+
+	for id, call := range sess.pending {
+		if time.Since(call.sentAt) < sess.readTimeout {
+			continue
+		}
+		delete(sess.pending, id)
+		delete(sess.progress, call.token)
+		call.err = fmt.Errorf("read error: %w", os.ErrDeadlineExceeded)
+		close(call.done)
+	}
+}
+
+// end ends the session, failing all pending calls with err.
+func (sess *session) end(err error) {
+	sess.mutex.Lock()
+	defer sess.mutex.Unlock()
+
+	if sess.err != nil {
+		return
+	}
+	sess.err = err
+	close(sess.closed)
+
+	for id, call := range sess.pending {
+		delete(sess.pending, id)
+		call.err = err
+		close(call.done)
+	}
+	sess.progress = make(map[string]*pendingCall)
+}
+
+// failure returns the error that ended the session.
+func (sess *session) failure() error {
+	sess.mutex.Lock()
+	defer sess.mutex.Unlock()
+	return sess.err
+}
+
+// close ends the session and closes its connection.
+func (sess *session) close() error {
+	sess.end(errConnectionClosed)
+	return sess.conn.close()
+}
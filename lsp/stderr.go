@@ -0,0 +1,92 @@
+package lsp
+
+import (
+	"bytes"
+	"sync"
+	"time"
+)
+
+const (
+	// Number of lines of the LSP server's stderr output kept, to be
+	// reported when it exits.
+	maxStderrLines = 20
+	// Lines longer than this are truncated.
+	maxStderrLineLength = 1024
+	// Maximum time to wait for the rest of the stderr output once the
+	// subprocess has exited.
+	stderrDrainTimeout = 200 * time.Millisecond
+)
+
+// stderrTail keeps the last lines written by the LSP server subprocess to
+// its stderr.
+type stderrTail struct {
+	mutex   sync.Mutex
+	lines   []string
+	partial []byte
+	// Closed once the end of the output has been reached.
+	done chan struct{}
+}
+
+func newStderrTail() *stderrTail {
+	return &stderrTail{done: make(chan struct{})}
+}
+
+// write adds the output in p, and returns the lines it completes.
+func (t *stderrTail) write(p []byte) []string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	var lines []string
+	for len(p) > 0 {
+		line, rest, found := bytes.Cut(p, []byte("\n"))
+		if len(t.partial) < maxStderrLineLength {
+			t.partial = append(t.partial, line[:min(len(line), maxStderrLineLength-len(t.partial))]...)
+		}
+		p = rest
+		if !found {
+			break
+		}
+		complete := string(bytes.TrimSuffix(t.partial, []byte("\r")))
+		t.add(complete)
+		lines = append(lines, complete)
+		t.partial = t.partial[:0]
+	}
+	return lines
+}
+
+// add appends a complete line. It must be called with t.mutex held.
+func (t *stderrTail) add(line string) {
+	t.lines = append(t.lines, line)
+	if len(t.lines) > maxStderrLines {
+		t.lines = t.lines[len(t.lines)-maxStderrLines:]
+	}
+}
+
+// end is called once the end of the output has been reached.
+func (t *stderrTail) end() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if len(t.partial) > 0 {
+		t.add(string(t.partial))
+		t.partial = nil
+	}
+	close(t.done)
+}
+
+// drain waits for the end of the output (for up to stderrDrainTimeout), and
+// returns the last lines.
+func (t *stderrTail) drain() []string {
+	select {
+	case <-t.done:
+	case <-time.After(stderrDrainTimeout):
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	lines := append([]string{}, t.lines...)
+	if len(t.partial) > 0 {
+		lines = append(lines, string(t.partial))
+	}
+	return lines
+}
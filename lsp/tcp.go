@@ -0,0 +1,145 @@
+package lsp
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"time"
+)
+
+// TCPOptions configures connections to LSP servers over TCP.
+type TCPOptions struct {
+	// Maximum time a request may wait for its response without any data
+	// being received. Zero means no timeout.
+	ReadTimeout time.Duration
+	// Maximum time each write may take. Zero means no timeout.
+	WriteTimeout time.Duration
+	// Whether to disable Nagle's algorithm (TCP_NODELAY), so that small
+	// messages are sent immediately.
+	NoDelay bool
+	// Interval between keep-alive probes. Zero uses the system default,
+	// and a negative value disables keep-alives.
+	KeepAlive time.Duration
+	// Sizes of the socket's receive and send buffers, in bytes. Zero uses
+	// the system default.
+	ReadBuffer  int
+	WriteBuffer int
+	// Period during which failed connection attempts are retried, with
+	// exponential backoff. Zero means no retries.
+	DialRetry time.Duration
+}
+
+// Optional prefix of TCP connection methods, e.g. "tcp:localhost:9000".
+const tcpConnectPrefix = "tcp:"
+
+// Delays between connection attempts.
+const (
+	dialBackoffInitial = 100 * time.Millisecond
+	dialBackoffMax     = 5 * time.Second
+)
+
+type serverConnTCP struct {
+	conn net.Conn
+	opts TCPOptions
+}
+
+func newServerConnTCP(addr string, opts TCPOptions, logger *slog.Logger) (*serverConnTCP, error) {
+	conn, err := dialTCP(addr, opts, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	err = configureTCP(conn.(*net.TCPConn), opts)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &serverConnTCP{conn: conn, opts: opts}, nil
+}
+
+// dialTCP connects to addr, retrying with exponential backoff for up to
+// opts.DialRetry, e.g. while the LSP server is still starting up.
+func dialTCP(addr string, opts TCPOptions, logger *slog.Logger) (net.Conn, error) {
+	dialer := net.Dialer{KeepAlive: opts.KeepAlive}
+	giveUp := time.Now().Add(opts.DialRetry)
+	backoff := dialBackoffInitial
+
+	for attempt := 1; ; attempt++ {
+		conn, err := dialer.Dial("tcp", addr)
+		if err == nil {
+			if attempt > 1 {
+				logger.Info("connected to LSP server", "addr", addr, "attempts", attempt)
+			}
+			return conn, nil
+		}
+
+		remaining := time.Until(giveUp)
+		if remaining <= 0 {
+			if attempt > 1 {
+				return nil, fmt.Errorf("giving up after %v attempts: %w", attempt, err)
+			}
+			return nil, err
+		}
+
+		wait := min(backoff, remaining)
+		logger.Warn("unable to connect to LSP server, retrying", "addr", addr, "err", err, "retry_in", wait)
+		time.Sleep(wait)
+		backoff = min(2*backoff, dialBackoffMax)
+	}
+}
+
+// configureTCP applies the socket options in opts to a connection.
+func configureTCP(conn *net.TCPConn, opts TCPOptions) error {
+	err := conn.SetNoDelay(opts.NoDelay)
+	if err != nil {
+		return fmt.Errorf("unable to set TCP_NODELAY: %w", err)
+	}
+	if opts.ReadBuffer > 0 {
+		err = conn.SetReadBuffer(opts.ReadBuffer)
+		if err != nil {
+			return fmt.Errorf("unable to set read buffer size: %w", err)
+		}
+	}
+	if opts.WriteBuffer > 0 {
+		err = conn.SetWriteBuffer(opts.WriteBuffer)
+		if err != nil {
+			return fmt.Errorf("unable to set write buffer size: %w", err)
+		}
+	}
+	return nil
+}
+
+// deadline returns the deadline for an operation with the specified
+// timeout, or the zero time (no deadline) if it is zero.
+func deadline(timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
+
+func (c *serverConnTCP) read(p []byte) (int, error) {
+	err := c.conn.SetReadDeadline(deadline(c.opts.ReadTimeout))
+	if err != nil {
+		return 0, err
+	}
+	return c.conn.Read(p)
+}
+
+func (c *serverConnTCP) readErr(p []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (c *serverConnTCP) write(p []byte) (int, error) {
+	err := c.conn.SetWriteDeadline(deadline(c.opts.WriteTimeout))
+	if err != nil {
+		return 0, err
+	}
+	return c.conn.Write(p)
+}
+
+func (c *serverConnTCP) close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,163 @@
+package lsp
+
+import (
+	"fmt"
+	"sort"
+	"unicode/utf8"
+)
+
+const (
+	PositionEncodingUTF8  = "utf-8"
+	PositionEncodingUTF16 = "utf-16"
+	PositionEncodingUTF32 = "utf-32"
+)
+
+// lineStart returns the byte offset at which the specified line starts.
+// Lines can be terminated by "\n", "\r\n" or "\r". If the text has less
+// lines than requested, len(text) is returned.
+func lineStart(text string, line int) int {
+	offset := 0
+	for ; line > 0; line-- {
+		i := offset
+		for i < len(text) && text[i] != '\n' && text[i] != '\r' {
+			i++
+		}
+		if i == len(text) {
+			return len(text)
+		}
+		if text[i] == '\r' && i+1 < len(text) && text[i+1] == '\n' {
+			i++
+		}
+		offset = i + 1
+	}
+	return offset
+}
+
+func runeUnits(r rune, encoding string) int {
+	switch encoding {
+	case PositionEncodingUTF8:
+		return utf8.RuneLen(r)
+	case PositionEncodingUTF32:
+		return 1
+	default:
+		if r >= 0x10000 {
+			return 2
+		}
+		return 1
+	}
+}
+
+func checkEncoding(encoding string) error {
+	switch encoding {
+	case PositionEncodingUTF8, PositionEncodingUTF16, PositionEncodingUTF32:
+		return nil
+	default:
+		return fmt.Errorf("unsupported position encoding %q", encoding)
+	}
+}
+
+// Offset returns the byte offset in text corresponding to pos, where the
+// position's character is expressed in units of the specified encoding.
+// As specified by LSP, characters past the end of a line resolve to the
+// end of that line.
+func Offset(text string, pos Position, encoding string) (int, error) {
+	if err := checkEncoding(encoding); err != nil {
+		return 0, err
+	}
+	if pos.Line < 0 || pos.Character < 0 {
+		return 0, fmt.Errorf("invalid position %v:%v", pos.Line, pos.Character)
+	}
+
+	offset := lineStart(text, pos.Line)
+	for units := 0; offset < len(text); {
+		r, size := utf8.DecodeRuneInString(text[offset:])
+		if r == '\n' || r == '\r' {
+			break
+		}
+
+		units += runeUnits(r, encoding)
+		if units > pos.Character {
+			break
+		}
+		offset += size
+	}
+
+	return offset, nil
+}
+
+// PositionAt returns the position corresponding to the byte offset in
+// text, with the character expressed in units of the specified encoding.
+func PositionAt(text string, offset int, encoding string) (Position, error) {
+	if err := checkEncoding(encoding); err != nil {
+		return Position{}, err
+	}
+	if offset < 0 || offset > len(text) {
+		return Position{}, fmt.Errorf("offset %v out of range", offset)
+	}
+
+	pos := Position{}
+	for i := 0; i < offset; {
+		r, size := utf8.DecodeRuneInString(text[i:])
+		switch {
+		case r == '\r' && i+1 < len(text) && text[i+1] == '\n':
+			if i+1 == offset {
+				// Offset points in between "\r\n".
+				pos.Character++
+				return pos, nil
+			}
+			size = 2
+			fallthrough
+		case r == '\n' || r == '\r':
+			pos.Line++
+			pos.Character = 0
+		default:
+			pos.Character += runeUnits(r, encoding)
+		}
+		i += size
+	}
+
+	return pos, nil
+}
+
+// ApplyTextEdits applies a set of non-overlapping text edits to text. Edits
+// starting at the same position are applied in the order they were given.
+func ApplyTextEdits(text string, edits []TextEdit, encoding string) (string, error) {
+	type offsetEdit struct {
+		start, end int
+		newText    string
+	}
+
+	resolved := make([]offsetEdit, 0, len(edits))
+	for _, e := range edits {
+		start, err := Offset(text, e.Range.Start, encoding)
+		if err != nil {
+			return "", err
+		}
+		end, err := Offset(text, e.Range.End, encoding)
+		if err != nil {
+			return "", err
+		}
+		if end < start {
+			return "", fmt.Errorf("edit range end is before its start")
+		}
+		resolved = append(resolved, offsetEdit{start: start, end: end, newText: e.NewText})
+	}
+
+	sort.SliceStable(resolved, func(i, j int) bool {
+		return resolved[i].start < resolved[j].start
+	})
+
+	result := make([]byte, 0, len(text))
+	last := 0
+	for _, e := range resolved {
+		if e.start < last {
+			return "", fmt.Errorf("overlapping text edits")
+		}
+		result = append(result, text[last:e.start]...)
+		result = append(result, e.newText...)
+		last = e.end
+	}
+	result = append(result, text[last:]...)
+
+	return string(result), nil
+}
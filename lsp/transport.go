@@ -0,0 +1,99 @@
+package lsp
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Transport is a connection to an LSP server provided by a registered
+// transport (see RegisterTransport), such as an in-memory pipe or a QUIC
+// stream. Messages are written and read with the base protocol's framing
+// (Content-Length headers), like over stdio. Read may return an error
+// wrapping os.ErrDeadlineExceeded to fail the requests waiting for too
+// long while keeping the connection open.
+type Transport interface {
+	io.ReadWriteCloser
+}
+
+// TransportFactory opens a Transport for a connection method of its scheme,
+// e.g. "mem:gopls" for the "mem" scheme. It is called again with the same
+// connection method when reconnecting.
+type TransportFactory func(method string) (Transport, error)
+
+var (
+	transportsMutex sync.RWMutex
+	transports      = make(map[string]TransportFactory)
+)
+
+// RegisterTransport makes a transport available for connection methods of
+// the form "scheme:...", taking precedence over TCP addresses with the same
+// host name. Built-in connection methods can't be replaced. It panics if
+// the scheme is invalid or already registered, and is meant to be called
+// from init functions.
+func RegisterTransport(scheme string, factory TransportFactory) {
+	if scheme == "" || strings.ContainsAny(scheme, ":/") {
+		panic(fmt.Sprintf("lsp: invalid transport scheme %q", scheme))
+	}
+	switch scheme {
+	case ServerConnectStdio, "http", "https", "fd", "tcp":
+		panic(fmt.Sprintf("lsp: transport scheme %q is built in", scheme))
+	}
+	if factory == nil {
+		panic("lsp: nil transport factory")
+	}
+
+	transportsMutex.Lock()
+	defer transportsMutex.Unlock()
+	if _, ok := transports[scheme]; ok {
+		panic(fmt.Sprintf("lsp: transport scheme %q already registered", scheme))
+	}
+	transports[scheme] = factory
+}
+
+// transportFactory returns the factory of the registered transport for a
+// connection method, if any.
+func transportFactory(method string) (TransportFactory, bool) {
+	scheme, _, ok := strings.Cut(method, ":")
+	if !ok {
+		return nil, false
+	}
+
+	transportsMutex.RLock()
+	defer transportsMutex.RUnlock()
+	factory, ok := transports[scheme]
+	return factory, ok
+}
+
+// serverConnTransport is a connection through a registered transport.
+type serverConnTransport struct {
+	t Transport
+}
+
+func newServerConnTransport(method string, factory TransportFactory) (*serverConnTransport, error) {
+	t, err := factory(method)
+	if err != nil {
+		return nil, err
+	}
+	if t == nil {
+		return nil, fmt.Errorf("transport for %v returned no connection", method)
+	}
+	return &serverConnTransport{t: t}, nil
+}
+
+func (c *serverConnTransport) read(p []byte) (int, error) {
+	return c.t.Read(p)
+}
+
+func (c *serverConnTransport) readErr(p []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (c *serverConnTransport) write(p []byte) (int, error) {
+	return c.t.Write(p)
+}
+
+func (c *serverConnTransport) close() error {
+	return c.t.Close()
+}
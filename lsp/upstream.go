@@ -0,0 +1,226 @@
+package lsp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// serverConnHTTP is a connection to another hyperlsp instance (upstream),
+// through its HTTP API. Messages written to the connection are sent as
+// HTTP requests, and their responses are converted back into messages to
+// be read. Messages sent by the upstream LSP server itself (notifications
+// and requests) are not received.
+type serverConnHTTP struct {
+	base   *url.URL
+	apiKey string
+	client *http.Client
+	// Parses the messages written to the connection.
+	parser *messageParser
+	reader *io.PipeReader
+	writer *io.PipeWriter
+	ctx    context.Context
+	cancel context.CancelFunc
+	logger *slog.Logger
+}
+
+// isHTTPConnect reports whether a connection method is the URL of an
+// upstream hyperlsp instance.
+func isHTTPConnect(method string) bool {
+	return strings.HasPrefix(method, "http://") || strings.HasPrefix(method, "https://")
+}
+
+func newServerConnHTTP(rawURL string, logger *slog.Logger) (*serverConnHTTP, error) {
+	base, err := url.Parse(rawURL)
+	if err != nil || base.Host == "" {
+		return nil, fmt.Errorf("invalid upstream url: %v", rawURL)
+	}
+
+	apiKey := ""
+	if base.User != nil {
+		apiKey = base.User.Username()
+		base.User = nil
+	}
+	base.Path = strings.TrimSuffix(base.Path, "/")
+
+	reader, writer := io.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &serverConnHTTP{
+		base:   base,
+		apiKey: apiKey,
+		client: &http.Client{},
+		parser: newMessageParser(),
+		reader: reader,
+		writer: writer,
+		ctx:    ctx,
+		cancel: cancel,
+		logger: logger,
+	}
+	c.parser.logger = logger
+
+	// Check that the upstream instance is reachable.
+	resp, err := c.do(http.MethodGet, "/status", nil)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("unable to reach upstream: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		cancel()
+		return nil, fmt.Errorf("upstream returned status %v", resp.StatusCode)
+	}
+
+	return c, nil
+}
+
+func (c *serverConnHTTP) read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (c *serverConnHTTP) readErr(p []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (c *serverConnHTTP) write(p []byte) (int, error) {
+	err := c.parser.write(p)
+	if err != nil {
+		return 0, err
+	}
+
+	msgs, _ := c.parser.pop()
+	for _, msg := range msgs {
+		switch {
+		case msg.Method == "":
+			// Responses to requests sent by the upstream LSP server,
+			// which are never received.
+			c.logger.Warn("discarding response sent to upstream", "id", msg.id())
+		case msg.Id == nil:
+			err := c.notify(msg)
+			if err != nil {
+				return 0, err
+			}
+		default:
+			// Responses are read after the request is written, so they
+			// must be produced concurrently.
+			go c.request(msg)
+		}
+	}
+	return len(p), nil
+}
+
+func (c *serverConnHTTP) close() error {
+	c.cancel()
+	return c.writer.Close()
+}
+
+// do sends an HTTP request to the upstream instance.
+func (c *serverConnHTTP) do(method, path string, body []byte, headers ...string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(c.ctx, method, c.base.String()+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.apiKey != "" {
+		req.Header.Set("X-API-Key", c.apiKey)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+
+	return c.client.Do(req)
+}
+
+// post sends the params of a message to an endpoint of the upstream
+// instance.
+func (c *serverConnHTTP) post(path string, msg *incomingMessage) (*http.Response, error) {
+	body, err := json.Marshal(msg.Params)
+	if err != nil {
+		return nil, err
+	}
+
+	var headers []string
+	if msg.Id != nil {
+		headers = append(headers, "X-LSP-Id", msg.id())
+	}
+	return c.do(http.MethodPost, path+msg.Method, body, headers...)
+}
+
+func (c *serverConnHTTP) notify(msg *incomingMessage) error {
+	resp, err := c.post("/notify/", msg)
+	if err != nil {
+		return fmt.Errorf("upstream error: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted {
+		data, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("upstream returned status %v: %s", resp.StatusCode, bytes.TrimSpace(data))
+	}
+	return nil
+}
+
+// request sends a request upstream, and makes its response available to
+// be read from the connection.
+func (c *serverConnHTTP) request(msg *incomingMessage) {
+	response := map[string]any{
+		"jsonrpc": jsonRpcVersion,
+		"id":      msg.Id,
+	}
+
+	start := time.Now()
+	resp, err := c.post("/lsp/", msg)
+	if err != nil {
+		if c.ctx.Err() != nil {
+			return
+		}
+		response["error"] = &ResponseError{Code: CodeInternalError, Message: fmt.Sprintf("upstream error: %v", err)}
+	} else {
+		c.logger.Debug("upstream request", "lsp_method", msg.Method, "status", resp.StatusCode, "duration", time.Since(start))
+		result, respErr := readUpstreamResponse(resp)
+		if respErr != nil {
+			response["error"] = respErr
+		} else {
+			response["result"] = result
+		}
+	}
+
+	data, err := json.Marshal(response)
+	if err != nil {
+		c.logger.Error("unable to marshal upstream response", "err", err)
+		return
+	}
+	c.writer.Write([]byte(fmt.Sprintf("Content-Length: %v\r\n\r\n%s", len(data), data)))
+}
+
+// readUpstreamResponse converts the HTTP response of an upstream instance
+// into the result or error of an LSP response.
+func readUpstreamResponse(resp *http.Response) (json.RawMessage, *ResponseError) {
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, &ResponseError{Code: CodeInternalError, Message: fmt.Sprintf("upstream error: %v", err)}
+	}
+
+	if resp.StatusCode == http.StatusOK {
+		if len(data) == 0 {
+			return json.RawMessage("null"), nil
+		}
+		return data, nil
+	}
+
+	var respErr ResponseError
+	if json.Unmarshal(data, &respErr) != nil || respErr.Message == "" {
+		respErr = ResponseError{Code: CodeInternalError, Message: fmt.Sprintf("upstream returned status %v", resp.StatusCode)}
+	}
+	return nil, &respErr
+}
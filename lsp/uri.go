@@ -0,0 +1,34 @@
+package lsp
+
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+)
+
+// URIToPath converts a file:// URI into a local file path.
+func URIToPath(uri string) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", fmt.Errorf("invalid URI %q: %w", uri, err)
+	}
+	if u.Scheme != "file" {
+		return "", fmt.Errorf("unsupported URI scheme %q", u.Scheme)
+	}
+	if u.Path == "" {
+		return "", fmt.Errorf("URI %q has no path", uri)
+	}
+
+	return filepath.FromSlash(u.Path), nil
+}
+
+// PathToURI converts a local file path into a file:// URI.
+func PathToURI(path string) string {
+	abs, err := filepath.Abs(path)
+	if err == nil {
+		path = abs
+	}
+
+	u := url.URL{Scheme: "file", Path: filepath.ToSlash(path)}
+	return u.String()
+}
@@ -0,0 +1,73 @@
+package lsp
+
+import (
+	"errors"
+	"time"
+)
+
+// Default interval between samples of the LSP server subprocess's resource
+// usage.
+const DefaultUsageInterval = 10 * time.Second
+
+// Fraction of the memory limit above which a warning is logged.
+const memoryWarningThreshold = 0.9
+
+var errUsageUnsupported = errors.New("resource usage is only available on Linux")
+
+// ProcessUsage is a sample of the resources used by the LSP server
+// subprocess.
+type ProcessUsage struct {
+	Time time.Time `json:"time"`
+	// Resident set size, in bytes.
+	RSS uint64 `json:"rss"`
+	// Total CPU time (user and system) used so far, in seconds.
+	CPUSeconds float64 `json:"cpuSeconds"`
+	// CPU usage since the previous sample, where 100 is a whole CPU.
+	CPUPercent float64 `json:"cpuPercent"`
+	// Number of open file descriptors.
+	OpenFiles int `json:"openFiles"`
+}
+
+// sampleUsage periodically samples the resource usage of the subprocess
+// pid, until it exits.
+func (s *Server) sampleUsage(pid int, interval time.Duration, exited chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var prev *ProcessUsage
+	warned := false
+	for {
+		usage, err := readUsage(pid)
+		if errors.Is(err, errUsageUnsupported) {
+			return
+		} else if err != nil {
+			// Most likely, the process has just exited.
+			s.log().Debug("unable to sample LSP server resource usage", "err", err)
+		} else {
+			if prev != nil {
+				elapsed := usage.Time.Sub(prev.Time).Seconds()
+				if elapsed > 0 {
+					usage.CPUPercent = (usage.CPUSeconds - prev.CPUSeconds) / elapsed * 100
+				}
+			}
+			prev = usage
+
+			if limit := s.limits.Memory; limit > 0 && !warned && float64(usage.RSS) > memoryWarningThreshold*float64(limit) {
+				s.log().Warn("LSP server memory usage is close to its limit", "rss", usage.RSS, "limit", limit)
+				warned = true
+			}
+
+			s.stateMutex.Lock()
+			if s.exited == exited {
+				s.usage = usage
+			}
+			s.stateMutex.Unlock()
+		}
+
+		select {
+		case <-ticker.C:
+		case <-exited:
+			return
+		}
+	}
+}
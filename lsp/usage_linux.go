@@ -0,0 +1,66 @@
+//go:build linux
+
+package lsp
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Clock ticks per second used by /proc/[pid]/stat, which is 100 on all
+// common architectures.
+const clockTicks = 100
+
+// readUsage reads the resource usage of process pid from /proc.
+func readUsage(pid int) (*ProcessUsage, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%v/stat", pid))
+	if err != nil {
+		return nil, err
+	}
+
+	// The command name (second field) may contain spaces, so fields are
+	// counted from its closing parenthesis, starting at the third one.
+	i := strings.LastIndexByte(string(data), ')')
+	if i < 0 {
+		return nil, fmt.Errorf("malformed /proc/%v/stat", pid)
+	}
+	fields := strings.Fields(string(data[i+1:]))
+	if len(fields) < 22 {
+		return nil, fmt.Errorf("malformed /proc/%v/stat", pid)
+	}
+	utime, err1 := strconv.ParseUint(fields[11], 10, 64)
+	stime, err2 := strconv.ParseUint(fields[12], 10, 64)
+	rss, err3 := strconv.ParseUint(fields[21], 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return nil, fmt.Errorf("malformed /proc/%v/stat", pid)
+	}
+
+	fds, err := os.ReadDir(fmt.Sprintf("/proc/%v/fd", pid))
+	if err != nil {
+		return nil, err
+	}
+
+	return &ProcessUsage{
+		Time:       time.Now(),
+		RSS:        rss * uint64(os.Getpagesize()),
+		CPUSeconds: float64(utime+stime) / clockTicks,
+		OpenFiles:  len(fds),
+	}, nil
+}
+
+// processState returns the state of process pid (R, S, D, T, Z, etc.), as
+// reported by /proc.
+func processState(pid int) (byte, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%v/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+	i := strings.LastIndexByte(string(data), ')')
+	if i < 0 || i+2 >= len(data) {
+		return 0, fmt.Errorf("malformed /proc/%v/stat", pid)
+	}
+	return data[i+2], nil
+}
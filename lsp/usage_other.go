@@ -0,0 +1,11 @@
+//go:build !linux
+
+package lsp
+
+func readUsage(pid int) (*ProcessUsage, error) {
+	return nil, errUsageUnsupported
+}
+
+func processState(pid int) (byte, error) {
+	return 0, errUsageUnsupported
+}
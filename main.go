@@ -2,20 +2,29 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/federicotdn/hyperlsp/lsp"
+	bolt "go.etcd.io/bbolt"
 )
 
 const idHeader = "X-LSP-Id"
 
+var internalId atomic.Uint64
+
 func baseMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		slog.Info("HTTP request", "method", req.Method, "path", req.URL.Path, "lsp_method", req.PathValue("method"))
@@ -23,13 +32,21 @@ func baseMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-func errorResponse(id string, code int, message string, data ...any) *lsp.Response {
+// newUUID returns a random (version 4) UUID.
+func newUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// errorResponse returns the response for a request which failed in the
+// proxy, with the HTTP status code as error code.
+func errorResponse(id string, status int, message string, data ...any) *lsp.Response {
 	resp := &lsp.Response{
-		Id: id,
-		Error: &lsp.ResponseError{
-			Code:    code,
-			Message: message,
-		},
+		Id:    id,
+		Error: newProxyError(status, statusErrorCode(status), message, nil),
 	}
 
 	if len(data) > 0 {
@@ -39,36 +56,159 @@ func errorResponse(id string, code int, message string, data ...any) *lsp.Respon
 	return resp
 }
 
-func handleRequest(lspSrv *lsp.Server, w http.ResponseWriter, req *http.Request) {
-	pathMethod := req.PathValue("method")
-	id := req.Header.Get(idHeader)
-	var lspResp *lsp.Response
-	var params any
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		slog.Error("unable to marshal response json", "err", err)
+		status = http.StatusInternalServerError
+		data = []byte("{}")
+	}
 
-	defer req.Body.Close()
-	err := json.NewDecoder(req.Body).Decode(&params)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(status)
+
+	_, err = w.Write(data)
 	if err != nil {
-		lspResp = errorResponse(id, http.StatusBadRequest, "unable to unmarshal request json")
-	} else if req.Method != http.MethodPost {
-		lspResp = errorResponse(id, http.StatusMethodNotAllowed, "method not allowed")
-	} else if pathMethod == "" {
-		lspResp = errorResponse(id, http.StatusBadRequest, "no LSP method specified")
-	} else {
-		msg := lsp.Message{
-			Id:     id,
-			Method: pathMethod,
-			Params: params,
+		slog.Error("error writing response data", "err", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, newProxyError(status, statusErrorCode(status), message, nil))
+}
+
+// writeCallError writes an error returned by proxy.call. Errors returned
+// by the LSP server itself are written as-is with a 400 status code, like
+// in handleRequest, and requests rejected by the limits of the proxy with
+// the same status code as in handleRequest.
+func writeCallError(w http.ResponseWriter, err error) {
+	var limitErr *limitError
+	if errors.As(err, &limitErr) {
+		for k, v := range limitErr.resp.Headers {
+			w.Header().Set(k, v)
 		}
+		writeJSON(w, limitErr.status, limitErr.resp.Error)
+		return
+	}
 
-		var err error
-		lspClient := lsp.NewClient(lspSrv)
+	var respErr *lsp.ResponseError
+	if errors.As(err, &respErr) {
+		writeJSON(w, http.StatusBadRequest, respErr)
+		return
+	}
+
+	status, code, data := errorStatus(err)
+	writeJSON(w, status, newProxyError(status, code, err.Error(), data))
+}
+
+// forward sends a request (or a notification, if id is empty) to the LSP
+// server, with additional wire headers. Along with the response, it
+// returns the HTTP status code for errors generated by the proxy itself,
+// or zero. If ctx is done before the response is received (e.g. as the
+// HTTP client has disconnected), the request is cancelled.
+func (p *proxy) forward(ctx context.Context, id, method string, params any, headers map[string]string) (*lsp.Response, int) {
+	if method == "textDocument/didOpen" {
+		release, ok := p.docs.reserve(documentURI(params))
+		if !ok {
+			return errorResponse(id, http.StatusForbidden, errDocumentQuota.Error()), http.StatusForbidden
+		}
+		defer release()
+	}
+
+	if method == "initialize" {
+		params = p.withClientCaps(params)
+	}
+
+	msg := lsp.Message{
+		Id:      id,
+		Method:  method,
+		Params:  params,
+		Headers: headers,
+	}
+
+	if id == "" {
+		p.docSync.RLock()
+		defer p.docSync.RUnlock()
+	}
+	lspClient := lsp.NewClient(p.server())
+
+	start := time.Now()
+	lspResp, err := lspClient.SendContext(ctx, &msg)
+	if ctxErr := ctx.Err(); err != nil && ctxErr != nil && errors.Is(err, ctxErr) {
+		cause := context.Cause(ctx)
+		if cause == context.Canceled {
+			cause = errClientDisconnected
+		}
+		slog.Info("LSP request cancelled", "id", id, "lsp_method", method, "reason", cause)
+		status := http.StatusConflict
+		return &lsp.Response{Id: id, Error: newProxyError(status, codeCancelled, cause.Error(), nil)}, status
+	} else if err != nil {
+		err = p.proxyError(err)
+		status, code, data := errorStatus(err)
+		resp := &lsp.Response{Id: id, Error: newProxyError(status, code, err.Error(), data)}
+		if delay, ok := p.supervisor.retryAfter(); ok && status == http.StatusServiceUnavailable {
+			resp.Headers = map[string]string{"Retry-After": retryAfterSeconds(delay)}
+		}
+		return resp, status
+	}
+	lspResp.Headers = p.headers.expose(lspResp.Headers)
+
+	if p.mirror != nil {
+		if lspResp.Notification {
+			p.mirror.notify(method, params)
+		} else {
+			primary := &lsp.Response{Result: lspResp.Result, Error: lspResp.Error}
+			p.mirror.request(method, params, primary, time.Since(start))
+		}
+	}
 
-		lspResp, err = lspClient.Send(&msg)
+	if lspResp.Notification {
+		p.observeSettings(method, params)
+		p.invalidateCaches(method, params)
+		err = p.docs.observe(method, params, p.positionEncoding())
 		if err != nil {
-			lspResp = errorResponse(id, http.StatusInternalServerError, fmt.Sprintf("proxy error: %v", err))
+			slog.Warn("unable to track document state", "lsp_method", method, "err", err)
 		}
+		if method == "initialized" {
+			p.resumeAsync()
+			p.applyStoredSettings()
+			p.startWarmup()
+			if p.preindex != nil {
+				go p.preindexWorkspace()
+			}
+		}
+	} else if lspResp.Error == nil {
+		if method == "initialize" {
+			p.setCapabilities(lspResp.Result)
+			p.setInitParams(params)
+		}
+		lspResp.Result = p.applyDiagnosticRules(method, params, lspResp.Result)
+		lspResp.Result = p.filters.apply(method, lspResp.Result)
+	}
+
+	return lspResp, 0
+}
+
+// responseStatus returns the HTTP status code for an LSP response. status
+// is the HTTP status code for errors generated by the proxy itself, or zero.
+func responseStatus(lspResp *lsp.Response, status int) int {
+	switch {
+	case status != 0:
+		return status
+	case lspResp.Error != nil:
+		return http.StatusBadRequest
+	case lspResp.Notification:
+		return http.StatusNoContent
+	default:
+		return http.StatusOK
 	}
+}
 
+// writeResponse writes an LSP response to the HTTP client. status is the
+// HTTP status code for errors generated by the proxy itself, or zero.
+func writeResponse(w http.ResponseWriter, id string, lspResp *lsp.Response, status int) {
+	var err error
 	data := []byte{}
 	if !lspResp.Notification {
 		if lspResp.Error != nil {
@@ -76,6 +216,12 @@ func handleRequest(lspSrv *lsp.Server, w http.ResponseWriter, req *http.Request)
 			if err != nil {
 				slog.Error("unable to marshal response error json", "err", err)
 			}
+		} else if raw, ok := lspResp.Result.(json.RawMessage); ok {
+			// Results received from the LSP server are written as-is.
+			data = raw
+			if len(data) == 0 {
+				data = []byte("null")
+			}
 		} else {
 			data, err = json.Marshal(&lspResp.Result)
 			if err != nil {
@@ -93,11 +239,7 @@ func handleRequest(lspSrv *lsp.Server, w http.ResponseWriter, req *http.Request)
 		w.Header().Set(idHeader, id)
 	}
 
-	if lspResp.Error != nil {
-		w.WriteHeader(http.StatusBadRequest)
-	} else if lspResp.Notification {
-		w.WriteHeader(http.StatusNoContent)
-	}
+	w.WriteHeader(responseStatus(lspResp, status))
 
 	_, err = w.Write(data)
 	if err != nil {
@@ -105,41 +247,638 @@ func handleRequest(lspSrv *lsp.Server, w http.ResponseWriter, req *http.Request)
 	}
 }
 
+func (p *proxy) handleRequest(w http.ResponseWriter, req *http.Request) {
+	pathMethod := req.PathValue("method")
+	id := req.Header.Get(idHeader)
+	if id == "" && pathMethod != "" && !lsp.IsClientNotification(pathMethod) {
+		id = newUUID()
+	}
+	var params any
+
+	defer req.Body.Close()
+	err := json.NewDecoder(req.Body).Decode(&params)
+	if err != nil {
+		status := http.StatusBadRequest
+		var data []any
+		if d := p.decodeErrorData(err); d != nil {
+			data = append(data, d)
+		}
+		writeResponse(w, id, errorResponse(id, status, "unable to unmarshal request json", data...), status)
+		return
+	} else if req.Method != http.MethodPost {
+		status := http.StatusMethodNotAllowed
+		writeResponse(w, id, errorResponse(id, status, "method not allowed"), status)
+		return
+	} else if pathMethod == "" {
+		status := http.StatusBadRequest
+		writeResponse(w, id, errorResponse(id, status, "no LSP method specified"), status)
+		return
+	}
+
+	if mutatingMethods[pathMethod] && p.denyReadOnly(w, id, pathMethod) {
+		return
+	}
+	if pathMethod == "workspace/executeCommand" && !p.allowExecuteCommand(w, req, id, params) {
+		return
+	}
+
+	p.fillLanguageId(pathMethod, params)
+	if message, data := p.checkParams(pathMethod, params); message != "" {
+		status := http.StatusBadRequest
+		writeResponse(w, id, errorResponse(id, status, message, data), status)
+		return
+	}
+	if !p.awaitReady(w, req, pathMethod) {
+		return
+	}
+
+	async := req.URL.Query().Get("async")
+	if id != "" && (async == "1" || async == "true") {
+		p.handleAsync(w, req, id, pathMethod, params)
+		return
+	}
+
+	if req.URL.Query().Get("callback") != "" {
+		writeError(w, http.StatusBadRequest, "callback requires async=1")
+		return
+	}
+
+	release, ok := p.reserveID(w, req, id)
+	if !ok {
+		return
+	}
+	defer release()
+
+	if id != "" {
+		p.setDocumentHeaders(w.Header(), documentURI(params))
+	}
+	cacheDoc, cacheable := p.cacheableQuery(id, pathMethod, params)
+	var cacheGeneration int
+	if cacheable {
+		var cached *queryCacheEntry
+		cached, cacheGeneration = p.queryCache.get(cacheDoc, pathMethod, params)
+		if cached != nil {
+			w.Header().Set(queryCacheHeader, "hit")
+			w.Header().Set("ETag", cached.etag)
+			if etagMatches(req.Header.Get("If-None-Match"), cached.etag) {
+				w.Header().Set(idHeader, id)
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			writeResponse(w, id, cached.resp, 0)
+			return
+		}
+	}
+
+	ctx, done := p.supersede(req, id, pathMethod, params)
+	defer done()
+
+	if id != "" {
+		release, resp, status := p.acquireLimits(ctx, id, pathMethod, params)
+		if resp != nil {
+			writeResponse(w, id, resp, status)
+			return
+		}
+		defer release()
+	}
+	if superseded(ctx) {
+		writeCancelled(w, id, errSuperseded)
+		return
+	}
+
+	lspResp, status := p.forward(ctx, id, pathMethod, params, p.headers.forward(req.Header))
+	if cacheable {
+		if etag, ok := p.cacheResponse(cacheDoc, cacheGeneration, pathMethod, params, lspResp, status); ok {
+			w.Header().Set("ETag", etag)
+		}
+		w.Header().Set(queryCacheHeader, "miss")
+	}
+	writeResponse(w, id, lspResp, status)
+}
+
+// handleNotify sends a notification with the params in the body (which may
+// be empty), regardless of the method or the presence of an ID header.
+func (p *proxy) handleNotify(w http.ResponseWriter, req *http.Request) {
+	method := req.PathValue("method")
+	var params any
+
+	defer req.Body.Close()
+	err := json.NewDecoder(req.Body).Decode(&params)
+	if err != nil && err != io.EOF {
+		writeError(w, http.StatusBadRequest, "unable to unmarshal request json")
+		return
+	}
+	if method == "" {
+		writeError(w, http.StatusBadRequest, "no LSP method specified")
+		return
+	}
+	p.fillLanguageId(method, params)
+	if message, data := p.checkParams(method, params); message != "" {
+		writeJSON(w, http.StatusBadRequest, newProxyError(http.StatusBadRequest, codeInvalidRequest, message, data))
+		return
+	}
+	if method == "textDocument/didOpen" {
+		release, ok := p.docs.reserve(documentURI(params))
+		if !ok {
+			writeError(w, http.StatusForbidden, errDocumentQuota.Error())
+			return
+		}
+		defer release()
+	}
+	if !p.awaitReady(w, req, method) {
+		return
+	}
+
+	p.docSync.RLock()
+	defer p.docSync.RUnlock()
+	msg := lsp.Message{Method: method, Params: params, Headers: p.headers.forward(req.Header)}
+	_, err = lsp.NewClient(p.server()).SendContext(req.Context(), &msg)
+	if err != nil {
+		writeCallError(w, p.proxyError(err))
+		return
+	}
+
+	if p.mirror != nil {
+		p.mirror.notify(method, params)
+	}
+	p.observeSettings(method, params)
+	p.invalidateCaches(method, params)
+	err = p.docs.observe(method, params, p.positionEncoding())
+	if err != nil {
+		slog.Warn("unable to track document state", "lsp_method", method, "err", err)
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == lsp.ExecLimitedCommand {
+		os.Exit(lsp.ExecLimited(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "replay-http" {
+		os.Exit(replayHTTP(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		os.Exit(bench(os.Args[2:]))
+	}
+
 	addr := flag.String("addr", "localhost:8080", "Address to bind HTTP server to")
-	connect := flag.String("connect", lsp.ServerConnectStdio, "Connection method to use with LSP server")
+	connect := flag.String("connect", lsp.ServerConnectStdio, "Connection method to use with LSP server, or a comma-separated list of methods to try in order")
+	cmdLine := flag.String("cmd", "", "Command line of the LSP server subprocess, split like a shell would (instead of positional arguments)")
+	configPath := flag.String("config", "", "Path to JSON configuration file")
+	startupScript := flag.String("startup-script", "", "JSON Lines file of LSP requests and notifications to send after connecting to the LSP server")
+	harPath := flag.String("har", "", "Record HTTP requests, responses and LSP messages to a HAR file")
+	limits := limitsConfig{}
+	flag.StringVar(&limits.Memory, "memory-limit", "", "Memory limit for the LSP server subprocess, e.g. 2G")
+	flag.StringVar(&limits.CPUTime, "cpu-time-limit", "", "CPU time limit for the LSP server subprocess, e.g. 1h")
+	flag.StringVar(&limits.Cgroup, "cgroup", "", "Parent cgroup (v2) directory to place the LSP server subprocess in")
+	flag.Float64Var(&limits.CPUQuota, "cpu-quota", 0, "Maximum number of CPUs the LSP server subprocess may use (requires -cgroup)")
+	usageInterval := flag.String("usage-interval", "", "Interval between samples of the LSP server subprocess's resource usage, e.g. 30s (default 10s, 0s to disable)")
+	restart := restartConfig{}
+	flag.StringVar(&restart.Policy, "restart", restartOnFailure, "Restart policy for the LSP server subprocess: never, on-failure or always")
+	maxRestarts := flag.Int("max-restarts", defaultMaxRestarts, "Maximum number of consecutive LSP server restarts (0 for no limit)")
+	maxConcurrent := flag.Int("max-concurrent", 0, "Maximum number of requests sent to the LSP server at the same time (0 for no limit)")
+	maxQueue := flag.Int("max-queue", defaultMaxQueue, "Maximum number of requests waiting for -max-concurrent before new ones are rejected")
+	probeInterval := flag.Duration("probe-interval", 0, "Interval between liveness probes of the LSP server, e.g. 10s (0 to disable)")
+	probeTimeout := flag.Duration("probe-timeout", defaultProbeTimeout, "Maximum time to wait for the LSP server to answer a liveness probe")
+	swapCmd := flag.String("swap-cmd", "", "Command line of the LSP server subprocess started when swapping servers via /admin/server/swap (default: the current server's command)")
+	shadowCmd := flag.String("shadow-cmd", "", "Command line of a shadow LSP server subprocess, sent the same traffic as the LSP server to compare their responses via /compare")
+	filters := resultFilters{}
+	flag.Var(filters, "filter", "Result filters to apply to an LSP method, as method=filter[,filter...] (can be repeated)")
+	fc := floodControl{rates: notificationRates{}, windows: notificationWindows{}}
+	flag.Var(fc.rates, "notify-rate", "Maximum number of notifications of an LSP method streamed via /events per second, as method=rate (can be repeated)")
+	flag.Var(fc.windows, "notify-coalesce", "Only stream the latest notification of an LSP method (per document or progress token) during a period, as method=duration (can be repeated)")
+	logCfg := logConfig{}
+	flag.StringVar(&logCfg.Level, "log-level", "info", "Minimum level of log records: debug, info, warn or error")
+	flag.StringVar(&logCfg.Format, "log-format", "text", "Log format: text or json")
+	flag.StringVar(&logCfg.File, "log-file", "", "Write logs to a file instead of stderr")
+	logMaxSize := flag.String("log-max-size", "100M", "Size at which the log file is rotated (0 to disable rotation)")
+	flag.IntVar(&logCfg.MaxBackups, "log-max-backups", 5, "Number of rotated log files to keep")
+	webhookSecret := flag.String("webhook-secret", "", "Secret used to sign async result callbacks (enables callbacks)")
+	enableGraphQL := flag.Bool("graphql", false, "Enable the /graphql endpoint")
+	watch := flag.Bool("watch", false, "Reload tracked documents when their files are changed on disk by other tools")
+	watchInterval := flag.Duration("watch-interval", defaultWatchInterval, "Interval between checks of tracked files with -watch")
+	preindex := flag.String("preindex", "", "Comma-separated list of glob patterns (relative to the workspace root) of files to open once the LSP server is initialized, to force it to index them")
+	preindexTimeout := flag.Duration("preindex-timeout", defaultPreindexTimeout, "Maximum time to wait for the LSP server to publish diagnostics for a pre-indexed file before closing it")
+	warmupPath := flag.String("warmup", "", "JSON Lines file of LSP requests to send and files to open whenever the LSP server has been initialized")
+	queryCacheSize := flag.Int("query-cache", 0, "Maximum number of hover, definition and document symbol results of open documents to cache (0 to disable)")
+	roots := flag.String("root", "", "Comma-separated list of directories that file URIs in requests must be contained in (default: any)")
+	readOnly := flag.Bool("read-only", false, "Reject operations which modify files (applying edits, formatting write-back, workspace/executeCommand), only allowing queries")
+	serverEdits := flag.String("server-edits", serverEditsReject, "How to handle workspace/applyEdit requests of the LSP server: reject, approve (queue them for approval via /edits) or apply")
+	approvalTimeout := flag.Duration("approval-timeout", defaultApprovalTimeout, "Maximum time edits of the LSP server wait for approval with -server-edits approve")
+	validate := flag.Bool("validate", false, "Validate the params of known LSP methods before sending them to the LSP server")
+	headers := headersConfig{}
+	exposeHeaders := flag.String("expose-headers", "", "Comma-separated list of LSP response headers to surface as HTTP response headers (* for all)")
+	flag.StringVar(&headers.ExposePrefix, "expose-headers-prefix", "", "Prefix to add to the names of exposed LSP response headers")
+	readyGate := flag.String("ready-gate", gateOff, "How to handle LSP requests received before the LSP server is initialized: off, queue or reject")
+	readyTimeout := flag.Duration("ready-timeout", defaultGateTimeout, "Maximum time requests are queued for with -ready-gate queue")
+	invalidUTF8 := flag.String("invalid-utf8", lsp.InvalidUTF8Reject, "How to handle LSP server messages with invalid UTF-8 content: reject or replace")
+	readBufferSize := flag.String("read-buffer-size", "", "Size of the buffer used to read from the LSP server, e.g. 64K (default 4K)")
+	compression := flag.String("wire-compression", "", "Offer to compress messages exchanged with the LSP server, for servers supporting it: gzip or zstd")
+	var tcp tcpConfig
+	flag.StringVar(&tcp.ReadTimeout, "tcp-read-timeout", "", "Maximum time to wait for data from a TCP LSP server while waiting for a response, e.g. 30s")
+	flag.StringVar(&tcp.WriteTimeout, "tcp-write-timeout", "", "Maximum time a write to a TCP LSP server may take, e.g. 10s")
+	flag.StringVar(&tcp.DialRetry, "connect-retry", "", "Keep retrying to connect to a TCP LSP server for this long, with exponential backoff, e.g. 30s")
+	tcpNoDelay := flag.Bool("tcp-nodelay", true, "Disable Nagle's algorithm (TCP_NODELAY) on the connection to a TCP LSP server")
+	flag.StringVar(&tcp.KeepAlive, "tcp-keepalive", "", "Interval between keep-alive probes on the connection to a TCP LSP server, e.g. 30s (negative to disable)")
+	flag.StringVar(&tcp.ReadBuffer, "tcp-read-buffer", "", "Receive buffer size of the connection to a TCP LSP server, e.g. 256K")
+	flag.StringVar(&tcp.WriteBuffer, "tcp-write-buffer", "", "Send buffer size of the connection to a TCP LSP server, e.g. 256K")
+	forwardHeaders := flag.String("forward-headers", "", "Comma-separated list of HTTP request headers to attach to outgoing LSP messages")
+	asyncStore := flag.String("async-store", "", "Persist async requests and results in a database file")
+	settingsStorePath := flag.String("settings-store", "", "Persist the settings of the LSP server in a database file (may be the same as -async-store)")
+	webhookHosts := flag.String("webhook-hosts", "", "Comma-separated list of hosts async result callbacks may be sent to (default: any)")
+	accessLogPath := flag.String("access-log", "", "Write an HTTP access log to a file (- for stdout)")
+	accessLogFormat := flag.String("access-log-format", accessLogCombined, "Access log format: combined or json")
 	flag.Parse()
 
+	maxSize, err := lsp.ParseSize(*logMaxSize)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid log max size: %v\n", err)
+		os.Exit(1)
+	}
+	logCfg.MaxSize = int64(maxSize)
+
+	logHandler, err := logCfg.newHandler()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to set up logging: %v\n", err)
+		os.Exit(1)
+	}
+
+	logs := newLogHub()
+	slog.SetDefault(slog.New(teeHandler{logHandler, logs.handler()}))
+
 	slog.Info("starting hyperlsp server")
 
 	args := flag.Args()
+	if *cmdLine != "" {
+		if len(args) > 0 {
+			slog.Error("-cmd cannot be used along with positional arguments")
+			os.Exit(1)
+		}
+		args, err = splitCommand(*cmdLine)
+		if err != nil {
+			slog.Error("invalid LSP server command", "err", err)
+			os.Exit(1)
+		}
+	}
 
-	var lspSrv *lsp.Server
-	if len(args) > 0 {
-		lspSrv = lsp.NewSubprocessServer(args[0], args[1:]...)
-	} else {
-		lspSrv = lsp.NewExternalServer()
+	if !validGateMode(*readyGate) {
+		slog.Error("invalid readiness gate mode", "mode", *readyGate)
+		os.Exit(1)
 	}
 
-	err := lspSrv.Connect(*connect)
-	if err != nil {
-		slog.Error("unable to connect to LSP server", "err", err)
+	if !validServerEditsMode(*serverEdits) {
+		slog.Error("invalid server edits mode", "mode", *serverEdits)
 		os.Exit(1)
 	}
 
-	mux := http.NewServeMux()
-	srv := http.Server{Addr: *addr, Handler: mux}
+	if *readOnly && *serverEdits != serverEditsReject {
+		slog.Error("-server-edits cannot be used with -read-only")
+		os.Exit(1)
+	}
 
-	methods := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		handleRequest(lspSrv, w, req)
-	})
+	if *approvalTimeout <= 0 {
+		slog.Error("invalid approval timeout", "timeout", *approvalTimeout)
+		os.Exit(1)
+	}
 
-	notfound := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		http.NotFound(w, req)
-	})
+	if *watch && *watchInterval <= 0 {
+		slog.Error("invalid watch interval", "interval", *watchInterval)
+		os.Exit(1)
+	}
+
+	if *preindexTimeout <= 0 {
+		slog.Error("invalid pre-indexing timeout", "timeout", *preindexTimeout)
+		os.Exit(1)
+	}
+
+	if *queryCacheSize < 0 {
+		slog.Error("invalid query cache size", "size", *queryCacheSize)
+		os.Exit(1)
+	}
+
+	if *maxConcurrent < 0 || *maxQueue < 0 {
+		slog.Error("invalid concurrency limits", "max_concurrent", *maxConcurrent, "max_queue", *maxQueue)
+		os.Exit(1)
+	}
+
+	if *probeInterval < 0 || *probeTimeout <= 0 {
+		slog.Error("invalid liveness probe configuration", "interval", *probeInterval, "timeout", *probeTimeout)
+		os.Exit(1)
+	}
+
+	restart.MaxRestarts = maxRestarts
+	if err := restart.validate(); err != nil {
+		slog.Error("invalid restart configuration", "err", err)
+		os.Exit(1)
+	}
+
+	cfg := &config{}
+	if *configPath != "" {
+		var err error
+		cfg, err = loadConfig(*configPath)
+		if err != nil {
+			slog.Error("unable to load config", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	languages := newLanguageDetector(cfg.Extensions, cfg.Interpreters)
+
+	var warmup []warmupCall
+	if *warmupPath != "" {
+		warmup, err = loadWarmup(*warmupPath)
+		if err != nil {
+			slog.Error("unable to load warmup file", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	var handler http.Handler
+	var tenants tenantRouter
+	var shutdown func()
+	var servers []*lsp.Server
+	var proxies []*proxy
+
+	var sandbox []string
+	if *roots != "" {
+		if len(cfg.Tenants) > 0 {
+			slog.Error("-root cannot be used with tenants, which have their own roots")
+			os.Exit(1)
+		}
+		sandbox, err = sandboxRoots(strings.Split(*roots, ","))
+		if err != nil {
+			slog.Error("invalid root", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	if *shadowCmd != "" && (len(cfg.Tenants) > 0 || len(cfg.Servers) > 0) {
+		slog.Error("-shadow-cmd cannot be used with multiple servers")
+		os.Exit(1)
+	}
+	if *swapCmd != "" && (len(cfg.Tenants) > 0 || len(cfg.Servers) > 0) {
+		slog.Error("-swap-cmd cannot be used with multiple servers")
+		os.Exit(1)
+	}
+
+	if len(cfg.Tenants) > 0 {
+		if len(args) > 0 {
+			slog.Error("LSP server command cannot be specified when tenants are configured")
+			os.Exit(1)
+		}
+
+		tenants, err = newTenantRouter(cfg.Tenants, filters)
+		if err != nil {
+			slog.Error("unable to set up tenants", "err", err)
+			os.Exit(1)
+		}
+
+		handler = tenants
+		shutdown = tenants.shutdown
+		for _, t := range tenants {
+			servers = append(servers, t.proxy.server())
+			proxies = append(proxies, t.proxy)
+		}
+	} else if len(cfg.Servers) > 0 {
+		if len(args) > 0 {
+			slog.Error("LSP server command cannot be specified when servers are configured")
+			os.Exit(1)
+		}
+
+		lr, err := newLanguageRouter(cfg.Servers, languages, filters)
+		if err != nil {
+			slog.Error("unable to set up servers", "err", err)
+			os.Exit(1)
+		}
 
-	mux.Handle("/lsp/{method...}", baseMiddleware(methods))
-	mux.Handle("/", baseMiddleware(notfound))
+		handler = lr
+		shutdown = lr.shutdown
+		for _, rs := range lr.servers {
+			servers = append(servers, rs.proxy.server())
+			proxies = append(proxies, rs.proxy)
+		}
+	} else {
+		if *exposeHeaders != "" {
+			headers.Expose = strings.Split(*exposeHeaders, ",")
+		}
+		if *forwardHeaders != "" {
+			headers.Forward = strings.Split(*forwardHeaders, ",")
+		}
+		tcp.NoDelay = tcpNoDelay
+		sc := serverConfig{Command: args, Connect: *connect, Limits: limits, UsageInterval: *usageInterval, Restart: restart, Headers: headers, InvalidUTF8: *invalidUTF8, TCP: tcp, ReadBufferSize: *readBufferSize, Compression: *compression}
+		lspSrv, err := sc.start()
+		if err != nil {
+			slog.Error("unable to connect to LSP server", "err", err)
+			os.Exit(1)
+		}
+
+		p := newProxy(lspSrv, filters)
+		p.supervisor.configure(sc.Restart)
+		p.headers = sc.Headers
+		handler = p.routes()
+		servers = append(servers, lspSrv)
+		proxies = append(proxies, p)
+
+		if *swapCmd != "" {
+			p.swapCommand, err = splitCommand(*swapCmd)
+			if err != nil {
+				slog.Error("invalid swap LSP server command", "err", err)
+				os.Exit(1)
+			}
+		}
+
+		if *shadowCmd != "" {
+			ssc := sc
+			ssc.Command, err = splitCommand(*shadowCmd)
+			if err != nil {
+				slog.Error("invalid shadow LSP server command", "err", err)
+				os.Exit(1)
+			}
+			shadowSrv, err := ssc.start()
+			if err != nil {
+				slog.Error("unable to connect to shadow LSP server", "err", err)
+				os.Exit(1)
+			}
+			p.mirror = newMirror(shadowSrv, *shadowCmd)
+		}
+
+		shutdown = func() {
+			err := p.shutdown()
+			if err != nil {
+				slog.Error("error shuttting down LSP server", "err", err)
+			}
+			if p.mirror != nil {
+				p.mirror.srv.ShutdownAndExit()
+			}
+		}
+	}
+
+	var hosts []string
+	if *webhookHosts != "" {
+		hosts = strings.Split(*webhookHosts, ",")
+	}
+	webhooks := newWebhookSender(*webhookSecret, hosts)
+	for _, p := range proxies {
+		p.webhooks = webhooks
+		p.validate = *validate
+		p.readOnly = *readOnly
+		p.serverEdits = *serverEdits
+		p.approvalTimeout = *approvalTimeout
+		p.gate = *readyGate
+		p.gateTimeout = *readyTimeout
+		p.languages = languages
+		p.diagnosticRules = cfg.DiagnosticRules
+		p.classes = newMethodClasses(cfg.MethodClasses)
+		if sandbox != nil {
+			p.roots = sandbox
+		}
+		if len(cfg.Commands) > 0 {
+			p.commands = newCommandAllowlist(cfg.Commands)
+		}
+		if len(cfg.StderrDetectors) > 0 {
+			p.stderrDetectors = newStderrDetectors(cfg.StderrDetectors)
+			p.server().SetStderrHandler(p.handleStderr)
+		}
+		p.floodControl = fc
+		if *watch {
+			go p.watchFiles(*watchInterval)
+		}
+		p.warmup = warmup
+		if *preindex != "" {
+			p.preindex = newPreindexer(strings.Split(*preindex, ","), *preindexTimeout)
+		}
+		if *queryCacheSize > 0 {
+			p.queryCache = newQueryCache(*queryCacheSize)
+		}
+		if *maxConcurrent > 0 {
+			p.limiter = newConcurrencyLimiter(*maxConcurrent, *maxQueue)
+		}
+		if *probeInterval > 0 {
+			go p.probeServer(*probeInterval, *probeTimeout)
+		}
+
+		if *enableGraphQL {
+			schema, err := p.graphqlSchema()
+			if err != nil {
+				slog.Error("unable to build GraphQL schema", "err", err)
+				os.Exit(1)
+			}
+			p.graphql = &schema
+		}
+	}
+
+	// Database files, which may be shared by the async and settings stores.
+	databases := make(map[string]*bolt.DB)
+	defer func() {
+		for _, db := range databases {
+			db.Close()
+		}
+	}()
+	openDatabase := func(path, store string) *bolt.DB {
+		if db, ok := databases[path]; ok {
+			return db
+		}
+		db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+		if err != nil {
+			slog.Error("unable to open store", "store", store, "err", err)
+			os.Exit(1)
+		}
+		databases[path] = db
+		return db
+	}
+
+	// Buckets of each proxy's state in the stores.
+	storeBucket := func(prefix string, i int) string {
+		if len(cfg.Tenants) > 0 {
+			return prefix + ":" + cfg.Tenants[i].Name
+		} else if len(cfg.Servers) > 0 {
+			return prefix + ":" + cfg.Servers[i].Name
+		}
+		return prefix
+	}
+
+	if *settingsStorePath != "" {
+		db := openDatabase(*settingsStorePath, "settings")
+		for i, p := range proxies {
+			store, settings, err := openSettingsStore(db, storeBucket("settings", i))
+			if err != nil {
+				slog.Error("unable to load settings store", "err", err)
+				os.Exit(1)
+			}
+			p.settingsStore = store
+			if settings != nil {
+				p.settings = map[string]any{"settings": settings}
+			}
+		}
+	}
+
+	if *asyncStore != "" {
+		db := openDatabase(*asyncStore, "async")
+
+		for i, p := range proxies {
+			undelivered, err := p.results.open(db, storeBucket("results", i))
+			if err != nil {
+				slog.Error("unable to load async store", "err", err)
+				os.Exit(1)
+			}
+			for _, r := range undelivered {
+				go p.deliverAsync(r)
+			}
+		}
+	}
+
+	if *harPath != "" {
+		hr, err := newHARRecorder(*harPath)
+		if err != nil {
+			slog.Error("unable to create HAR file", "err", err)
+			os.Exit(1)
+		}
+		defer hr.close()
+
+		for _, s := range servers {
+			s.SetTracer(hr.traceLSP)
+		}
+		if tenants != nil {
+			// Requests are only recorded once authenticated.
+			for _, t := range tenants {
+				t.handler = hr.middleware(t.handler)
+			}
+		} else {
+			handler = hr.middleware(handler)
+		}
+	}
+
+	// Logs are shared by all tenants, so they are only exposed when there
+	// are none.
+	if len(cfg.Tenants) == 0 {
+		mux := http.NewServeMux()
+		mux.Handle("GET /debug/logs", baseMiddleware(http.HandlerFunc(logs.handleLogs)))
+		mux.Handle("/", handler)
+		handler = mux
+	}
+
+	handler = versionMiddleware(handler)
+
+	if *accessLogPath != "" {
+		al, err := newAccessLogger(*accessLogPath, *accessLogFormat, logCfg.MaxSize, logCfg.MaxBackups)
+		if err != nil {
+			slog.Error("unable to set up access log", "err", err)
+			os.Exit(1)
+		}
+		handler = al.middleware(handler)
+	}
+
+	if *startupScript != "" {
+		err := runStartupScript(*startupScript, handler)
+		if err != nil {
+			slog.Error("startup script failed", "err", err)
+			shutdown()
+			os.Exit(1)
+		}
+	}
+
+	srv := http.Server{Addr: *addr, Handler: handler}
 
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, os.Interrupt, os.Kill)
@@ -147,10 +886,7 @@ func main() {
 		<-sig
 		slog.Info("shutting down servers...")
 
-		err := lspSrv.ShutdownAndExit()
-		if err != nil {
-			slog.Error("error shuttting down LSP server", "err", err)
-		}
+		shutdown()
 		if err := srv.Shutdown(context.Background()); err != nil {
 			slog.Error("error shuttting down HTTP server", "err", err)
 		}
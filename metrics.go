@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// metric is a single sample exposed via /metrics.
+type metric struct {
+	name string
+	help string
+	// Either "gauge" or "counter".
+	kind  string
+	value float64
+}
+
+// metrics returns the current metrics of the proxy and its LSP server.
+func (p *proxy) metrics() []metric {
+	ms := []metric{
+		{"hyperlsp_documents", "Number of documents tracked.", "gauge", float64(len(p.docs.list()))},
+	}
+	if p.queryCache != nil {
+		entries, hits, misses, invalidations := p.queryCache.stats()
+		ms = append(ms,
+			metric{"hyperlsp_query_cache_entries", "Number of query results cached.", "gauge", float64(entries)},
+			metric{"hyperlsp_query_cache_hits_total", "Number of queries served from the query cache.", "counter", float64(hits)},
+			metric{"hyperlsp_query_cache_misses_total", "Number of cacheable queries not found in the query cache.", "counter", float64(misses)},
+			metric{"hyperlsp_query_cache_invalidations_total", "Number of query results dropped from the query cache because they may be stale.", "counter", float64(invalidations)},
+		)
+	}
+
+	status := p.server().Status()
+	if status == nil {
+		return ms
+	}
+
+	up := 0.0
+	if status.Running {
+		up = 1
+	}
+	ms = append(ms,
+		metric{"hyperlsp_server_up", "Whether the LSP server subprocess is running.", "gauge", up},
+		metric{"hyperlsp_server_restarts_total", "Number of times the LSP server subprocess has been restarted.", "counter", float64(status.Restarts)},
+	)
+
+	if usage := status.Usage; usage != nil {
+		ms = append(ms,
+			metric{"hyperlsp_server_resident_memory_bytes", "Resident memory size of the LSP server subprocess.", "gauge", float64(usage.RSS)},
+			metric{"hyperlsp_server_cpu_seconds_total", "CPU time used by the LSP server subprocess.", "counter", usage.CPUSeconds},
+			metric{"hyperlsp_server_cpu_percent", "CPU usage of the LSP server subprocess, where 100 is a whole CPU.", "gauge", usage.CPUPercent},
+			metric{"hyperlsp_server_open_fds", "Number of file descriptors opened by the LSP server subprocess.", "gauge", float64(usage.OpenFiles)},
+		)
+	}
+	return ms
+}
+
+// writeMetrics writes sets of metrics in the Prometheus text format. If
+// there is more than one set, each is labeled with its server's name.
+func writeMetrics(w http.ResponseWriter, names []string, sets [][]metric) {
+	var sb strings.Builder
+	written := make(map[string]bool)
+	for i, ms := range sets {
+		for _, m := range ms {
+			if written[m.name] {
+				continue
+			}
+			written[m.name] = true
+
+			fmt.Fprintf(&sb, "# HELP %v %v\n", m.name, m.help)
+			fmt.Fprintf(&sb, "# TYPE %v %v\n", m.name, m.kind)
+			// All samples of a metric must be written together.
+			for j := i; j < len(sets); j++ {
+				for _, other := range sets[j] {
+					if other.name != m.name {
+						continue
+					}
+					labels := ""
+					if len(sets) > 1 {
+						labels = fmt.Sprintf("{server=%q}", names[j])
+					}
+					fmt.Fprintf(&sb, "%v%v %v\n", m.name, labels, strconv.FormatFloat(other.value, 'g', -1, 64))
+				}
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(sb.String()))
+}
+
+// handleMetrics returns the metrics of the proxy and its LSP server.
+func (p *proxy) handleMetrics(w http.ResponseWriter, req *http.Request) {
+	writeMetrics(w, []string{""}, [][]metric{p.metrics()})
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/federicotdn/hyperlsp/lsp"
+)
+
+const (
+	// Number of messages waiting to be sent to the shadow server before
+	// new ones are dropped.
+	mirrorQueueSize = 256
+	// Number of the latest mismatches kept for /compare.
+	maxMismatchRecords = 100
+	// Diffs longer than this are truncated.
+	maxMismatchDiff = 16 * 1024
+)
+
+// mirrorMessage is a message sent to the primary LSP server, to be sent to
+// the shadow server as well. For requests, it includes the primary server's
+// response and how long it took.
+type mirrorMessage struct {
+	method  string
+	params  any
+	request bool
+	primary *lsp.Response
+	latency time.Duration
+}
+
+// mismatch is a request to which the shadow server answered differently
+// than the primary server.
+type mismatch struct {
+	Time      time.Time `json:"time"`
+	Method    string    `json:"method"`
+	PrimaryMs float64   `json:"primaryMs"`
+	ShadowMs  float64   `json:"shadowMs"`
+	// Unified diff of the responses, as indented JSON.
+	Diff string `json:"diff,omitempty"`
+	// Error sending the request to the shadow server, if any.
+	Error string `json:"error,omitempty"`
+}
+
+// methodComparison aggregates the comparisons of a method's responses.
+type methodComparison struct {
+	Requests   int `json:"requests"`
+	Matches    int `json:"matches"`
+	Mismatches int `json:"mismatches"`
+	// Requests which could not be sent to the shadow server.
+	Errors int `json:"errors"`
+	// Total latencies of the requests answered by both servers.
+	primary time.Duration
+	shadow  time.Duration
+}
+
+func (mc *methodComparison) MarshalJSON() ([]byte, error) {
+	type alias methodComparison
+	var primary, shadow time.Duration
+	if answered := mc.Requests - mc.Errors; answered > 0 {
+		primary = mc.primary / time.Duration(answered)
+		shadow = mc.shadow / time.Duration(answered)
+	}
+	return json.Marshal(struct {
+		*alias
+		PrimaryAvgMs float64 `json:"primaryAvgMs"`
+		ShadowAvgMs  float64 `json:"shadowAvgMs"`
+		DeltaAvgMs   float64 `json:"deltaAvgMs"`
+	}{(*alias)(mc), milliseconds(primary), milliseconds(shadow), milliseconds(shadow - primary)})
+}
+
+// milliseconds returns d in milliseconds, with microsecond precision.
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// mirror sends the traffic of the primary LSP server to a shadow server as
+// well, e.g. a newer version of the same server, and compares their
+// responses and latencies. Messages are sent to the shadow server in the
+// order they were sent to the primary server, one at a time, so that
+// mirroring never slows down the primary server.
+type mirror struct {
+	srv     *lsp.Server
+	command string
+	queue   chan mirrorMessage
+
+	mutex      sync.Mutex
+	methods    map[string]*methodComparison
+	mismatches []mismatch
+	// Messages dropped because the queue was full.
+	dropped int
+}
+
+func newMirror(srv *lsp.Server, command string) *mirror {
+	m := &mirror{
+		srv:     srv,
+		command: command,
+		queue:   make(chan mirrorMessage, mirrorQueueSize),
+		methods: make(map[string]*methodComparison),
+	}
+	go m.run()
+	return m
+}
+
+// mirrored reports whether messages of a method are sent to the shadow
+// server. The shadow server's lifecycle is managed separately, and request
+// IDs don't match between the servers.
+func mirrored(method string) bool {
+	switch method {
+	case "shutdown", "exit", "$/cancelRequest":
+		return false
+	}
+	return true
+}
+
+// notify queues a notification sent to the primary server.
+func (m *mirror) notify(method string, params any) {
+	m.enqueue(mirrorMessage{method: method, params: params})
+}
+
+// request queues a request answered by the primary server.
+func (m *mirror) request(method string, params any, primary *lsp.Response, latency time.Duration) {
+	m.enqueue(mirrorMessage{method: method, params: params, request: true, primary: primary, latency: latency})
+}
+
+func (m *mirror) enqueue(msg mirrorMessage) {
+	if !mirrored(msg.method) {
+		return
+	}
+	select {
+	case m.queue <- msg:
+	default:
+		m.mutex.Lock()
+		m.dropped++
+		m.mutex.Unlock()
+	}
+}
+
+func (m *mirror) run() {
+	for msg := range m.queue {
+		if !msg.request {
+			_, err := lsp.NewClient(m.srv).Send(&lsp.Message{Method: msg.method, Params: msg.params})
+			if err != nil {
+				slog.Warn("unable to mirror notification", "lsp_method", msg.method, "err", err)
+			}
+			continue
+		}
+
+		start := time.Now()
+		resp, err := lsp.NewClient(m.srv).Send(&lsp.Message{
+			Id:     fmt.Sprintf("hyperlsp-shadow-%v", internalId.Add(1)),
+			Method: msg.method,
+			Params: msg.params,
+		})
+		m.compare(msg, resp, time.Since(start), err)
+	}
+}
+
+// comparableResponse returns a response's result or error as indented JSON,
+// which is equal for equivalent responses, as object keys are sorted.
+func comparableResponse(resp *lsp.Response) string {
+	v := map[string]any{"result": decodeResult(resp.Result)}
+	if resp.Error != nil {
+		v = map[string]any{"error": map[string]any{"code": resp.Error.Code, "message": resp.Error.Message}}
+	}
+	data, _ := json.MarshalIndent(v, "", "  ")
+	return string(data) + "\n"
+}
+
+// compare records the shadow server's response to a request.
+func (m *mirror) compare(msg mirrorMessage, resp *lsp.Response, latency time.Duration, err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	mc, ok := m.methods[msg.method]
+	if !ok {
+		mc = &methodComparison{}
+		m.methods[msg.method] = mc
+	}
+	mc.Requests++
+
+	record := mismatch{
+		Time:      time.Now(),
+		Method:    msg.method,
+		PrimaryMs: milliseconds(msg.latency),
+		ShadowMs:  milliseconds(latency),
+	}
+	if err != nil {
+		mc.Errors++
+		record.Error = err.Error()
+	} else {
+		mc.primary += msg.latency
+		mc.shadow += latency
+		record.Diff = unifiedDiff("primary", "shadow", comparableResponse(msg.primary), comparableResponse(resp))
+		if record.Diff == "" {
+			mc.Matches++
+			return
+		}
+		mc.Mismatches++
+		if len(record.Diff) > maxMismatchDiff {
+			record.Diff = record.Diff[:maxMismatchDiff] + "\n[truncated]\n"
+		}
+	}
+
+	m.mismatches = append(m.mismatches, record)
+	if len(m.mismatches) > maxMismatchRecords {
+		m.mismatches = m.mismatches[len(m.mismatches)-maxMismatchRecords:]
+	}
+}
+
+// handleCompare reports how the shadow server's responses compare to the
+// primary server's, by method, along with the latest mismatches. The
+// optional ?method= parameter only reports the mismatches of a method.
+func (p *proxy) handleCompare(w http.ResponseWriter, req *http.Request) {
+	m := p.mirror
+	if m == nil {
+		writeError(w, http.StatusNotFound, "mirroring is not enabled, see -shadow-cmd")
+		return
+	}
+	method := req.URL.Query().Get("method")
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	mismatches := []mismatch{}
+	for _, record := range m.mismatches {
+		if method == "" || record.Method == method {
+			mismatches = append(mismatches, record)
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"shadow": map[string]any{
+			"command": m.command,
+			"process": m.srv.Status(),
+		},
+		"queued":     len(m.queue),
+		"dropped":    m.dropped,
+		"methods":    m.methods,
+		"mismatches": mismatches,
+	})
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/federicotdn/hyperlsp/lsp"
+)
+
+// outlineSymbol is a symbol of a document's outline, normalized from
+// either a DocumentSymbol or a SymbolInformation.
+type outlineSymbol struct {
+	Name   string `json:"name"`
+	Detail string `json:"detail,omitempty"`
+	Kind   string `json:"kind"`
+	// Name of the symbol containing this one, in flat outlines.
+	ContainerName  string           `json:"containerName,omitempty"`
+	Range          lsp.Range        `json:"range"`
+	SelectionRange lsp.Range        `json:"selectionRange"`
+	Children       []*outlineSymbol `json:"children,omitempty"`
+}
+
+// documentSymbol represents both the DocumentSymbol and SymbolInformation
+// types, which can be returned by textDocument/documentSymbol.
+type documentSymbol struct {
+	Name           string            `json:"name"`
+	Detail         string            `json:"detail"`
+	Kind           int               `json:"kind"`
+	Range          *lsp.Range        `json:"range"`
+	SelectionRange *lsp.Range        `json:"selectionRange"`
+	Children       []*documentSymbol `json:"children"`
+	// Only in SymbolInformation.
+	Location *struct {
+		Range lsp.Range `json:"range"`
+	} `json:"location"`
+}
+
+// before reports whether position a is before b.
+func before(a, b lsp.Position) bool {
+	return a.Line < b.Line || (a.Line == b.Line && a.Character < b.Character)
+}
+
+// contains reports whether range outer contains inner.
+func contains(outer, inner lsp.Range) bool {
+	return !before(inner.Start, outer.Start) && !before(outer.End, inner.End)
+}
+
+// sortOutline sorts symbols by their position in the document, with
+// enclosing symbols before the ones they contain.
+func sortOutline(symbols []*outlineSymbol) {
+	sort.SliceStable(symbols, func(i, j int) bool {
+		a, b := symbols[i].Range, symbols[j].Range
+		if a.Start != b.Start {
+			return before(a.Start, b.Start)
+		}
+		return before(b.End, a.End)
+	})
+}
+
+// hierarchicalOutline converts DocumentSymbols into an outline tree.
+func hierarchicalOutline(symbols []*documentSymbol) []*outlineSymbol {
+	outline := make([]*outlineSymbol, 0, len(symbols))
+	for _, s := range symbols {
+		o := &outlineSymbol{
+			Name:     s.Name,
+			Detail:   s.Detail,
+			Kind:     lsp.SymbolKindName(s.Kind),
+			Children: hierarchicalOutline(s.Children),
+		}
+		if s.Range != nil {
+			o.Range = *s.Range
+		}
+		o.SelectionRange = o.Range
+		if s.SelectionRange != nil {
+			o.SelectionRange = *s.SelectionRange
+		}
+		outline = append(outline, o)
+	}
+	sortOutline(outline)
+	return outline
+}
+
+// nestedOutline converts SymbolInformations, which are flat, into an
+// outline tree by nesting symbols within the ones whose range contains
+// theirs.
+func nestedOutline(symbols []*documentSymbol) []*outlineSymbol {
+	all := make([]*outlineSymbol, 0, len(symbols))
+	for _, s := range symbols {
+		var r lsp.Range
+		if s.Location != nil {
+			r = s.Location.Range
+		}
+		all = append(all, &outlineSymbol{
+			Name:           s.Name,
+			Kind:           lsp.SymbolKindName(s.Kind),
+			Range:          r,
+			SelectionRange: r,
+		})
+	}
+	sortOutline(all)
+
+	// Symbols enclosing the current one, from the outermost.
+	var stack []*outlineSymbol
+	outline := []*outlineSymbol{}
+	for _, s := range all {
+		for len(stack) > 0 && !contains(stack[len(stack)-1].Range, s.Range) {
+			stack = stack[:len(stack)-1]
+		}
+		if len(stack) == 0 {
+			outline = append(outline, s)
+		} else {
+			parent := stack[len(stack)-1]
+			parent.Children = append(parent.Children, s)
+		}
+		stack = append(stack, s)
+	}
+	return outline
+}
+
+// flattenOutline returns all symbols of an outline tree in document order,
+// with the names of their containers.
+func flattenOutline(outline []*outlineSymbol, container string, flat []*outlineSymbol) []*outlineSymbol {
+	for _, s := range outline {
+		flat = append(flat, &outlineSymbol{
+			Name:           s.Name,
+			Detail:         s.Detail,
+			Kind:           s.Kind,
+			ContainerName:  container,
+			Range:          s.Range,
+			SelectionRange: s.SelectionRange,
+		})
+		flat = flattenOutline(s.Children, s.Name, flat)
+	}
+	return flat
+}
+
+// handleOutline wraps textDocument/documentSymbol, normalizing the
+// DocumentSymbol and SymbolInformation results of different servers into
+// a tree of symbols, or a flat list sorted by position with flat=true.
+func (p *proxy) handleOutline(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	uri := query.Get("uri")
+	if uri == "" {
+		writeError(w, http.StatusBadRequest, "no document uri specified")
+		return
+	}
+
+	var result []*documentSymbol
+	err := p.call(req.Context(), "textDocument/documentSymbol", map[string]any{"textDocument": lsp.TextDocumentIdentifier{URI: uri}}, &result)
+	if err != nil {
+		writeCallError(w, err)
+		return
+	}
+
+	// SymbolInformations have a location instead of a range.
+	var outline []*outlineSymbol
+	if len(result) > 0 && result[0].Location != nil {
+		outline = nestedOutline(result)
+	} else {
+		outline = hierarchicalOutline(result)
+	}
+
+	if query.Get("flat") == "true" {
+		writeJSON(w, http.StatusOK, map[string]any{"symbols": flattenOutline(outline, "", []*outlineSymbol{})})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"symbols": outline})
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/federicotdn/hyperlsp/lsp"
+)
+
+// Maximum number of conversions in a single POST /util/position request.
+const maxPositionConversions = 10000
+
+// positionQuery is a location in a document, specified by exactly one of
+// a byte offset, a rune (Unicode code point) offset or an LSP position.
+type positionQuery struct {
+	Offset     *int          `json:"offset,omitempty"`
+	RuneOffset *int          `json:"runeOffset,omitempty"`
+	Position   *lsp.Position `json:"position,omitempty"`
+}
+
+// positionResult is a location in a document in all supported forms.
+type positionResult struct {
+	Offset     int          `json:"offset"`
+	RuneOffset int          `json:"runeOffset"`
+	Position   lsp.Position `json:"position"`
+	// Position in every encoding, with the character in its units.
+	Positions map[string]lsp.Position `json:"positions"`
+}
+
+// convertPosition resolves a location in text, with positions expressed
+// in the specified encoding.
+func convertPosition(text string, q positionQuery, encoding string) (*positionResult, error) {
+	set := 0
+	for _, ok := range []bool{q.Offset != nil, q.RuneOffset != nil, q.Position != nil} {
+		if ok {
+			set++
+		}
+	}
+	if set != 1 {
+		return nil, fmt.Errorf("exactly one of offset, runeOffset or position must be specified")
+	}
+
+	var offset int
+	switch {
+	case q.Offset != nil:
+		offset = *q.Offset
+		if offset < 0 || offset > len(text) {
+			return nil, fmt.Errorf("offset %v out of range, the document has %v bytes", offset, len(text))
+		}
+		if offset < len(text) && !utf8.RuneStart(text[offset]) {
+			return nil, fmt.Errorf("offset %v is in the middle of a character", offset)
+		}
+	case q.RuneOffset != nil:
+		if *q.RuneOffset < 0 {
+			return nil, fmt.Errorf("rune offset %v out of range", *q.RuneOffset)
+		}
+		for n := 0; n < *q.RuneOffset; n++ {
+			if offset == len(text) {
+				return nil, fmt.Errorf("rune offset %v out of range, the document has %v runes", *q.RuneOffset, n)
+			}
+			_, size := utf8.DecodeRuneInString(text[offset:])
+			offset += size
+		}
+	default:
+		var err error
+		offset, err = lsp.Offset(text, *q.Position, encoding)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result := &positionResult{
+		Offset:     offset,
+		RuneOffset: utf8.RuneCountInString(text[:offset]),
+		Positions:  make(map[string]lsp.Position),
+	}
+	for _, enc := range []string{lsp.PositionEncodingUTF8, lsp.PositionEncodingUTF16, lsp.PositionEncodingUTF32} {
+		pos, err := lsp.PositionAt(text, offset, enc)
+		if err != nil {
+			return nil, err
+		}
+		result.Positions[enc] = pos
+	}
+	pos, err := lsp.PositionAt(text, offset, encoding)
+	if err != nil {
+		return nil, err
+	}
+	result.Position = pos
+	return result, nil
+}
+
+// positionDocument returns the tracked document and position encoding of
+// a position conversion request, writing an error if they are invalid.
+func (p *proxy) positionDocument(w http.ResponseWriter, uri, encoding string) (document, string, bool) {
+	if uri == "" {
+		writeError(w, http.StatusBadRequest, "no document uri specified")
+		return document{}, "", false
+	}
+	doc, ok := p.docs.get(uri)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("document %v is not open", uri))
+		return document{}, "", false
+	}
+
+	if encoding == "" {
+		encoding = p.positionEncoding()
+	}
+	switch encoding {
+	case lsp.PositionEncodingUTF8, lsp.PositionEncodingUTF16, lsp.PositionEncodingUTF32:
+	default:
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("unsupported position encoding %q", encoding))
+		return document{}, "", false
+	}
+	return doc, encoding, true
+}
+
+// handlePositionGet converts a single location in a tracked document,
+// specified by the offset, runeOffset or line and character query
+// parameters. Positions are expressed in the encoding parameter's units,
+// which defaults to the encoding negotiated with the LSP server.
+func (p *proxy) handlePositionGet(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	doc, encoding, ok := p.positionDocument(w, query.Get("uri"), query.Get("encoding"))
+	if !ok {
+		return
+	}
+
+	var q positionQuery
+	parse := func(name string) (*int, bool) {
+		if !query.Has(name) {
+			return nil, true
+		}
+		n, err := strconv.Atoi(query.Get(name))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid %v: %v", name, query.Get(name)))
+			return nil, false
+		}
+		return &n, true
+	}
+	var line, character *int
+	if q.Offset, ok = parse("offset"); !ok {
+		return
+	}
+	if q.RuneOffset, ok = parse("runeOffset"); !ok {
+		return
+	}
+	if line, ok = parse("line"); !ok {
+		return
+	}
+	if character, ok = parse("character"); !ok {
+		return
+	}
+	if line != nil || character != nil {
+		if line == nil || character == nil {
+			writeError(w, http.StatusBadRequest, "both line and character must be specified")
+			return
+		}
+		q.Position = &lsp.Position{Line: *line, Character: *character}
+	}
+
+	result, err := convertPosition(doc.Text, q, encoding)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"uri":      doc.URI,
+		"version":  doc.Version,
+		"encoding": encoding,
+		"result":   result,
+	})
+}
+
+// handlePositionPost converts a list of locations in a tracked document at
+// once.
+func (p *proxy) handlePositionPost(w http.ResponseWriter, req *http.Request) {
+	var body struct {
+		URI       string          `json:"uri"`
+		Encoding  string          `json:"encoding"`
+		Positions []positionQuery `json:"positions"`
+	}
+
+	defer req.Body.Close()
+	err := json.NewDecoder(req.Body).Decode(&body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "unable to unmarshal request json")
+		return
+	}
+	if len(body.Positions) > maxPositionConversions {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("at most %v positions can be converted at once", maxPositionConversions))
+		return
+	}
+	doc, encoding, ok := p.positionDocument(w, body.URI, body.Encoding)
+	if !ok {
+		return
+	}
+
+	results := make([]*positionResult, len(body.Positions))
+	for i, q := range body.Positions {
+		results[i], err = convertPosition(doc.Text, q, encoding)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, newProxyError(http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("position %v: %v", i, err), map[string]any{"index": i}))
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"uri":      doc.URI,
+		"version":  doc.Version,
+		"encoding": encoding,
+		"results":  results,
+	})
+}
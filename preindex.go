@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/federicotdn/hyperlsp/lsp"
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
+)
+
+const defaultPreindexTimeout = 10 * time.Second
+
+// Number of files opened in the LSP server at the same time while
+// pre-indexing.
+const preindexConcurrency = 8
+
+// Maximum number of files opened while pre-indexing a workspace root.
+const preindexMaxFiles = 10000
+
+// preindexer opens the files of the workspace matching some glob patterns
+// once the LSP server has been initialized, and closes each of them once
+// the server has published its diagnostics (or after a timeout). This
+// forces servers which only analyze open documents to index the whole
+// workspace eagerly.
+type preindexer struct {
+	// Patterns relative to the workspace roots (see matchGlob).
+	patterns []string
+	timeout  time.Duration
+	once     sync.Once
+
+	mutex sync.Mutex
+	// Closed when the LSP server publishes diagnostics for a document
+	// being pre-indexed.
+	pending map[string]chan struct{}
+}
+
+func newPreindexer(patterns []string, timeout time.Duration) *preindexer {
+	return &preindexer{
+		patterns: patterns,
+		timeout:  timeout,
+		pending:  make(map[string]chan struct{}),
+	}
+}
+
+// acknowledge signals that the LSP server has published diagnostics for a
+// document, if it is being pre-indexed.
+func (pi *preindexer) acknowledge(uri string) {
+	pi.mutex.Lock()
+	defer pi.mutex.Unlock()
+	if ch, ok := pi.pending[uri]; ok {
+		close(ch)
+		delete(pi.pending, uri)
+	}
+}
+
+// wait registers a document being pre-indexed, and returns a channel
+// closed once it has been acknowledged.
+func (pi *preindexer) wait(uri string) chan struct{} {
+	ch := make(chan struct{})
+	pi.mutex.Lock()
+	defer pi.mutex.Unlock()
+	pi.pending[uri] = ch
+	return ch
+}
+
+func (pi *preindexer) forget(uri string) {
+	pi.mutex.Lock()
+	defer pi.mutex.Unlock()
+	delete(pi.pending, uri)
+}
+
+// files returns the files under root matching the patterns, skipping the
+// ones ignored by .gitignore files.
+func (pi *preindexer) files(root string) ([]string, error) {
+	patterns, err := gitignore.ReadPatterns(osfs.New(root), nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read .gitignore files: %w", err)
+	}
+	ignored := gitignore.NewMatcher(patterns)
+
+	var files []string
+	err = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Unreadable directories are skipped.
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil || rel == "." {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+
+		if d.IsDir() {
+			if d.Name() == ".git" || ignored.Match(strings.Split(rel, "/"), true) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() || ignored.Match(strings.Split(rel, "/"), false) {
+			return nil
+		}
+
+		for _, pattern := range pi.patterns {
+			if matchGlob(pattern, rel) {
+				files = append(files, p)
+				break
+			}
+		}
+		if len(files) > preindexMaxFiles {
+			return fmt.Errorf("more than %v files match the pre-indexing patterns", preindexMaxFiles)
+		}
+		return nil
+	})
+	return files, err
+}
+
+// workspaceRoots returns the directories of the workspace folders (or the
+// root URI) in the params of an initialize request.
+func workspaceRoots(initParams any) []string {
+	params, _ := decodeResult(initParams).(map[string]any)
+	var uris []string
+	if folders, ok := params["workspaceFolders"].([]any); ok && len(folders) > 0 {
+		for _, f := range folders {
+			folder, _ := f.(map[string]any)
+			if uri, ok := folder["uri"].(string); ok {
+				uris = append(uris, uri)
+			}
+		}
+	} else if uri, ok := params["rootUri"].(string); ok {
+		uris = append(uris, uri)
+	}
+
+	var roots []string
+	for _, uri := range uris {
+		path, err := lsp.URIToPath(uri)
+		if err == nil {
+			roots = append(roots, path)
+		}
+	}
+	if len(roots) == 0 {
+		if path, ok := params["rootPath"].(string); ok && path != "" {
+			roots = append(roots, path)
+		}
+	}
+	return roots
+}
+
+// preindexWorkspace pre-indexes the workspace roots of the LSP server (see
+// preindexer), the first time it is called.
+func (p *proxy) preindexWorkspace() {
+	p.preindex.once.Do(func() {
+		p.mutex.Lock()
+		initParams := p.initParams
+		p.mutex.Unlock()
+
+		start := time.Now()
+		count := 0
+		for _, root := range workspaceRoots(initParams) {
+			files, err := p.preindex.files(root)
+			if err != nil {
+				slog.Warn("unable to pre-index workspace", "root", root, "err", err)
+				continue
+			}
+			count += p.preindexFiles(files)
+		}
+
+		slog.Info("workspace pre-indexed", "files", count, "duration", time.Since(start))
+		p.recordEvent(serverEvent{Type: "preindex", Message: fmt.Sprintf("Pre-indexed %v files in %v", count, time.Since(start).Round(time.Millisecond))})
+	})
+}
+
+// preindexFiles opens files which are not tracked in the LSP server, a few
+// at a time, and closes them once acknowledged. It returns the number of
+// files opened.
+func (p *proxy) preindexFiles(files []string) int {
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	count := 0
+	sem := make(chan struct{}, preindexConcurrency)
+
+	for _, file := range files {
+		uri := lsp.PathToURI(file)
+		if _, ok := p.docs.get(uri); ok {
+			continue
+		}
+
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			opened, err := p.preindexFile(file, uri)
+			if err != nil {
+				slog.Debug("unable to pre-index file", "uri", uri, "err", err)
+			}
+			if opened {
+				mutex.Lock()
+				count++
+				mutex.Unlock()
+			}
+		}()
+	}
+
+	wg.Wait()
+	return count
+}
+
+// preindexFile opens a file in the LSP server without tracking it, waits
+// until the server publishes its diagnostics, and closes it unless it has
+// been opened by a client in the meantime.
+func (p *proxy) preindexFile(path, uri string) (bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	languageId := p.languages.detect(uri, string(data))
+	if languageId == "" {
+		return false, errUnknownLanguage
+	}
+
+	ack := p.preindex.wait(uri)
+	defer p.preindex.forget(uri)
+
+	doc := document{URI: uri, LanguageID: languageId, Version: 1, Text: string(data)}
+	err = p.sendUntracked("textDocument/didOpen", map[string]any{"textDocument": &doc})
+	if err != nil {
+		return false, err
+	}
+
+	select {
+	case <-ack:
+	case <-time.After(p.preindex.timeout):
+	}
+
+	if _, ok := p.docs.get(uri); ok {
+		return true, nil
+	}
+	params := map[string]any{"textDocument": lsp.TextDocumentIdentifier{URI: uri}}
+	return true, p.sendUntracked("textDocument/didClose", params)
+}
+
+// sendUntracked sends a notification to the LSP server on behalf of the
+// proxy, without updating the document store.
+func (p *proxy) sendUntracked(method string, params any) error {
+	p.docSync.RLock()
+	defer p.docSync.RUnlock()
+
+	_, err := sendTo(p.server(), method, params)
+	if err != nil {
+		return p.proxyError(err)
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+)
+
+const (
+	defaultProbeTimeout = 5 * time.Second
+	// Number of consecutive failed liveness probes after which the LSP
+	// server is considered unhealthy.
+	probeFailureThreshold = 3
+)
+
+// probeServer periodically checks that the LSP server is alive (see
+// lsp.Server.Probe), so that a dead or hung server is noticed before the
+// next request to it fails.
+func (p *proxy) probeServer(interval, timeout time.Duration) {
+	failures := 0
+	for range time.Tick(interval) {
+		state := p.supervisor.currentState()
+		if state != "running" && state != "unhealthy" {
+			// Restarting, or given up on.
+			failures = 0
+			continue
+		}
+
+		err := p.server().Probe(timeout)
+		if err == nil {
+			if failures >= probeFailureThreshold {
+				slog.Info("LSP server passed liveness probe")
+			}
+			failures = 0
+			p.supervisor.handleProbeSuccess()
+			continue
+		}
+
+		failures++
+		slog.Warn("LSP server failed liveness probe", "err", err, "failures", failures)
+		if failures == probeFailureThreshold {
+			p.supervisor.handleProbeFailure(err)
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/federicotdn/hyperlsp/lsp"
+	"github.com/graphql-go/graphql"
+)
+
+// proxy holds the state associated with a single LSP server, and
+// implements the HTTP endpoints that interact with it.
+type proxy struct {
+	// LSP server, which is replaced when swapping servers (see swap.go).
+	srv         atomic.Pointer[lsp.Server]
+	filters     resultFilters
+	completions *completionCache
+	docs        *documentStore
+	roots       []string
+	supervisor  *supervisor
+	results     *asyncResults
+	webhooks    *webhookSender
+	graphql     *graphql.Schema
+	languages   *languageDetector
+	headers     headersConfig
+	// Name of the LSP server, with multiple servers.
+	name string
+	// Whether to validate params against the schemas of known methods.
+	validate bool
+	// Whether operations modifying files are rejected (see readonly.go).
+	readOnly bool
+	// Commands of the LSP server allowed to be executed, if set.
+	commands commandAllowlist
+	// How workspace/applyEdit requests of the LSP server are handled, and
+	// the maximum time edits wait for approval.
+	serverEdits     string
+	approvalTimeout time.Duration
+	// Edits of the LSP server waiting for approval, and the ones applied.
+	pendingEdits *pendingEdits
+	editJournal  editJournal
+	// Rules applied to diagnostics received from the LSP server.
+	diagnosticRules diagnosticRules
+	// Notifications sent by the LSP server, streamed via /events.
+	notifications *eventHub
+	floodControl  floodControl
+	// Limits the requests sent to the LSP server at the same time, if set.
+	limiter *concurrencyLimiter
+	// Limits of the classes the methods of requests are assigned to.
+	classes methodClasses
+	// Client-supplied IDs of the requests in flight.
+	requestIDs *requestIDs
+	// Workspace roots of the sessions sharing the LSP server.
+	workspaces *workspaceSessions
+	// Pending requests which may be superseded by newer ones.
+	supersessions *supersessions
+	// Detects known errors in the LSP server's stderr output, if set.
+	stderrDetectors *stderrDetectors
+	// Caches the results of queries about open documents, if set.
+	queryCache *queryCache
+	// Sends traffic to a shadow LSP server as well, if set.
+	mirror *mirror
+	// Opens the workspace's files once initialized, if set.
+	preindex *preindexer
+	// Calls sent whenever the LSP server has been initialized.
+	warmup []warmupCall
+	// Readiness gate mode and the maximum time requests are queued for.
+	gate        string
+	gateTimeout time.Duration
+	// Held for reading while sending notifications, so that the document
+	// store matches what the LSP server was sent when swapping servers.
+	docSync sync.RWMutex
+	// Held while swapping servers.
+	swapping sync.Mutex
+	// Command run when swapping servers instead of the current server's,
+	// if set, and whether swapping is denied (for tenants).
+	swapCommand []string
+	swapDenied  bool
+	// Held while updating the settings via /settings, so that concurrent
+	// updates are not lost.
+	settingsUpdate sync.Mutex
+
+	mutex      sync.Mutex
+	serverCaps any
+	initParams any
+	// Params of the last workspace/didChangeConfiguration notification.
+	settings any
+	// Persists the settings, if set.
+	settingsStore *settingsStore
+	events        []serverEvent
+	requests      []requestRecord
+	diagnostics   map[string][]lsp.Diagnostic
+	// Closed once the LSP server has been initialized.
+	readyCh chan struct{}
+	// Client capabilities declared via /capabilities/client.
+	clientCaps map[string]any
+}
+
+func newProxy(srv *lsp.Server, filters resultFilters) *proxy {
+	p := &proxy{
+		filters:         filters,
+		completions:     newCompletionCache(),
+		docs:            newDocumentStore(),
+		diagnostics:     make(map[string][]lsp.Diagnostic),
+		results:         newAsyncResults(),
+		languages:       newLanguageDetector(nil, nil),
+		gate:            gateOff,
+		gateTimeout:     defaultGateTimeout,
+		readyCh:         make(chan struct{}),
+		notifications:   newEventHub(),
+		supersessions:   newSupersessions(),
+		workspaces:      newWorkspaceSessions(),
+		requestIDs:      newRequestIDs(),
+		serverEdits:     serverEditsReject,
+		approvalTimeout: defaultApprovalTimeout,
+		pendingEdits:    newPendingEdits(),
+	}
+	p.srv.Store(srv)
+	p.supervisor = newSupervisor(p)
+	srv.SetNotificationHandler(p.handleNotification)
+	srv.SetRequestHandler(p.handleServerRequest)
+	srv.SetExitHandler(p.supervisor.handleExit)
+	return p
+}
+
+// server returns the current LSP server.
+func (p *proxy) server() *lsp.Server {
+	return p.srv.Load()
+}
+
+func (p *proxy) routes() http.Handler {
+	mux := http.NewServeMux()
+
+	notfound := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.NotFound(w, req)
+	})
+
+	mux.Handle("/lsp/{method...}", baseMiddleware(http.HandlerFunc(p.handleRequest)))
+	mux.Handle("POST /notify/{method...}", baseMiddleware(http.HandlerFunc(p.handleNotify)))
+	mux.Handle("GET /results/{id}", baseMiddleware(http.HandlerFunc(p.handleResult)))
+	mux.Handle("POST /completions", baseMiddleware(http.HandlerFunc(p.handleCompletions)))
+	mux.Handle("POST /semantic-tokens", baseMiddleware(http.HandlerFunc(p.handleSemanticTokens)))
+	mux.Handle("GET /codelens", baseMiddleware(p.documentHeaders(http.HandlerFunc(p.handleCodeLens))))
+	mux.Handle("GET /inlayhints", baseMiddleware(p.documentHeaders(http.HandlerFunc(p.handleInlayHints))))
+	mux.Handle("GET /foldingranges", baseMiddleware(p.documentHeaders(http.HandlerFunc(p.handleFoldingRanges))))
+	mux.Handle("GET /selectionranges", baseMiddleware(p.documentHeaders(http.HandlerFunc(p.handleSelectionRanges))))
+	mux.Handle("GET /highlight", baseMiddleware(p.documentHeaders(http.HandlerFunc(p.handleHighlight))))
+	mux.Handle("POST /diagnostics/junit", baseMiddleware(http.HandlerFunc(p.handleDiagnosticsJUnit)))
+	mux.Handle("GET /diagnostics/changed", baseMiddleware(http.HandlerFunc(p.handleDiagnosticsChanged)))
+	mux.Handle("GET /diagnostics/summary", baseMiddleware(http.HandlerFunc(p.handleDiagnosticsSummary)))
+	mux.Handle("GET /symbols", baseMiddleware(http.HandlerFunc(p.handleSymbols)))
+	mux.Handle("GET /outline", baseMiddleware(p.documentHeaders(http.HandlerFunc(p.handleOutline))))
+	mux.Handle("POST /edits/apply", baseMiddleware(http.HandlerFunc(p.handleEditsApply)))
+	mux.Handle("GET /edits/pending", baseMiddleware(http.HandlerFunc(p.handleEditsPending)))
+	mux.Handle("POST /edits/{id}/approve", baseMiddleware(http.HandlerFunc(p.handleEditApprove)))
+	mux.Handle("POST /edits/{id}/reject", baseMiddleware(http.HandlerFunc(p.handleEditReject)))
+	mux.Handle("GET /edits/journal", baseMiddleware(http.HandlerFunc(p.handleEditsJournal)))
+	mux.Handle("POST /edits/journal/{id}/undo", baseMiddleware(http.HandlerFunc(p.handleEditUndo)))
+	mux.Handle("POST /commands/{name}", baseMiddleware(http.HandlerFunc(p.handleCommand)))
+	mux.Handle("POST /format", baseMiddleware(http.HandlerFunc(p.handleFormat)))
+	mux.Handle("POST /rename/preview", baseMiddleware(http.HandlerFunc(p.handleRenamePreview)))
+	mux.Handle("GET /callhierarchy", baseMiddleware(p.documentHeaders(http.HandlerFunc(p.handleCallHierarchy))))
+	mux.Handle("POST /references/stream", baseMiddleware(http.HandlerFunc(p.handleReferencesStream)))
+	mux.Handle("POST /docs/sync", baseMiddleware(http.HandlerFunc(p.handleDocsSync)))
+	mux.Handle("POST /docs/open-bulk", baseMiddleware(http.HandlerFunc(p.handleDocsOpenBulk)))
+	mux.Handle("GET /docs/snapshot", baseMiddleware(http.HandlerFunc(p.handleSnapshotExport)))
+	mux.Handle("POST /docs/snapshot", baseMiddleware(http.HandlerFunc(p.handleSnapshotImport)))
+	mux.Handle("GET /docs/{uri...}", baseMiddleware(http.HandlerFunc(p.handleDocGet)))
+	mux.Handle("PATCH /docs/{uri...}", baseMiddleware(http.HandlerFunc(p.handleDocPatch)))
+	mux.Handle("GET /util/position", baseMiddleware(p.documentHeaders(http.HandlerFunc(p.handlePositionGet))))
+	mux.Handle("POST /util/position", baseMiddleware(http.HandlerFunc(p.handlePositionPost)))
+	mux.Handle("GET /settings", baseMiddleware(http.HandlerFunc(p.handleSettingsGet)))
+	mux.Handle("PUT /settings", baseMiddleware(http.HandlerFunc(p.handleSettingsPut)))
+	mux.Handle("POST /capabilities/client", baseMiddleware(http.HandlerFunc(p.handleClientCapabilities)))
+	mux.Handle("GET /session/workspace", baseMiddleware(http.HandlerFunc(p.handleWorkspaceGet)))
+	mux.Handle("PUT /session/workspace", baseMiddleware(http.HandlerFunc(p.handleWorkspacePut)))
+	mux.Handle("DELETE /session/workspace", baseMiddleware(http.HandlerFunc(p.handleWorkspaceDelete)))
+	mux.Handle("GET /readyz", baseMiddleware(http.HandlerFunc(p.handleReady)))
+	mux.Handle("GET /status", baseMiddleware(http.HandlerFunc(p.handleStatus)))
+	mux.Handle("GET /events", baseMiddleware(http.HandlerFunc(p.handleEvents)))
+	mux.Handle("GET /compare", baseMiddleware(http.HandlerFunc(p.handleCompare)))
+	mux.Handle("GET /metrics", baseMiddleware(http.HandlerFunc(p.handleMetrics)))
+	mux.Handle("GET /admin/server/status", baseMiddleware(http.HandlerFunc(p.handleServerStatus)))
+	mux.Handle("POST /admin/server/soft-restart", baseMiddleware(http.HandlerFunc(p.handleSoftRestart)))
+	mux.Handle("POST /admin/server/swap", baseMiddleware(http.HandlerFunc(p.handleSwap)))
+	mux.Handle("GET /admin/server/restarts", baseMiddleware(http.HandlerFunc(p.supervisor.handleRestarts)))
+	mux.Handle("GET /graphql", baseMiddleware(http.HandlerFunc(p.handleGraphQL)))
+	mux.Handle("POST /graphql", baseMiddleware(http.HandlerFunc(p.handleGraphQL)))
+	mux.Handle("GET /ui", baseMiddleware(http.HandlerFunc(p.handleUI)))
+	mux.Handle("GET /ui/state", baseMiddleware(http.HandlerFunc(p.handleUIState)))
+	mux.Handle("/", baseMiddleware(notfound))
+
+	return p.trackRequests(p.restrictRoots(p.scopeWorkspace(mux)))
+}
+
+// decodeResult returns the result of an LSP response as unmarshaled JSON
+// (maps, slices, strings, etc.), as results received from the LSP server
+// are kept as raw JSON until needed.
+func decodeResult(result any) any {
+	raw, ok := result.(json.RawMessage)
+	if !ok {
+		return result
+	}
+
+	var v any
+	if len(raw) == 0 || json.Unmarshal(raw, &v) != nil {
+		return nil
+	}
+	return v
+}
+
+// setCapabilities stores the server capabilities found in the result of
+// an initialize request.
+func (p *proxy) setCapabilities(initResult any) {
+	result, _ := decodeResult(initResult).(map[string]any)
+	// Results computed by a previous server may differ.
+	if p.queryCache != nil {
+		p.queryCache.clear()
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.serverCaps = result["capabilities"]
+	if p.serverCaps != nil {
+		p.markReady()
+	}
+}
+
+// setInitParams stores the params of a successful initialize request, so
+// that the handshake can be replayed if the server is restarted.
+func (p *proxy) setInitParams(params any) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.initParams = params
+}
+
+// capabilities decodes the server capabilities into caps. An error is
+// returned if the server has not been initialized yet.
+func (p *proxy) capabilities(caps any) error {
+	p.mutex.Lock()
+	serverCaps := p.serverCaps
+	p.mutex.Unlock()
+
+	if serverCaps == nil {
+		return fmt.Errorf("LSP server has not been initialized")
+	}
+
+	data, err := json.Marshal(serverCaps)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, caps)
+}
+
+// call sends a request to the LSP server on behalf of the proxy itself,
+// and decodes its result into result (if non-nil). If ctx is done before
+// the response is received (e.g. as the HTTP client has disconnected), the
+// request is cancelled.
+func (p *proxy) call(ctx context.Context, method string, params any, result any) error {
+	msg := lsp.Message{
+		Id:     fmt.Sprintf("hyperlsp-%v", internalId.Add(1)),
+		Method: method,
+		Params: params,
+	}
+
+	// The initialize handshake replayed after restarting the LSP server
+	// (see reinitialize) can't be rejected, as the server would be left
+	// uninitialized.
+	if method != "initialize" {
+		release, limitResp, status := p.acquireLimits(ctx, msg.Id, method, params)
+		if limitResp != nil {
+			return &limitError{resp: limitResp, status: status}
+		}
+		defer release()
+	}
+
+	resp, err := lsp.NewClient(p.server()).SendContext(ctx, &msg)
+	if ctxErr := ctx.Err(); err != nil && ctxErr != nil && errors.Is(err, ctxErr) {
+		return err
+	} else if err != nil {
+		return p.proxyError(err)
+	}
+	if resp.Error != nil {
+		return resp.Error
+	}
+	if result == nil {
+		return nil
+	}
+
+	filtered := p.filters.apply(method, resp.Result)
+	data, ok := filtered.(json.RawMessage)
+	if !ok {
+		data, err = json.Marshal(filtered)
+		if err != nil {
+			return fmt.Errorf("unable to marshal result json: %w", err)
+		}
+	}
+	err = json.Unmarshal(data, result)
+	if err != nil {
+		return fmt.Errorf("unable to unmarshal result json: %w", err)
+	}
+	return nil
+}
+
+// positionEncoding returns the position encoding negotiated with the LSP
+// server, which defaults to UTF-16.
+func (p *proxy) positionEncoding() string {
+	var caps struct {
+		PositionEncoding string `json:"positionEncoding"`
+	}
+
+	err := p.capabilities(&caps)
+	if err != nil || caps.PositionEncoding == "" {
+		return lsp.PositionEncodingUTF16
+	}
+	return caps.PositionEncoding
+}
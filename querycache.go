@@ -0,0 +1,270 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/federicotdn/hyperlsp/lsp"
+)
+
+// Header set on responses to cacheable queries, to either "hit" or "miss".
+const queryCacheHeader = "X-HyperLSP-Cache"
+
+// Methods whose results are cached with -query-cache, which tend to be
+// sent repeatedly by clients for the same positions.
+var cacheableMethods = map[string]bool{
+	"textDocument/hover":          true,
+	"textDocument/definition":     true,
+	"textDocument/documentSymbol": true,
+}
+
+// Methods whose results only depend on the document they are for, and so
+// are not invalidated by changes to other documents.
+var documentScopedMethods = map[string]bool{
+	"textDocument/documentSymbol": true,
+}
+
+type queryCacheEntry struct {
+	key     string
+	uri     string
+	method  string
+	version int
+	resp    *lsp.Response
+	// Entity tag of the response, which changes along with its content.
+	etag string
+}
+
+// queryCache is an LRU cache of the responses to queries about tracked
+// documents. Entries are keyed by the document's URI, the method and its
+// params, and only served for the version of the document they were
+// computed for: once a newer version is seen, the entries of the document
+// are dropped.
+type queryCache struct {
+	size int
+
+	mutex sync.Mutex
+	// Number of lookups served from the cache or not, and number of entries
+	// dropped because they may be stale.
+	hits          int
+	misses        int
+	invalidations int
+	// Incremented whenever entries are invalidated, so that results of
+	// queries sent before then are not cached.
+	generation int
+
+	entries map[string]*list.Element
+	// Entries from the most recently used.
+	lru *list.List
+}
+
+func newQueryCache(size int) *queryCache {
+	return &queryCache{
+		size:    size,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// queryKey returns the cache key of a query. Params are marshaled, which
+// sorts the keys of their objects, so that equal params have equal keys.
+func queryKey(uri, method string, params any) (string, bool) {
+	data, err := json.Marshal(params)
+	if err != nil {
+		return "", false
+	}
+	return uri + "\x00" + method + "\x00" + string(data), true
+}
+
+// removeIf drops the entries for which stale returns true. The mutex must
+// be held.
+func (qc *queryCache) removeIf(stale func(entry *queryCacheEntry) bool) {
+	for e := qc.lru.Front(); e != nil; {
+		next := e.Next()
+		entry := e.Value.(*queryCacheEntry)
+		if stale(entry) {
+			qc.lru.Remove(e)
+			delete(qc.entries, entry.key)
+			qc.invalidations++
+		}
+		e = next
+	}
+}
+
+// removeDocument drops the entries of a document with a version other
+// than version. The mutex must be held.
+func (qc *queryCache) removeDocument(uri string, version int) {
+	qc.removeIf(func(entry *queryCacheEntry) bool {
+		return entry.uri == uri && entry.version != version
+	})
+}
+
+// invalidate drops the entries which may be stale after a document has
+// been changed: the ones of the document itself, and the ones of other
+// documents whose results may depend on it.
+func (qc *queryCache) invalidate(uri string) {
+	qc.mutex.Lock()
+	defer qc.mutex.Unlock()
+
+	qc.generation++
+	qc.removeIf(func(entry *queryCacheEntry) bool {
+		return entry.uri == uri || !documentScopedMethods[entry.method]
+	})
+}
+
+// clear drops all entries.
+func (qc *queryCache) clear() {
+	qc.mutex.Lock()
+	defer qc.mutex.Unlock()
+
+	qc.generation++
+	qc.removeIf(func(*queryCacheEntry) bool { return true })
+}
+
+// stats returns the number of entries in the cache, hits, misses and
+// invalidated entries.
+func (qc *queryCache) stats() (int, int, int, int) {
+	qc.mutex.Lock()
+	defer qc.mutex.Unlock()
+
+	return qc.lru.Len(), qc.hits, qc.misses, qc.invalidations
+}
+
+// get returns the cached entry of a query about doc, if any. If there is
+// none, it returns the current generation, to be passed to add.
+func (qc *queryCache) get(doc document, method string, params any) (*queryCacheEntry, int) {
+	key, ok := queryKey(doc.URI, method, params)
+	if !ok {
+		return nil, 0
+	}
+
+	qc.mutex.Lock()
+	defer qc.mutex.Unlock()
+
+	e, ok := qc.entries[key]
+	if !ok {
+		qc.misses++
+		return nil, qc.generation
+	}
+	entry := e.Value.(*queryCacheEntry)
+	if entry.version != doc.Version {
+		qc.removeDocument(doc.URI, doc.Version)
+		qc.misses++
+		return nil, qc.generation
+	}
+	qc.hits++
+	qc.lru.MoveToFront(e)
+	return entry, 0
+}
+
+// add caches the response to a query about doc, evicting the least
+// recently used entries if the cache is full, and returns its entity tag.
+// The response is not cached if entries have been invalidated since the
+// generation returned by get.
+func (qc *queryCache) add(doc document, generation int, method string, params any, resp *lsp.Response) (string, bool) {
+	key, ok := queryKey(doc.URI, method, params)
+	if !ok {
+		return "", false
+	}
+
+	qc.mutex.Lock()
+	defer qc.mutex.Unlock()
+
+	if generation != qc.generation {
+		return "", false
+	}
+
+	// The same query about the same version of the document may only have
+	// a different result if entries have been invalidated in between.
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%v\x00%v\x00%v", key, doc.Version, generation)))
+	etag := `"` + hex.EncodeToString(sum[:12]) + `"`
+
+	qc.removeDocument(doc.URI, doc.Version)
+	if e, ok := qc.entries[key]; ok {
+		qc.lru.Remove(e)
+	}
+	qc.entries[key] = qc.lru.PushFront(&queryCacheEntry{key: key, uri: doc.URI, method: method, version: doc.Version, resp: resp, etag: etag})
+
+	for qc.lru.Len() > qc.size {
+		e := qc.lru.Back()
+		qc.lru.Remove(e)
+		delete(qc.entries, e.Value.(*queryCacheEntry).key)
+	}
+	return etag, true
+}
+
+// etagMatches reports whether an If-None-Match header matches etag.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, v := range strings.Split(ifNoneMatch, ",") {
+		v = strings.TrimPrefix(strings.TrimSpace(v), "W/")
+		if v == "*" || v == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheableQuery returns the tracked document a request is about, if its
+// response may be cached.
+func (p *proxy) cacheableQuery(id, method string, params any) (document, bool) {
+	if p.queryCache == nil || id == "" || !cacheableMethods[method] {
+		return document{}, false
+	}
+	return p.docs.get(documentURI(params))
+}
+
+// cacheResponse caches the response to a query about doc, unless it is an
+// error or the document has been changed while the query was running, and
+// returns its entity tag.
+func (p *proxy) cacheResponse(doc document, generation int, method string, params any, lspResp *lsp.Response, status int) (string, bool) {
+	if status != 0 || lspResp.Error != nil {
+		return "", false
+	}
+	current, ok := p.docs.get(doc.URI)
+	if !ok || current.Version != doc.Version {
+		return "", false
+	}
+	return p.queryCache.add(doc, generation, method, params, &lsp.Response{Result: lspResp.Result, Headers: lspResp.Headers})
+}
+
+// invalidateCaches drops the cached results which may be stale after a
+// notification has been sent to the LSP server: query results after a
+// document is opened, changed or closed, or after files are changed on
+// disk, and the diagnostics of deleted files.
+func (p *proxy) invalidateCaches(method string, params any) {
+	switch method {
+	case "textDocument/didOpen", "textDocument/didChange", "textDocument/didClose":
+		if p.queryCache != nil {
+			p.queryCache.invalidate(documentURI(params))
+		}
+	case "workspace/didChangeWatchedFiles":
+		if p.queryCache != nil {
+			p.queryCache.clear()
+		}
+
+		data, err := json.Marshal(params)
+		if err != nil {
+			return
+		}
+		var changed struct {
+			Changes []struct {
+				URI  string `json:"uri"`
+				Type int    `json:"type"`
+			} `json:"changes"`
+		}
+		if json.Unmarshal(data, &changed) != nil {
+			return
+		}
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		for _, c := range changed.Changes {
+			if c.Type == fileDeleted {
+				delete(p.diagnostics, c.URI)
+			}
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"unicode/utf8"
+
+	"github.com/federicotdn/hyperlsp/lsp"
+)
+
+// Folding range kinds. Ranges without a kind, or with a kind not defined
+// by LSP, are normalized to foldingKindCode.
+const (
+	foldingKindComment = "comment"
+	foldingKindImports = "imports"
+	foldingKindRegion  = "region"
+	foldingKindCode    = "code"
+)
+
+type foldingRange struct {
+	StartLine      int     `json:"startLine"`
+	StartCharacter *int    `json:"startCharacter,omitempty"`
+	EndLine        int     `json:"endLine"`
+	EndCharacter   *int    `json:"endCharacter,omitempty"`
+	Kind           string  `json:"kind"`
+	CollapsedText  *string `json:"collapsedText,omitempty"`
+	// Offsets in Unicode code points, with offsets=true.
+	StartOffset *int `json:"startOffset,omitempty"`
+	EndOffset   *int `json:"endOffset,omitempty"`
+}
+
+// selectionRange is a range of a selection range chain, with its offsets
+// in Unicode code points with offsets=true.
+type selectionRange struct {
+	Range       lsp.Range `json:"range"`
+	StartOffset *int      `json:"startOffset,omitempty"`
+	EndOffset   *int      `json:"endOffset,omitempty"`
+}
+
+// codePointOffset returns the offset of pos in text in Unicode code
+// points. As in LSP, characters past the end of a line resolve to the end
+// of the line.
+func codePointOffset(text string, pos lsp.Position, encoding string) (*int, error) {
+	offset, err := lsp.Offset(text, pos, encoding)
+	if err != nil {
+		return nil, err
+	}
+	n := utf8.RuneCountInString(text[:offset])
+	return &n, nil
+}
+
+// rangeDocument returns the content of the document a range request is
+// for if offsets were requested, opening it if needed. Otherwise, it
+// returns false without writing an error.
+func (p *proxy) rangeDocument(w http.ResponseWriter, req *http.Request, uri string) (document, bool, bool) {
+	query := req.URL.Query()
+	if query.Get("offsets") != "true" {
+		return document{}, false, true
+	}
+
+	doc, err := p.openDocument(uri, query.Get("languageId"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return document{}, false, false
+	}
+	return doc, true, true
+}
+
+// handleFoldingRanges runs textDocument/foldingRange, normalizing the
+// kinds of the ranges and sorting them by position, with enclosing ranges
+// first. With offsets=true, the offsets of the ranges in the document are
+// also returned, where missing characters resolve to the end of the line.
+func (p *proxy) handleFoldingRanges(w http.ResponseWriter, req *http.Request) {
+	uri := req.URL.Query().Get("uri")
+	if uri == "" {
+		writeError(w, http.StatusBadRequest, "no document uri specified")
+		return
+	}
+	doc, offsets, ok := p.rangeDocument(w, req, uri)
+	if !ok {
+		return
+	}
+
+	var ranges []foldingRange
+	err := p.call(req.Context(), "textDocument/foldingRange", map[string]any{"textDocument": lsp.TextDocumentIdentifier{URI: uri}}, &ranges)
+	if err != nil {
+		writeCallError(w, err)
+		return
+	}
+
+	encoding := p.positionEncoding()
+	for i := range ranges {
+		r := &ranges[i]
+		switch r.Kind {
+		case foldingKindComment, foldingKindImports, foldingKindRegion:
+		default:
+			r.Kind = foldingKindCode
+		}
+
+		if !offsets {
+			continue
+		}
+		start := lsp.Position{Line: r.StartLine, Character: math.MaxInt32}
+		if r.StartCharacter != nil {
+			start.Character = *r.StartCharacter
+		}
+		end := lsp.Position{Line: r.EndLine, Character: math.MaxInt32}
+		if r.EndCharacter != nil {
+			end.Character = *r.EndCharacter
+		}
+		if r.StartOffset, err = codePointOffset(doc.Text, start, encoding); err == nil {
+			r.EndOffset, err = codePointOffset(doc.Text, end, encoding)
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	sort.SliceStable(ranges, func(i, j int) bool {
+		a, b := ranges[i], ranges[j]
+		if a.StartLine != b.StartLine {
+			return a.StartLine < b.StartLine
+		}
+		return a.EndLine > b.EndLine
+	})
+	if ranges == nil {
+		ranges = []foldingRange{}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"ranges": ranges})
+}
+
+// handleSelectionRanges runs textDocument/selectionRange for a position,
+// and returns the resulting chain of ranges as a list, from the innermost
+// range to the outermost one. With offsets=true, the offsets of the
+// ranges in the document are also returned.
+func (p *proxy) handleSelectionRanges(w http.ResponseWriter, req *http.Request) {
+	uri := req.URL.Query().Get("uri")
+	if uri == "" {
+		writeError(w, http.StatusBadRequest, "no document uri specified")
+		return
+	}
+	line, err := queryInt(req, "line", -1)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	char, err := queryInt(req, "char", -1)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	doc, offsets, ok := p.rangeDocument(w, req, uri)
+	if !ok {
+		return
+	}
+
+	type chain struct {
+		Range  lsp.Range `json:"range"`
+		Parent *chain    `json:"parent"`
+	}
+	var result []*chain
+	err = p.call(req.Context(), "textDocument/selectionRange", map[string]any{
+		"textDocument": lsp.TextDocumentIdentifier{URI: uri},
+		"positions":    []lsp.Position{{Line: line, Character: char}},
+	}, &result)
+	if err != nil {
+		writeCallError(w, err)
+		return
+	}
+
+	ranges := []selectionRange{}
+	encoding := p.positionEncoding()
+	var innermost *chain
+	if len(result) > 0 {
+		innermost = result[0]
+	}
+	for r := innermost; r != nil; r = r.Parent {
+		sr := selectionRange{Range: r.Range}
+		if offsets {
+			if sr.StartOffset, err = codePointOffset(doc.Text, r.Range.Start, encoding); err == nil {
+				sr.EndOffset, err = codePointOffset(doc.Text, r.Range.End, encoding)
+			}
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+		}
+		ranges = append(ranges, sr)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"ranges": ranges})
+}
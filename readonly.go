@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Methods of LSP requests which may make the LSP server modify files, e.g.
+// by sending workspace/applyEdit requests back, rejected with -read-only.
+var mutatingMethods = map[string]bool{
+	"workspace/executeCommand": true,
+}
+
+// denyReadOnly writes a 403 response if the proxy is in read-only mode,
+// for an operation which would modify files, and returns true.
+func (p *proxy) denyReadOnly(w http.ResponseWriter, id, operation string) bool {
+	if !p.readOnly {
+		return false
+	}
+
+	status := http.StatusForbidden
+	message := fmt.Sprintf("%v is not allowed in read-only mode", operation)
+	if id != "" {
+		writeResponse(w, id, errorResponse(id, status, message), status)
+	} else {
+		writeError(w, status, message)
+	}
+	return true
+}
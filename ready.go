@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Readiness gate modes, see proxy.awaitReady.
+const (
+	gateOff    = "off"
+	gateQueue  = "queue"
+	gateReject = "reject"
+
+	defaultGateTimeout = 30 * time.Second
+)
+
+// validGateMode reports whether mode is a known readiness gate mode.
+func validGateMode(mode string) bool {
+	return mode == gateOff || mode == gateQueue || mode == gateReject
+}
+
+// readyExempt reports whether method can be sent before the LSP server is
+// ready, as it is part of (or precedes) the initialize handshake.
+func readyExempt(method string) bool {
+	switch method {
+	case "initialize", "initialized", "shutdown", "exit":
+		return true
+	}
+	return strings.HasPrefix(method, "$/")
+}
+
+// markReady signals that the LSP server has been initialized, releasing
+// any queued requests. It must be called with p.mutex held.
+func (p *proxy) markReady() {
+	select {
+	case <-p.readyCh:
+	default:
+		close(p.readyCh)
+	}
+}
+
+// markNotReady resets the readiness of the LSP server, e.g. when it is
+// restarted. It must be called with p.mutex held.
+func (p *proxy) markNotReady() {
+	select {
+	case <-p.readyCh:
+		p.readyCh = make(chan struct{})
+	default:
+	}
+}
+
+// ready reports whether the LSP server is connected and initialized, and
+// returns the reason if not.
+func (p *proxy) ready() (bool, string) {
+	if reason := p.supervisor.notRunningReason(); reason != "" {
+		return false, reason
+	}
+	if p.stderrDetectors != nil {
+		if reason := p.stderrDetectors.notReadyReason(); reason != "" {
+			return false, reason
+		}
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.serverCaps == nil {
+		return false, "LSP server has not been initialized"
+	}
+	return true, ""
+}
+
+// awaitReady applies the readiness gate to a request for method. In queue
+// mode, it waits until the LSP server is ready (or the gate timeout
+// expires, or the HTTP request is cancelled); in reject mode, it fails
+// immediately. On failure, a 503 response is written and false returned.
+func (p *proxy) awaitReady(w http.ResponseWriter, req *http.Request, method string) bool {
+	if p.gate == "" || p.gate == gateOff || readyExempt(method) {
+		return true
+	}
+
+	p.mutex.Lock()
+	readyCh := p.readyCh
+	p.mutex.Unlock()
+
+	select {
+	case <-readyCh:
+		return true
+	default:
+	}
+
+	if p.gate == gateQueue {
+		ctx, cancel := context.WithTimeout(req.Context(), p.gateTimeout)
+		defer cancel()
+
+		select {
+		case <-readyCh:
+			return true
+		case <-ctx.Done():
+		}
+	}
+
+	_, reason := p.ready()
+	if reason == "" {
+		reason = "LSP server is not ready"
+	}
+	setRetryAfter(w.Header(), p.retryAfter())
+	writeError(w, http.StatusServiceUnavailable, reason)
+	return false
+}
+
+// retryAfter returns how long clients should wait before retrying a
+// request rejected because the LSP server is not ready: until the next
+// restart attempt while it is being restarted, or a second otherwise.
+func (p *proxy) retryAfter() time.Duration {
+	if delay, ok := p.supervisor.retryAfter(); ok {
+		return delay
+	}
+	return time.Second
+}
+
+// handleReady reports whether the proxy can serve LSP requests, with a
+// 200 status code, or 503 otherwise.
+func (p *proxy) handleReady(w http.ResponseWriter, req *http.Request) {
+	ok, reason := p.ready()
+	if !ok {
+		setRetryAfter(w.Header(), p.retryAfter())
+		writeError(w, http.StatusServiceUnavailable, reason)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"ready": true})
+}
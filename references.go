@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+
+	"github.com/federicotdn/hyperlsp/lsp"
+)
+
+const referencesChunkSize = 100
+
+// locationStream writes locations as newline-delimited JSON, flushing
+// after every chunk so that clients receive them progressively.
+type locationStream struct {
+	w       http.ResponseWriter
+	rc      *http.ResponseController
+	enc     *json.Encoder
+	started bool
+	err     error
+}
+
+func newLocationStream(w http.ResponseWriter) *locationStream {
+	return &locationStream{
+		w:   w,
+		rc:  http.NewResponseController(w),
+		enc: json.NewEncoder(w),
+	}
+}
+
+func (ls *locationStream) start() {
+	if ls.started {
+		return
+	}
+
+	ls.w.Header().Set("Content-Type", "application/x-ndjson")
+	ls.w.WriteHeader(http.StatusOK)
+	ls.started = true
+}
+
+func (ls *locationStream) write(value any) {
+	locations, _ := value.([]any)
+	ls.start()
+
+	for i, loc := range locations {
+		if ls.err != nil {
+			return
+		}
+
+		ls.err = ls.enc.Encode(loc)
+		if (i+1)%referencesChunkSize == 0 || i == len(locations)-1 {
+			if err := ls.rc.Flush(); err != nil && ls.err == nil {
+				ls.err = err
+			}
+		}
+	}
+}
+
+// fail reports an error, either as a regular error response if nothing
+// has been streamed yet, or as a final {"error": ...} line otherwise.
+func (ls *locationStream) fail(status int, respErr *lsp.ResponseError) {
+	if !ls.started {
+		writeJSON(ls.w, status, respErr)
+		return
+	}
+
+	err := ls.enc.Encode(map[string]any{"error": respErr})
+	if err != nil {
+		slog.Error("error writing response data", "err", err)
+	}
+}
+
+// partialResults queues the partial results of a request until they are
+// written.
+type partialResults struct {
+	mutex  sync.Mutex
+	values []any
+	// Receives a value once values have been queued.
+	ready chan struct{}
+}
+
+func newPartialResults() *partialResults {
+	return &partialResults{ready: make(chan struct{}, 1)}
+}
+
+// add queues a partial result, without waiting for it to be written.
+func (pr *partialResults) add(value any) {
+	pr.mutex.Lock()
+	pr.values = append(pr.values, value)
+	pr.mutex.Unlock()
+
+	select {
+	case pr.ready <- struct{}{}:
+	default:
+	}
+}
+
+// take returns the queued partial results, removing them.
+func (pr *partialResults) take() []any {
+	pr.mutex.Lock()
+	defer pr.mutex.Unlock()
+	values := pr.values
+	pr.values = nil
+	return values
+}
+
+// handleReferencesStream runs textDocument/references with the
+// ReferenceParams in the body, and streams the resulting locations as
+// newline-delimited JSON. If the LSP server supports partial results,
+// locations are streamed as soon as they are reported; otherwise, the
+// final result is streamed in chunks.
+func (p *proxy) handleReferencesStream(w http.ResponseWriter, req *http.Request) {
+	var params map[string]any
+
+	defer req.Body.Close()
+	err := json.NewDecoder(req.Body).Decode(&params)
+	if err != nil || params == nil {
+		writeError(w, http.StatusBadRequest, "body must be a JSON object")
+		return
+	}
+
+	method := "textDocument/references"
+	token := fmt.Sprintf("hyperlsp-partial-%v", internalId.Add(1))
+	params["partialResultToken"] = token
+
+	msg := lsp.Message{
+		Id:     fmt.Sprintf("hyperlsp-%v", internalId.Add(1)),
+		Method: method,
+		Params: params,
+	}
+
+	release, limitResp, status := p.acquireLimits(req.Context(), msg.Id, method, params)
+	if limitResp != nil {
+		writeCallError(w, &limitError{resp: limitResp, status: status})
+		return
+	}
+	defer release()
+
+	// Partial results are reported on the LSP session's reader goroutine,
+	// which must not wait for the HTTP client, so they are written here.
+	partials := newPartialResults()
+	sent := make(chan struct{})
+	var resp *lsp.Response
+	go func() {
+		defer close(sent)
+		resp, err = lsp.NewClient(p.server()).SendWithPartialResultsContext(req.Context(), &msg, token, partials.add)
+	}()
+
+	ls := newLocationStream(w)
+	for waiting := true; waiting; {
+		select {
+		case <-partials.ready:
+		case <-sent:
+			// All partial results are reported before the response.
+			waiting = false
+		}
+		for _, value := range partials.take() {
+			ls.write(p.filters.apply(method, value))
+		}
+	}
+
+	ctxErr := req.Context().Err()
+	switch {
+	case err != nil && ctxErr != nil && errors.Is(err, ctxErr):
+		// The HTTP client has disconnected, and the request has been
+		// cancelled.
+		slog.Info("LSP request cancelled", "id", msg.Id, "lsp_method", method, "reason", errClientDisconnected)
+		return
+	case err != nil:
+		err = p.proxyError(err)
+		status, code, data := errorStatus(err)
+		ls.fail(status, newProxyError(status, code, err.Error(), data))
+	case resp.Error != nil:
+		ls.fail(http.StatusBadRequest, resp.Error)
+	default:
+		ls.write(decodeResult(p.filters.apply(method, resp.Result)))
+	}
+
+	if ls.err != nil {
+		slog.Error("error writing response data", "err", ls.err)
+	}
+}
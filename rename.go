@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+)
+
+// handleRenamePreview runs textDocument/rename with the RenameParams in
+// the body, and renders the resulting WorkspaceEdit as a unified diff
+// without applying it.
+func (p *proxy) handleRenamePreview(w http.ResponseWriter, req *http.Request) {
+	var params any
+
+	defer req.Body.Close()
+	err := json.NewDecoder(req.Body).Decode(&params)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "unable to unmarshal request json")
+		return
+	}
+
+	var edit workspaceEdit
+	err = p.call(req.Context(), "textDocument/rename", params, &edit)
+	if err != nil {
+		writeCallError(w, err)
+		return
+	}
+
+	plan := newEditPlan(p.positionEncoding(), p.docs)
+	err = plan.add(&edit)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	data := []byte(plan.diff())
+	w.Header().Set("Content-Type", "text/x-diff")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	_, err = w.Write(data)
+	if err != nil {
+		slog.Error("error writing response data", "err", err)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// Headers not copied from recorded requests when replaying them.
+var replaySkippedHeaders = map[string]bool{
+	"Host":            true,
+	"Content-Length":  true,
+	"Accept-Encoding": true,
+	"Connection":      true,
+	apiKeyHeader:      true,
+	"Authorization":   true,
+}
+
+// sameBody reports whether two response bodies are equal, comparing them
+// as JSON values if both are valid JSON.
+func sameBody(a, b string) bool {
+	var va, vb any
+	if json.Unmarshal([]byte(a), &va) == nil && json.Unmarshal([]byte(b), &vb) == nil {
+		return reflect.DeepEqual(va, vb)
+	}
+	return a == b
+}
+
+func replayEntry(client *http.Client, base, apiKey string, entry *harEntry) (*http.Response, string, error) {
+	var body io.Reader
+	if entry.Request.PostData != nil {
+		body = strings.NewReader(entry.Request.PostData.Text)
+	}
+
+	req, err := http.NewRequest(entry.Request.Method, base+entry.Request.URL, body)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, h := range entry.Request.Headers {
+		if !replaySkippedHeaders[h.Name] {
+			req.Header.Add(h.Name, h.Value)
+		}
+	}
+	if apiKey != "" {
+		req.Header.Set(apiKeyHeader, apiKey)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	var buf bytes.Buffer
+	_, err = io.Copy(&buf, resp.Body)
+	return resp, buf.String(), err
+}
+
+// replayHTTP implements the replay-http subcommand, which re-issues the
+// requests recorded in a HAR file against a running hyperlsp instance and
+// reports responses that differ from the recorded ones.
+func replayHTTP(args []string) int {
+	fs := flag.NewFlagSet("replay-http", flag.ExitOnError)
+	addr := fs.String("addr", "localhost:8080", "Address of the hyperlsp instance to replay requests against")
+	apiKey := fs.String("api-key", "", "API key to send with every request (recorded keys are redacted)")
+	statusOnly := fs.Bool("status-only", false, "Only compare response status codes")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: hyperlsp replay-http [flags] file.har\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	data, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	var log harLog
+	err = json.Unmarshal(data, &log)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to parse HAR file: %v\n", err)
+		return 1
+	}
+
+	base := *addr
+	if !strings.Contains(base, "://") {
+		base = "http://" + base
+	}
+
+	client := &http.Client{}
+	failed := 0
+	for i := range log.Log.Entries {
+		entry := &log.Log.Entries[i]
+		name := fmt.Sprintf("%v %v", entry.Request.Method, entry.Request.URL)
+
+		resp, body, err := replayEntry(client, base, *apiKey, entry)
+		switch {
+		case err != nil:
+			fmt.Printf("FAIL %v: %v\n", name, err)
+		case resp.StatusCode != entry.Response.Status:
+			fmt.Printf("FAIL %v: status %v, recorded %v\n", name, resp.StatusCode, entry.Response.Status)
+		case !*statusOnly && !sameBody(body, entry.Response.Content.Text):
+			fmt.Printf("FAIL %v: response body differs\n  got:      %v\n  recorded: %v\n", name, body, entry.Response.Content.Text)
+		default:
+			fmt.Printf("ok   %v\n", name)
+			continue
+		}
+		failed++
+	}
+
+	fmt.Printf("%v/%v requests matched\n", len(log.Log.Entries)-failed, len(log.Log.Entries))
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
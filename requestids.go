@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// requestIDs tracks the client-supplied IDs of the requests in flight, as
+// reusing the ID of a pending request would make their responses
+// indistinguishable.
+type requestIDs struct {
+	mutex sync.Mutex
+	ids   map[string]bool
+}
+
+func newRequestIDs() *requestIDs {
+	return &requestIDs{ids: make(map[string]bool)}
+}
+
+// reserve marks an ID as in use, unless it already is.
+func (ri *requestIDs) reserve(id string) bool {
+	ri.mutex.Lock()
+	defer ri.mutex.Unlock()
+
+	if ri.ids[id] {
+		return false
+	}
+	ri.ids[id] = true
+	return true
+}
+
+func (ri *requestIDs) release(id string) {
+	ri.mutex.Lock()
+	defer ri.mutex.Unlock()
+
+	delete(ri.ids, id)
+}
+
+// reserveID reserves the ID of a request, if it was supplied by the client
+// via the ID header, and returns a function to be called once the request
+// has completed. If the ID is in use by a pending request, it writes a
+// 409 response and returns false.
+func (p *proxy) reserveID(w http.ResponseWriter, req *http.Request, id string) (func(), bool) {
+	if id == "" || req.Header.Get(idHeader) == "" {
+		return func() {}, true
+	}
+
+	if !p.requestIDs.reserve(id) {
+		status := http.StatusConflict
+		message := fmt.Sprintf("request ID %v is already in use by a pending request", id)
+		writeResponse(w, id, errorResponse(id, status, message), status)
+		return nil, false
+	}
+	return func() { p.requestIDs.release(id) }, true
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// Header selecting the server (with multiple servers) or tenant (with
+// tenants) a request is sent to, by name.
+const workspaceHeader = "X-LSP-Workspace"
+
+// Methods sent to all servers, since they are not related to a document.
+var broadcastMethods = map[string]bool{
+	"initialize":                          true,
+	"initialized":                         true,
+	"shutdown":                            true,
+	"exit":                                true,
+	"$/setTrace":                          true,
+	"workspace/didChangeConfiguration":    true,
+	"workspace/didChangeWatchedFiles":     true,
+	"workspace/didChangeWorkspaceFolders": true,
+}
+
+type routedServerConfig struct {
+	Name string `json:"name"`
+	serverConfig
+	// languageId values handled by the server.
+	Languages []string `json:"languages"`
+	// Whether requests for unknown languages are sent to this server. If no
+	// server is marked as default, the first one is used.
+	Default bool `json:"default"`
+}
+
+type routedServer struct {
+	name      string
+	languages map[string]bool
+	proxy     *proxy
+	handler   http.Handler
+}
+
+// languageRouter routes HTTP requests to one of several LSP servers, based
+// on the language of the document they refer to. Each server has its own
+// proxy state.
+type languageRouter struct {
+	servers   []*routedServer
+	fallback  *routedServer
+	languages *languageDetector
+}
+
+func newLanguageRouter(configs []routedServerConfig, languages *languageDetector, filters resultFilters) (*languageRouter, error) {
+	lr := &languageRouter{languages: languages}
+	notifications := newEventHub()
+	for _, sc := range configs {
+		srv, err := sc.start()
+		if err != nil {
+			lr.shutdown()
+			return nil, fmt.Errorf("unable to start LSP server %v: %w", sc.Name, err)
+		}
+
+		p := newProxy(srv, filters)
+		p.supervisor.configure(sc.Restart)
+		p.languages = languages
+		p.headers = sc.Headers
+		// Notifications of all servers are numbered in a single sequence.
+		p.notifications = notifications
+		if len(configs) > 1 {
+			p.name = sc.Name
+		}
+
+		rs := &routedServer{
+			name:      sc.Name,
+			languages: make(map[string]bool),
+			proxy:     p,
+			handler:   p.routes(),
+		}
+		for _, l := range sc.Languages {
+			rs.languages[l] = true
+		}
+
+		lr.servers = append(lr.servers, rs)
+		if sc.Default {
+			lr.fallback = rs
+		}
+	}
+
+	if lr.fallback == nil && len(lr.servers) > 0 {
+		lr.fallback = lr.servers[0]
+	}
+	return lr, nil
+}
+
+// requestDocument returns the URI and languageId (either may be empty) of
+// the document an HTTP request refers to, looking at the query parameters
+// and at the JSON body.
+func requestDocument(req *http.Request, body []byte) (string, string) {
+	uri := req.URL.Query().Get("uri")
+	languageId := req.URL.Query().Get("languageId")
+
+	var v any
+	if json.Unmarshal(body, &v) == nil {
+		obj, _ := v.(map[string]any)
+		td, _ := obj["textDocument"].(map[string]any)
+		for _, o := range []map[string]any{td, obj} {
+			if s, ok := o["uri"].(string); ok && uri == "" {
+				uri = s
+			}
+			if s, ok := o["languageId"].(string); ok && languageId == "" {
+				languageId = s
+			}
+		}
+	}
+
+	return uri, languageId
+}
+
+// server returns the server with the specified name, if any.
+func (lr *languageRouter) server(name string) *routedServer {
+	for _, rs := range lr.servers {
+		if rs.name == name {
+			return rs
+		}
+	}
+	return nil
+}
+
+// route returns the server that should handle a request for a document.
+func (lr *languageRouter) route(uri, languageId string) *routedServer {
+	// Documents already open stay with the server they were opened in.
+	if uri != "" {
+		for _, rs := range lr.servers {
+			if _, ok := rs.proxy.docs.get(uri); ok {
+				return rs
+			}
+		}
+	}
+
+	if languageId == "" && uri != "" {
+		languageId = lr.languages.detectFile(uri)
+	}
+	for _, rs := range lr.servers {
+		if rs.languages[languageId] {
+			return rs
+		}
+	}
+	return lr.fallback
+}
+
+// broadcast sends a request to all servers. Only the response of the
+// default server is written; errors from the others are logged.
+func (lr *languageRouter) broadcast(w http.ResponseWriter, req *http.Request, body []byte) {
+	for _, rs := range lr.servers {
+		if rs == lr.fallback {
+			continue
+		}
+
+		r := req.Clone(req.Context())
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		dw := &discardWriter{header: make(http.Header)}
+		rs.handler.ServeHTTP(dw, r)
+		if dw.status >= http.StatusBadRequest {
+			slog.Warn("broadcast request failed", "server", rs.name, "path", req.URL.Path, "status", dw.status)
+		}
+	}
+
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	lr.fallback.handler.ServeHTTP(w, req)
+}
+
+func (lr *languageRouter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "unable to read request body")
+		return
+	}
+
+	for _, prefix := range []string{"/lsp/", "/notify/"} {
+		if method, ok := strings.CutPrefix(req.URL.Path, prefix); ok && broadcastMethods[method] {
+			lr.broadcast(w, req, body)
+			return
+		}
+	}
+
+	if name := req.Header.Get(workspaceHeader); name != "" {
+		rs := lr.server(name)
+		if rs == nil {
+			writeError(w, http.StatusNotFound, fmt.Sprintf("unknown workspace %v", name))
+			return
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		rs.handler.ServeHTTP(w, req)
+		return
+	}
+
+	if req.URL.Path == "/readyz" {
+		lr.handleReady(w, req)
+		return
+	}
+	if req.URL.Path == "/metrics" {
+		lr.handleMetrics(w, req)
+		return
+	}
+	if req.URL.Path == "/events" {
+		lr.handleEvents(w, req)
+		return
+	}
+
+	// Async results are only known by the server that handled the request.
+	if id, ok := strings.CutPrefix(req.URL.Path, "/results/"); ok {
+		for _, rs := range lr.servers {
+			if _, ok := rs.proxy.results.get(id); ok {
+				rs.handler.ServeHTTP(w, req)
+				return
+			}
+		}
+	}
+
+	rs := lr.route(requestDocument(req, body))
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	rs.handler.ServeHTTP(w, req)
+}
+
+// handleReady reports whether all servers are ready.
+func (lr *languageRouter) handleReady(w http.ResponseWriter, req *http.Request) {
+	for _, rs := range lr.servers {
+		if ok, reason := rs.proxy.ready(); !ok {
+			setRetryAfter(w.Header(), rs.proxy.retryAfter())
+			writeError(w, http.StatusServiceUnavailable, fmt.Sprintf("%v: %v", rs.name, reason))
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"ready": true})
+}
+
+// handleEvents streams the notifications sent by all servers.
+func (lr *languageRouter) handleEvents(w http.ResponseWriter, req *http.Request) {
+	p := lr.servers[0].proxy
+	serveEvents(w, req, p.notifications, p.floodControl)
+}
+
+// handleMetrics returns the metrics of all servers.
+func (lr *languageRouter) handleMetrics(w http.ResponseWriter, req *http.Request) {
+	var names []string
+	var sets [][]metric
+	for _, rs := range lr.servers {
+		names = append(names, rs.name)
+		sets = append(sets, rs.proxy.metrics())
+	}
+	writeMetrics(w, names, sets)
+}
+
+func (lr *languageRouter) shutdown() {
+	for _, rs := range lr.servers {
+		err := rs.proxy.shutdown()
+		if err != nil {
+			slog.Error("error shuttting down LSP server", "server", rs.name, "err", err)
+		}
+	}
+}
+
+// discardWriter is an http.ResponseWriter that only records the status
+// code.
+type discardWriter struct {
+	header http.Header
+	status int
+}
+
+func (w *discardWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *discardWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return len(p), nil
+}
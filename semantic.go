@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/federicotdn/hyperlsp/lsp"
+)
+
+type semanticTokensLegend struct {
+	TokenTypes     []string `json:"tokenTypes"`
+	TokenModifiers []string `json:"tokenModifiers"`
+}
+
+type semanticToken struct {
+	Range     lsp.Range `json:"range"`
+	Type      string    `json:"type"`
+	Modifiers []string  `json:"modifiers"`
+}
+
+// semanticTokensLegend returns the token legend advertised by the LSP
+// server in its initialize response, if any.
+func (p *proxy) semanticTokensLegend() (*semanticTokensLegend, error) {
+	var caps struct {
+		SemanticTokensProvider *struct {
+			Legend semanticTokensLegend `json:"legend"`
+		} `json:"semanticTokensProvider"`
+	}
+
+	err := p.capabilities(&caps)
+	if err != nil {
+		return nil, err
+	}
+	if caps.SemanticTokensProvider == nil {
+		return nil, fmt.Errorf("LSP server does not provide semantic tokens")
+	}
+
+	return &caps.SemanticTokensProvider.Legend, nil
+}
+
+// decodeSemanticTokens decodes the relative, integer-encoded semantic
+// tokens data (five integers per token) into absolute tokens.
+func decodeSemanticTokens(data []int, legend *semanticTokensLegend) ([]semanticToken, error) {
+	if len(data)%5 != 0 {
+		return nil, fmt.Errorf("semantic tokens data length is not a multiple of 5")
+	}
+
+	tokens := make([]semanticToken, 0, len(data)/5)
+	line, char := 0, 0
+
+	for i := 0; i < len(data); i += 5 {
+		deltaLine, deltaChar, length, typ, mods := data[i], data[i+1], data[i+2], data[i+3], data[i+4]
+
+		if deltaLine > 0 {
+			line += deltaLine
+			char = deltaChar
+		} else {
+			char += deltaChar
+		}
+
+		if typ < 0 || typ >= len(legend.TokenTypes) {
+			return nil, fmt.Errorf("token type index %v out of range", typ)
+		}
+
+		modifiers := []string{}
+		for bit := 0; mods>>bit != 0; bit++ {
+			if mods&(1<<bit) == 0 {
+				continue
+			}
+			if bit >= len(legend.TokenModifiers) {
+				return nil, fmt.Errorf("token modifier bit %v out of range", bit)
+			}
+			modifiers = append(modifiers, legend.TokenModifiers[bit])
+		}
+
+		tokens = append(tokens, semanticToken{
+			Range: lsp.Range{
+				Start: lsp.Position{Line: line, Character: char},
+				End:   lsp.Position{Line: line, Character: char + length},
+			},
+			Type:      legend.TokenTypes[typ],
+			Modifiers: modifiers,
+		})
+	}
+
+	return tokens, nil
+}
+
+// handleSemanticTokens runs textDocument/semanticTokens/full for the
+// document specified in the body, and returns the decoded tokens.
+func (p *proxy) handleSemanticTokens(w http.ResponseWriter, req *http.Request) {
+	var params struct {
+		TextDocument lsp.TextDocumentIdentifier `json:"textDocument"`
+	}
+
+	defer req.Body.Close()
+	err := json.NewDecoder(req.Body).Decode(&params)
+	if err != nil || params.TextDocument.URI == "" {
+		writeError(w, http.StatusBadRequest, "unable to unmarshal request json")
+		return
+	}
+
+	legend, err := p.semanticTokensLegend()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	p.setDocumentHeaders(w.Header(), params.TextDocument.URI)
+	var result struct {
+		Data []int `json:"data"`
+	}
+	err = p.call(req.Context(), "textDocument/semanticTokens/full", &params, &result)
+	if err != nil {
+		writeCallError(w, err)
+		return
+	}
+
+	tokens, err := decodeSemanticTokens(result.Data, legend)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("unable to decode semantic tokens: %v", err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"tokens": tokens})
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/federicotdn/hyperlsp/lsp"
+)
+
+// Modes of handling workspace/applyEdit requests sent by the LSP server.
+const (
+	// Requests are answered with a MethodNotFound error.
+	serverEditsReject = "reject"
+	// Requests are queued until approved or rejected via /edits.
+	serverEditsApprove = "approve"
+	// Requests are applied immediately.
+	serverEditsApply = "apply"
+
+	defaultApprovalTimeout = 10 * time.Minute
+)
+
+// Method of the events streamed via /events when an edit of the LSP server
+// is waiting for approval.
+const editPendingMethod = "$/hyperlsp/editPending"
+
+// validServerEditsMode reports whether mode is a known mode of handling
+// workspace/applyEdit requests.
+func validServerEditsMode(mode string) bool {
+	return mode == serverEditsReject || mode == serverEditsApprove || mode == serverEditsApply
+}
+
+// applyEditResult is the ApplyWorkspaceEditResult answered to the LSP
+// server.
+type applyEditResult struct {
+	Applied       bool   `json:"applied"`
+	FailureReason string `json:"failureReason,omitempty"`
+}
+
+// pendingEdit is a workspace/applyEdit request of the LSP server waiting
+// for approval.
+type pendingEdit struct {
+	ID       string        `json:"id"`
+	Label    string        `json:"label,omitempty"`
+	Received time.Time     `json:"received"`
+	Files    []appliedFile `json:"files"`
+	Diff     string        `json:"diff"`
+
+	edit workspaceEdit
+	// Receives the result answered to the LSP server.
+	result chan applyEditResult
+}
+
+// pendingEdits holds the edits waiting for approval, by ID.
+type pendingEdits struct {
+	mutex sync.Mutex
+	edits map[string]*pendingEdit
+}
+
+func newPendingEdits() *pendingEdits {
+	return &pendingEdits{edits: make(map[string]*pendingEdit)}
+}
+
+func (pe *pendingEdits) add(edit *pendingEdit) {
+	pe.mutex.Lock()
+	defer pe.mutex.Unlock()
+	pe.edits[edit.ID] = edit
+}
+
+// take removes a pending edit, so that it is only decided on once.
+func (pe *pendingEdits) take(id string) (*pendingEdit, bool) {
+	pe.mutex.Lock()
+	defer pe.mutex.Unlock()
+	edit, ok := pe.edits[id]
+	delete(pe.edits, id)
+	return edit, ok
+}
+
+// list returns the pending edits, from the oldest.
+func (pe *pendingEdits) list() []*pendingEdit {
+	pe.mutex.Lock()
+	defer pe.mutex.Unlock()
+
+	edits := make([]*pendingEdit, 0, len(pe.edits))
+	for _, edit := range pe.edits {
+		edits = append(edits, edit)
+	}
+	sort.Slice(edits, func(i, j int) bool {
+		return edits[i].Received.Before(edits[j].Received)
+	})
+	return edits
+}
+
+// handleServerRequest answers the requests sent by the LSP server (see
+// also settings.go).
+func (p *proxy) handleServerRequest(method string, params any) (any, error) {
+	switch method {
+	case "workspace/applyEdit":
+		switch p.serverEdits {
+		case serverEditsApprove:
+			return p.awaitApproval(params), nil
+		case serverEditsApply:
+			return p.applyEditNow(params), nil
+		}
+	case "workspace/configuration":
+		return p.handleConfiguration(params)
+	}
+	return nil, lsp.ErrUnsupportedRequest
+}
+
+// applyEditParams are the params of a workspace/applyEdit request.
+type applyEditParams struct {
+	Label string        `json:"label"`
+	Edit  workspaceEdit `json:"edit"`
+}
+
+func parseApplyEdit(params any) (*applyEditParams, error) {
+	var req applyEditParams
+	data, err := json.Marshal(params)
+	if err == nil {
+		err = json.Unmarshal(data, &req)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid workspace/applyEdit params")
+	}
+	return &req, nil
+}
+
+// applyEditNow applies a workspace/applyEdit request to disk, and returns
+// the result to answer the LSP server with.
+func (p *proxy) applyEditNow(params any) applyEditResult {
+	req, err := parseApplyEdit(params)
+	if err != nil {
+		return applyEditResult{FailureReason: err.Error()}
+	}
+
+	entry, err := p.applyServerEdit(req.Label, &req.Edit)
+	if err != nil {
+		slog.Warn("unable to apply LSP server edit", "label", req.Label, "err", err)
+		return applyEditResult{FailureReason: err.Error()}
+	}
+	slog.Info("LSP server edit applied", "id", entry.ID, "label", entry.Label, "files", len(entry.Files))
+	return applyEditResult{Applied: true}
+}
+
+// serverEditPlan computes the changes of a WorkspaceEdit of the LSP server,
+// against the content of tracked documents, as seen by the server. As the
+// server may name any file, the edit is confined to the proxy's roots, like
+// the requests of HTTP clients.
+func (p *proxy) serverEditPlan(edit *workspaceEdit) (*editPlan, error) {
+	plan := newEditPlan(p.positionEncoding(), p.docs)
+	plan.allowedPath = p.allowedPath
+	err := plan.add(edit)
+	if err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+// awaitApproval queues a workspace/applyEdit request until it is approved
+// or rejected via /edits, or until the approval timeout expires, and
+// returns the result to answer the LSP server with.
+func (p *proxy) awaitApproval(params any) applyEditResult {
+	req, err := parseApplyEdit(params)
+	if err != nil {
+		return applyEditResult{FailureReason: err.Error()}
+	}
+
+	// Edits outside of the roots are rejected right away, rather than
+	// offered for approval.
+	plan, err := p.serverEditPlan(&req.Edit)
+	if err != nil {
+		slog.Warn("rejecting LSP server edit", "label", req.Label, "err", err)
+		return applyEditResult{FailureReason: err.Error()}
+	}
+
+	edit := &pendingEdit{
+		ID:       newUUID(),
+		Label:    req.Label,
+		Received: time.Now(),
+		Files:    []appliedFile{},
+		Diff:     plan.diff(),
+		edit:     req.Edit,
+		result:   make(chan applyEditResult, 1),
+	}
+	for _, fc := range plan.changes() {
+		edit.Files = append(edit.Files, appliedFile{Path: fc.path, Action: fc.action()})
+	}
+
+	p.pendingEdits.add(edit)
+	slog.Info("LSP server edit waiting for approval", "id", edit.ID, "label", edit.Label, "files", len(edit.Files))
+	p.notifications.publish(serverNotification{
+		Method: editPendingMethod,
+		Params: map[string]any{"id": edit.ID, "label": edit.Label, "files": edit.Files},
+		Server: p.name,
+	})
+
+	timer := time.NewTimer(p.approvalTimeout)
+	defer timer.Stop()
+	select {
+	case result := <-edit.result:
+		return result
+	case <-timer.C:
+		if _, ok := p.pendingEdits.take(edit.ID); ok {
+			slog.Warn("LSP server edit not approved in time", "id", edit.ID)
+			return applyEditResult{FailureReason: "edit was not approved in time"}
+		}
+		// Being decided on right now.
+		return <-edit.result
+	}
+}
+
+// applyServerEdit writes an edit of the LSP server to disk, keeping
+// timestamped backups, updates the tracked documents it modifies and
+// records it in the journal, so that it can be undone.
+func (p *proxy) applyServerEdit(label string, edit *workspaceEdit) (*journalEntry, error) {
+	p.editJournal.mutex.Lock()
+	defer p.editJournal.mutex.Unlock()
+
+	plan, err := p.serverEditPlan(edit)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	plan.backupSuffix = timestampedBackupSuffix(now)
+	entry := &journalEntry{
+		ID:      newUUID(),
+		Label:   label,
+		Applied: now,
+		Files:   []appliedFile{},
+		hashes:  make(map[string]string),
+	}
+	for _, fc := range plan.changes() {
+		if fc.content != nil {
+			entry.hashes[fc.path] = contentHash(*fc.content)
+		}
+	}
+
+	files, err := plan.apply(true)
+	if err != nil {
+		return nil, err
+	}
+	entry.Files = append(entry.Files, files...)
+
+	p.reloadDocuments(entry.Files)
+	p.editJournal.add(entry)
+	return entry, nil
+}
+
+// handleEditsPending returns the edits of the LSP server waiting for
+// approval.
+func (p *proxy) handleEditsPending(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, p.pendingEdits.list())
+}
+
+// handleEditApprove applies a pending edit of the LSP server to disk, and
+// answers its workspace/applyEdit request.
+func (p *proxy) handleEditApprove(w http.ResponseWriter, req *http.Request) {
+	edit, ok := p.pendingEdits.take(req.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "no pending edit with the specified id")
+		return
+	}
+
+	// The edit is planned again, and so checked against the roots again.
+	entry, err := p.applyServerEdit(edit.Label, &edit.edit)
+	if err != nil {
+		edit.result <- applyEditResult{FailureReason: err.Error()}
+		status := http.StatusInternalServerError
+		if errors.Is(err, errOutsideRoots) {
+			status = http.StatusForbidden
+		}
+		writeError(w, status, fmt.Sprintf("unable to apply edit: %v", err))
+		return
+	}
+
+	edit.result <- applyEditResult{Applied: true}
+	slog.Info("LSP server edit approved", "id", edit.ID, "files", len(entry.Files))
+	writeJSON(w, http.StatusOK, entry)
+}
+
+// handleEditReject answers the workspace/applyEdit request of a pending
+// edit of the LSP server without applying it. The body may contain the
+// reason, reported to the LSP server.
+func (p *proxy) handleEditReject(w http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	defer req.Body.Close()
+	json.NewDecoder(req.Body).Decode(&body)
+	if body.Reason == "" {
+		body.Reason = "edit was rejected"
+	}
+
+	edit, ok := p.pendingEdits.take(req.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "no pending edit with the specified id")
+		return
+	}
+
+	edit.result <- applyEditResult{FailureReason: body.Reason}
+	slog.Info("LSP server edit rejected", "id", edit.ID, "reason", body.Reason)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// settingsStore persists the settings of an LSP server, so that they
+// survive restarts of hyperlsp. Each top-level section of the settings
+// document is stored under its own key.
+type settingsStore struct {
+	db     *bolt.DB
+	bucket []byte
+}
+
+// openSettingsStore opens the bucket of an LSP server's settings, and
+// returns the settings stored in it, if any.
+func openSettingsStore(db *bolt.DB, bucket string) (*settingsStore, any, error) {
+	ss := &settingsStore{db: db, bucket: []byte(bucket)}
+
+	var settings map[string]any
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(ss.bucket)
+		if err != nil {
+			return err
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			var value any
+			if err := json.Unmarshal(v, &value); err != nil {
+				slog.Warn("discarding invalid settings section", "section", string(k), "err", err)
+				return nil
+			}
+			if settings == nil {
+				settings = make(map[string]any)
+			}
+			settings[string(k)] = value
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if settings == nil {
+		return ss, nil, nil
+	}
+	return ss, settings, nil
+}
+
+// save replaces the stored settings. Settings which are not a JSON object
+// are not stored.
+func (ss *settingsStore) save(settings any) error {
+	sections, _ := settings.(map[string]any)
+	return ss.db.Update(func(tx *bolt.Tx) error {
+		err := tx.DeleteBucket(ss.bucket)
+		if err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		b, err := tx.CreateBucket(ss.bucket)
+		if err != nil {
+			return err
+		}
+
+		for name, value := range sections {
+			data, err := json.Marshal(value)
+			if err != nil {
+				return fmt.Errorf("unable to marshal settings section %v: %w", name, err)
+			}
+			if err := b.Put([]byte(name), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// mergeSettings returns the result of applying a JSON merge patch (RFC
+// 7396) to a settings document: objects are merged recursively, null
+// values remove properties, and any other value replaces the previous one.
+func mergeSettings(dst, patch any) any {
+	patchObj, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+
+	dstObj, _ := dst.(map[string]any)
+	merged := make(map[string]any, len(dstObj)+len(patchObj))
+	for k, v := range dstObj {
+		merged[k] = v
+	}
+	for k, v := range patchObj {
+		if v == nil {
+			delete(merged, k)
+			continue
+		}
+		merged[k] = mergeSettings(merged[k], v)
+	}
+	return merged
+}
+
+// currentSettings returns the settings of the last
+// workspace/didChangeConfiguration notification sent to the LSP server, if
+// any.
+func (p *proxy) currentSettings() any {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	params, _ := p.settings.(map[string]any)
+	return params["settings"]
+}
+
+// settingsSection returns the value of a section of the settings, e.g.
+// "gopls.hints", or nil if it is not set. The empty section is the whole
+// settings document.
+func settingsSection(settings any, section string) any {
+	if section == "" {
+		return settings
+	}
+
+	value := settings
+	for _, name := range strings.Split(section, ".") {
+		obj, ok := value.(map[string]any)
+		if !ok {
+			return nil
+		}
+		value = obj[name]
+	}
+	return value
+}
+
+// applyStoredSettings sends the settings loaded from the settings store to
+// a newly initialized LSP server, if any.
+func (p *proxy) applyStoredSettings() {
+	if p.settingsStore == nil {
+		return
+	}
+	settings := p.currentSettings()
+	if settings == nil {
+		return
+	}
+
+	err := p.notify("workspace/didChangeConfiguration", map[string]any{"settings": settings})
+	if err != nil {
+		slog.Warn("unable to apply stored settings", "err", err)
+	}
+}
+
+// handleConfiguration answers workspace/configuration requests of the LSP
+// server with the sections of the current settings, regardless of the
+// scope of the items.
+func (p *proxy) handleConfiguration(params any) (any, error) {
+	var req struct {
+		Items []struct {
+			ScopeURI string `json:"scopeUri"`
+			Section  string `json:"section"`
+		} `json:"items"`
+	}
+	data, err := json.Marshal(params)
+	if err == nil {
+		err = json.Unmarshal(data, &req)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	settings := p.currentSettings()
+	result := make([]any, len(req.Items))
+	for i, item := range req.Items {
+		result[i] = settingsSection(settings, item.Section)
+	}
+	return result, nil
+}
+
+// handleSettingsGet returns the current settings of the LSP server, or
+// the value of one of their sections, e.g. section=gopls.hints.
+func (p *proxy) handleSettingsGet(w http.ResponseWriter, req *http.Request) {
+	settings := p.currentSettings()
+	section := req.URL.Query().Get("section")
+	if section == "" {
+		if settings == nil {
+			settings = map[string]any{}
+		}
+		writeJSON(w, http.StatusOK, settings)
+		return
+	}
+
+	value := settingsSection(settings, section)
+	if value == nil {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("settings section %v is not set", section))
+		return
+	}
+	writeJSON(w, http.StatusOK, value)
+}
+
+// handleSettingsPut merges the JSON object in the body into the settings
+// of the LSP server, as a JSON merge patch, and sends them with a
+// workspace/didChangeConfiguration notification. The merged settings are
+// returned.
+func (p *proxy) handleSettingsPut(w http.ResponseWriter, req *http.Request) {
+	var patch map[string]any
+	defer req.Body.Close()
+	err := json.NewDecoder(req.Body).Decode(&patch)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "body must be a JSON object")
+		return
+	}
+
+	p.settingsUpdate.Lock()
+	defer p.settingsUpdate.Unlock()
+
+	settings := mergeSettings(p.currentSettings(), patch)
+	err = p.notify("workspace/didChangeConfiguration", map[string]any{"settings": settings})
+	if err != nil {
+		writeCallError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, settings)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+type snapshotDocument struct {
+	URI        string  `json:"uri"`
+	LanguageID string  `json:"languageId"`
+	Version    int     `json:"version"`
+	SHA256     string  `json:"sha256"`
+	Text       *string `json:"text,omitempty"`
+}
+
+type snapshot struct {
+	Documents []snapshotDocument `json:"documents"`
+}
+
+func contentHash(text string) string {
+	sum := sha256.Sum256([]byte(text))
+	return hex.EncodeToString(sum[:])
+}
+
+// handleSnapshotExport exports the state of all tracked documents. The
+// documents' content is included unless content=false is specified.
+func (p *proxy) handleSnapshotExport(w http.ResponseWriter, req *http.Request) {
+	withContent := req.URL.Query().Get("content") != "false"
+
+	snap := snapshot{Documents: []snapshotDocument{}}
+	for _, doc := range p.docs.list() {
+		sd := snapshotDocument{
+			URI:        doc.URI,
+			LanguageID: doc.LanguageID,
+			Version:    doc.Version,
+			SHA256:     contentHash(doc.Text),
+		}
+		if withContent {
+			sd.Text = &doc.Text
+		}
+		snap.Documents = append(snap.Documents, sd)
+	}
+
+	writeJSON(w, http.StatusOK, &snap)
+}
+
+// handleSnapshotImport restores the state of the documents in a snapshot
+// (which must include their content). Documents not being tracked are
+// opened, and tracked documents with a different content are changed.
+func (p *proxy) handleSnapshotImport(w http.ResponseWriter, req *http.Request) {
+	var snap snapshot
+
+	defer req.Body.Close()
+	err := json.NewDecoder(req.Body).Decode(&snap)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "unable to unmarshal request json")
+		return
+	}
+
+	for _, sd := range snap.Documents {
+		if sd.URI == "" || sd.Text == nil {
+			writeError(w, http.StatusBadRequest, "snapshot documents must contain a uri and a text")
+			return
+		}
+		if sd.SHA256 != "" && sd.SHA256 != contentHash(*sd.Text) {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("content hash mismatch for %v", sd.URI))
+			return
+		}
+	}
+
+	results := []map[string]any{}
+	for _, sd := range snap.Documents {
+		action := "unchanged"
+		doc, ok := p.docs.get(sd.URI)
+
+		switch {
+		case !ok:
+			action = "opened"
+			doc = document{URI: sd.URI, LanguageID: sd.LanguageID, Version: sd.Version, Text: *sd.Text}
+			err = p.openSnapshotDocument(&doc)
+		case doc.Text != *sd.Text:
+			action = "changed"
+			// Versions sent to the server must always increase.
+			doc.Version = max(doc.Version, sd.Version-1)
+			doc, err = p.changeDocument(doc, *sd.Text)
+		}
+		if errors.Is(err, errDocumentQuota) {
+			writeError(w, http.StatusForbidden, fmt.Sprintf("unable to import %v: %v", sd.URI, err))
+			return
+		} else if err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Sprintf("unable to import %v: %v", sd.URI, err))
+			return
+		}
+
+		results = append(results, map[string]any{
+			"uri":     sd.URI,
+			"version": doc.Version,
+			"action":  action,
+		})
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"documents": results})
+}
+
+// openSnapshotDocument opens a document of a snapshot in the LSP server,
+// subject to the document quota.
+func (p *proxy) openSnapshotDocument(doc *document) error {
+	release, ok := p.docs.reserve(doc.URI)
+	if !ok {
+		return errDocumentQuota
+	}
+	defer release()
+
+	return p.notify("textDocument/didOpen", map[string]any{"textDocument": doc})
+}
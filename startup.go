@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+)
+
+// startupCall is a line of a startup script.
+type startupCall struct {
+	Method string `json:"method"`
+	Params any    `json:"params"`
+	// Request ID. If not set, the call is sent like an HTTP request to
+	// /lsp/{method} without an X-LSP-Id header.
+	Id any `json:"id"`
+	// Whether to always send the call as a notification.
+	Notification bool `json:"notification"`
+	// Additional HTTP headers, e.g. an API key.
+	Headers map[string]string `json:"headers"`
+}
+
+// runStartupScript sends the LSP requests and notifications in a JSON
+// Lines file to handler, in order, as if they were received via HTTP. It
+// stops at the first call that fails.
+func runStartupScript(path string, handler http.Handler) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 64*1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var call startupCall
+		err := json.Unmarshal(line, &call)
+		if err != nil {
+			return fmt.Errorf("line %v: %w", n, err)
+		}
+		if call.Method == "" {
+			return fmt.Errorf("line %v: no LSP method specified", n)
+		}
+
+		err = call.run(handler)
+		if err != nil {
+			return fmt.Errorf("line %v (%v): %w", n, call.Method, err)
+		}
+	}
+	return scanner.Err()
+}
+
+func (call *startupCall) run(handler http.Handler) error {
+	body, err := json.Marshal(call.Params)
+	if err != nil {
+		return err
+	}
+
+	path := "/lsp/" + call.Method
+	if call.Notification {
+		path = "/notify/" + call.Method
+	}
+	req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body))
+	for k, v := range call.Headers {
+		req.Header.Set(k, v)
+	}
+	if call.Id != nil && !call.Notification {
+		req.Header.Set(idHeader, fmt.Sprint(call.Id))
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code >= http.StatusBadRequest {
+		return fmt.Errorf("status %v: %v", rec.Code, strings.TrimSpace(rec.Body.String()))
+	}
+
+	slog.Info("startup script call", "lsp_method", call.Method, "status", rec.Code)
+	return nil
+}
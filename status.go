@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/federicotdn/hyperlsp/lsp"
+)
+
+const maxServerEvents = 100
+
+// serverEvent is a notable event in the LSP server's lifecycle, reported
+// via /status.
+type serverEvent struct {
+	Time    time.Time     `json:"time"`
+	Type    string        `json:"type"`
+	Message string        `json:"message"`
+	Exit    *lsp.ExitInfo `json:"exit,omitempty"`
+}
+
+func (p *proxy) recordEvent(event serverEvent) {
+	event.Time = time.Now()
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.events = append(p.events, event)
+	if len(p.events) > maxServerEvents {
+		p.events = p.events[len(p.events)-maxServerEvents:]
+	}
+}
+
+// restartServer restarts the LSP server subprocess, and then reinitializes
+// it (see reinitialize).
+func (p *proxy) restartServer() error {
+	err := p.server().Restart()
+	if err != nil {
+		return err
+	}
+	return p.reinitialize()
+}
+
+// reconnectServer reopens the connection to an external LSP server, and
+// then reinitializes it.
+func (p *proxy) reconnectServer() error {
+	err := p.server().Reconnect()
+	if err != nil {
+		return err
+	}
+	return p.reinitialize()
+}
+
+// observeSettings keeps the params of workspace/didChangeConfiguration
+// notifications sent to the LSP server, to be sent again after restarting
+// it, and persists them in the settings store (if any).
+func (p *proxy) observeSettings(method string, params any) {
+	if method != "workspace/didChangeConfiguration" {
+		return
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.settings = params
+
+	if p.settingsStore != nil {
+		obj, _ := params.(map[string]any)
+		err := p.settingsStore.save(obj["settings"])
+		if err != nil {
+			slog.Warn("unable to persist settings", "err", err)
+		}
+	}
+}
+
+// reinitialize replays the initialize handshake with a new LSP server (if
+// the previous one had been initialized), the last configuration change
+// and reopens all tracked documents.
+func (p *proxy) reinitialize() error {
+	p.mutex.Lock()
+	initParams := p.initParams
+	settings := p.settings
+	p.serverCaps = nil
+	p.markNotReady()
+	p.mutex.Unlock()
+	if p.stderrDetectors != nil {
+		p.stderrDetectors.reset()
+	}
+
+	if initParams == nil {
+		return nil
+	}
+
+	var result any
+	err := p.call(context.Background(), "initialize", initParams, &result)
+	if err != nil {
+		return fmt.Errorf("unable to initialize LSP server: %w", err)
+	}
+	p.setCapabilities(result)
+
+	// The state is only replayed to the new server, and not mirrored to
+	// the shadow server, if any.
+	srv := p.server()
+	_, err = sendTo(srv, "initialized", map[string]any{})
+	if err != nil {
+		return p.proxyError(err)
+	}
+
+	if settings != nil {
+		_, err = sendTo(srv, "workspace/didChangeConfiguration", settings)
+		if err != nil {
+			return p.proxyError(err)
+		}
+	}
+	err = p.replayWorkspaceFolders(srv)
+	if err != nil {
+		return p.proxyError(err)
+	}
+
+	for _, doc := range p.docs.list() {
+		_, err := sendTo(srv, "textDocument/didOpen", map[string]any{"textDocument": doc})
+		if err != nil {
+			return p.proxyError(err)
+		}
+	}
+
+	p.startWarmup()
+	return nil
+}
+
+// Maximum time to wait for the LSP server to exit gracefully when soft
+// restarting it.
+const softRestartTimeout = 10 * time.Second
+
+// closeDocuments closes all tracked documents in the LSP server, so that
+// servers which persist their state don't see them as abandoned. The
+// documents are still tracked afterwards.
+func (p *proxy) closeDocuments() {
+	docs := p.docs.list()
+	for _, doc := range docs {
+		params := map[string]any{"textDocument": lsp.TextDocumentIdentifier{URI: doc.URI}}
+		_, err := lsp.NewClient(p.server()).Send(&lsp.Message{Method: "textDocument/didClose", Params: params})
+		if err != nil {
+			slog.Warn("unable to close document", "uri", doc.URI, "err", err)
+		}
+	}
+	if len(docs) > 0 {
+		slog.Info("closed tracked documents", "count", len(docs))
+	}
+}
+
+// shutdown closes all tracked documents and then shuts down and exits the
+// LSP server subprocess (if any). Messages are sent to the server one at a
+// time, so notifications already being sent are written first.
+func (p *proxy) shutdown() error {
+	if ok, _ := p.ready(); ok {
+		p.closeDocuments()
+	}
+	return p.server().ShutdownAndExit()
+}
+
+// softRestart closes all tracked documents, shuts down the LSP server
+// subprocess gracefully and starts a new one, which is then reinitialized.
+func (p *proxy) softRestart() error {
+	p.mutex.Lock()
+	initialized := p.serverCaps != nil
+	p.mutex.Unlock()
+
+	if initialized {
+		p.closeDocuments()
+	}
+	err := p.server().SoftRestart(softRestartTimeout)
+	if err != nil {
+		return err
+	}
+	return p.reinitialize()
+}
+
+// handleSoftRestart restarts the LSP server subprocess gracefully on
+// request, replaying its state (see reinitialize). It returns once the new
+// server has been initialized and all documents have been reopened.
+func (p *proxy) handleSoftRestart(w http.ResponseWriter, req *http.Request) {
+	if p.server().Status() == nil {
+		writeError(w, http.StatusBadRequest, "soft restart requires an LSP server subprocess")
+		return
+	}
+	if !p.supervisor.beginRestart() {
+		writeError(w, http.StatusConflict, "LSP server is already being restarted")
+		return
+	}
+
+	start := time.Now()
+	err := p.softRestart()
+	p.supervisor.endRestart(err)
+	if err != nil {
+		slog.Error("unable to soft restart LSP server", "err", err)
+		p.recordEvent(serverEvent{Type: "restart-failed", Message: err.Error()})
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("unable to restart LSP server: %v", err))
+		return
+	}
+	p.recordEvent(serverEvent{Type: "soft-restart", Message: "LSP server restarted gracefully"})
+
+	p.mutex.Lock()
+	initialized := p.serverCaps != nil
+	p.mutex.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"initialized": initialized,
+		"documents":   len(p.docs.list()),
+		"durationMs":  time.Since(start).Milliseconds(),
+		"process":     p.server().Status(),
+	})
+}
+
+// handleServerStatus returns the state of the LSP server: whether it is
+// running (according to the supervisor), and for a subprocess, its process
+// details, including how it last exited and its last lines of stderr
+// output.
+func (p *proxy) handleServerStatus(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"state":   p.supervisor.currentState(),
+		"process": p.server().Status(),
+	})
+}
+
+// handleStatus returns the state of the LSP server subprocess and its
+// recent lifecycle events.
+func (p *proxy) handleStatus(w http.ResponseWriter, req *http.Request) {
+	p.mutex.Lock()
+	initialized := p.serverCaps != nil
+	events := append([]serverEvent{}, p.events...)
+	p.mutex.Unlock()
+
+	status := map[string]any{
+		"initialized": initialized,
+		"process":     p.server().Status(),
+		"documents":   len(p.docs.list()),
+		"events":      events,
+	}
+	if p.readOnly {
+		status["readOnly"] = true
+	}
+	if p.stderrDetectors != nil {
+		status["stderrDetectors"] = p.stderrDetectors.status()
+	}
+	writeJSON(w, http.StatusOK, status)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// Method of the events streamed via /events when a line of the LSP
+// server's stderr output matches a detector.
+const stderrMatchMethod = "$/hyperlsp/stderrMatch"
+
+// stderrDetectorConfig detects a known error in the stderr output of the
+// LSP server subprocess, e.g. a panic or an expired license.
+type stderrDetectorConfig struct {
+	Name string `json:"name"`
+	// Regular expression matched against every line of output.
+	Pattern string `json:"pattern"`
+	// Whether the LSP server is reported as not ready once a line matches,
+	// until it is restarted.
+	NotReady bool `json:"notReady"`
+}
+
+type stderrDetectorsConfig []stderrDetectorConfig
+
+func (sc stderrDetectorsConfig) validate() error {
+	names := make(map[string]bool)
+	for i, d := range sc {
+		if d.Name == "" {
+			return fmt.Errorf("stderr detector %v has no name", i)
+		}
+		if names[d.Name] {
+			return fmt.Errorf("duplicate stderr detector name %v", d.Name)
+		}
+		names[d.Name] = true
+		if d.Pattern == "" {
+			return fmt.Errorf("stderr detector %v has no pattern", d.Name)
+		}
+		if _, err := regexp.Compile(d.Pattern); err != nil {
+			return fmt.Errorf("stderr detector %v: invalid pattern: %w", d.Name, err)
+		}
+	}
+	return nil
+}
+
+// stderrDetection is the state of a detector, reported via /status.
+type stderrDetection struct {
+	Detector string     `json:"detector"`
+	Matches  int        `json:"matches"`
+	LastLine string     `json:"lastLine,omitempty"`
+	LastTime *time.Time `json:"lastTime,omitempty"`
+}
+
+type stderrDetector struct {
+	name     string
+	pattern  *regexp.Regexp
+	notReady bool
+}
+
+// stderrDetectors matches the lines of the LSP server's stderr output
+// against the configured detectors.
+type stderrDetectors struct {
+	detectors []stderrDetector
+
+	mutex      sync.Mutex
+	detections []stderrDetection
+	// Why the LSP server is not ready, once a line has matched a detector
+	// with NotReady set.
+	failure string
+}
+
+// newStderrDetectors creates the detectors of a validated configuration.
+func newStderrDetectors(cfg stderrDetectorsConfig) *stderrDetectors {
+	sd := &stderrDetectors{}
+	for _, d := range cfg {
+		sd.detectors = append(sd.detectors, stderrDetector{name: d.Name, pattern: regexp.MustCompile(d.Pattern), notReady: d.NotReady})
+		sd.detections = append(sd.detections, stderrDetection{Detector: d.Name})
+	}
+	return sd
+}
+
+// match records the detectors matching a line, and returns them.
+func (sd *stderrDetectors) match(line string) []stderrDetector {
+	var matched []int
+	for i, d := range sd.detectors {
+		if d.pattern.MatchString(line) {
+			matched = append(matched, i)
+		}
+	}
+	if len(matched) == 0 {
+		return nil
+	}
+
+	sd.mutex.Lock()
+	defer sd.mutex.Unlock()
+
+	now := time.Now()
+	detectors := make([]stderrDetector, len(matched))
+	for j, i := range matched {
+		detectors[j] = sd.detectors[i]
+		detection := &sd.detections[i]
+		detection.Matches++
+		detection.LastLine = line
+		detection.LastTime = &now
+		if sd.detectors[i].notReady && sd.failure == "" {
+			sd.failure = fmt.Sprintf("LSP server reported a known error (%v): %v", sd.detectors[i].name, line)
+		}
+	}
+	return detectors
+}
+
+// notReadyReason returns why the LSP server is not ready according to the
+// detectors, or an empty string.
+func (sd *stderrDetectors) notReadyReason() string {
+	sd.mutex.Lock()
+	defer sd.mutex.Unlock()
+	return sd.failure
+}
+
+// reset clears the failure of a previous LSP server, once it has been
+// replaced.
+func (sd *stderrDetectors) reset() {
+	sd.mutex.Lock()
+	defer sd.mutex.Unlock()
+	sd.failure = ""
+}
+
+func (sd *stderrDetectors) status() []stderrDetection {
+	sd.mutex.Lock()
+	defer sd.mutex.Unlock()
+	return append([]stderrDetection{}, sd.detections...)
+}
+
+// handleStderr is called for every line written by the LSP server
+// subprocess to its stderr. Lines matching a detector are logged, recorded
+// as lifecycle events and streamed via /events.
+func (p *proxy) handleStderr(line string) {
+	for _, d := range p.stderrDetectors.match(line) {
+		slog.Warn("known error in LSP server stderr output", "detector", d.name, "line", line)
+		p.recordEvent(serverEvent{Type: "stderr-match", Message: fmt.Sprintf("LSP server stderr output matched detector %v: %v", d.name, line)})
+		p.notifications.publish(serverNotification{
+			Method: stderrMatchMethod,
+			Params: map[string]any{"detector": d.name, "line": line, "notReady": d.notReady},
+			Server: p.name,
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+
+	"github.com/federicotdn/hyperlsp/lsp"
+)
+
+// Header identifying the client sending a request, e.g. an editor
+// session, so that its stale requests can be cancelled.
+const clientHeader = "X-HyperLSP-Client"
+
+// Methods whose pending requests are superseded by newer requests of the
+// same client about the same document, as editors cancel them once the
+// cursor has moved.
+var supersedableMethods = map[string]bool{
+	"textDocument/completion": true,
+	"textDocument/hover":      true,
+}
+
+var (
+	errSuperseded         = errors.New("request superseded by a newer request from the same client")
+	errClientDisconnected = errors.New("HTTP client disconnected")
+)
+
+type pendingRequest struct {
+	cancel context.CancelCauseFunc
+}
+
+// supersessions tracks the pending supersedable requests, by client,
+// method and document.
+type supersessions struct {
+	mutex   sync.Mutex
+	pending map[string]*pendingRequest
+}
+
+func newSupersessions() *supersessions {
+	return &supersessions{pending: make(map[string]*pendingRequest)}
+}
+
+// begin registers a request, superseding the pending request with the
+// same key (if any), which is returned. It also returns a function to be
+// called once the request has completed.
+func (ss *supersessions) begin(key string, r *pendingRequest) (*pendingRequest, func()) {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	previous := ss.pending[key]
+	ss.pending[key] = r
+	return previous, func() {
+		ss.mutex.Lock()
+		defer ss.mutex.Unlock()
+		if ss.pending[key] == r {
+			delete(ss.pending, key)
+		}
+	}
+}
+
+// supersede registers a request sent by a client identified by the
+// clientHeader header, cancelling the previous pending request of the
+// client for the same method and document: its context is cancelled with
+// errSuperseded, so that it is not sent if it is still waiting, or is
+// cancelled in the LSP server otherwise (see forward). It returns the
+// context of the request, and a function to be called once it completes.
+func (p *proxy) supersede(req *http.Request, id, method string, params any) (context.Context, func()) {
+	client := req.Header.Get(clientHeader)
+	uri := documentURI(params)
+	if client == "" || id == "" || uri == "" || !supersedableMethods[method] {
+		return req.Context(), func() {}
+	}
+
+	ctx, cancel := context.WithCancelCause(req.Context())
+	previous, done := p.supersessions.begin(client+"\x00"+method+"\x00"+uri, &pendingRequest{cancel: cancel})
+	if previous != nil {
+		previous.cancel(errSuperseded)
+	}
+
+	return ctx, func() {
+		done()
+		cancel(nil)
+	}
+}
+
+// superseded reports whether the request with the specified context has
+// been superseded by a newer one.
+func superseded(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), errSuperseded)
+}
+
+// cancelledResponse returns the error response, and its HTTP status code,
+// for a request cancelled before being sent to the LSP server.
+func cancelledResponse(id string, err error) (*lsp.Response, int) {
+	status := http.StatusConflict
+	return &lsp.Response{Id: id, Error: newProxyError(status, codeCancelled, err.Error(), nil)}, status
+}
+
+// writeCancelled writes the response for a request cancelled before being
+// sent to the LSP server.
+func writeCancelled(w http.ResponseWriter, id string, err error) {
+	resp, status := cancelledResponse(id, err)
+	writeResponse(w, id, resp, status)
+}
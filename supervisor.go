@@ -0,0 +1,345 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/federicotdn/hyperlsp/lsp"
+)
+
+const (
+	restartNever     = "never"
+	restartOnFailure = "on-failure"
+	restartAlways    = "always"
+
+	defaultMaxRestarts = 5
+	maxRestartRecords  = 100
+
+	// A server that exits before running for stableUptime is considered
+	// to be crash looping, and restarts are delayed with an exponential
+	// backoff.
+	stableUptime   = time.Minute
+	backoffInitial = time.Second
+	backoffMax     = time.Minute
+)
+
+type restartConfig struct {
+	// One of never, on-failure (default) or always.
+	Policy string `json:"policy"`
+	// Maximum number of consecutive restarts, 0 for no limit. Defaults to
+	// defaultMaxRestarts.
+	MaxRestarts *int `json:"maxRestarts"`
+}
+
+func (rc *restartConfig) validate() error {
+	switch rc.Policy {
+	case "", restartNever, restartOnFailure, restartAlways:
+	default:
+		return fmt.Errorf("invalid restart policy: %v", rc.Policy)
+	}
+	if rc.MaxRestarts != nil && *rc.MaxRestarts < 0 {
+		return fmt.Errorf("invalid max restarts: %v", *rc.MaxRestarts)
+	}
+	return nil
+}
+
+type restartRecord struct {
+	Time time.Time `json:"time"`
+	// Exit of the LSP server subprocess, or the error of the liveness probe
+	// which triggered the restart.
+	Exit    *lsp.ExitInfo `json:"exit,omitempty"`
+	Probe   string        `json:"probe,omitempty"`
+	Attempt int           `json:"attempt"`
+	// Backoff delay before restarting, in milliseconds.
+	Delay     int64  `json:"delayMs"`
+	CrashLoop bool   `json:"crashLoop"`
+	Error     string `json:"error,omitempty"`
+}
+
+// supervisor restarts the LSP server subprocess according to a restart
+// policy when it exits unexpectedly, or reconnects to an external server,
+// when it fails its liveness probe.
+type supervisor struct {
+	p           *proxy
+	policy      string
+	maxRestarts int
+
+	mutex    sync.Mutex
+	failures int
+	state    string
+	history  []restartRecord
+	// Error of the liveness probe, while the server is unhealthy.
+	probeErr error
+	// When the connection to an external server was last recovered.
+	recoveredAt time.Time
+	// When the next restart will be attempted, while restarting.
+	restartAt time.Time
+}
+
+func newSupervisor(p *proxy) *supervisor {
+	return &supervisor{
+		p:           p,
+		policy:      restartOnFailure,
+		maxRestarts: defaultMaxRestarts,
+		state:       "running",
+	}
+}
+
+func (s *supervisor) configure(rc restartConfig) {
+	if rc.Policy != "" {
+		s.policy = rc.Policy
+	}
+	if rc.MaxRestarts != nil {
+		s.maxRestarts = *rc.MaxRestarts
+	}
+}
+
+func (s *supervisor) shouldRestart(info lsp.ExitInfo) bool {
+	switch s.policy {
+	case restartAlways:
+		return true
+	case restartOnFailure:
+		return info.Code != 0 || info.OOM
+	default:
+		return false
+	}
+}
+
+func (s *supervisor) addRecord(record restartRecord) {
+	s.history = append(s.history, record)
+	if len(s.history) > maxRestartRecords {
+		s.history = s.history[len(s.history)-maxRestartRecords:]
+	}
+}
+
+// handleExit is called when the LSP server subprocess exits.
+func (s *supervisor) handleExit(info lsp.ExitInfo) {
+	if info.Expected {
+		return
+	}
+
+	event := serverEvent{
+		Type:    "exit",
+		Message: fmt.Sprintf("LSP server exited unexpectedly with code %v", info.Code),
+		Exit:    &info,
+	}
+	if info.OOM {
+		event.Type = "oom"
+		event.Message = "LSP server ran out of memory"
+	}
+	s.p.recordEvent(event)
+
+	if !s.shouldRestart(info) {
+		s.mutex.Lock()
+		s.state = "stopped"
+		s.mutex.Unlock()
+		return
+	}
+
+	var uptime time.Duration
+	if status := s.p.server().Status(); status != nil {
+		uptime = info.Time.Sub(status.StartedAt)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.recover(restartRecord{Exit: &info}, uptime)
+}
+
+// handleProbeFailure is called when the LSP server fails its liveness
+// probe repeatedly. Unless the restart policy is never, the subprocess is
+// restarted, or the connection to an external server reopened, without
+// waiting for a request to fail; otherwise, the server is only reported as
+// unhealthy.
+func (s *supervisor) handleProbeFailure(err error) {
+	s.p.recordEvent(serverEvent{Type: "probe-failed", Message: fmt.Sprintf("LSP server failed liveness probe: %v", err)})
+
+	started := time.Time{}
+	if status := s.p.server().Status(); status != nil {
+		started = status.StartedAt
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.state != "running" {
+		return
+	}
+	if s.policy == restartNever {
+		s.state = "unhealthy"
+		s.probeErr = err
+		return
+	}
+
+	if started.IsZero() {
+		started = s.recoveredAt
+	}
+	uptime := stableUptime
+	if !started.IsZero() {
+		uptime = time.Since(started)
+	}
+	s.recover(restartRecord{Probe: err.Error()}, uptime)
+}
+
+// handleProbeSuccess is called when the LSP server passes its liveness
+// probe after having failed it.
+func (s *supervisor) handleProbeSuccess() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.state == "unhealthy" {
+		s.state = "running"
+		s.probeErr = nil
+		s.p.recordEvent(serverEvent{Type: "probe-recovered", Message: "LSP server passed liveness probe"})
+	}
+}
+
+// recover restarts the LSP server (or reconnects to it) after a failure,
+// applying the restart limits and backoff. The server had been running for
+// uptime. It must be called with s.mutex held.
+func (s *supervisor) recover(record restartRecord, uptime time.Duration) {
+	if uptime >= stableUptime {
+		s.failures = 0
+	}
+	s.failures++
+
+	record.Time = time.Now()
+	record.Attempt = s.failures
+	record.CrashLoop = s.failures > 1
+
+	if s.maxRestarts > 0 && s.failures > s.maxRestarts {
+		s.state = "gave-up"
+		record.Error = fmt.Sprintf("giving up after %v consecutive restarts", s.maxRestarts)
+		s.addRecord(record)
+		s.p.recordEvent(serverEvent{Type: "crash-loop", Message: record.Error})
+		slog.Error("LSP server is crash looping", "restarts", s.maxRestarts)
+		return
+	}
+
+	var delay time.Duration
+	if record.CrashLoop {
+		delay = min(backoffInitial<<min(s.failures-2, 16), backoffMax)
+		s.state = "backoff"
+	} else {
+		s.state = "restarting"
+	}
+	record.Delay = delay.Milliseconds()
+	s.restartAt = time.Now().Add(delay)
+
+	go func() {
+		time.Sleep(delay)
+		reconnect := s.p.server().Status() == nil
+		var err error
+		if reconnect {
+			err = s.p.reconnectServer()
+		} else {
+			err = s.p.restartServer()
+		}
+
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+
+		switch {
+		case err != nil:
+			slog.Error("unable to restart LSP server", "err", err)
+			record.Error = err.Error()
+			s.state = "stopped"
+			s.p.recordEvent(serverEvent{Type: "restart-failed", Message: err.Error()})
+		case reconnect:
+			s.state = "running"
+			s.recoveredAt = time.Now()
+			s.p.recordEvent(serverEvent{Type: "reconnect", Message: "reconnected to LSP server"})
+		default:
+			s.state = "running"
+			s.p.recordEvent(serverEvent{Type: "restart", Message: "LSP server restarted"})
+		}
+		s.addRecord(record)
+	}()
+}
+
+// beginRestart marks the LSP server as being restarted on request, unless
+// it is already being restarted.
+func (s *supervisor) beginRestart() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.state == "restarting" || s.state == "backoff" {
+		return false
+	}
+	s.state = "restarting"
+	s.restartAt = time.Now()
+	return true
+}
+
+// endRestart is called once a restart started with beginRestart has
+// completed, successfully if err is nil.
+func (s *supervisor) endRestart(err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err != nil {
+		s.state = "stopped"
+		return
+	}
+	s.state = "running"
+	s.failures = 0
+	s.probeErr = nil
+}
+
+// currentState returns the state of the supervisor: running, restarting,
+// backoff, unhealthy, stopped or gave-up.
+func (s *supervisor) currentState() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.state
+}
+
+// retryAfter returns how long until the LSP server is restarted, if it is
+// being restarted.
+func (s *supervisor) retryAfter() (time.Duration, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.state != "restarting" && s.state != "backoff" {
+		return 0, false
+	}
+	return max(time.Until(s.restartAt), 0), true
+}
+
+// notRunningReason returns why the LSP server is not running, or an empty
+// string if it is.
+func (s *supervisor) notRunningReason() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	switch s.state {
+	case "running":
+		return ""
+	case "unhealthy":
+		return fmt.Sprintf("LSP server is unhealthy: %v", s.probeErr)
+	case "backoff":
+		return "LSP server is waiting to be restarted"
+	}
+	return fmt.Sprintf("LSP server is %v", s.state)
+}
+
+// handleRestarts returns the supervisor's configuration, state and restart
+// history.
+func (s *supervisor) handleRestarts(w http.ResponseWriter, req *http.Request) {
+	// The response is written without holding the mutex, so that a slow
+	// client doesn't block restarts.
+	s.mutex.Lock()
+	restarts := map[string]any{
+		"policy":      s.policy,
+		"maxRestarts": s.maxRestarts,
+		"state":       s.state,
+		"failures":    s.failures,
+		"history":     append([]restartRecord{}, s.history...),
+	}
+	s.mutex.Unlock()
+
+	writeJSON(w, http.StatusOK, restarts)
+}
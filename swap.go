@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/federicotdn/hyperlsp/lsp"
+)
+
+// Maximum time to wait for the retired LSP server to exit gracefully after
+// swapping servers.
+const retireTimeout = 10 * time.Second
+
+// sendTo sends a message to a specific LSP server, which may not be the
+// current one, failing on error responses.
+func sendTo(srv *lsp.Server, method string, params any) (*lsp.Response, error) {
+	msg := lsp.Message{Method: method, Params: params}
+	if method == "initialize" {
+		msg.Id = fmt.Sprintf("hyperlsp-%v", internalId.Add(1))
+	}
+	resp, err := lsp.NewClient(srv).Send(&msg)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Error != nil {
+		return nil, resp.Error
+	}
+	return resp, nil
+}
+
+// warmStandby replays the state of the current LSP server to a standby
+// server like reinitialize: the initialize handshake (if the current server
+// has been initialized), the last configuration change and all tracked
+// documents. It returns the initialize result and the documents opened.
+func (p *proxy) warmStandby(standby *lsp.Server) (any, map[string]document, error) {
+	p.mutex.Lock()
+	initParams := p.initParams
+	settings := p.settings
+	p.mutex.Unlock()
+
+	opened := make(map[string]document)
+	if initParams == nil {
+		return nil, opened, nil
+	}
+
+	resp, err := sendTo(standby, "initialize", initParams)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to initialize LSP server: %w", err)
+	}
+	_, err = sendTo(standby, "initialized", map[string]any{})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if settings != nil {
+		_, err = sendTo(standby, "workspace/didChangeConfiguration", settings)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	err = p.replayWorkspaceFolders(standby)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, doc := range p.docs.list() {
+		_, err := sendTo(standby, "textDocument/didOpen", map[string]any{"textDocument": doc})
+		if err != nil {
+			return nil, nil, err
+		}
+		opened[doc.URI] = doc
+	}
+
+	return resp.Result, opened, nil
+}
+
+// catchUp brings the documents opened in a standby LSP server up to date
+// with the documents changed, opened or closed while it was being warmed.
+// Changed documents are reopened with their full text. It must be called
+// with p.docSync held, so that the document store doesn't change.
+func (p *proxy) catchUp(standby *lsp.Server, opened map[string]document) error {
+	current := make(map[string]bool)
+	for _, doc := range p.docs.list() {
+		current[doc.URI] = true
+		prev, ok := opened[doc.URI]
+		if ok && prev == doc {
+			continue
+		}
+		if ok {
+			params := map[string]any{"textDocument": lsp.TextDocumentIdentifier{URI: doc.URI}}
+			_, err := sendTo(standby, "textDocument/didClose", params)
+			if err != nil {
+				return err
+			}
+		}
+		_, err := sendTo(standby, "textDocument/didOpen", map[string]any{"textDocument": doc})
+		if err != nil {
+			return err
+		}
+	}
+
+	for uri := range opened {
+		if current[uri] {
+			continue
+		}
+		params := map[string]any{"textDocument": lsp.TextDocumentIdentifier{URI: uri}}
+		_, err := sendTo(standby, "textDocument/didClose", params)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// swapServer starts a new LSP server subprocess, running the command set
+// with -swap-cmd (or the current server's command), warms it up with the current
+// server's state, and then switches all traffic to it. The previous server
+// keeps answering the requests already sent to it, and is then shut down
+// gracefully in the background. It returns the number of documents
+// replayed to the new server.
+func (p *proxy) swapServer() (int, error) {
+	old := p.server()
+	standby, err := old.NewStandby(p.swapCommand)
+	if err != nil {
+		return 0, fmt.Errorf("unable to start LSP server: %w", err)
+	}
+	// The standby's notifications are handled like the current server's,
+	// but its exits are ignored until it replaces it.
+	standby.SetExitHandler(func(info lsp.ExitInfo) {
+		if p.server() == standby {
+			p.supervisor.handleExit(info)
+		}
+	})
+
+	initResult, opened, err := p.warmStandby(standby)
+	if err != nil {
+		standby.Stop(0)
+		return 0, err
+	}
+
+	p.docSync.Lock()
+	if state := p.supervisor.currentState(); state != "running" {
+		p.docSync.Unlock()
+		standby.Stop(0)
+		return 0, fmt.Errorf("LSP server is %v", state)
+	}
+	err = p.catchUp(standby, opened)
+	if err != nil {
+		p.docSync.Unlock()
+		standby.Stop(0)
+		return 0, err
+	}
+	p.srv.Store(standby)
+	if initResult != nil {
+		p.setCapabilities(initResult)
+	}
+	if p.stderrDetectors != nil {
+		p.stderrDetectors.reset()
+	}
+	p.docSync.Unlock()
+
+	go func() {
+		old.Stop(retireTimeout)
+		slog.Info("retired previous LSP server")
+	}()
+	p.startWarmup()
+	return len(p.docs.list()), nil
+}
+
+// handleSwap replaces the LSP server subprocess with a new one without
+// downtime (see swapServer), e.g. to upgrade the server. As the new
+// server's command can only be set by the operator, HTTP clients can't run
+// arbitrary programs. It returns once traffic has been switched to the new
+// server.
+func (p *proxy) handleSwap(w http.ResponseWriter, req *http.Request) {
+	if p.swapDenied {
+		writeError(w, http.StatusForbidden, "swapping servers is not allowed for tenants")
+		return
+	}
+	if p.denyReadOnly(w, "", "swapping servers") {
+		return
+	}
+
+	var body map[string]any
+	defer req.Body.Close()
+	err := json.NewDecoder(req.Body).Decode(&body)
+	if err != nil && err != io.EOF {
+		writeError(w, http.StatusBadRequest, "unable to unmarshal request json")
+		return
+	}
+	if _, ok := body["command"]; ok {
+		writeError(w, http.StatusBadRequest, "the command of the new LSP server can only be set with -swap-cmd")
+		return
+	}
+
+	if p.server().Status() == nil {
+		writeError(w, http.StatusBadRequest, "swapping servers requires an LSP server subprocess")
+		return
+	}
+	if !p.swapping.TryLock() {
+		writeError(w, http.StatusConflict, "LSP server is already being swapped")
+		return
+	}
+	defer p.swapping.Unlock()
+	if reason := p.supervisor.notRunningReason(); reason != "" {
+		writeError(w, http.StatusConflict, reason)
+		return
+	}
+
+	start := time.Now()
+	documents, err := p.swapServer()
+	if err != nil {
+		slog.Error("unable to swap LSP server", "err", err)
+		p.recordEvent(serverEvent{Type: "swap-failed", Message: err.Error()})
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("unable to swap LSP server: %v", err))
+		return
+	}
+	p.recordEvent(serverEvent{Type: "swap", Message: "LSP server swapped"})
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"documents":  documents,
+		"durationMs": time.Since(start).Milliseconds(),
+		"process":    p.server().Status(),
+	})
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/federicotdn/hyperlsp/lsp"
+)
+
+const symbolsDefaultLimit = 100
+
+type symbol struct {
+	Name          string     `json:"name"`
+	Kind          string     `json:"kind"`
+	ContainerName string     `json:"containerName,omitempty"`
+	URI           string     `json:"uri"`
+	Range         *lsp.Range `json:"range,omitempty"`
+
+	score int
+}
+
+// workspaceSymbol represents both the SymbolInformation and
+// WorkspaceSymbol types, which can be returned by workspace/symbol.
+type workspaceSymbol struct {
+	Name          string `json:"name"`
+	Kind          int    `json:"kind"`
+	ContainerName string `json:"containerName"`
+	Location      struct {
+		URI   string     `json:"uri"`
+		Range *lsp.Range `json:"range"`
+	} `json:"location"`
+}
+
+// fuzzyScore scores how well name matches query. Exact matches score
+// highest, followed by prefix matches, substring matches, and finally
+// matches where the query is a subsequence of name. A negative score means
+// that name does not match. Matching is case-insensitive, but matches
+// with the same casing score slightly higher.
+func fuzzyScore(name, query string) int {
+	if query == "" {
+		return 0
+	}
+
+	lowerName, lowerQuery := strings.ToLower(name), strings.ToLower(query)
+	score := 0
+
+	switch {
+	case lowerName == lowerQuery:
+		score = 4000
+	case strings.HasPrefix(lowerName, lowerQuery):
+		score = 3000
+	case strings.Contains(lowerName, lowerQuery):
+		score = 2000
+	default:
+		// Subsequence match: reward consecutive characters and matches at
+		// word boundaries.
+		nameRunes, queryRunes := []rune(name), []rune(lowerQuery)
+		qi, prev := 0, -2
+		for ni := 0; ni < len(nameRunes) && qi < len(queryRunes); ni++ {
+			if unicode.ToLower(nameRunes[ni]) != queryRunes[qi] {
+				continue
+			}
+
+			score += 10
+			if ni == prev+1 {
+				score += 5
+			}
+			if ni == 0 || unicode.IsUpper(nameRunes[ni]) || !unicode.IsLetter(nameRunes[ni-1]) {
+				score += 10
+			}
+			prev = ni
+			qi++
+		}
+		if qi < len(queryRunes) {
+			return -1
+		}
+		score += 1000
+	}
+
+	if strings.Contains(name, query) {
+		score += 100
+	}
+
+	// Prefer shorter names.
+	return score - len(name)
+}
+
+func parseSymbolKinds(value string) (map[int]bool, bool) {
+	kinds := make(map[int]bool)
+	for _, name := range strings.Split(value, ",") {
+		kind, err := strconv.Atoi(name)
+		if err != nil {
+			kind = lsp.SymbolKindByName(name)
+		}
+		if lsp.SymbolKindName(kind) == "unknown" {
+			return nil, false
+		}
+		kinds[kind] = true
+	}
+	return kinds, true
+}
+
+// searchSymbols runs workspace/symbol, returning the symbols matching q
+// (and kinds, if not nil) ranked by fuzzyScore, up to limit.
+func (p *proxy) searchSymbols(ctx context.Context, q string, kinds map[int]bool, limit int) ([]symbol, error) {
+	var result []workspaceSymbol
+	err := p.call(ctx, "workspace/symbol", map[string]any{"query": q}, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	symbols := []symbol{}
+	for _, ws := range result {
+		if kinds != nil && !kinds[ws.Kind] {
+			continue
+		}
+
+		score := fuzzyScore(ws.Name, q)
+		if score < 0 {
+			continue
+		}
+
+		symbols = append(symbols, symbol{
+			Name:          ws.Name,
+			Kind:          lsp.SymbolKindName(ws.Kind),
+			ContainerName: ws.ContainerName,
+			URI:           ws.Location.URI,
+			Range:         ws.Location.Range,
+			score:         score,
+		})
+	}
+
+	sort.SliceStable(symbols, func(i, j int) bool {
+		a, b := symbols[i], symbols[j]
+		if a.score != b.score {
+			return a.score > b.score
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.URI < b.URI
+	})
+
+	if len(symbols) > limit {
+		symbols = symbols[:limit]
+	}
+
+	return symbols, nil
+}
+
+// handleSymbols wraps workspace/symbol, filtering and ranking the results
+// on the proxy (as servers differ on how they interpret the query), and
+// returning them in a flat shape.
+func (p *proxy) handleSymbols(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	q := query.Get("q")
+
+	var kinds map[int]bool
+	if v := query.Get("kind"); v != "" {
+		var ok bool
+		kinds, ok = parseSymbolKinds(v)
+		if !ok {
+			writeError(w, http.StatusBadRequest, "invalid symbol kind")
+			return
+		}
+	}
+
+	limit := symbolsDefaultLimit
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+		limit = n
+	}
+
+	symbols, err := p.searchSymbols(req.Context(), q, kinds, limit)
+	if err != nil {
+		writeCallError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"symbols": symbols})
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/federicotdn/hyperlsp/lsp"
+)
+
+const apiKeyHeader = "X-API-Key"
+
+// rateLimiter limits the amount of requests allowed per minute, using a
+// fixed window.
+type rateLimiter struct {
+	mutex       sync.Mutex
+	limit       int
+	count       int
+	windowStart time.Time
+}
+
+// allow reports whether a request is allowed. If it isn't, it also
+// returns the time left until the next window.
+func (rl *rateLimiter) allow() (bool, time.Duration) {
+	if rl.limit <= 0 {
+		return true, 0
+	}
+
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(rl.windowStart) >= time.Minute {
+		rl.windowStart = now
+		rl.count = 0
+	}
+
+	if rl.count >= rl.limit {
+		return false, rl.windowStart.Add(time.Minute).Sub(now)
+	}
+	rl.count++
+	return true, 0
+}
+
+type tenant struct {
+	name string
+	keys [][]byte
+	// Names of the other tenants whose servers may be accessed with the
+	// tenant's API keys, via the workspaceHeader header.
+	workspaces map[string]bool
+	proxy      *proxy
+	handler    http.Handler
+	limiter    *rateLimiter
+}
+
+// tenantRouter authenticates HTTP requests via their API key, and routes
+// them to the tenant the key belongs to. Each tenant has its own LSP
+// server and proxy state.
+type tenantRouter []*tenant
+
+func newTenantRouter(configs []tenantConfig, filters resultFilters) (tenantRouter, error) {
+	var tr tenantRouter
+	for _, tc := range configs {
+		srv, err := tc.Server.start()
+		if err != nil {
+			tr.shutdown()
+			return nil, fmt.Errorf("unable to start LSP server for tenant %v: %w", tc.Name, err)
+		}
+
+		p := newProxy(srv, filters)
+		p.supervisor.configure(tc.Server.Restart)
+		p.headers = tc.Server.Headers
+		p.docs.limit = tc.Quota.MaxDocuments
+		p.swapDenied = true
+		p.roots, err = sandboxRoots(tc.Roots)
+		if err != nil {
+			tr.shutdown()
+			return nil, err
+		}
+
+		t := &tenant{
+			name:       tc.Name,
+			workspaces: make(map[string]bool),
+			proxy:      p,
+			handler:    p.routes(),
+			limiter:    &rateLimiter{limit: tc.Quota.RequestsPerMinute},
+		}
+		for _, name := range tc.Workspaces {
+			t.workspaces[name] = true
+		}
+		for _, key := range tc.APIKeys {
+			t.keys = append(t.keys, []byte(key))
+		}
+
+		tr = append(tr, t)
+	}
+
+	return tr, nil
+}
+
+func requestAPIKey(req *http.Request) string {
+	if key := req.Header.Get(apiKeyHeader); key != "" {
+		return key
+	}
+
+	auth := req.Header.Get("Authorization")
+	if token, ok := strings.CutPrefix(auth, "Bearer "); ok {
+		return token
+	}
+	return ""
+}
+
+func (tr tenantRouter) authenticate(req *http.Request) *tenant {
+	key := []byte(requestAPIKey(req))
+	if len(key) == 0 {
+		return nil
+	}
+
+	var found *tenant
+	for _, t := range tr {
+		for _, k := range t.keys {
+			// Check all keys, to avoid leaking timing information.
+			if subtle.ConstantTimeCompare(k, key) == 1 {
+				found = t
+			}
+		}
+	}
+	return found
+}
+
+func (tr tenantRouter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	t := tr.authenticate(req)
+	if t == nil {
+		writeError(w, http.StatusUnauthorized, "missing or invalid API key")
+		return
+	}
+
+	if ok, retry := t.limiter.allow(); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(retry.Seconds())+1))
+		writeError(w, http.StatusTooManyRequests, "request quota exceeded")
+		return
+	}
+
+	if name := req.Header.Get(workspaceHeader); name != "" && name != t.name {
+		target := tr.workspace(t, name)
+		if target == nil {
+			writeError(w, http.StatusForbidden, fmt.Sprintf("workspace %v is not accessible with this API key", name))
+			return
+		}
+		t = target
+	}
+
+	t.handler.ServeHTTP(w, req)
+}
+
+// workspace returns the tenant with the specified name, if the API keys of
+// t may access it.
+func (tr tenantRouter) workspace(t *tenant, name string) *tenant {
+	if !t.workspaces[name] {
+		return nil
+	}
+	for _, other := range tr {
+		if other.name == name {
+			return other
+		}
+	}
+	return nil
+}
+
+func (tr tenantRouter) shutdown() {
+	for _, t := range tr {
+		err := t.proxy.shutdown()
+		if err != nil {
+			slog.Error("error shuttting down LSP server", "tenant", t.name, "err", err)
+		}
+	}
+}
+
+// collectFileURIs appends all strings in v (including object keys) which
+// are file URIs.
+func collectFileURIs(v any, uris []string) []string {
+	switch v := v.(type) {
+	case string:
+		// URI schemes are case-insensitive.
+		if len(v) >= 5 && strings.EqualFold(v[:5], "file:") {
+			uris = append(uris, v)
+		}
+	case map[string]any:
+		for k, e := range v {
+			uris = collectFileURIs(k, uris)
+			uris = collectFileURIs(e, uris)
+		}
+	case []any:
+		for _, e := range v {
+			uris = collectFileURIs(e, uris)
+		}
+	}
+	return uris
+}
+
+// sandboxRoots returns the absolute paths of the directories that file
+// URIs must be contained in, with symbolic links resolved.
+func sandboxRoots(dirs []string) ([]string, error) {
+	var roots []string
+	for _, dir := range dirs {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, err
+		}
+		roots = append(roots, resolvePath(abs))
+	}
+	return roots, nil
+}
+
+// resolvePath resolves the symbolic links of an absolute path, so that
+// links can't be used to escape from the roots. If the path doesn't exist,
+// the links of its closest existing ancestor are resolved.
+func resolvePath(abs string) string {
+	rest := ""
+	for dir := abs; ; dir = filepath.Dir(dir) {
+		if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+			return filepath.Join(resolved, rest)
+		}
+		if dir == filepath.Dir(dir) {
+			return abs
+		}
+		rest = filepath.Join(filepath.Base(dir), rest)
+	}
+}
+
+// withinRoot reports whether the absolute path abs is root or is contained
+// in it.
+func withinRoot(root, abs string) bool {
+	rel, err := filepath.Rel(root, abs)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// errOutsideRoots is returned for paths which are not contained in any of
+// the proxy's roots.
+var errOutsideRoots = errors.New("file is outside of the allowed roots")
+
+// allowedPath reports whether path is contained in one of the proxy's
+// roots. If no roots are configured, all paths are allowed.
+func (p *proxy) allowedPath(path string) bool {
+	if len(p.roots) == 0 {
+		return true
+	}
+
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	abs = resolvePath(abs)
+
+	for _, root := range p.roots {
+		if withinRoot(root, abs) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedURI reports whether uri is allowed by the proxy's roots. Only
+// file URIs are restricted.
+func (p *proxy) allowedURI(uri string) bool {
+	if len(collectFileURIs(uri, nil)) == 0 {
+		return true
+	}
+	path, err := lsp.URIToPath(uri)
+	return err == nil && p.allowedPath(path)
+}
+
+// requestFileURIs returns the file URIs in the path (e.g. in /docs/{uri}),
+// the query parameters and the JSON body of a request. The body is
+// restored, so that it can be read again.
+func requestFileURIs(req *http.Request) ([]string, error) {
+	var uris []string
+	if i := strings.Index(strings.ToLower(req.URL.Path), "file:"); i >= 0 {
+		uris = append(uris, req.URL.Path[i:])
+	}
+	for _, values := range req.URL.Query() {
+		for _, v := range values {
+			uris = collectFileURIs(v, uris)
+		}
+	}
+
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+
+	var v any
+	if json.Unmarshal(body, &v) == nil {
+		uris = collectFileURIs(v, uris)
+	}
+	return uris, nil
+}
+
+// restrictRoots rejects requests containing file URIs (see
+// requestFileURIs) outside of the proxy's roots, so that HTTP clients
+// can't use the LSP server (or the proxy itself) to read other files of
+// the host.
+func (p *proxy) restrictRoots(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if len(p.roots) == 0 {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		uris, err := requestFileURIs(req)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "unable to read request body")
+			return
+		}
+
+		for _, uri := range uris {
+			if !p.allowedURI(uri) {
+				writeError(w, http.StatusForbidden, fmt.Sprintf("URI %v is outside of the allowed roots", uri))
+				return
+			}
+		}
+
+		next.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/federicotdn/hyperlsp/lsp"
+)
+
+// sandboxDirs creates a root directory and a directory outside of it, with
+// symbolic links from the root to both, and returns a proxy restricted to
+// the root.
+func sandboxDirs(t *testing.T) (p *proxy, root, outside string) {
+	t.Helper()
+	base := resolvePath(t.TempDir())
+	root = filepath.Join(base, "root")
+	outside = filepath.Join(base, "outside")
+
+	for _, dir := range []string{root, filepath.Join(root, "sub"), outside, root + "-sibling"} {
+		err := os.Mkdir(dir, 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{filepath.Join(root, "a.go"), filepath.Join(root, "sub", "b.go"), filepath.Join(outside, "secret.go")} {
+		err := os.WriteFile(file, []byte("package a\n"), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		filepath.Join(root, "escape"):     outside,
+		filepath.Join(root, "secret.go"):  filepath.Join(outside, "secret.go"),
+		filepath.Join(root, "inner"):      filepath.Join(root, "sub"),
+		filepath.Join(root, "sub", "up"):  "..",
+		filepath.Join(root, "sub", "out"): filepath.Join("..", "..", "outside"),
+	}
+	for link, target := range links {
+		err := os.Symlink(target, link)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	roots, err := sandboxRoots([]string{root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &proxy{roots: roots}, root, outside
+}
+
+func TestAllowedPath(t *testing.T) {
+	p, root, outside := sandboxDirs(t)
+
+	tests := []struct {
+		name    string
+		path    string
+		allowed bool
+	}{
+		{"root", root, true},
+		{"file", filepath.Join(root, "a.go"), true},
+		{"nested file", filepath.Join(root, "sub", "b.go"), true},
+		{"missing file", filepath.Join(root, "new", "c.go"), true},
+		{"outside", filepath.Join(outside, "secret.go"), false},
+		{"parent of root", filepath.Dir(root), false},
+		{"sibling with root as prefix", root + "-sibling", false},
+		{"dot dot", root + "/../outside/secret.go", false},
+		{"nested dot dot", root + "/sub/../../outside/secret.go", false},
+		{"dot dot within root", root + "/sub/../a.go", true},
+		{"link to outside directory", filepath.Join(root, "escape", "secret.go"), false},
+		{"link to outside file", filepath.Join(root, "secret.go"), false},
+		{"missing file behind link", filepath.Join(root, "escape", "new", "c.go"), false},
+		{"relative link to outside", filepath.Join(root, "sub", "out", "secret.go"), false},
+		{"link within root", filepath.Join(root, "inner", "b.go"), true},
+		{"relative link within root", filepath.Join(root, "sub", "up", "a.go"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := p.allowedPath(tt.path); got != tt.allowed {
+				t.Errorf("allowedPath(%q) = %v, expected %v", tt.path, got, tt.allowed)
+			}
+		})
+	}
+
+	unrestricted := &proxy{}
+	if !unrestricted.allowedPath(filepath.Join(outside, "secret.go")) {
+		t.Error("all paths should be allowed without roots")
+	}
+}
+
+func TestAllowedURI(t *testing.T) {
+	p, root, outside := sandboxDirs(t)
+	rootURI := lsp.PathToURI(root)
+
+	tests := []struct {
+		name    string
+		uri     string
+		allowed bool
+	}{
+		{"file", lsp.PathToURI(filepath.Join(root, "a.go")), true},
+		{"outside", lsp.PathToURI(filepath.Join(outside, "secret.go")), false},
+		{"dot dot", rootURI + "/../outside/secret.go", false},
+		{"encoded dot dot", rootURI + "/%2e%2e/outside/secret.go", false},
+		{"encoded slashes", rootURI + "/sub%2F..%2F..%2Foutside%2Fsecret.go", false},
+		{"encoded file", rootURI + "/%61.go", true},
+		{"encoded link to outside", rootURI + "/%65scape/secret.go", false},
+		{"upper case scheme", "FILE://" + filepath.ToSlash(filepath.Join(outside, "secret.go")), false},
+		{"host", "file://localhost" + filepath.ToSlash(filepath.Join(outside, "secret.go")), false},
+		{"single slash", "file:" + filepath.ToSlash(filepath.Join(outside, "secret.go")), false},
+		{"opaque", "file:secret.go", false},
+		{"invalid", "file://%zz", false},
+		{"other scheme", "untitled:Untitled-1", true},
+		{"http", "https://example.com/secret.go", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := p.allowedURI(tt.uri); got != tt.allowed {
+				t.Errorf("allowedURI(%q) = %v, expected %v", tt.uri, got, tt.allowed)
+			}
+		})
+	}
+}
+
+func TestCollectFileURIs(t *testing.T) {
+	tests := []struct {
+		name string
+		v    any
+		uris []string
+	}{
+		{"string", "file:///a.go", []string{"file:///a.go"}},
+		{"upper case scheme", "File:///a.go", []string{"File:///a.go"}},
+		{"other scheme", "untitled:a", nil},
+		{"text document", map[string]any{"textDocument": map[string]any{"uri": "file:///a.go"}}, []string{"file:///a.go"}},
+		{
+			"array",
+			map[string]any{"locations": []any{
+				map[string]any{"uri": "file:///a.go"},
+				map[string]any{"uri": "file:///b.go", "other": []any{"file:///c.go"}},
+			}},
+			[]string{"file:///a.go", "file:///b.go", "file:///c.go"},
+		},
+		{
+			"object key",
+			map[string]any{"edit": map[string]any{"changes": map[string]any{"file:///a.go": []any{}}}},
+			[]string{"file:///a.go"},
+		},
+		{"other values", map[string]any{"line": 1.0, "ok": true, "none": nil}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := collectFileURIs(tt.v, nil)
+			slices.Sort(got)
+			if !slices.Equal(got, tt.uris) {
+				t.Errorf("collectFileURIs() = %v, expected %v", got, tt.uris)
+			}
+		})
+	}
+}
+
+func TestRestrictRoots(t *testing.T) {
+	p, root, outside := sandboxDirs(t)
+	inside := lsp.PathToURI(filepath.Join(root, "a.go"))
+	secret := lsp.PathToURI(filepath.Join(outside, "secret.go"))
+
+	var received string
+	handler := p.restrictRoots(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		received = string(body)
+	}))
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		body   string
+		status int
+	}{
+		{"inside", "POST", "/lsp/textDocument/hover", `{"textDocument":{"uri":"` + inside + `"}}`, http.StatusOK},
+		{"outside", "POST", "/lsp/textDocument/hover", `{"textDocument":{"uri":"` + secret + `"}}`, http.StatusForbidden},
+		{"nested", "POST", "/lsp/workspace/executeCommand", `{"arguments":[{"files":["` + inside + `","` + secret + `"]}]}`, http.StatusForbidden},
+		{"object key", "POST", "/lsp/workspace/applyEdit", `{"edit":{"changes":{"` + secret + `":[]}}}`, http.StatusForbidden},
+		{"encoded dot dot", "POST", "/lsp/textDocument/hover", `{"textDocument":{"uri":"` + lsp.PathToURI(root) + `/%2e%2e/outside/secret.go"}}`, http.StatusForbidden},
+		{"path", "GET", "/docs/" + secret, "", http.StatusForbidden},
+		{"encoded path", "GET", "/docs/" + strings.ReplaceAll(secret, "/", "%2F"), "", http.StatusForbidden},
+		{"path inside", "GET", "/docs/" + inside, "", http.StatusOK},
+		{"query", "GET", "/symbols?uri=" + secret, "", http.StatusForbidden},
+		{"string body", "POST", "/lsp/textDocument/hover", `"` + secret + `"`, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			received = ""
+			req := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != tt.status {
+				t.Fatalf("expected status %v, got %v: %v", tt.status, w.Code, w.Body)
+			}
+			if tt.status == http.StatusOK && received != tt.body {
+				t.Errorf("expected the handler to receive the body %q, got %q", tt.body, received)
+			}
+		})
+	}
+}
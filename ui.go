@@ -0,0 +1,184 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/federicotdn/hyperlsp/lsp"
+)
+
+const maxRecentRequests = 50
+
+//go:embed ui/index.html
+var uiPage []byte
+
+type requestRecord struct {
+	Time      time.Time `json:"time"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	LSPMethod string    `json:"lspMethod,omitempty"`
+	Status    int       `json:"status"`
+	// Latency in milliseconds.
+	Latency float64 `json:"latencyMs"`
+}
+
+// statusWriter records the status code and number of bytes written by a
+// handler.
+type statusWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+// Unwrap allows http.ResponseController to flush the underlying writer.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// trackRequests records the latest requests handled, except for the ones
+// made by the dashboard itself.
+func (p *proxy) trackRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if strings.HasPrefix(req.URL.Path, "/ui") {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, req)
+
+		record := requestRecord{
+			Time:    start,
+			Method:  req.Method,
+			Path:    req.URL.Path,
+			Status:  sw.status,
+			Latency: float64(time.Since(start).Microseconds()) / 1000,
+		}
+		if record.Status == 0 {
+			record.Status = http.StatusOK
+		}
+		if method, ok := strings.CutPrefix(req.URL.Path, "/lsp/"); ok {
+			record.LSPMethod = method
+		}
+
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		p.requests = append(p.requests, record)
+		if len(p.requests) > maxRecentRequests {
+			p.requests = p.requests[len(p.requests)-maxRecentRequests:]
+		}
+	})
+}
+
+// handleNotification is called for every notification sent by the LSP
+// server, which is streamed to the subscribers of /events. The latest
+// published diagnostics of each document are kept.
+func (p *proxy) handleNotification(method string, params any) {
+	if method == "textDocument/publishDiagnostics" {
+		params = p.cacheDiagnostics(params)
+		if p.preindex != nil {
+			obj, _ := params.(map[string]any)
+			uri, _ := obj["uri"].(string)
+			p.preindex.acknowledge(uri)
+		}
+	}
+	p.notifications.publish(serverNotification{Method: method, Params: params, Server: p.name})
+}
+
+// cacheDiagnostics keeps the diagnostics of a publishDiagnostics
+// notification, and returns its params after applying the diagnostic
+// rules.
+func (p *proxy) cacheDiagnostics(params any) any {
+	data, err := json.Marshal(params)
+	if err != nil {
+		return params
+	}
+	var published struct {
+		URI         string           `json:"uri"`
+		Diagnostics []lsp.Diagnostic `json:"diagnostics"`
+	}
+	if json.Unmarshal(data, &published) != nil || published.URI == "" {
+		return params
+	}
+	published.Diagnostics = p.diagnosticRules.apply(published.URI, published.Diagnostics)
+
+	p.mutex.Lock()
+	if len(published.Diagnostics) == 0 {
+		delete(p.diagnostics, published.URI)
+	} else {
+		p.diagnostics[published.URI] = published.Diagnostics
+	}
+	p.mutex.Unlock()
+
+	obj, ok := params.(map[string]any)
+	items, _ := obj["diagnostics"].([]any)
+	if !ok || len(p.diagnosticRules) == 0 {
+		return params
+	}
+	filtered := make(map[string]any, len(obj))
+	for k, v := range obj {
+		filtered[k] = v
+	}
+	filtered["diagnostics"] = p.diagnosticRules.applyJSON(published.URI, items)
+	return filtered
+}
+
+func (p *proxy) handleUI(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(uiPage)
+}
+
+// handleUIState returns all the information shown by the dashboard.
+func (p *proxy) handleUIState(w http.ResponseWriter, req *http.Request) {
+	type documentInfo struct {
+		URI        string `json:"uri"`
+		LanguageID string `json:"languageId"`
+		Version    int    `json:"version"`
+		Size       int    `json:"size"`
+	}
+	documents := []documentInfo{}
+	for _, doc := range p.docs.list() {
+		documents = append(documents, documentInfo{
+			URI:        doc.URI,
+			LanguageID: doc.LanguageID,
+			Version:    doc.Version,
+			Size:       len(doc.Text),
+		})
+	}
+
+	p.mutex.Lock()
+	capabilities := p.serverCaps
+	events := append([]serverEvent{}, p.events...)
+	requests := append([]requestRecord{}, p.requests...)
+	p.mutex.Unlock()
+	diagnostics := p.cachedDiagnostics()
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"process":      p.server().Status(),
+		"capabilities": capabilities,
+		"documents":    documents,
+		"events":       events,
+		"requests":     requests,
+		"diagnostics":  diagnostics,
+	})
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/federicotdn/hyperlsp/lsp"
+)
+
+// paramsErrorData is the data of the error returned when the params of a
+// request do not match the schema of its method.
+type paramsErrorData struct {
+	Method     string           `json:"method"`
+	Definition string           `json:"definition"`
+	Errors     []lsp.ParamError `json:"errors"`
+}
+
+// syntaxErrorData is the data of the error returned when the body of a
+// request is not valid JSON.
+type syntaxErrorData struct {
+	// Offset of the syntax error in the body, if known.
+	Offset int64  `json:"offset,omitempty"`
+	Error  string `json:"error"`
+}
+
+// checkParams validates params against the schema of method, if schema
+// validation is enabled. It returns the message and data of a 400 error,
+// or an empty message if params are valid.
+func (p *proxy) checkParams(method string, params any) (string, any) {
+	if !p.validate {
+		return "", nil
+	}
+
+	errs := lsp.ValidateParams(method, params)
+	if len(errs) == 0 {
+		return "", nil
+	}
+
+	message := fmt.Sprintf("invalid params for %v: %v", method, errs[0])
+	if len(errs) > 1 {
+		message += fmt.Sprintf(" (and %v more)", len(errs)-1)
+	}
+	return message, paramsErrorData{Method: method, Definition: lsp.SpecURL(method), Errors: errs}
+}
+
+// decodeErrorData returns the data of the error returned when the body of
+// a request cannot be decoded, if schema validation is enabled.
+func (p *proxy) decodeErrorData(err error) any {
+	if !p.validate {
+		return nil
+	}
+
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		return syntaxErrorData{Offset: syntaxErr.Offset, Error: syntaxErr.Error()}
+	}
+	return syntaxErrorData{Error: err.Error()}
+}
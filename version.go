@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Header used to request a version of the HTTP API, which is also set in
+// every response.
+const apiVersionHeader = "X-HyperLSP-API-Version"
+
+// Versions of the HTTP API, the last one being the current one. Endpoints
+// are available under /v{version}/, and (for the current version) at
+// their unversioned legacy paths.
+var apiVersions = []string{"1"}
+
+var apiVersionPrefix = regexp.MustCompile(`^/v([0-9]+)(/|$)`)
+
+type apiVersionKey struct{}
+
+// apiVersion returns the version of the HTTP API a request was made for.
+func apiVersion(req *http.Request) string {
+	if v, ok := req.Context().Value(apiVersionKey{}).(string); ok {
+		return v
+	}
+	return apiVersions[len(apiVersions)-1]
+}
+
+func supportedAPIVersion(version string) bool {
+	for _, v := range apiVersions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// versionMiddleware determines the API version of requests, from their
+// path prefix (e.g. /v1/lsp/initialize) or from the X-HyperLSP-API-Version
+// header, and strips the prefix before passing them on to next. Requests
+// without either use the current version.
+func versionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		version := req.Header.Get(apiVersionHeader)
+		if version != "" && !supportedAPIVersion(version) {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("unsupported API version: %v (supported: %v)", version, strings.Join(apiVersions, ", ")))
+			return
+		}
+
+		if m := apiVersionPrefix.FindStringSubmatch(req.URL.Path); m != nil {
+			if !supportedAPIVersion(m[1]) {
+				writeError(w, http.StatusNotFound, fmt.Sprintf("unknown API version: %v (supported: %v)", m[1], strings.Join(apiVersions, ", ")))
+				return
+			}
+			if version != "" && version != m[1] {
+				writeError(w, http.StatusBadRequest, fmt.Sprintf("API version %v requested in header, but %v in path", version, m[1]))
+				return
+			}
+			version = m[1]
+
+			prefix := "/v" + version
+			req = req.Clone(req.Context())
+			req.URL.Path = strings.TrimPrefix(req.URL.Path, prefix)
+			req.URL.RawPath = strings.TrimPrefix(req.URL.RawPath, prefix)
+			if req.URL.Path == "" {
+				req.URL.Path = "/"
+			}
+		}
+
+		if version == "" {
+			version = apiVersions[len(apiVersions)-1]
+		}
+		w.Header().Set(apiVersionHeader, version)
+		next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), apiVersionKey{}, version)))
+	})
+}
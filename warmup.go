@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/federicotdn/hyperlsp/lsp"
+)
+
+// Placeholder replaced with the URI of the workspace root in the params of
+// warmup calls.
+const warmupRootPlaceholder = "${rootUri}"
+
+// warmupCall is a line of a warmup file: either an LSP request (or
+// notification) to send, or a file to open.
+type warmupCall struct {
+	Method string `json:"method"`
+	Params any    `json:"params"`
+	// Whether to send the call as a notification.
+	Notification bool `json:"notification"`
+	// Path of a file to open, relative to the workspace root. Files are
+	// closed once all calls have been sent, unless a client opened them
+	// in the meantime.
+	Open string `json:"open"`
+}
+
+// loadWarmup reads a JSON Lines file of warmup calls.
+func loadWarmup(path string) ([]warmupCall, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var calls []warmupCall
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 64*1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var call warmupCall
+		err := json.Unmarshal(line, &call)
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %w", n, err)
+		}
+		if (call.Method == "") == (call.Open == "") {
+			return nil, fmt.Errorf("line %v: either an LSP method or a file to open must be specified", n)
+		}
+		calls = append(calls, call)
+	}
+	return calls, scanner.Err()
+}
+
+// expandRoot replaces the workspace root placeholder in the strings of
+// params.
+func expandRoot(params any, rootURI string) any {
+	switch v := params.(type) {
+	case string:
+		return strings.ReplaceAll(v, warmupRootPlaceholder, rootURI)
+	case map[string]any:
+		expanded := make(map[string]any, len(v))
+		for key, value := range v {
+			expanded[key] = expandRoot(value, rootURI)
+		}
+		return expanded
+	case []any:
+		expanded := make([]any, len(v))
+		for i, value := range v {
+			expanded[i] = expandRoot(value, rootURI)
+		}
+		return expanded
+	}
+	return params
+}
+
+// startWarmup sends the warmup calls in the background, if any.
+func (p *proxy) startWarmup() {
+	if len(p.warmup) > 0 {
+		go p.warmUp()
+	}
+}
+
+// warmUp sends the warmup calls to the LSP server once it has been
+// initialized, so that the first requests of clients don't have to wait
+// for it to load the workspace. Failed calls are logged and skipped.
+func (p *proxy) warmUp() {
+	p.mutex.Lock()
+	initParams := p.initParams
+	p.mutex.Unlock()
+
+	root := ""
+	if roots := workspaceRoots(initParams); len(roots) > 0 {
+		root = roots[0]
+	}
+	rootURI := ""
+	if root != "" {
+		rootURI = lsp.PathToURI(root)
+	}
+
+	start := time.Now()
+	var opened []string
+	failed := 0
+	for _, call := range p.warmup {
+		callStart := time.Now()
+		var err error
+		if call.Open != "" {
+			var uri string
+			uri, err = p.warmUpOpen(root, call.Open)
+			if uri != "" {
+				opened = append(opened, uri)
+			}
+		} else if call.Notification {
+			err = p.notify(call.Method, expandRoot(call.Params, rootURI))
+		} else {
+			err = p.call(context.Background(), call.Method, expandRoot(call.Params, rootURI), nil)
+		}
+
+		if err != nil {
+			failed++
+			slog.Warn("warmup call failed", "lsp_method", call.Method, "open", call.Open, "err", err)
+			continue
+		}
+		slog.Debug("warmup call", "lsp_method", call.Method, "open", call.Open, "duration", time.Since(callStart))
+	}
+
+	for _, uri := range opened {
+		if _, ok := p.docs.get(uri); ok {
+			continue
+		}
+		params := map[string]any{"textDocument": lsp.TextDocumentIdentifier{URI: uri}}
+		err := p.sendUntracked("textDocument/didClose", params)
+		if err != nil {
+			slog.Warn("unable to close warmup file", "uri", uri, "err", err)
+		}
+	}
+
+	slog.Info("LSP server warmed up", "calls", len(p.warmup), "failed", failed, "duration", time.Since(start))
+	p.recordEvent(serverEvent{Type: "warmup", Message: fmt.Sprintf("Sent %v warmup calls (%v failed) in %v", len(p.warmup), failed, time.Since(start).Round(time.Millisecond))})
+}
+
+// warmUpOpen opens a file in the LSP server without tracking it, unless it
+// is already open, and returns its URI if opened.
+func (p *proxy) warmUpOpen(root, file string) (string, error) {
+	if !filepath.IsAbs(file) {
+		if root == "" {
+			return "", fmt.Errorf("no workspace root to resolve %v against", file)
+		}
+		file = filepath.Join(root, file)
+	}
+	uri := lsp.PathToURI(file)
+	if _, ok := p.docs.get(uri); ok {
+		return "", nil
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	languageId := p.languages.detect(uri, string(data))
+	if languageId == "" {
+		return "", errUnknownLanguage
+	}
+
+	doc := document{URI: uri, LanguageID: languageId, Version: 1, Text: string(data)}
+	err = p.sendUntracked("textDocument/didOpen", map[string]any{"textDocument": &doc})
+	if err != nil {
+		return "", err
+	}
+	return uri, nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/federicotdn/hyperlsp/lsp"
+)
+
+const defaultWatchInterval = time.Second
+
+// File change types of workspace/didChangeWatchedFiles.
+const (
+	fileCreated = 1
+	fileChanged = 2
+	fileDeleted = 3
+)
+
+// fileState is what is known about a file on disk when it was last
+// checked. The zero value means that the file did not exist.
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+// watchFiles periodically checks the files of all tracked documents, and
+// reloads the ones changed on disk by other tools, notifying the LSP
+// server. It runs until the process exits.
+func (p *proxy) watchFiles(interval time.Duration) {
+	seen := make(map[string]fileState)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if ok, _ := p.ready(); !ok {
+			continue
+		}
+
+		tracked := make(map[string]bool)
+		for _, doc := range p.docs.list() {
+			tracked[doc.URI] = true
+			p.checkFile(doc, seen)
+		}
+		for uri := range seen {
+			if !tracked[uri] {
+				delete(seen, uri)
+			}
+		}
+	}
+}
+
+// checkFile checks whether the file of a tracked document has changed
+// since it was last seen. Files are only reloaded once they have been seen
+// at least once, and if their content differs from the document's, so
+// that changes made through the API aren't sent again.
+func (p *proxy) checkFile(doc document, seen map[string]fileState) {
+	path, err := lsp.URIToPath(doc.URI)
+	if err != nil {
+		return
+	}
+
+	info, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		if last, ok := seen[doc.URI]; ok && last != (fileState{}) {
+			seen[doc.URI] = fileState{}
+			slog.Info("tracked file deleted", "uri", doc.URI)
+			p.notifyWatchedFile(doc.URI, fileDeleted)
+		}
+		return
+	} else if err != nil {
+		return
+	}
+
+	state := fileState{modTime: info.ModTime(), size: info.Size()}
+	last, ok := seen[doc.URI]
+	seen[doc.URI] = state
+	if !ok || last == state {
+		return
+	}
+
+	changeType := fileChanged
+	if last == (fileState{}) {
+		changeType = fileCreated
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		slog.Warn("unable to read changed file", "uri", doc.URI, "err", err)
+		return
+	}
+	// The document may have been changed through the API in the meantime.
+	doc, ok = p.docs.get(doc.URI)
+	if !ok {
+		return
+	}
+	if bytes.Equal(data, []byte(doc.Text)) {
+		if changeType == fileCreated {
+			p.notifyWatchedFile(doc.URI, changeType)
+		}
+		return
+	}
+
+	slog.Info("reloading tracked file changed on disk", "uri", doc.URI)
+	doc, err = p.changeDocument(doc, string(data))
+	if err != nil {
+		slog.Warn("unable to reload changed file", "path", path, "err", err)
+		return
+	}
+
+	params := map[string]any{"textDocument": lsp.TextDocumentIdentifier{URI: doc.URI}}
+	if p.saveIncludesText() {
+		params["text"] = doc.Text
+	}
+	err = p.notify("textDocument/didSave", params)
+	if err != nil {
+		slog.Warn("unable to notify saved file", "uri", doc.URI, "err", err)
+	}
+	p.notifyWatchedFile(doc.URI, changeType)
+}
+
+// notifyWatchedFile sends a workspace/didChangeWatchedFiles notification
+// for a single file.
+func (p *proxy) notifyWatchedFile(uri string, changeType int) {
+	err := p.notify("workspace/didChangeWatchedFiles", map[string]any{
+		"changes": []map[string]any{{"uri": uri, "type": changeType}},
+	})
+	if err != nil {
+		slog.Warn("unable to notify changed file", "uri", uri, "err", err)
+	}
+}
+
+// saveIncludesText reports whether the LSP server expects the content of
+// saved documents in textDocument/didSave notifications.
+func (p *proxy) saveIncludesText() bool {
+	var caps struct {
+		TextDocumentSync struct {
+			Save struct {
+				IncludeText bool `json:"includeText"`
+			} `json:"save"`
+		} `json:"textDocumentSync"`
+	}
+	// Decoding fails if textDocumentSync is a number or save a boolean,
+	// in which case no text is expected either.
+	err := p.capabilities(&caps)
+	return err == nil && caps.TextDocumentSync.Save.IncludeText
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/federicotdn/hyperlsp/lsp"
+)
+
+const (
+	webhookSignatureHeader = "X-Hyperlsp-Signature"
+	webhookTimestampHeader = "X-Hyperlsp-Timestamp"
+
+	webhookMaxAttempts = 5
+	webhookBackoff     = time.Second
+	webhookTimeout     = 10 * time.Second
+)
+
+// webhookPayload is POSTed to the callback URL of an async request once
+// it completes.
+type webhookPayload struct {
+	ID         string             `json:"id"`
+	RequestID  string             `json:"requestId"`
+	Method     string             `json:"method"`
+	HTTPStatus int                `json:"httpStatus"`
+	Result     any                `json:"result,omitempty"`
+	Error      *lsp.ResponseError `json:"error,omitempty"`
+}
+
+// webhookSender delivers the results of async requests to callback URLs,
+// signing them with HMAC-SHA256.
+type webhookSender struct {
+	secret []byte
+	// If not empty, the only hosts callback URLs may point to.
+	hosts  map[string]bool
+	client *http.Client
+}
+
+func newWebhookSender(secret string, hosts []string) *webhookSender {
+	ws := &webhookSender{
+		secret: []byte(secret),
+		hosts:  make(map[string]bool),
+		client: &http.Client{
+			Timeout: webhookTimeout,
+			// Redirects are not followed, as they could lead to hosts
+			// outside of the allowlist.
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+	for _, h := range hosts {
+		ws.hosts[h] = true
+	}
+	return ws
+}
+
+func (ws *webhookSender) validate(callback string) error {
+	if ws == nil || len(ws.secret) == 0 {
+		return fmt.Errorf("callbacks are not enabled (see -webhook-secret)")
+	}
+
+	u, err := url.Parse(callback)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid callback url: %v", callback)
+	}
+	if len(ws.hosts) > 0 && !ws.hosts[u.Hostname()] {
+		return fmt.Errorf("callback host not allowed: %v", u.Hostname())
+	}
+	return nil
+}
+
+// sign returns the signature of a payload sent at timestamp.
+func (ws *webhookSender) sign(timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, ws.secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// post sends a payload once. The returned bool reports whether the
+// delivery may be retried after an error.
+func (ws *webhookSender) post(callback string, body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, callback, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookTimestampHeader, timestamp)
+	req.Header.Set(webhookSignatureHeader, ws.sign(timestamp, body))
+
+	resp, err := ws.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	return retry, fmt.Errorf("callback returned status %v", resp.StatusCode)
+}
+
+// deliver sends the result of a completed async request to its callback
+// URL, retrying with an exponential backoff.
+func (ws *webhookSender) deliver(r asyncResult) webhookDelivery {
+	payload := webhookPayload{
+		ID:         r.ID,
+		RequestID:  r.RequestID,
+		Method:     r.Method,
+		HTTPStatus: responseStatus(r.Response, r.ErrorStatus),
+		Result:     r.Response.Result,
+		Error:      r.Response.Error,
+	}
+
+	var delivery webhookDelivery
+	body, err := json.Marshal(payload)
+	if err != nil {
+		delivery.LastError = err.Error()
+		return delivery
+	}
+
+	delay := webhookBackoff
+	for delivery.Attempts < webhookMaxAttempts {
+		if delivery.Attempts > 0 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+		delivery.Attempts++
+
+		retry, err := ws.post(r.Callback, body)
+		if err == nil {
+			delivery.Delivered = true
+			delivery.LastError = ""
+			return delivery
+		}
+
+		delivery.LastError = err.Error()
+		slog.Warn("unable to deliver async result", "id", r.ID, "callback", r.Callback, "attempt", delivery.Attempts, "err", err)
+		if !retry {
+			break
+		}
+	}
+
+	return delivery
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/federicotdn/hyperlsp/lsp"
+)
+
+// workspaceFolder is a WorkspaceFolder of the LSP specification.
+type workspaceFolder struct {
+	URI  string `json:"uri"`
+	Name string `json:"name"`
+}
+
+// workspaceSessions binds sessions, identified by the clientHeader header,
+// to workspace roots on a server shared by all of them. Roots which are
+// not workspace folders of the server yet are added to it while sessions
+// are bound to them.
+type workspaceSessions struct {
+	mutex sync.Mutex
+	// Workspace root of each session, by client.
+	roots map[string]string
+	// Number of sessions bound to each root added to the server.
+	members map[string]int
+}
+
+func newWorkspaceSessions() *workspaceSessions {
+	return &workspaceSessions{
+		roots:   make(map[string]string),
+		members: make(map[string]int),
+	}
+}
+
+// root returns the workspace root a session is bound to, if any.
+func (ws *workspaceSessions) root(client string) (string, bool) {
+	if client == "" {
+		return "", false
+	}
+
+	ws.mutex.Lock()
+	defer ws.mutex.Unlock()
+	root, ok := ws.roots[client]
+	return root, ok
+}
+
+// added returns the roots added to the server for sessions, sorted.
+func (ws *workspaceSessions) added() []string {
+	ws.mutex.Lock()
+	defer ws.mutex.Unlock()
+
+	roots := make([]string, 0, len(ws.members))
+	for root := range ws.members {
+		roots = append(roots, root)
+	}
+	sort.Strings(roots)
+	return roots
+}
+
+// folder returns the workspace folder of a root directory.
+func folder(root string) workspaceFolder {
+	return workspaceFolder{URI: lsp.PathToURI(root), Name: filepath.Base(root)}
+}
+
+// foldersEvent returns the params of a workspace/didChangeWorkspaceFolders
+// notification.
+func foldersEvent(added, removed []string) map[string]any {
+	event := map[string][]workspaceFolder{"added": {}, "removed": {}}
+	for _, root := range added {
+		event["added"] = append(event["added"], folder(root))
+	}
+	for _, root := range removed {
+		event["removed"] = append(event["removed"], folder(root))
+	}
+	return map[string]any{"event": event}
+}
+
+// initialRoots returns the workspace roots the LSP server was initialized
+// with, which are never removed from it.
+func (p *proxy) initialRoots() []string {
+	p.mutex.Lock()
+	initParams := p.initParams
+	p.mutex.Unlock()
+
+	var roots []string
+	for _, root := range workspaceRoots(initParams) {
+		if abs, err := filepath.Abs(root); err == nil {
+			roots = append(roots, abs)
+		}
+	}
+	return roots
+}
+
+// supportsWorkspaceFolders reports whether the LSP server accepts
+// workspace/didChangeWorkspaceFolders notifications.
+func (p *proxy) supportsWorkspaceFolders() (bool, error) {
+	var caps struct {
+		Workspace struct {
+			WorkspaceFolders struct {
+				Supported bool `json:"supported"`
+				// Either a boolean or a registration ID.
+				ChangeNotifications any `json:"changeNotifications"`
+			} `json:"workspaceFolders"`
+		} `json:"workspace"`
+	}
+	err := p.capabilities(&caps)
+	if err != nil {
+		return false, err
+	}
+
+	folders := caps.Workspace.WorkspaceFolders
+	switch v := folders.ChangeNotifications.(type) {
+	case bool:
+		return folders.Supported && v, nil
+	case string:
+		return folders.Supported && v != "", nil
+	}
+	return false, nil
+}
+
+// bindWorkspace binds a session to a workspace root, adding it to the
+// LSP server if needed, and unbinds it from its previous root (see
+// unbindWorkspace).
+func (p *proxy) bindWorkspace(client, root string) error {
+	initial := p.initialRoots()
+
+	p.workspaces.mutex.Lock()
+	defer p.workspaces.mutex.Unlock()
+
+	previous, bound := p.workspaces.roots[client]
+	if bound && previous == root {
+		return nil
+	}
+
+	var added, removed []string
+	if !slices.Contains(initial, root) && p.workspaces.members[root] == 0 {
+		added = append(added, root)
+	}
+	if bound && p.workspaces.members[previous] == 1 {
+		removed = append(removed, previous)
+	}
+	if len(added) > 0 || len(removed) > 0 {
+		err := p.notify("workspace/didChangeWorkspaceFolders", foldersEvent(added, removed))
+		if err != nil {
+			return err
+		}
+	}
+
+	if bound {
+		p.workspaces.leave(previous)
+	}
+	p.workspaces.roots[client] = root
+	if !slices.Contains(initial, root) {
+		p.workspaces.members[root]++
+	}
+	return nil
+}
+
+// unbindWorkspace unbinds a session from its workspace root, removing the
+// root from the LSP server if no other session is bound to it. It returns
+// false if the session was not bound.
+func (p *proxy) unbindWorkspace(client string) (bool, error) {
+	p.workspaces.mutex.Lock()
+	defer p.workspaces.mutex.Unlock()
+
+	root, ok := p.workspaces.roots[client]
+	if !ok {
+		return false, nil
+	}
+	if p.workspaces.members[root] == 1 {
+		err := p.notify("workspace/didChangeWorkspaceFolders", foldersEvent(nil, []string{root}))
+		if err != nil {
+			return true, err
+		}
+	}
+
+	p.workspaces.leave(root)
+	delete(p.workspaces.roots, client)
+	return true, nil
+}
+
+// leave decrements the number of sessions bound to a root added to the
+// server. The mutex must be held.
+func (ws *workspaceSessions) leave(root string) {
+	if _, ok := ws.members[root]; !ok {
+		return
+	}
+	ws.members[root]--
+	if ws.members[root] == 0 {
+		delete(ws.members, root)
+	}
+}
+
+// workspaceFolders returns the workspace folders of the LSP server: the
+// ones it was initialized with, and the ones added for sessions.
+func (p *proxy) workspaceFolders() []workspaceFolder {
+	folders := []workspaceFolder{}
+	for _, root := range append(p.initialRoots(), p.workspaces.added()...) {
+		folders = append(folders, folder(root))
+	}
+	return folders
+}
+
+// replayWorkspaceFolders adds the workspace roots of sessions to a new
+// LSP server, once it has been initialized.
+func (p *proxy) replayWorkspaceFolders(srv *lsp.Server) error {
+	added := p.workspaces.added()
+	if len(added) == 0 {
+		return nil
+	}
+	_, err := sendTo(srv, "workspace/didChangeWorkspaceFolders", foldersEvent(added, nil))
+	return err
+}
+
+// handleWorkspaceGet returns the workspace root the session of the client
+// is bound to.
+func (p *proxy) handleWorkspaceGet(w http.ResponseWriter, req *http.Request) {
+	client := req.Header.Get(clientHeader)
+	root, ok := p.workspaces.root(client)
+	if !ok {
+		writeError(w, http.StatusNotFound, "session is not bound to a workspace")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"root":    root,
+		"uri":     lsp.PathToURI(root),
+		"folders": p.workspaceFolders(),
+	})
+}
+
+// handleWorkspacePut binds the session of the client to a workspace root,
+// so that several sessions can share a server supporting multiple
+// workspace folders, each with its own root. Requests of the session
+// referencing files outside of its root are rejected (see scopeWorkspace).
+func (p *proxy) handleWorkspacePut(w http.ResponseWriter, req *http.Request) {
+	client := req.Header.Get(clientHeader)
+	if client == "" {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("the %v header must identify the session", clientHeader))
+		return
+	}
+
+	var body struct {
+		Root string `json:"root"`
+	}
+	defer req.Body.Close()
+	err := json.NewDecoder(req.Body).Decode(&body)
+	if err != nil || body.Root == "" {
+		writeError(w, http.StatusBadRequest, "body must specify the workspace root")
+		return
+	}
+	root := body.Root
+	if strings.HasPrefix(root, "file:") {
+		root, err = lsp.URIToPath(root)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	if !filepath.IsAbs(root) {
+		writeError(w, http.StatusBadRequest, "workspace root must be an absolute path")
+		return
+	}
+	root = filepath.Clean(root)
+	if !p.allowedPath(root) {
+		writeError(w, http.StatusForbidden, fmt.Sprintf("workspace root %v is outside of the allowed roots", root))
+		return
+	}
+	if info, err := os.Stat(root); err != nil || !info.IsDir() {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("workspace root %v is not a directory", root))
+		return
+	}
+
+	supported, err := p.supportsWorkspaceFolders()
+	if err != nil {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if !supported {
+		writeError(w, http.StatusBadRequest, "LSP server does not support multiple workspace folders")
+		return
+	}
+
+	err = p.bindWorkspace(client, root)
+	if err != nil {
+		writeCallError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"root":    root,
+		"uri":     lsp.PathToURI(root),
+		"folders": p.workspaceFolders(),
+	})
+}
+
+// handleWorkspaceDelete unbinds the session of the client from its
+// workspace root.
+func (p *proxy) handleWorkspaceDelete(w http.ResponseWriter, req *http.Request) {
+	ok, err := p.unbindWorkspace(req.Header.Get(clientHeader))
+	if err != nil {
+		writeCallError(w, err)
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, "session is not bound to a workspace")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// scopeWorkspace rejects requests of sessions bound to a workspace root
+// containing file URIs (see requestFileURIs) outside of it, so that
+// sessions sharing a server only operate on the documents of their own
+// workspace.
+func (p *proxy) scopeWorkspace(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		root, ok := p.workspaces.root(req.Header.Get(clientHeader))
+		if !ok || strings.HasPrefix(req.URL.Path, "/session/") {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		uris, err := requestFileURIs(req)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "unable to read request body")
+			return
+		}
+
+		for _, uri := range uris {
+			path, err := lsp.URIToPath(uri)
+			if err != nil || !withinRoot(resolvePath(root), resolvePath(path)) {
+				writeError(w, http.StatusForbidden, fmt.Sprintf("URI %v is outside of the session's workspace", uri))
+				return
+			}
+		}
+
+		next.ServeHTTP(w, req)
+	})
+}